@@ -0,0 +1,174 @@
+// Package api holds the OpenAPI 3 document of the HTTP API served by cmd/server, and the checks the
+// server and client tests use to keep their routes and types in sync with it.
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OpenAPI is the OpenAPI document served at /openapi.json.
+//
+//go:embed openapi.json
+var OpenAPI []byte
+
+// Document is the part of the OpenAPI document the contract checks read.
+type Document struct {
+	Paths      map[string]map[string]Operation `json:"paths"`
+	Components struct {
+		Schemas map[string]Schema `json:"schemas"`
+	} `json:"components"`
+}
+
+// Operation is an operation of a path, keyed by lowercase HTTP method.
+type Operation struct {
+	OperationID string                     `json:"operationId"`
+	Scope       string                     `json:"x-scope"`
+	Responses   map[string]json.RawMessage `json:"responses"`
+}
+
+// Schema is a JSON schema of the document, only the keywords the checks compare.
+type Schema struct {
+	Ref        string            `json:"$ref"`
+	Type       string            `json:"type"`
+	Format     string            `json:"format"`
+	Required   []string          `json:"required"`
+	Properties map[string]Schema `json:"properties"`
+	Items      *Schema           `json:"items"`
+}
+
+// Load parses the embedded document.
+func Load() (*Document, error) {
+	var doc Document
+	if err := json.Unmarshal(OpenAPI, &doc); err != nil {
+		return nil, fmt.Errorf("error decoding OpenAPI document: %w", err)
+	}
+	return &doc, nil
+}
+
+// Routes returns every operation as a ServeMux pattern like "GET /devices/{id}", sorted.
+func (d *Document) Routes() []string {
+	var routes []string
+	for path, operations := range d.Paths {
+		for method := range operations {
+			routes = append(routes, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+// Match returns the path template and operation a request for method and path is documented by.
+func (d *Document) Match(method, path string) (string, *Operation, bool) {
+	requested := strings.Split(strings.Trim(path, "/"), "/")
+	for template, operations := range d.Paths {
+		operation, ok := operations[strings.ToLower(method)]
+		if !ok {
+			continue
+		}
+		segments := strings.Split(strings.Trim(template, "/"), "/")
+		if len(segments) != len(requested) {
+			continue
+		}
+		matched := true
+		for i, segment := range segments {
+			if !strings.HasPrefix(segment, "{") && segment != requested[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return template, &operation, true
+		}
+	}
+	return "", nil, false
+}
+
+// CheckType reports how the JSON encoding of t differs from the named schema: both must have the same
+// properties of compatible types, and required properties may not be omitted when empty.
+func (d *Document) CheckType(name string, t reflect.Type) error {
+	schema, ok := d.Components.Schemas[name]
+	if !ok {
+		return fmt.Errorf("schema %s is not documented", name)
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var problems []string
+	fields := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		fieldName, options, _ := strings.Cut(tag, ",")
+		if fieldName == "" {
+			fieldName = field.Name
+		}
+		fields[fieldName] = true
+
+		property, ok := schema.Properties[fieldName]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("field %s is not documented", fieldName))
+			continue
+		}
+		if want := jsonType(field.Type); want != "" && property.Ref == "" && property.Type != want {
+			problems = append(problems, fmt.Sprintf("field %s is a %s, documented as %s", fieldName, want, property.Type))
+		}
+		if strings.Contains(options, "omitempty") && contains(schema.Required, fieldName) {
+			problems = append(problems, fmt.Sprintf("field %s is required but omitted when empty", fieldName))
+		}
+	}
+	for property := range schema.Properties {
+		if !fields[property] {
+			problems = append(problems, fmt.Sprintf("property %s has no field", property))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%s does not match schema %s: %s", t, name, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// jsonType returns the JSON schema type a Go type is encoded as, empty when it cannot tell.
+func jsonType(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return "string"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	}
+	return ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
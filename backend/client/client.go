@@ -0,0 +1,586 @@
+// Package client is a typed Go client of the HomeBunny HTTP API described by api/openapi.json.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers understood by the server.
+const (
+	APIKeyHeader         = "X-API-Key"
+	IdempotencyKeyHeader = "Idempotency-Key"
+)
+
+// Client calls the HomeBunny server at BaseURL, e.g. "http://localhost:8080".
+type Client struct {
+	BaseURL     string
+	HTTPClient  *http.Client // http.DefaultClient when nil
+	APIKey      string       // Sent as X-API-Key when set
+	BearerToken string       // Sent as a bearer token when set and there is no API key
+
+	// Requests that are safe to repeat are retried after network and server errors, waiting
+	// RetryBackoff longer before each attempt. Retried POST requests reuse their Idempotency-Key.
+	MaxAttempts  int
+	RetryBackoff time.Duration
+}
+
+// New creates a client for the server at baseURL that tries requests up to 3 times.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:      strings.TrimSuffix(baseURL, "/"),
+		MaxAttempts:  3,
+		RetryBackoff: 500 * time.Millisecond,
+	}
+}
+
+// ErrStreamClosed is returned by WatchEvents when the server ends the stream, e.g. because the client fell
+// behind. Callers resume by watching again after the last event they received.
+var ErrStreamClosed = errors.New("event stream closed by the server")
+
+// Error is a response with an unexpected status code. The server describes errors in plain text.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected status code %d: %s", e.StatusCode, e.Message)
+}
+
+// StatusCode returns the status code of an *Error, or 0 for other errors.
+func StatusCode(err error) int {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+// request is a call of an API operation.
+type request struct {
+	method     string
+	path       string
+	query      url.Values
+	header     http.Header
+	body       any
+	idempotent bool // Sent with an Idempotency-Key, so it may be retried
+	status     int  // Expected status code
+	out        any  // Decoded from the response body when set
+}
+
+// do sends a request, retrying network and server errors when it is safe to.
+func (c *Client) do(ctx context.Context, req request) (*http.Response, error) {
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			return nil, fmt.Errorf("error encoding request: %w", err)
+		}
+	}
+	header := req.header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if req.idempotent {
+		header.Set(IdempotencyKeyHeader, newIdempotencyKey())
+	}
+	retry := req.idempotent || req.method == http.MethodGet || req.method == http.MethodPut || req.method == http.MethodDelete
+
+	attempts := c.MaxAttempts
+	if attempts <= 0 || !retry {
+		attempts = 1
+	}
+	var resp *http.Response
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(attempt-1) * c.RetryBackoff):
+			}
+		}
+		resp, err = c.send(ctx, req, header, body)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			break
+		}
+		if err == nil && attempt < attempts {
+			resp.Body.Close()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != req.status {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return resp, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	if req.out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(req.out); err != nil {
+			return resp, fmt.Errorf("error decoding response: %w", err)
+		}
+	}
+	return resp, nil
+}
+
+func (c *Client) send(ctx context.Context, req request, header http.Header, body []byte) (*http.Response, error) {
+	target := c.BaseURL + req.path
+	if len(req.query) > 0 {
+		target += "?" + req.query.Encode()
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header = header.Clone()
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		httpReq.Header.Set(APIKeyHeader, c.APIKey)
+	} else if c.BearerToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(httpReq)
+}
+
+// newIdempotencyKey returns a random key identifying a request across its retries.
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// timeRange adds the from and to query parameters when they are set.
+func timeRange(query url.Values, from, to time.Time) {
+	if !from.IsZero() {
+		query.Set("from", from.Format(time.RFC3339))
+	}
+	if !to.IsZero() {
+		query.Set("to", to.Format(time.RFC3339))
+	}
+}
+
+// limitQuery returns the limit query parameter, none when limit is not positive.
+func limitQuery(limit int) url.Values {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	return query
+}
+
+func escape(segment string) string {
+	return url.PathEscape(segment)
+}
+
+// RegisterDevice registers a device, or updates its room.
+func (c *Client) RegisterDevice(ctx context.Context, device Device) error {
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/devices", body: device, idempotent: true, status: http.StatusCreated})
+	return err
+}
+
+// ListDevices returns the devices the caller may read.
+func (c *Client) ListDevices(ctx context.Context) ([]Device, error) {
+	var devices []Device
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/devices", status: http.StatusOK, out: &devices})
+	return devices, err
+}
+
+// GetDevice returns a device.
+func (c *Client) GetDevice(ctx context.Context, id string) (*Device, error) {
+	var device Device
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/devices/" + escape(id), status: http.StatusOK, out: &device})
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// DeleteDevice deletes a device.
+func (c *Client) DeleteDevice(ctx context.Context, id string) error {
+	_, err := c.do(ctx, request{method: http.MethodDelete, path: "/devices/" + escape(id), status: http.StatusNoContent})
+	return err
+}
+
+// SendCommand asks a device to change to state and returns the message ID of the command.
+func (c *Client) SendCommand(ctx context.Context, id, state string) (string, error) {
+	var response struct {
+		ID string `json:"id"`
+	}
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/devices/" + escape(id) + "/commands",
+		body: map[string]string{"state": state}, status: http.StatusAccepted, out: &response})
+	return response.ID, err
+}
+
+// DeviceHistory returns up to limit state changes of a device, newest first.
+func (c *Client) DeviceHistory(ctx context.Context, id string, limit int) ([]StateChange, error) {
+	var history []StateChange
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/devices/" + escape(id) + "/history",
+		query: limitQuery(limit), status: http.StatusOK, out: &history})
+	return history, err
+}
+
+// SendHeartbeat records that a device is online.
+func (c *Client) SendHeartbeat(ctx context.Context, id string) error {
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/devices/" + escape(id) + "/heartbeat", status: http.StatusNoContent})
+	return err
+}
+
+// PublishEvent publishes a device event and returns the ETag of the updated device. With a Version,
+// the event is only published when the device is at that version.
+func (c *Client) PublishEvent(ctx context.Context, device Device) (string, error) {
+	resp, err := c.do(ctx, request{method: http.MethodPost, path: "/publish", body: device, idempotent: true, status: http.StatusOK})
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// PublishReading publishes a telemetry reading, which the server stores asynchronously.
+func (c *Client) PublishReading(ctx context.Context, reading Reading) error {
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/telemetry", body: reading, idempotent: true, status: http.StatusAccepted})
+	return err
+}
+
+// ListReadings returns the readings of a device metric.
+func (c *Client) ListReadings(ctx context.Context, id string, q ReadingQuery) ([]Reading, error) {
+	query := limitQuery(q.Limit)
+	query.Set("metric", q.Metric)
+	timeRange(query, q.From, q.To)
+	var readings []Reading
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/devices/" + escape(id) + "/telemetry",
+		query: query, status: http.StatusOK, out: &readings})
+	return readings, err
+}
+
+// AggregateReadings returns the minimum, maximum and average of a device metric per interval.
+func (c *Client) AggregateReadings(ctx context.Context, id string, q AggregateQuery) ([]Aggregate, error) {
+	query := url.Values{"metric": {q.Metric}}
+	timeRange(query, q.From, q.To)
+	if q.Interval > 0 {
+		query.Set("interval", q.Interval.String())
+	}
+	var aggregates []Aggregate
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/devices/" + escape(id) + "/telemetry/aggregate",
+		query: query, status: http.StatusOK, out: &aggregates})
+	return aggregates, err
+}
+
+func energyQuery(q EnergyQuery) url.Values {
+	query := url.Values{}
+	if q.Period != "" {
+		query.Set("period", q.Period)
+	}
+	timeRange(query, q.From, q.To)
+	return query
+}
+
+// DeviceEnergy reports the energy consumption of a device.
+func (c *Client) DeviceEnergy(ctx context.Context, id string, q EnergyQuery) (*EnergyReport, error) {
+	var report EnergyReport
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/energy/devices/" + escape(id),
+		query: energyQuery(q), status: http.StatusOK, out: &report})
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// RoomEnergy reports the energy consumption of the devices in a room.
+func (c *Client) RoomEnergy(ctx context.Context, room string, q EnergyQuery) (*EnergyReport, error) {
+	var report EnergyReport
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/energy/rooms/" + escape(room),
+		query: energyQuery(q), status: http.StatusOK, out: &report})
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// CreateUser creates or updates a household user.
+func (c *Client) CreateUser(ctx context.Context, user User) error {
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/users", body: user, status: http.StatusCreated})
+	return err
+}
+
+// CreatePermission grants or denies a user access to a device or room.
+func (c *Client) CreatePermission(ctx context.Context, userID string, permission Permission) (*Permission, error) {
+	var created Permission
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/users/" + escape(userID) + "/permissions",
+		body: permission, status: http.StatusCreated, out: &created})
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// ListPermissions returns the permissions of a user.
+func (c *Client) ListPermissions(ctx context.Context, userID string) ([]Permission, error) {
+	var permissions []Permission
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/users/" + escape(userID) + "/permissions",
+		status: http.StatusOK, out: &permissions})
+	return permissions, err
+}
+
+// ListAuditEntries returns up to limit denied requests, newest first.
+func (c *Client) ListAuditEntries(ctx context.Context, limit int) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/audit", query: limitQuery(limit), status: http.StatusOK, out: &entries})
+	return entries, err
+}
+
+// SendNotification publishes a notification and returns it with its ID and timestamp.
+func (c *Client) SendNotification(ctx context.Context, notification Notification) (*Notification, error) {
+	var sent Notification
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/notifications", body: notification,
+		idempotent: true, status: http.StatusAccepted, out: &sent})
+	if err != nil {
+		return nil, err
+	}
+	return &sent, nil
+}
+
+// ListNotificationDeliveries returns up to limit deliveries to a user, newest first. Empty values
+// select every user or status.
+func (c *Client) ListNotificationDeliveries(ctx context.Context, userID, status string, limit int) ([]NotificationDelivery, error) {
+	query := limitQuery(limit)
+	if userID != "" {
+		query.Set("user_id", userID)
+	}
+	if status != "" {
+		query.Set("status", status)
+	}
+	var deliveries []NotificationDelivery
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/notifications", query: query, status: http.StatusOK, out: &deliveries})
+	return deliveries, err
+}
+
+// ListNotificationPreferences returns the notification channels of a user.
+func (c *Client) ListNotificationPreferences(ctx context.Context, userID string) ([]NotificationPreference, error) {
+	var preferences []NotificationPreference
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/users/" + escape(userID) + "/notification-preferences",
+		status: http.StatusOK, out: &preferences})
+	return preferences, err
+}
+
+// ReplaceNotificationPreferences replaces the notification channels of a user.
+func (c *Client) ReplaceNotificationPreferences(ctx context.Context, userID string, preferences []NotificationPreference) ([]NotificationPreference, error) {
+	var saved []NotificationPreference
+	_, err := c.do(ctx, request{method: http.MethodPut, path: "/users/" + escape(userID) + "/notification-preferences",
+		body: preferences, status: http.StatusOK, out: &saved})
+	return saved, err
+}
+
+// CreateWebhook subscribes a URL to device events. The returned subscription carries the secret
+// signing its deliveries, which is not returned again.
+func (c *Client) CreateWebhook(ctx context.Context, subscription WebhookSubscription) (*WebhookSubscription, error) {
+	var created WebhookSubscription
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/webhooks", body: subscription, status: http.StatusCreated, out: &created})
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// ListWebhooks returns the webhook subscriptions.
+func (c *Client) ListWebhooks(ctx context.Context) ([]WebhookSubscription, error) {
+	var subscriptions []WebhookSubscription
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/webhooks", status: http.StatusOK, out: &subscriptions})
+	return subscriptions, err
+}
+
+// GetWebhook returns a webhook subscription.
+func (c *Client) GetWebhook(ctx context.Context, id int64) (*WebhookSubscription, error) {
+	var subscription WebhookSubscription
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/webhooks/" + strconv.FormatInt(id, 10), status: http.StatusOK, out: &subscription})
+	if err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+// UpdateWebhook updates the URL, filter and state of a webhook subscription.
+func (c *Client) UpdateWebhook(ctx context.Context, subscription WebhookSubscription) (*WebhookSubscription, error) {
+	var updated WebhookSubscription
+	_, err := c.do(ctx, request{method: http.MethodPut, path: "/webhooks/" + strconv.FormatInt(subscription.ID, 10),
+		body: subscription, status: http.StatusOK, out: &updated})
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// DeleteWebhook deletes a webhook subscription.
+func (c *Client) DeleteWebhook(ctx context.Context, id int64) error {
+	_, err := c.do(ctx, request{method: http.MethodDelete, path: "/webhooks/" + strconv.FormatInt(id, 10), status: http.StatusNoContent})
+	return err
+}
+
+// ListWebhookDeliveries returns up to limit delivery attempts of a webhook subscription, newest first.
+func (c *Client) ListWebhookDeliveries(ctx context.Context, id int64, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/webhooks/" + strconv.FormatInt(id, 10) + "/deliveries",
+		query: limitQuery(limit), status: http.StatusOK, out: &deliveries})
+	return deliveries, err
+}
+
+// ListScenes returns the scenes.
+func (c *Client) ListScenes(ctx context.Context) ([]Scene, error) {
+	var scenes []Scene
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/scenes", status: http.StatusOK, out: &scenes})
+	return scenes, err
+}
+
+// GetScene returns a scene.
+func (c *Client) GetScene(ctx context.Context, name string) (*Scene, error) {
+	var scene Scene
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/scenes/" + escape(name), status: http.StatusOK, out: &scene})
+	if err != nil {
+		return nil, err
+	}
+	return &scene, nil
+}
+
+// PutScene creates or replaces a scene.
+func (c *Client) PutScene(ctx context.Context, scene Scene) (*Scene, error) {
+	var saved Scene
+	_, err := c.do(ctx, request{method: http.MethodPut, path: "/scenes/" + escape(scene.Name), body: scene, status: http.StatusOK, out: &saved})
+	if err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+// DeleteScene deletes a scene that no rule activates.
+func (c *Client) DeleteScene(ctx context.Context, name string) error {
+	_, err := c.do(ctx, request{method: http.MethodDelete, path: "/scenes/" + escape(name), status: http.StatusNoContent})
+	return err
+}
+
+// ActivateScene sends the commands of a scene to its devices and returns them.
+func (c *Client) ActivateScene(ctx context.Context, name string) ([]SceneCommand, error) {
+	var commands []SceneCommand
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/scenes/" + escape(name) + "/activate",
+		status: http.StatusAccepted, out: &commands})
+	return commands, err
+}
+
+// ListRules returns the rules.
+func (c *Client) ListRules(ctx context.Context) ([]Rule, error) {
+	var rules []Rule
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/rules", status: http.StatusOK, out: &rules})
+	return rules, err
+}
+
+// GetRule returns a rule.
+func (c *Client) GetRule(ctx context.Context, name string) (*Rule, error) {
+	var rule Rule
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/rules/" + escape(name), status: http.StatusOK, out: &rule})
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// PutRule creates or replaces a rule.
+func (c *Client) PutRule(ctx context.Context, rule Rule) (*Rule, error) {
+	var saved Rule
+	_, err := c.do(ctx, request{method: http.MethodPut, path: "/rules/" + escape(rule.Name), body: rule, status: http.StatusOK, out: &saved})
+	if err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+// DeleteRule deletes a rule.
+func (c *Client) DeleteRule(ctx context.Context, name string) error {
+	_, err := c.do(ctx, request{method: http.MethodDelete, path: "/rules/" + escape(name), status: http.StatusNoContent})
+	return err
+}
+
+// WatchEvents streams the device events matching filter, starting after lastEventID when it is not 0,
+// and calls handle for each of them until ctx is done, handle fails or the stream ends.
+func (c *Client) WatchEvents(ctx context.Context, filter string, lastEventID uint64, handle func(Event) error) error {
+	header := http.Header{"Accept": {"text/event-stream"}}
+	if lastEventID > 0 {
+		header.Set("Last-Event-ID", strconv.FormatUint(lastEventID, 10))
+	}
+	query := url.Values{}
+	if filter != "" {
+		query.Set("filter", filter)
+	}
+	resp, err := c.send(ctx, request{method: http.MethodGet, path: "/events/stream", query: query}, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+
+	// Events are "id:", "event:" and "data:" lines ended by a blank line, comments are heartbeats
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data = append(data, strings.TrimPrefix(value, " "))
+			continue
+		}
+		if line != "" || len(data) == 0 {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(strings.Join(data, "\n")), &event); err != nil {
+			return fmt.Errorf("error decoding event: %w", err)
+		}
+		data = nil
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return ErrStreamClosed
+}
+
+// Ready returns the readiness of the server, with an *Error carrying the report's status code when a
+// dependency is down.
+func (c *Client) Ready(ctx context.Context) (*HealthReport, error) {
+	var report HealthReport
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/readyz", status: http.StatusOK, out: &report})
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
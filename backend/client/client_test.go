@@ -0,0 +1,258 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"smart-home-assistant/api"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTypesMatchSchemas(t *testing.T) {
+	doc, err := api.Load()
+	require.NoError(t, err)
+
+	types := map[string]any{
+		"Device":                 Device{},
+		"StateChange":            StateChange{},
+		"Reading":                Reading{},
+		"Aggregate":              Aggregate{},
+		"EnergyBucket":           EnergyBucket{},
+		"EnergyReport":           EnergyReport{},
+		"User":                   User{},
+		"Permission":             Permission{},
+		"AuditEntry":             AuditEntry{},
+		"Notification":           Notification{},
+		"NotificationPreference": NotificationPreference{},
+		"NotificationDelivery":   NotificationDelivery{},
+		"WebhookSubscription":    WebhookSubscription{},
+		"WebhookDelivery":        WebhookDelivery{},
+		"Scene":                  Scene{},
+		"SceneAction":            SceneAction{},
+		"SceneCommand":           SceneCommand{},
+		"Rule":                   Rule{},
+		"Event":                  Event{},
+		"CheckResult":            CheckResult{},
+		"HealthReport":           HealthReport{},
+	}
+	for name, value := range types {
+		assert.NoError(t, doc.CheckType(name, reflect.TypeOf(value)))
+	}
+}
+
+// TestRequestsMatchDocument calls every method against a server that answers each documented operation
+// with its success status, so requests the document does not describe fail.
+func TestRequestsMatchDocument(t *testing.T) {
+	doc, err := api.Load()
+	require.NoError(t, err)
+
+	called := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		template, operation, ok := doc.Match(r.Method, r.URL.Path)
+		if !assert.True(t, ok, "%s %s is not documented", r.Method, r.URL.Path) {
+			http.Error(w, "Not documented", http.StatusNotFound)
+			return
+		}
+		called[r.Method+" "+template] = true
+		assert.Equal(t, "hb_test", r.Header.Get(APIKeyHeader))
+
+		for code := range operation.Responses {
+			status, err := strconv.Atoi(code)
+			if err != nil || status >= 300 {
+				continue
+			}
+			if status == http.StatusNoContent {
+				w.WriteHeader(status)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			switch template {
+			case "/devices", "/devices/{id}/history", "/devices/{id}/telemetry", "/devices/{id}/telemetry/aggregate",
+				"/users/{id}/permissions", "/audit", "/webhooks", "/webhooks/{id}/deliveries", "/users/{id}/notification-preferences",
+				"/scenes", "/rules":
+				if r.Method == http.MethodGet || r.Method == http.MethodPut {
+					w.Write([]byte("[]"))
+					return
+				}
+			case "/scenes/{name}/activate":
+				w.Write([]byte("[]"))
+				return
+			case "/notifications":
+				if r.Method == http.MethodGet {
+					w.Write([]byte("[]"))
+					return
+				}
+			}
+			w.Write([]byte("{}"))
+			return
+		}
+		t.Errorf("%s %s documents no success status", r.Method, template)
+	}))
+	defer server.Close()
+
+	c := New(server.URL)
+	c.APIKey = "hb_test"
+	ctx := context.Background()
+	from := time.Now().Add(-time.Hour)
+
+	require.NoError(t, c.RegisterDevice(ctx, Device{ID: "tv1", Type: "tv", State: "on"}))
+	_, err = c.ListDevices(ctx)
+	require.NoError(t, err)
+	_, err = c.GetDevice(ctx, "tv1")
+	require.NoError(t, err)
+	require.NoError(t, c.DeleteDevice(ctx, "tv1"))
+	_, err = c.SendCommand(ctx, "tv1", "off")
+	require.NoError(t, err)
+	_, err = c.DeviceHistory(ctx, "tv1", 10)
+	require.NoError(t, err)
+	require.NoError(t, c.SendHeartbeat(ctx, "tv1"))
+	_, err = c.PublishEvent(ctx, Device{ID: "tv1", Type: "tv", State: "off"})
+	require.NoError(t, err)
+	require.NoError(t, c.PublishReading(ctx, Reading{DeviceID: "t1", DeviceType: "thermostat", Metric: "temperature", Value: 21}))
+	_, err = c.ListReadings(ctx, "t1", ReadingQuery{Metric: "temperature", From: from, Limit: 5})
+	require.NoError(t, err)
+	_, err = c.AggregateReadings(ctx, "t1", AggregateQuery{Metric: "temperature", Interval: time.Minute})
+	require.NoError(t, err)
+	_, err = c.DeviceEnergy(ctx, "plug1", EnergyQuery{Period: "daily"})
+	require.NoError(t, err)
+	_, err = c.RoomEnergy(ctx, "kitchen", EnergyQuery{From: from})
+	require.NoError(t, err)
+	require.NoError(t, c.CreateUser(ctx, User{ID: "kid", Name: "Kid", Role: "child"}))
+	_, err = c.CreatePermission(ctx, "kid", Permission{DeviceID: "tv1", Action: "control"})
+	require.NoError(t, err)
+	_, err = c.ListPermissions(ctx, "kid")
+	require.NoError(t, err)
+	_, err = c.ListAuditEntries(ctx, 10)
+	require.NoError(t, err)
+	_, err = c.SendNotification(ctx, Notification{Severity: "info", Title: "Door open"})
+	require.NoError(t, err)
+	_, err = c.ListNotificationDeliveries(ctx, "kid", "sent", 10)
+	require.NoError(t, err)
+	_, err = c.ListNotificationPreferences(ctx, "kid")
+	require.NoError(t, err)
+	_, err = c.ReplaceNotificationPreferences(ctx, "kid", []NotificationPreference{{Channel: "log", Enabled: true}})
+	require.NoError(t, err)
+	_, err = c.CreateWebhook(ctx, WebhookSubscription{URL: "https://example.com/hook", Filter: "#"})
+	require.NoError(t, err)
+	_, err = c.ListWebhooks(ctx)
+	require.NoError(t, err)
+	_, err = c.GetWebhook(ctx, 1)
+	require.NoError(t, err)
+	_, err = c.UpdateWebhook(ctx, WebhookSubscription{ID: 1, URL: "https://example.com/hook", Enabled: true})
+	require.NoError(t, err)
+	require.NoError(t, c.DeleteWebhook(ctx, 1))
+	_, err = c.ListWebhookDeliveries(ctx, 1, 10)
+	require.NoError(t, err)
+	_, err = c.PutScene(ctx, Scene{Name: "movie_night", Actions: []SceneAction{{DeviceID: "tv1", State: "on"}}})
+	require.NoError(t, err)
+	_, err = c.ListScenes(ctx)
+	require.NoError(t, err)
+	_, err = c.GetScene(ctx, "movie_night")
+	require.NoError(t, err)
+	_, err = c.ActivateScene(ctx, "movie_night")
+	require.NoError(t, err)
+	require.NoError(t, c.DeleteScene(ctx, "movie_night"))
+	_, err = c.PutRule(ctx, Rule{Name: "tv_on_motion", Trigger: "device.motion_sensor.detected", Scene: "movie_night", Enabled: true})
+	require.NoError(t, err)
+	_, err = c.ListRules(ctx)
+	require.NoError(t, err)
+	_, err = c.GetRule(ctx, "tv_on_motion")
+	require.NoError(t, err)
+	require.NoError(t, c.DeleteRule(ctx, "tv_on_motion"))
+	_, err = c.Ready(ctx)
+	require.NoError(t, err)
+
+	assert.Len(t, called, 37, "every JSON operation should have a client method")
+}
+
+func TestWatchEvents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/events/stream", r.URL.Path)
+		assert.Equal(t, "device.tv.*", r.URL.Query().Get("filter"))
+		assert.Equal(t, "41", r.Header.Get("Last-Event-ID"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(": heartbeat\n\n"))
+		w.Write([]byte("id: 42\nevent: device_event\ndata: {\"id\":42,\"routing_key\":\"device.tv.on\",\"body\":\"{tv1 tv on }\"}\n\n"))
+		w.Write([]byte("id: 43\nevent: device_event\ndata: {\"id\":43,\"routing_key\":\"device.tv.off\",\"body\":\"{tv1 tv off }\"}\n\n"))
+	}))
+	defer server.Close()
+
+	var events []Event
+	err := New(server.URL).WatchEvents(context.Background(), "device.tv.*", 41, func(event Event) error {
+		events = append(events, event)
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrStreamClosed, "the end of the stream should be reported so callers can resume")
+	require.Len(t, events, 2)
+	assert.Equal(t, uint64(42), events[0].ID)
+	assert.Equal(t, "device.tv.off", events[1].RoutingKey)
+}
+
+func TestRetriesReuseIdempotencyKey(t *testing.T) {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(IdempotencyKeyHeader))
+		if len(keys) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	c := New(server.URL)
+	c.RetryBackoff = time.Millisecond
+	err := c.PublishReading(context.Background(), Reading{DeviceID: "t1", Metric: "temperature"})
+	require.NoError(t, err)
+	require.Len(t, keys, 2, "server errors should be retried")
+	assert.NotEmpty(t, keys[0])
+	assert.Equal(t, keys[0], keys[1], "retries should reuse the Idempotency-Key")
+}
+
+func TestErrorCarriesStatusAndMessage(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.URL.Path == "/users" {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Device not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	c := New(server.URL)
+	c.RetryBackoff = time.Millisecond
+	_, err := c.GetDevice(context.Background(), "missing")
+	require.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, StatusCode(err))
+	assert.Equal(t, &Error{StatusCode: http.StatusNotFound, Message: "Device not found"}, err)
+	assert.Equal(t, 1, attempts, "client errors should not be retried")
+
+	attempts = 0
+	err = c.CreateUser(context.Background(), User{ID: "kid"})
+	assert.Equal(t, http.StatusInternalServerError, StatusCode(err))
+	assert.Equal(t, 1, attempts, "requests without an Idempotency-Key should not be retried")
+}
+
+func TestReadyFailsWhenDependencyDown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(HealthReport{Status: "unavailable", Checks: map[string]CheckResult{"postgres": {Status: "down"}}})
+	}))
+	defer server.Close()
+
+	c := New(server.URL)
+	c.MaxAttempts = 1
+	_, err := c.Ready(context.Background())
+	assert.Equal(t, http.StatusServiceUnavailable, StatusCode(err))
+}
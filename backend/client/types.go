@@ -0,0 +1,239 @@
+package client
+
+import "time"
+
+// The types mirror the schemas of api/openapi.json, the client tests fail when they drift apart.
+
+// Device is a registered device, also sent as the payload of a device event.
+type Device struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	State string `json:"state"`
+	Room  string `json:"room,omitempty"`
+
+	Version   int64      `json:"version,omitempty"`    // Expected version when publishing, 0 to skip the check
+	EventTime *time.Time `json:"event_time,omitempty"` // Defaults to now when publishing
+
+	Status     string     `json:"status,omitempty"` // Presence: "online", "offline" or "unknown"
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+}
+
+// StateChange is an entry of the state history of a device.
+type StateChange struct {
+	DeviceID      string    `json:"device_id"`
+	PreviousState string    `json:"previous_state"`
+	State         string    `json:"state"`
+	MessageID     string    `json:"message_id"`
+	ChangedAt     time.Time `json:"changed_at"`
+}
+
+// Reading is a numeric measurement reported by a device.
+type Reading struct {
+	DeviceID   string    `json:"device_id"`
+	DeviceType string    `json:"device_type"`
+	Metric     string    `json:"metric"`
+	Value      float64   `json:"value"`
+	Unit       string    `json:"unit,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Aggregate summarizes the readings of an interval.
+type Aggregate struct {
+	Start time.Time `json:"start"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+	Count int64     `json:"count"`
+}
+
+// EnergyBucket is the consumption within one period of an energy report.
+type EnergyBucket struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	KWh   float64   `json:"kwh"`
+	Cost  float64   `json:"cost"`
+}
+
+// EnergyReport is the consumption of a device or room.
+type EnergyReport struct {
+	DeviceID  string         `json:"device_id,omitempty"`
+	Room      string         `json:"room,omitempty"`
+	Source    string         `json:"source,omitempty"`
+	Period    string         `json:"period"`
+	From      time.Time      `json:"from"`
+	To        time.Time      `json:"to"`
+	Currency  string         `json:"currency,omitempty"`
+	TotalKWh  float64        `json:"total_kwh"`
+	TotalCost float64        `json:"total_cost"`
+	Buckets   []EnergyBucket `json:"buckets,omitempty"`
+	Devices   []EnergyReport `json:"devices,omitempty"`
+}
+
+// User is a member of the household.
+type User struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Role      string     `json:"role"` // "owner", "adult", "child" or "guest"
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Permission grants or denies a user an action on a device or room.
+type Permission struct {
+	ID        int64      `json:"id"`
+	UserID    string     `json:"user_id"`
+	DeviceID  string     `json:"device_id,omitempty"`
+	Room      string     `json:"room,omitempty"`
+	Action    string     `json:"action"` // "read" or "control"
+	Allow     bool       `json:"allow"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// AuditEntry records a denied request.
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	UserID    string    `json:"user_id"`
+	Action    string    `json:"action"`
+	DeviceID  string    `json:"device_id,omitempty"`
+	State     string    `json:"state,omitempty"`
+	Allowed   bool      `json:"allowed"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Notification is an alert for a user, or every user when UserID is empty.
+type Notification struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id,omitempty"`
+	Severity  string    `json:"severity"` // "info", "warning" or "critical"
+	Title     string    `json:"title"`
+	Message   string    `json:"message,omitempty"`
+	DeviceID  string    `json:"device_id,omitempty"`
+	DedupKey  string    `json:"dedup_key,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NotificationPreference configures a notification channel of a user.
+type NotificationPreference struct {
+	UserID      string `json:"user_id"`
+	Channel     string `json:"channel"` // "email", "webhook" or "log"
+	Address     string `json:"address,omitempty"`
+	MinSeverity string `json:"min_severity,omitempty"`
+	QuietFrom   string `json:"quiet_from,omitempty"`
+	QuietTo     string `json:"quiet_to,omitempty"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// NotificationDelivery is the outcome of sending a notification on a channel.
+type NotificationDelivery struct {
+	ID             int64     `json:"id"`
+	NotificationID string    `json:"notification_id"`
+	UserID         string    `json:"user_id"`
+	Channel        string    `json:"channel"`
+	Severity       string    `json:"severity"`
+	Title          string    `json:"title"`
+	DedupKey       string    `json:"dedup_key"`
+	Status         string    `json:"status"`
+	Error          string    `json:"error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// WebhookSubscription delivers the device events matching Filter to URL.
+type WebhookSubscription struct {
+	ID                  int64      `json:"id"`
+	URL                 string     `json:"url"`
+	Filter              string     `json:"filter"`
+	Secret              string     `json:"secret,omitempty"` // Only returned when the subscription is created
+	Enabled             bool       `json:"enabled"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	DisabledAt          *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+}
+
+// SceneAction is the state a scene asks a device for.
+type SceneAction struct {
+	DeviceID string `json:"device_id"`
+	State    string `json:"state"`
+}
+
+// Scene is a named set of device states applied together.
+type Scene struct {
+	Name      string        `json:"name"`
+	Actions   []SceneAction `json:"actions"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// SceneCommand is a command sent to activate a scene.
+type SceneCommand struct {
+	DeviceID string `json:"device_id"`
+	State    string `json:"state"`
+	ID       string `json:"id"` // Message ID of the published command
+}
+
+// Rule activates a scene when a device event matching Trigger is published.
+type Rule struct {
+	Name      string    `json:"name"`
+	Trigger   string    `json:"trigger"`             // Routing key pattern, e.g. "device.motion_sensor.detected"
+	DeviceID  string    `json:"device_id,omitempty"` // Only events of this device trigger the rule when set
+	Scene     string    `json:"scene"`
+	Enabled   bool      `json:"enabled"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WebhookDelivery is an attempt to deliver an event to a webhook subscription.
+type WebhookDelivery struct {
+	ID             int64     `json:"id"`
+	SubscriptionID int64     `json:"subscription_id"`
+	MessageID      string    `json:"message_id"`
+	RoutingKey     string    `json:"routing_key"`
+	Attempt        int       `json:"attempt"`
+	StatusCode     int       `json:"status_code,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Success        bool      `json:"success"`
+	DurationMs     int64     `json:"duration_ms"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Event is a device event streamed by WatchEvents.
+type Event struct {
+	ID          uint64    `json:"id"`
+	RoutingKey  string    `json:"routing_key"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        string    `json:"body"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// CheckResult is the outcome of a readiness check.
+type CheckResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// HealthReport is the readiness of the server and each of its dependencies.
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// ReadingQuery selects the readings of a metric. Zero times select the last 24 hours.
+type ReadingQuery struct {
+	Metric string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+// AggregateQuery selects the readings of a metric to aggregate into intervals.
+type AggregateQuery struct {
+	Metric   string
+	From     time.Time
+	To       time.Time
+	Interval time.Duration // Defaults to 5 minutes
+}
+
+// EnergyQuery selects the periods of an energy report. Zero times select the last 30 days.
+type EnergyQuery struct {
+	Period string // "daily", "weekly" or "monthly"
+	From   time.Time
+	To     time.Time
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"smart-home-assistant/internal"
+	"strings"
+)
+
+func main() {
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintln(out, "Usage:")
+		fmt.Fprintln(out, "  apikey create <name> <scope>...  Issue a key and print it once")
+		fmt.Fprintln(out, "  apikey revoke <name>             Revoke the key with the name")
+		fmt.Fprintf(out, "Scopes: %s\n", strings.Join(internal.Scopes, ", "))
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 || (args[0] == "create" && len(args) < 3) || (args[0] == "revoke" && len(args) != 2) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	for _, scope := range args[2:] {
+		if !slices.Contains(internal.Scopes, scope) {
+			log.Fatalf("Unknown scope %q", scope)
+		}
+	}
+
+	// Load the application configuration
+	config, err := internal.LoadAppConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	dbClient, err := internal.ConnectPostgreSQL(*config)
+	if err != nil {
+		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+	}
+	defer dbClient.Close()
+	if err := dbClient.Migrate(); err != nil {
+		log.Fatalf("Failed to apply migrations: %v", err)
+	}
+
+	name := args[1]
+	switch args[0] {
+	case "create":
+		key, err := dbClient.CreateAPIKey(name, args[2:])
+		if err != nil {
+			log.Fatalf("Failed to create API key: %v", err)
+		}
+		// The key is only stored hashed, so this is the only time it can be read
+		fmt.Println(key)
+	case "revoke":
+		revoked, err := dbClient.RevokeAPIKey(name)
+		if err != nil {
+			log.Fatalf("Failed to revoke API key: %v", err)
+		}
+		if !revoked {
+			log.Fatalf("No active API key named %q", name)
+		}
+		log.Printf("Revoked API key %s", name)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"smart-home-assistant/internal"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 func main() {
@@ -60,19 +65,92 @@ func main() {
 		log.Fatalf("Failed to create binding: %v", err)
 	}
 
-	// Consume events for the device
-	messages, err := client.ConsumeEvent(queue.Name)
+	// Consume events for the device, acknowledging each once it is handled
+	messages, err := client.ConsumeEventWithAck(queue.Name)
 	if err != nil {
 		log.Fatalf("Failed to consume events: %v", err)
 	}
 
+	// Expose processing metrics and health probes for Prometheus and the orchestrator
+	if config.Consumer.MetricsPort != "" {
+		health := internal.NewHealth(config.Health.Timeout)
+		health.Add("rabbitmq", client.Check)
+		internal.ServeMetrics(config.Consumer.MetricsPort, health)
+	}
+
+	// Announce the device to the server's presence tracking when it is named
+	if deviceID := os.Getenv("DEVICE_ID"); deviceID != "" {
+		heartbeatClient, err := internal.NewRabbitMQClient(conn)
+		if err != nil {
+			log.Fatalf("Failed to create RabbitMQ client for heartbeats: %v", err)
+		}
+		defer heartbeatClient.Close()
+
+		interval := config.Presence.HeartbeatInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		device := internal.Device{ID: deviceID, Type: deviceType}
+		go internal.SendHeartbeats(context.Background(), heartbeatClient, device, interval)
+	}
+
+	// Skip events that were already processed, e.g. after a redelivery or a retried publish
+	dedup, err := newDeduplicator(*config, queue.Name)
+	if err != nil {
+		log.Fatalf("Failed to create deduplicator: %v", err)
+	}
+	if processed, ok := dedup.(*internal.PostgresDeduplicator); ok {
+		window := config.Consumer.DedupWindow
+		if window <= 0 {
+			window = 24 * time.Hour
+		}
+		go func() {
+			for range time.Tick(time.Hour) {
+				if _, err := processed.Purge(time.Now().Add(-window)); err != nil {
+					log.Printf("Failed to purge processed messages: %v", err)
+				}
+			}
+		}()
+	}
+
+	// Discard events that arrive after a newer event of the same device
+	order := internal.NewEventOrder()
+
 	go func() {
 		for msg := range messages {
-			log.Printf("%s received event: %s", deviceType, msg.Body)
-			handleDeviceEvent(deviceType, string(msg.Body))
+			start := time.Now()
+			if dedup != nil && msg.MessageId != "" {
+				duplicate, err := dedup.MarkProcessed(msg.MessageId)
+				if err != nil {
+					log.Printf("Failed to check for duplicate event: %v", err)
+				}
+				if duplicate {
+					log.Printf("%s skipped duplicate event %s", deviceType, msg.MessageId)
+					ack(msg)
+					continue
+				}
+			}
+
+			if deviceID, ok := msg.Headers[internal.DeviceIDHeader].(string); ok {
+				if !order.Accept(deviceID, internal.EventTime(msg)) {
+					log.Printf("%s discarded out-of-order event %s for device %s", deviceType, msg.MessageId, deviceID)
+					ack(msg)
+					continue
+				}
+			}
 
-			// Manually acknowledge the message
-			msg.Ack(false)
+			log.Printf("%s received event: %s", deviceType, msg.Body)
+			err := handleDeviceEvent(deviceType, string(msg.Body))
+			if err != nil {
+				log.Printf("%s failed to handle event %s: %v", deviceType, msg.MessageId, err)
+				// Not requeued, the event would fail the same way again
+				if err := msg.Nack(false, false); err != nil {
+					log.Printf("Failed to reject event: %v", err)
+				}
+			} else {
+				ack(msg)
+			}
+			internal.ObserveConsume(deviceType, start, err)
 		}
 	}()
 
@@ -80,6 +158,34 @@ func main() {
 	select {}
 }
 
+// ack acknowledges a handled or skipped event
+func ack(msg amqp.Delivery) {
+	if err := msg.Ack(false); err != nil {
+		log.Printf("Failed to acknowledge event: %v", err)
+	}
+}
+
+// newDeduplicator creates the deduplicator selected by Consumer.Dedup, or nil when disabled
+func newDeduplicator(config internal.AppConfig, consumer string) (internal.Deduplicator, error) {
+	switch config.Consumer.Dedup {
+	case "":
+		return nil, nil
+	case "memory":
+		return internal.NewLRUDeduplicator(config.Consumer.DedupSize), nil
+	case "postgres":
+		dbClient, err := internal.ConnectPostgreSQL(config)
+		if err != nil {
+			return nil, err
+		}
+		if err := dbClient.Migrate(); err != nil {
+			return nil, err
+		}
+		return internal.NewPostgresDeduplicator(dbClient, consumer), nil
+	default:
+		return nil, fmt.Errorf("unknown deduplicator %q", config.Consumer.Dedup)
+	}
+}
+
 // Helper function to get environment variables or fallback to default values
 func getEnv(key, fallback string) string {
 	value := os.Getenv(key)
@@ -89,14 +195,20 @@ func getEnv(key, fallback string) string {
 	return value
 }
 
-// Utility function to handle events for a device
-func handleDeviceEvent(deviceID, event string) {
+// Utility function to handle events for a device, failing for events it cannot read
+func handleDeviceEvent(deviceID, event string) error {
 	switch event {
 	case "Air conditioner is cooling":
 		log.Printf("Cooling on device %s", deviceID)
 	case "Air conditioner is turned off":
 		log.Printf("Turning off device %s", deviceID)
 	default:
-		log.Printf("Unknown event for device %s: %s", deviceID, event)
+		// Device events carry {<id> <type> <state> <room>}
+		fields := strings.Fields(strings.Trim(event, "{}"))
+		if !strings.HasPrefix(event, "{") || len(fields) < 3 {
+			return fmt.Errorf("unknown event for device %s: %s", deviceID, event)
+		}
+		log.Printf("Device %s is now %s", fields[0], fields[2])
 	}
+	return nil
 }
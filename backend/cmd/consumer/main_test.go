@@ -100,3 +100,9 @@ func TestConsumer(t *testing.T) {
 	assert.Equal(t, "device.air_conditioner.#", mockClient.BindingKey, "Binding key should match")
 	assert.Equal(t, "device_events", mockClient.ExchangeName, "Exchange name should match")
 }
+
+func TestHandleDeviceEvent(t *testing.T) {
+	assert.NoError(t, handleDeviceEvent("air_conditioner", "Air conditioner is cooling"))
+	assert.NoError(t, handleDeviceEvent("air_conditioner", "{ac1 air_conditioner cooling bedroom}"))
+	assert.Error(t, handleDeviceEvent("air_conditioner", "garbage"), "unreadable events should fail")
+}
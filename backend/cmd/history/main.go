@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"smart-home-assistant/internal"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// stringList collects the values of a flag given several times.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func main() {
+	var filters stringList
+	consumer := flag.String("consumer", "", "Consumer name whose offset is stored, so the next run resumes after it")
+	from := flag.String("from", "stored", "Where to start: first, last, next, stored, an offset, an RFC 3339 time or a duration ago")
+	output := flag.String("o", "", "Append the events to this NDJSON recording instead of printing them")
+	idle := flag.Duration("idle", 0, "Stop once no event arrived for this long, follow the stream when 0")
+	flag.Var(&filters, "filter", "Only read events matching this routing key pattern, may be repeated")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: history [flags]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	start, err := internal.ParseStreamOffset(*from)
+	if err != nil {
+		log.Fatalf("Invalid -from: %v", err)
+	}
+	for _, filter := range filters {
+		if err := internal.ValidateRoutingKeyFilter(filter); err != nil {
+			log.Fatalf("Invalid filter: %v", err)
+		}
+	}
+
+	// Load the application configuration
+	config, err := internal.LoadAppConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Named consumers keep their offset in PostgreSQL, anonymous ones start over every run
+	var offsets internal.OffsetStore = internal.NewMemoryOffsetStore()
+	name := *consumer
+	if name != "" {
+		dbClient, err := internal.ConnectPostgreSQL(*config)
+		if err != nil {
+			log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+		}
+		defer dbClient.Close()
+		if err := dbClient.Migrate(); err != nil {
+			log.Fatalf("Failed to apply migrations: %v", err)
+		}
+		offsets = internal.NewPostgresOffsetStore(dbClient)
+	} else {
+		name = "history-" + internal.NewMessageID()
+	}
+
+	var recorder *internal.Recorder
+	if *output != "" {
+		file, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Fatalf("Failed to open recording: %v", err)
+		}
+		defer file.Close()
+		recorder = internal.NewRecorder(file)
+	}
+
+	// Connect to RabbitMQ using values from the config
+	conn, err := internal.ConnectRabbitMQ(
+		config.RabbitMQ.User,
+		config.RabbitMQ.Password,
+		config.RabbitMQ.Host,
+		config.RabbitMQ.VHost,
+	)
+	if err != nil {
+		log.Fatalf("Failed to connect to RabbitMQ: %v", err)
+	}
+	defer conn.Close()
+
+	client, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to create RabbitMQ client: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.CreateTopicExchange("device_events"); err != nil {
+		log.Fatalf("Failed to create exchange: %v", err)
+	}
+	if _, err := internal.MirrorToHistory(*config, client); err != nil {
+		log.Fatalf("Failed to declare the history stream: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var idleTimer *time.Timer
+	if *idle > 0 {
+		idleTimer = time.AfterFunc(*idle, stop)
+	}
+
+	read, matched := 0, 0
+	err = internal.NewStreamConsumer(*config, client, name, offsets).Consume(ctx, start, func(msg amqp.Delivery) error {
+		if idleTimer != nil {
+			idleTimer.Reset(*idle)
+		}
+		read++
+		if !matchesAny(filters, msg.RoutingKey) {
+			return nil
+		}
+		matched++
+		if recorder != nil {
+			return recorder.Record(msg)
+		}
+		offset, _ := internal.DeliveryStreamOffset(msg)
+		fmt.Printf("%d %s %s %s\n", offset, msg.Timestamp.Format(time.RFC3339), msg.RoutingKey, msg.Body)
+		return nil
+	})
+	if recorder != nil {
+		if flushErr := recorder.Flush(); flushErr != nil {
+			log.Printf("Failed to flush recording: %v", flushErr)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to read the history stream: %v", err)
+	}
+	log.Printf("Read %d events, %d matching", read, matched)
+}
+
+// matchesAny reports whether the routing key matches one of the filters, or there are none.
+func matchesAny(filters []string, routingKey string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, filter := range filters {
+		if internal.MatchRoutingKey(filter, routingKey) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"smart-home-assistant/internal"
+)
+
+func (c *cli) config(args []string) error {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(c.stderr, "Usage: homebunny config validate [path]")
+		return errUsage
+	}
+	fs := c.newFlagSet("config validate")
+	positional, err := c.parse(fs, args[1:])
+	if err != nil || len(positional) > 1 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny config validate [path]")
+		return errUsage
+	}
+	path := "config/config.yaml"
+	if len(positional) == 1 {
+		path = positional[0]
+	}
+
+	config, err := internal.LoadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	if err := config.Validate(); err != nil {
+		var joined interface{ Unwrap() []error }
+		if errors.As(err, &joined) {
+			for _, problem := range joined.Unwrap() {
+				problems = append(problems, problem.Error())
+			}
+		} else {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	result := struct {
+		Path     string   `json:"path"`
+		Valid    bool     `json:"valid"`
+		Problems []string `json:"problems,omitempty"`
+	}{path, len(problems) == 0, problems}
+	if err := c.write(result, func() [][]string {
+		if len(problems) == 0 {
+			return [][]string{{path + " is valid"}}
+		}
+		rows := [][]string{{"PROBLEM"}}
+		for _, problem := range problems {
+			rows = append(rows, []string{problem})
+		}
+		return rows
+	}); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s has %d problem(s)", path, len(problems))
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"smart-home-assistant/client"
+	"strconv"
+	"strings"
+)
+
+// deviceRows returns the table of devices, with the header first.
+func deviceRows(devices ...client.Device) [][]string {
+	rows := [][]string{{"ID", "TYPE", "STATE", "ROOM", "STATUS", "VERSION", "LAST SEEN"}}
+	for _, device := range devices {
+		rows = append(rows, []string{device.ID, device.Type, device.State, orDash(device.Room), orDash(device.Status),
+			strconv.FormatInt(device.Version, 10), formatTime(device.LastSeenAt)})
+	}
+	return rows
+}
+
+// messageRows returns a table with a single message, for commands that change something.
+func messageRows(format string, args ...any) func() [][]string {
+	return func() [][]string { return [][]string{{fmt.Sprintf(format, args...)}} }
+}
+
+func (c *cli) devices(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny devices list|get|register|delete")
+		return errUsage
+	}
+	switch args[0] {
+	case "list":
+		return c.listDevices(ctx, args[1:])
+	case "get":
+		return c.getDevice(ctx, args[1:])
+	case "register":
+		return c.registerDevice(ctx, args[1:])
+	case "delete":
+		return c.deleteDevice(ctx, args[1:])
+	}
+	fmt.Fprintf(c.stderr, "Unknown devices command %q, expected list, get, register or delete\n", args[0])
+	return errUsage
+}
+
+func (c *cli) listDevices(ctx context.Context, args []string) error {
+	fs := c.newFlagSet("devices list")
+	if positional, err := c.parse(fs, args); err != nil || len(positional) != 0 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny devices list")
+		return errUsage
+	}
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	devices, err := apiClient.ListDevices(ctx)
+	if err != nil {
+		return err
+	}
+	return c.write(devices, func() [][]string { return deviceRows(devices...) })
+}
+
+func (c *cli) getDevice(ctx context.Context, args []string) error {
+	fs := c.newFlagSet("devices get")
+	positional, err := c.parse(fs, args)
+	if err != nil || len(positional) != 1 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny devices get <id>")
+		return errUsage
+	}
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	device, err := apiClient.GetDevice(ctx, positional[0])
+	if err != nil {
+		return err
+	}
+	return c.write(device, func() [][]string { return deviceRows(*device) })
+}
+
+// newDeviceFlagSet returns the flags of a command describing a device.
+func (c *cli) newDeviceFlagSet(name string, device *client.Device) *flag.FlagSet {
+	fs := c.newFlagSet(name)
+	fs.StringVar(&device.Type, "type", "", "Device type, e.g. tv")
+	fs.StringVar(&device.State, "state", "", "Device state, e.g. on")
+	fs.StringVar(&device.Room, "room", "", "Room of the device")
+	return fs
+}
+
+func (c *cli) registerDevice(ctx context.Context, args []string) error {
+	var device client.Device
+	positional, err := c.parse(c.newDeviceFlagSet("devices register", &device), args)
+	if err != nil || len(positional) != 1 || device.Type == "" || device.State == "" {
+		fmt.Fprintln(c.stderr, "Usage: homebunny devices register <id> --type <type> --state <state> [--room <room>]")
+		return errUsage
+	}
+	device.ID = positional[0]
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	if err := apiClient.RegisterDevice(ctx, device); err != nil {
+		return err
+	}
+	return c.write(device, messageRows("Registered %s", device.ID))
+}
+
+func (c *cli) deleteDevice(ctx context.Context, args []string) error {
+	fs := c.newFlagSet("devices delete")
+	positional, err := c.parse(fs, args)
+	if err != nil || len(positional) != 1 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny devices delete <id>")
+		return errUsage
+	}
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	if err := apiClient.DeleteDevice(ctx, positional[0]); err != nil {
+		return err
+	}
+	return c.write(map[string]string{"id": positional[0]}, messageRows("Deleted %s", positional[0]))
+}
+
+func (c *cli) publish(ctx context.Context, args []string) error {
+	var device client.Device
+	fs := c.newDeviceFlagSet("publish", &device)
+	fs.Int64Var(&device.Version, "version", 0, "Only publish when the device is at this version")
+	positional, err := c.parse(fs, args)
+	if err != nil || len(positional) != 1 || device.Type == "" || device.State == "" {
+		fmt.Fprintln(c.stderr, "Usage: homebunny publish <id> --type <type> --state <state> [--room <room>] [--version <version>]")
+		return errUsage
+	}
+	device.ID = positional[0]
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	etag, err := apiClient.PublishEvent(ctx, device)
+	if err != nil {
+		return err
+	}
+
+	// The ETag carries the version the event moved the device to
+	version, _ := strconv.ParseInt(strings.Trim(etag, `"`), 10, 64)
+	result := struct {
+		ID      string `json:"id"`
+		State   string `json:"state"`
+		Version int64  `json:"version,omitempty"`
+	}{device.ID, device.State, version}
+	return c.write(result, messageRows("Published %s %s (version %d)", device.ID, device.State, version))
+}
+
+func (c *cli) command(ctx context.Context, args []string) error {
+	fs := c.newFlagSet("command")
+	positional, err := c.parse(fs, args)
+	if err != nil || len(positional) != 2 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny command <id> <state>")
+		return errUsage
+	}
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	id, err := apiClient.SendCommand(ctx, positional[0], positional[1])
+	if err != nil {
+		return err
+	}
+	result := map[string]string{"id": id, "device_id": positional[0], "state": positional[1]}
+	return c.write(result, messageRows("Sent command %s to %s", id, positional[0]))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"smart-home-assistant/client"
+	"strings"
+)
+
+const usage = `Usage: homebunny [flags] <command> [arguments]
+
+Commands:
+  devices list                         List the devices you may read
+  devices get <id>                     Show a device
+  devices register <id> --type --state Register a device, or update its room
+  devices delete <id>                  Delete a device
+  publish <id> --type --state          Publish a device event
+  command <id> <state>                 Ask a device to change its state
+  watch [--filter] [--last-event-id]   Tail live device events
+  scenes list                          List the scenes
+  scenes get <name>                    Show a scene
+  scenes put <name> --action ...       Save a scene of <device>=<state> actions
+  scenes delete <name>                 Delete a scene
+  scenes activate <name>               Send the commands of a scene
+  rules list                           List the rules
+  rules get <name>                     Show a rule
+  rules put <name> --trigger --scene   Save a rule activating a scene on matching events
+  rules delete <name>                  Delete a rule
+  config validate [path]               Check a server configuration file
+
+Flags, accepted before or after the command:
+`
+
+// errUsage reports invalid arguments, after the usage has been printed.
+var errUsage = errors.New("invalid arguments")
+
+// options are the flags every command accepts.
+type options struct {
+	server   string
+	profile  string
+	profiles string
+	output   string
+}
+
+func (o *options) bind(fs *flag.FlagSet) {
+	fs.StringVar(&o.server, "server", o.server, "URL of the server, overrides the profile")
+	fs.StringVar(&o.profile, "profile", o.profile, "Profile to use, default $HOMEBUNNY_PROFILE or the file's Default")
+	fs.StringVar(&o.profiles, "profiles", o.profiles, "Profile file, default $HOMEBUNNY_PROFILES or ~/.config/homebunny/profiles.yaml")
+	fs.StringVar(&o.output, "output", o.output, "Output format: table, json or yaml")
+	fs.StringVar(&o.output, "o", o.output, "Shorthand for --output")
+}
+
+// cli is the state shared by the commands of one invocation.
+type cli struct {
+	opts   options
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// newFlagSet returns the flags of a command, including the shared ones.
+func (c *cli) newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	c.opts.bind(fs)
+	return fs
+}
+
+// parse parses flags placed anywhere among the arguments and returns the positional arguments.
+func (c *cli) parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, errUsage
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// client builds an API client from the selected profile and the --server flag.
+func (c *cli) client() (*client.Client, error) {
+	profile, err := loadProfile(c.opts.profiles, c.opts.profile)
+	if err != nil {
+		return nil, err
+	}
+	server := profile.Server
+	if c.opts.server != "" {
+		server = c.opts.server
+	}
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+
+	apiClient := client.New(server)
+	apiClient.APIKey = profile.APIKey
+	apiClient.BearerToken = profile.BearerToken
+	if profile.BearerTokenFile != "" {
+		token, err := os.ReadFile(profile.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bearer token file: %w", err)
+		}
+		apiClient.BearerToken = strings.TrimSpace(string(token))
+	}
+	if c.opts.output == "" {
+		c.opts.output = profile.Output
+	}
+	return apiClient, nil
+}
+
+// run executes the command line and returns the process exit code.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	c := &cli{stdout: stdout, stderr: stderr}
+	fs := c.newFlagSet("homebunny")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "devices":
+		err = c.devices(ctx, args[1:])
+	case "publish":
+		err = c.publish(ctx, args[1:])
+	case "command":
+		err = c.command(ctx, args[1:])
+	case "watch":
+		err = c.watch(ctx, args[1:])
+	case "config":
+		err = c.config(args[1:])
+	case "scenes":
+		err = c.scenes(ctx, args[1:])
+	case "rules":
+		err = c.rules(ctx, args[1:])
+	case "help":
+		fs.SetOutput(stdout)
+		fmt.Fprint(stdout, usage)
+		fs.PrintDefaults()
+		return 0
+	default:
+		fmt.Fprintf(stderr, "homebunny: unknown command %q\n\n", args[0])
+		fs.Usage()
+		return 2
+	}
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	default:
+		fmt.Fprintf(stderr, "homebunny: %v\n", err)
+		return 1
+	}
+}
+
+func main() {
+	// Interrupting watch ends it cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
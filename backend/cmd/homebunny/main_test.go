@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"smart-home-assistant/client"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runCLI runs the command line without profiles unless --profiles is given, returning the exit code
+// and output.
+func runCLI(t *testing.T, args ...string) (int, string, string) {
+	t.Setenv("HOMEBUNNY_PROFILES", filepath.Join(t.TempDir(), "missing.yaml"))
+	t.Setenv("HOMEBUNNY_PROFILE", "")
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// writeProfiles writes a profile file and returns its path.
+func writeProfiles(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "profiles.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestDevicesList(t *testing.T) {
+	seen := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/devices", r.URL.Path)
+		assert.Equal(t, http.MethodGet, r.Method)
+		json.NewEncoder(w).Encode([]client.Device{
+			{ID: "tv1", Type: "tv", State: "on", Room: "living", Status: "online", Version: 3, LastSeenAt: &seen},
+			{ID: "ac1", Type: "air_conditioner", State: "cooling"},
+		})
+	}))
+	defer server.Close()
+
+	code, stdout, stderr := runCLI(t, "--server", server.URL, "devices", "list")
+	require.Equal(t, 0, code, stderr)
+	assert.Contains(t, stdout, "ID")
+	assert.Regexp(t, `tv1\s+tv\s+on\s+living\s+online\s+3`, stdout)
+	assert.Regexp(t, `ac1\s+air_conditioner\s+cooling\s+-\s+-\s+0\s+-`, stdout)
+
+	code, stdout, _ = runCLI(t, "devices", "list", "--server", server.URL, "-o", "json")
+	require.Equal(t, 0, code)
+	var devices []client.Device
+	require.NoError(t, json.Unmarshal([]byte(stdout), &devices), "flags after the command should apply too")
+	assert.Len(t, devices, 2)
+
+	code, stdout, _ = runCLI(t, "devices", "list", "--server", server.URL, "--output", "yaml")
+	require.Equal(t, 0, code)
+	assert.Contains(t, stdout, "- id: tv1\n")
+	assert.Contains(t, stdout, "  last_seen_at: \"2024-05-01T12:00:00Z\"\n", "YAML should use the JSON field names")
+}
+
+func TestRegisterAndPublish(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		var device client.Device
+		require.NoError(t, json.Unmarshal(body, &device), "should send a device payload")
+		assert.Equal(t, client.Device{ID: "tv1", Type: "tv", State: "on", Room: "living"}, device)
+
+		if r.URL.Path == "/publish" {
+			w.Header().Set("ETag", `"4"`)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	code, stdout, stderr := runCLI(t, "--server", server.URL, "devices", "register", "tv1", "--type", "tv", "--state", "on", "--room", "living")
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, "Registered tv1\n", stdout)
+
+	code, stdout, stderr = runCLI(t, "--server", server.URL, "publish", "--type", "tv", "tv1", "--state", "on", "--room", "living", "-o", "json")
+	require.Equal(t, 0, code, stderr)
+	assert.JSONEq(t, `{"id": "tv1", "state": "on", "version": 4}`, stdout)
+	assert.Equal(t, []string{"POST /devices", "POST /publish"}, requests)
+
+	code, _, stderr = runCLI(t, "--server", server.URL, "publish", "tv1", "--type", "tv")
+	assert.Equal(t, 2, code, "a missing state is a usage error")
+	assert.Contains(t, stderr, "Usage: homebunny publish")
+}
+
+func TestCommandAndErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/devices/tv1/commands":
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{"id":"cmd-1"}`))
+		case "/devices/tv1":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Device not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	code, stdout, stderr := runCLI(t, "--server", server.URL, "command", "tv1", "off")
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, "Sent command cmd-1 to tv1\n", stdout)
+
+	code, stdout, _ = runCLI(t, "--server", server.URL, "devices", "delete", "tv1")
+	require.Equal(t, 0, code)
+	assert.Equal(t, "Deleted tv1\n", stdout)
+
+	code, _, stderr = runCLI(t, "--server", server.URL, "devices", "get", "missing")
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "homebunny: unexpected status code 404: Device not found\n", stderr)
+
+	code, _, _ = runCLI(t, "reboot")
+	assert.Equal(t, 2, code, "unknown commands are usage errors")
+}
+
+func TestScenesAndRules(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method + " " + r.URL.Path {
+		case "PUT /scenes/movie_night":
+			var scene client.Scene
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&scene))
+			assert.Equal(t, []client.SceneAction{{DeviceID: "tv1", State: "on"}, {DeviceID: "lamp1", State: "off"}}, scene.Actions)
+			json.NewEncoder(w).Encode(scene)
+		case "GET /scenes":
+			json.NewEncoder(w).Encode([]client.Scene{{Name: "movie_night", Actions: []client.SceneAction{{DeviceID: "tv1", State: "on"}, {DeviceID: "lamp1", State: "off"}}}})
+		case "POST /scenes/movie_night/activate":
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode([]client.SceneCommand{{DeviceID: "tv1", State: "on", ID: "cmd-1"}})
+		case "PUT /rules/movie_on_motion":
+			var rule client.Rule
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&rule))
+			assert.Equal(t, client.Rule{Name: "movie_on_motion", Trigger: "device.motion_sensor.detected", DeviceID: "m1", Scene: "movie_night"}, rule,
+				"--disabled should save the rule disabled")
+			json.NewEncoder(w).Encode(rule)
+		case "GET /rules/movie_on_motion":
+			json.NewEncoder(w).Encode(client.Rule{Name: "movie_on_motion", Trigger: "device.motion_sensor.detected", Scene: "movie_night", Enabled: true})
+		case "DELETE /scenes/movie_night":
+			http.Error(w, "Scene is activated by a rule, delete the rule first", http.StatusConflict)
+		case "DELETE /rules/movie_on_motion":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	code, stdout, stderr := runCLI(t, "--server", server.URL, "scenes", "put", "movie_night", "--action", "tv1=on", "--action", "lamp1=off")
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, "Saved scene movie_night\n", stdout)
+
+	code, stdout, stderr = runCLI(t, "--server", server.URL, "scenes", "list")
+	require.Equal(t, 0, code, stderr)
+	assert.Regexp(t, `movie_night\s+tv1=on lamp1=off\s+-`, stdout)
+
+	code, stdout, stderr = runCLI(t, "--server", server.URL, "scenes", "activate", "movie_night")
+	require.Equal(t, 0, code, stderr)
+	assert.Regexp(t, `tv1\s+on\s+cmd-1`, stdout)
+
+	code, stdout, stderr = runCLI(t, "--server", server.URL, "rules", "put", "movie_on_motion", "--trigger", "device.motion_sensor.detected",
+		"--scene", "movie_night", "--device", "m1", "--disabled")
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, "Saved rule movie_on_motion\n", stdout)
+
+	code, stdout, stderr = runCLI(t, "--server", server.URL, "rules", "get", "movie_on_motion", "-o", "json")
+	require.Equal(t, 0, code, stderr)
+	var rule client.Rule
+	require.NoError(t, json.Unmarshal([]byte(stdout), &rule))
+	assert.True(t, rule.Enabled)
+
+	code, _, stderr = runCLI(t, "--server", server.URL, "scenes", "delete", "movie_night")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "delete the rule first")
+
+	code, stdout, stderr = runCLI(t, "--server", server.URL, "rules", "delete", "movie_on_motion")
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, "Deleted rule movie_on_motion\n", stdout)
+
+	code, _, stderr = runCLI(t, "--server", server.URL, "scenes", "put", "movie_night", "--action", "tv1")
+	assert.Equal(t, 2, code, "actions without a state are usage errors")
+	assert.Contains(t, stderr, "Usage: homebunny scenes put")
+	code, _, _ = runCLI(t, "--server", server.URL, "rules", "put", "movie_on_motion", "--trigger", "#")
+	assert.Equal(t, 2, code, "a rule without a scene is a usage error")
+
+	assert.Equal(t, []string{"PUT /scenes/movie_night", "GET /scenes", "POST /scenes/movie_night/activate", "PUT /rules/movie_on_motion",
+		"GET /rules/movie_on_motion", "DELETE /scenes/movie_night", "DELETE /rules/movie_on_motion"}, requests)
+}
+
+func TestProfiles(t *testing.T) {
+	var keys, tokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(client.APIKeyHeader))
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "support.jwt")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("jwt-token\n"), 0o600))
+	profiles := writeProfiles(t, `
+Default: home
+Profiles:
+  home:
+    Server: "`+server.URL+`"
+    APIKey: "hb_test"
+  support:
+    Server: "`+server.URL+`"
+    BearerTokenFile: "`+tokenFile+`"
+    Output: json
+`)
+
+	code, _, stderr := runCLI(t, "--profiles", profiles, "devices", "list")
+	require.Equal(t, 0, code, stderr)
+	code, stdout, stderr := runCLI(t, "--profiles", profiles, "--profile", "support", "devices", "list")
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, "[]\n", stdout, "the profile's output format should apply")
+
+	assert.Equal(t, []string{"hb_test", ""}, keys, "the default profile should send its API key")
+	assert.Equal(t, []string{"", "Bearer jwt-token"}, tokens, "the support profile should send its bearer token")
+
+	code, _, stderr = runCLI(t, "--profiles", profiles, "--profile", "staging", "devices", "list")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, `profile "staging" not found`)
+}
+
+func TestWatch(t *testing.T) {
+	connections := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections++
+		assert.Equal(t, "device.tv.*", r.URL.Query().Get("filter"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		if connections == 1 {
+			assert.Empty(t, r.Header.Get("Last-Event-ID"))
+			w.Write([]byte("id: 7\nevent: device_event\ndata: {\"id\":7,\"routing_key\":\"device.tv.on\",\"body\":\"{tv1 tv on }\"}\n\n"))
+			return
+		}
+		assert.Equal(t, "7", r.Header.Get("Last-Event-ID"), "watch should resume after the last event")
+		http.Error(w, "Invalid filter", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	original := reconnectDelay
+	reconnectDelay = time.Millisecond
+	defer func() { reconnectDelay = original }()
+
+	code, stdout, stderr := runCLI(t, "--server", server.URL, "watch", "--filter", "device.tv.*", "-o", "json")
+	assert.Equal(t, 1, code, "client errors should end the watch")
+	assert.Contains(t, stderr, "Invalid filter")
+	assert.JSONEq(t, `{"id":7,"routing_key":"device.tv.on","body":"{tv1 tv on }","timestamp":"0001-01-01T00:00:00Z"}`, stdout)
+	assert.Equal(t, 2, connections)
+}
+
+func TestConfigValidate(t *testing.T) {
+	code, stdout, stderr := runCLI(t, "config", "validate", "../../config/config.yaml")
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, "../../config/config.yaml is valid\n", stdout)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("Stream:\n  SlowClientPolicy: block\nMQTT:\n  QoS: 3\n"), 0o600))
+	code, stdout, _ = runCLI(t, "config", "validate", path, "-o", "json")
+	assert.Equal(t, 1, code)
+	var result struct {
+		Valid    bool     `json:"valid"`
+		Problems []string `json:"problems"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(stdout), &result))
+	assert.False(t, result.Valid)
+	assert.Len(t, result.Problems, 2)
+}
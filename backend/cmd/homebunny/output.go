@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// write prints v as JSON or YAML, or as the rows returned by table, each a list of columns with the
+// header first.
+func (c *cli) write(v any, table func() [][]string) error {
+	switch c.opts.output {
+	case "", outputTable:
+		tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+		for _, row := range table() {
+			for i, column := range row {
+				if i > 0 {
+					fmt.Fprint(tw, "\t")
+				}
+				fmt.Fprint(tw, column)
+			}
+			fmt.Fprintln(tw)
+		}
+		return tw.Flush()
+	case outputJSON:
+		encoder := json.NewEncoder(c.stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	case outputYAML:
+		return writeYAML(c.stdout, v)
+	}
+	return fmt.Errorf("unknown output format %q, expected table, json or yaml", c.opts.output)
+}
+
+// writeYAML prints v as a YAML document with the same keys as its JSON encoding.
+func writeYAML(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var generic any
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(generic); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// formatTime prints a time for tables, "-" when it is not set.
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+// orDash prints "-" for empty table cells.
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Profile holds the server and credentials of an environment, e.g. a customer's home or staging.
+type Profile struct {
+	Server          string `yaml:"Server"`
+	APIKey          string `yaml:"APIKey"`
+	BearerToken     string `yaml:"BearerToken"`
+	BearerTokenFile string `yaml:"BearerTokenFile"` // Read instead of BearerToken when set
+	Output          string `yaml:"Output"`          // Default output format of the profile
+}
+
+// ProfileFile is the YAML file listing the profiles.
+type ProfileFile struct {
+	Default  string             `yaml:"Default"` // Used when no profile is selected
+	Profiles map[string]Profile `yaml:"Profiles"`
+}
+
+// defaultProfilesPath returns $HOMEBUNNY_PROFILES or profiles.yaml in the user's config directory.
+func defaultProfilesPath() string {
+	if path := os.Getenv("HOMEBUNNY_PROFILES"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "homebunny", "profiles.yaml")
+}
+
+// loadProfile returns the named profile, or $HOMEBUNNY_PROFILE or the default of the file when name is
+// empty. A missing file is only an error when a profile was asked for.
+func loadProfile(path, name string) (Profile, error) {
+	if path == "" {
+		path = defaultProfilesPath()
+	}
+	if name == "" {
+		name = os.Getenv("HOMEBUNNY_PROFILE")
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && name == "" {
+		return Profile{}, nil
+	}
+	if err != nil {
+		return Profile{}, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	var file ProfileFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return Profile{}, fmt.Errorf("failed to decode profiles: %w", err)
+	}
+
+	if name == "" {
+		name = file.Default
+	}
+	if name == "" {
+		return Profile{}, nil
+	}
+	profile, ok := file.Profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("profile %q not found in %s", name, path)
+	}
+	return profile, nil
+}
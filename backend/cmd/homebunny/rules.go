@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"smart-home-assistant/client"
+	"strconv"
+)
+
+// ruleRows returns the table of rules, with the header first.
+func ruleRows(rules ...client.Rule) [][]string {
+	rows := [][]string{{"NAME", "TRIGGER", "DEVICE", "SCENE", "ENABLED", "UPDATED"}}
+	for _, rule := range rules {
+		rows = append(rows, []string{rule.Name, rule.Trigger, orDash(rule.DeviceID), rule.Scene,
+			strconv.FormatBool(rule.Enabled), formatTime(&rule.UpdatedAt)})
+	}
+	return rows
+}
+
+func (c *cli) rules(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny rules list|get|put|delete")
+		return errUsage
+	}
+	switch args[0] {
+	case "list":
+		return c.listRules(ctx, args[1:])
+	case "get":
+		return c.getRule(ctx, args[1:])
+	case "put":
+		return c.putRule(ctx, args[1:])
+	case "delete":
+		return c.deleteRule(ctx, args[1:])
+	}
+	fmt.Fprintf(c.stderr, "Unknown rules command %q, expected list, get, put or delete\n", args[0])
+	return errUsage
+}
+
+func (c *cli) listRules(ctx context.Context, args []string) error {
+	fs := c.newFlagSet("rules list")
+	if positional, err := c.parse(fs, args); err != nil || len(positional) != 0 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny rules list")
+		return errUsage
+	}
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	rules, err := apiClient.ListRules(ctx)
+	if err != nil {
+		return err
+	}
+	return c.write(rules, func() [][]string { return ruleRows(rules...) })
+}
+
+func (c *cli) getRule(ctx context.Context, args []string) error {
+	fs := c.newFlagSet("rules get")
+	positional, err := c.parse(fs, args)
+	if err != nil || len(positional) != 1 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny rules get <name>")
+		return errUsage
+	}
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	rule, err := apiClient.GetRule(ctx, positional[0])
+	if err != nil {
+		return err
+	}
+	return c.write(rule, func() [][]string { return ruleRows(*rule) })
+}
+
+func (c *cli) putRule(ctx context.Context, args []string) error {
+	var rule client.Rule
+	var disabled bool
+	fs := c.newFlagSet("rules put")
+	fs.StringVar(&rule.Trigger, "trigger", "", "Routing key pattern of the device events, e.g. device.motion_sensor.detected")
+	fs.StringVar(&rule.Scene, "scene", "", "Scene activated by the rule")
+	fs.StringVar(&rule.DeviceID, "device", "", "Only events of this device trigger the rule")
+	fs.BoolVar(&disabled, "disabled", false, "Save the rule without applying it")
+	positional, err := c.parse(fs, args)
+	if err != nil || len(positional) != 1 || rule.Trigger == "" || rule.Scene == "" {
+		fmt.Fprintln(c.stderr, "Usage: homebunny rules put <name> --trigger <pattern> --scene <scene> [--device <id>] [--disabled]")
+		return errUsage
+	}
+	rule.Name = positional[0]
+	rule.Enabled = !disabled
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	saved, err := apiClient.PutRule(ctx, rule)
+	if err != nil {
+		return err
+	}
+	return c.write(saved, messageRows("Saved rule %s", saved.Name))
+}
+
+func (c *cli) deleteRule(ctx context.Context, args []string) error {
+	fs := c.newFlagSet("rules delete")
+	positional, err := c.parse(fs, args)
+	if err != nil || len(positional) != 1 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny rules delete <name>")
+		return errUsage
+	}
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	if err := apiClient.DeleteRule(ctx, positional[0]); err != nil {
+		return err
+	}
+	return c.write(map[string]string{"name": positional[0]}, messageRows("Deleted rule %s", positional[0]))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"smart-home-assistant/client"
+	"strings"
+)
+
+// sceneRows returns the table of scenes, with the header first.
+func sceneRows(scenes ...client.Scene) [][]string {
+	rows := [][]string{{"NAME", "ACTIONS", "UPDATED"}}
+	for _, scene := range scenes {
+		actions := make([]string, 0, len(scene.Actions))
+		for _, action := range scene.Actions {
+			actions = append(actions, action.DeviceID+"="+action.State)
+		}
+		rows = append(rows, []string{scene.Name, orDash(strings.Join(actions, " ")), formatTime(&scene.UpdatedAt)})
+	}
+	return rows
+}
+
+// actionFlags collects the repeated --action <device>=<state> flags of a scene.
+type actionFlags []client.SceneAction
+
+func (a *actionFlags) String() string {
+	return fmt.Sprint(*a)
+}
+
+func (a *actionFlags) Set(value string) error {
+	deviceID, state, ok := strings.Cut(value, "=")
+	if !ok || deviceID == "" || state == "" {
+		return fmt.Errorf("expected <device>=<state>, got %q", value)
+	}
+	*a = append(*a, client.SceneAction{DeviceID: deviceID, State: state})
+	return nil
+}
+
+func (c *cli) scenes(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny scenes list|get|put|delete|activate")
+		return errUsage
+	}
+	switch args[0] {
+	case "list":
+		return c.listScenes(ctx, args[1:])
+	case "get":
+		return c.getScene(ctx, args[1:])
+	case "put":
+		return c.putScene(ctx, args[1:])
+	case "delete":
+		return c.deleteScene(ctx, args[1:])
+	case "activate":
+		return c.activateScene(ctx, args[1:])
+	}
+	fmt.Fprintf(c.stderr, "Unknown scenes command %q, expected list, get, put, delete or activate\n", args[0])
+	return errUsage
+}
+
+func (c *cli) listScenes(ctx context.Context, args []string) error {
+	fs := c.newFlagSet("scenes list")
+	if positional, err := c.parse(fs, args); err != nil || len(positional) != 0 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny scenes list")
+		return errUsage
+	}
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	scenes, err := apiClient.ListScenes(ctx)
+	if err != nil {
+		return err
+	}
+	return c.write(scenes, func() [][]string { return sceneRows(scenes...) })
+}
+
+func (c *cli) getScene(ctx context.Context, args []string) error {
+	fs := c.newFlagSet("scenes get")
+	positional, err := c.parse(fs, args)
+	if err != nil || len(positional) != 1 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny scenes get <name>")
+		return errUsage
+	}
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	scene, err := apiClient.GetScene(ctx, positional[0])
+	if err != nil {
+		return err
+	}
+	return c.write(scene, func() [][]string { return sceneRows(*scene) })
+}
+
+func (c *cli) putScene(ctx context.Context, args []string) error {
+	var actions actionFlags
+	fs := c.newFlagSet("scenes put")
+	fs.Var(&actions, "action", "Device state of the scene as <device>=<state>, repeatable")
+	positional, err := c.parse(fs, args)
+	if err != nil || len(positional) != 1 || len(actions) == 0 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny scenes put <name> --action <device>=<state> [--action ...]")
+		return errUsage
+	}
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	scene, err := apiClient.PutScene(ctx, client.Scene{Name: positional[0], Actions: actions})
+	if err != nil {
+		return err
+	}
+	return c.write(scene, messageRows("Saved scene %s", scene.Name))
+}
+
+func (c *cli) deleteScene(ctx context.Context, args []string) error {
+	fs := c.newFlagSet("scenes delete")
+	positional, err := c.parse(fs, args)
+	if err != nil || len(positional) != 1 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny scenes delete <name>")
+		return errUsage
+	}
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	if err := apiClient.DeleteScene(ctx, positional[0]); err != nil {
+		return err
+	}
+	return c.write(map[string]string{"name": positional[0]}, messageRows("Deleted scene %s", positional[0]))
+}
+
+func (c *cli) activateScene(ctx context.Context, args []string) error {
+	fs := c.newFlagSet("scenes activate")
+	positional, err := c.parse(fs, args)
+	if err != nil || len(positional) != 1 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny scenes activate <name>")
+		return errUsage
+	}
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	commands, err := apiClient.ActivateScene(ctx, positional[0])
+	if err != nil {
+		return err
+	}
+	return c.write(commands, func() [][]string {
+		rows := [][]string{{"DEVICE", "STATE", "COMMAND"}}
+		for _, command := range commands {
+			rows = append(rows, []string{command.DeviceID, command.State, command.ID})
+		}
+		return rows
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"smart-home-assistant/client"
+	"time"
+)
+
+// Delay before watch reconnects after the stream ended or the server was unreachable.
+var reconnectDelay = 2 * time.Second
+
+// watch prints device events as they arrive, one line or document per event, and reconnects with the
+// last event ID when the stream ends so no buffered events are missed.
+func (c *cli) watch(ctx context.Context, args []string) error {
+	fs := c.newFlagSet("watch")
+	filter := fs.String("filter", "#", "Routing key pattern, e.g. device.light.*")
+	lastEventID := fs.Uint64("last-event-id", 0, "Replay the buffered events after this ID")
+	if positional, err := c.parse(fs, args); err != nil || len(positional) != 0 {
+		fmt.Fprintln(c.stderr, "Usage: homebunny watch [--filter <pattern>] [--last-event-id <id>]")
+		return errUsage
+	}
+	apiClient, err := c.client()
+	if err != nil {
+		return err
+	}
+	switch c.opts.output {
+	case "", outputTable, outputJSON, outputYAML:
+	default:
+		return fmt.Errorf("unknown output format %q, expected table, json or yaml", c.opts.output)
+	}
+
+	handle := func(event client.Event) error {
+		*lastEventID = event.ID
+		switch c.opts.output {
+		case outputJSON:
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(c.stdout, "%s\n", data)
+			return err
+		case outputYAML:
+			fmt.Fprintln(c.stdout, "---")
+			return writeYAML(c.stdout, event)
+		}
+		_, err := fmt.Fprintf(c.stdout, "%-8d %s  %-32s %s\n", event.ID, event.Timestamp.Local().Format(time.DateTime), event.RoutingKey, event.Body)
+		return err
+	}
+
+	for {
+		err := apiClient.WatchEvents(ctx, *filter, *lastEventID, handle)
+		if ctx.Err() != nil {
+			return nil
+		}
+		// Requests the server rejects fail the same way on every attempt
+		var apiErr *client.Error
+		if errors.As(err, &apiErr) && apiErr.StatusCode < 500 {
+			return err
+		}
+		if !errors.Is(err, client.ErrStreamClosed) {
+			fmt.Fprintf(c.stderr, "Lost the event stream: %v, reconnecting\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+	"smart-home-assistant/internal"
+)
+
+func main() {
+	// Load the application configuration
+	config, err := internal.LoadAppConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Connect to RabbitMQ using values from the config
+	conn, err := internal.ConnectRabbitMQ(
+		config.RabbitMQ.User,
+		config.RabbitMQ.Password,
+		config.RabbitMQ.Host,
+		config.RabbitMQ.VHost,
+	)
+	if err != nil {
+		log.Fatalf("Failed to connect to RabbitMQ: %v", err)
+	}
+	defer conn.Close()
+
+	// Publish and consume on separate channels, so waiting for confirms does not hold up deliveries
+	publishClient, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to create RabbitMQ client: %v", err)
+	}
+	defer publishClient.Close()
+
+	consumeClient, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to create RabbitMQ client: %v", err)
+	}
+	defer consumeClient.Close()
+
+	if err := publishClient.CreateTopicExchange("device_events"); err != nil {
+		log.Fatalf("Failed to create exchange: %v", err)
+	}
+
+	// States received from MQTT are recorded in the registry before they are published
+	dbClient, err := internal.ConnectPostgreSQL(*config)
+	if err != nil {
+		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+	}
+	defer dbClient.Close()
+
+	bridge := internal.NewMQTTBridge(*config, publishClient, dbClient)
+	if err := bridge.Connect(); err != nil {
+		log.Fatalf("Failed to connect to MQTT broker: %v", err)
+	}
+	defer bridge.Close()
+
+	// Announce the registered devices to Home Assistant, later changes arrive as registry events
+	if config.MQTT.HomeAssistant.Enabled {
+		devices, err := dbClient.ListDevices()
+		if err != nil {
+			log.Fatalf("Failed to list devices: %v", err)
+		}
+		if err := bridge.SyncDiscovery(context.Background(), devices); err != nil {
+			log.Fatalf("Failed to publish Home Assistant discovery: %v", err)
+		}
+	}
+
+	// Receive every device event, command and registry event, messages that came from MQTT are skipped
+	// by the bridge
+	queueName := config.MQTT.Queue
+	if queueName == "" {
+		queueName = "mqtt_bridge_queue"
+	}
+	queue, err := consumeClient.CreateQueue(queueName)
+	if err != nil {
+		log.Fatalf("Failed to create queue: %v", err)
+	}
+	for _, bindingKey := range []string{"device.#", "command.#", "registry.#"} {
+		err = consumeClient.CreateBinding(queue.Name, bindingKey, "device_events")
+		if err != nil {
+			log.Fatalf("Failed to create binding: %v", err)
+		}
+	}
+
+	// Keep a few events in flight while the MQTT broker acknowledges them
+	if err := consumeClient.ApplyQos(16, false); err != nil {
+		log.Fatalf("Failed to set QoS: %v", err)
+	}
+
+	messages, err := consumeClient.ConsumeEventWithAck(queue.Name)
+	if err != nil {
+		log.Fatalf("Failed to consume events: %v", err)
+	}
+
+	if config.MQTT.MetricsPort != "" {
+		health := internal.NewHealth(config.Health.Timeout)
+		health.Add("rabbitmq", consumeClient.Check)
+		health.Add("mqtt", bridge.Check)
+		internal.ServeMetrics(config.MQTT.MetricsPort, health)
+	}
+
+	log.Printf("Bridging device events between queue %s and %s", queue.Name, config.MQTT.Broker)
+	bridge.Run(context.Background(), messages)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log"
+	"smart-home-assistant/internal"
+)
+
+func main() {
+	// Load the application configuration
+	config, err := internal.LoadAppConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Connect to RabbitMQ using values from the config
+	conn, err := internal.ConnectRabbitMQ(
+		config.RabbitMQ.User,
+		config.RabbitMQ.Password,
+		config.RabbitMQ.Host,
+		config.RabbitMQ.VHost,
+	)
+	if err != nil {
+		log.Fatalf("Failed to connect to RabbitMQ: %v", err)
+	}
+	defer conn.Close()
+
+	client, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to create RabbitMQ client: %v", err)
+	}
+	defer client.Close()
+
+	// Connect to PostgreSQL, where preferences and deliveries are stored
+	dbClient, err := internal.ConnectPostgreSQL(*config)
+	if err != nil {
+		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+	}
+	defer dbClient.Close()
+
+	if err := dbClient.Migrate(); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	notifier, err := internal.NewNotifier(*config, dbClient, internal.NewNotificationChannels(*config))
+	if err != nil {
+		log.Fatalf("Failed to create notifier: %v", err)
+	}
+
+	// Receive every notification, e.g. "notification.critical"
+	if err := client.CreateTopicExchange(internal.NotificationExchange); err != nil {
+		log.Fatalf("Failed to create exchange: %v", err)
+	}
+	queueName := config.Notifier.Queue
+	if queueName == "" {
+		queueName = "notifications_queue"
+	}
+	queue, err := client.CreateQueue(queueName)
+	if err != nil {
+		log.Fatalf("Failed to create queue: %v", err)
+	}
+	err = client.CreateBinding(queue.Name, "notification.#", internal.NotificationExchange)
+	if err != nil {
+		log.Fatalf("Failed to create binding: %v", err)
+	}
+
+	messages, err := client.ConsumeEventWithAck(queue.Name)
+	if err != nil {
+		log.Fatalf("Failed to consume notifications: %v", err)
+	}
+
+	if config.Notifier.MetricsPort != "" {
+		health := internal.NewHealth(config.Health.Timeout)
+		health.Add("rabbitmq", client.Check)
+		health.Add("postgres", dbClient.Ping)
+		internal.ServeMetrics(config.Notifier.MetricsPort, health)
+	}
+
+	log.Printf("Delivering notifications from queue %s", queue.Name)
+	notifier.Run(context.Background(), messages)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"smart-home-assistant/internal"
+	"time"
+)
+
+// projections are the projections that can be rebuilt, by name.
+var projections = map[string]internal.Projection{
+	internal.DeviceProjection{}.Name(): internal.DeviceProjection{},
+}
+
+func main() {
+	name := flag.String("projection", "devices", "Projection to rebuild")
+	asOf := flag.String("as-of", "", "Restore the devices to their state at this RFC 3339 time, e.g. 2024-05-01T19:00:00Z")
+	dryRun := flag.Bool("dry-run", false, "Print the devices that would change instead of rebuilding them")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: rebuild [-projection devices] [-as-of <time>] [-dry-run]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	projection, ok := projections[*name]
+	if !ok {
+		log.Fatalf("Unknown projection %q", *name)
+	}
+	var until time.Time
+	if *asOf != "" {
+		var err error
+		if until, err = time.Parse(time.RFC3339, *asOf); err != nil {
+			log.Fatalf("Invalid -as-of time: %v", err)
+		}
+	}
+
+	// Load the application configuration
+	config, err := internal.LoadAppConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	dbClient, err := internal.ConnectPostgreSQL(*config)
+	if err != nil {
+		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+	}
+	defer dbClient.Close()
+	if err := dbClient.Migrate(); err != nil {
+		log.Fatalf("Failed to apply migrations: %v", err)
+	}
+
+	ctx := context.Background()
+	if *dryRun {
+		if projection.Name() != "devices" {
+			log.Fatalf("Dry runs are only supported for the devices projection")
+		}
+		if err := previewDevices(ctx, dbClient, until); err != nil {
+			log.Fatalf("Failed to preview rebuild: %v", err)
+		}
+		return
+	}
+
+	start := time.Now()
+	if !until.IsZero() {
+		if projection.Name() != "devices" {
+			log.Fatalf("Only the devices projection can be restored to an earlier time")
+		}
+		events, err := dbClient.RestoreDevices(ctx, until)
+		if err != nil {
+			log.Fatalf("Failed to restore devices: %v", err)
+		}
+		log.Printf("Restored devices as of %s with %d compensating events in %s",
+			until.Format(time.RFC3339), len(events), time.Since(start).Round(time.Millisecond))
+		return
+	}
+	result, err := dbClient.Rebuild(ctx, projection)
+	if err != nil {
+		log.Fatalf("Failed to rebuild projection %s: %v", projection.Name(), err)
+	}
+	log.Printf("Rebuilt projection %s from %d events up to position %d in %s",
+		projection.Name(), result.Events, result.Position, time.Since(start).Round(time.Millisecond))
+}
+
+// previewDevices prints how a rebuild, or a restore to asOf, would change the devices.
+func previewDevices(ctx context.Context, dbClient *internal.PostgreSQLClient, asOf time.Time) error {
+	current, err := dbClient.ListDevices()
+	if err != nil {
+		return err
+	}
+	rebuilt, err := dbClient.PreviewDeviceRebuild(ctx, asOf)
+	if err != nil {
+		return err
+	}
+
+	before := make(map[string]internal.Device, len(current))
+	for _, device := range current {
+		before[device.ID] = device
+	}
+	changes := 0
+	for _, device := range rebuilt {
+		previous, ok := before[device.ID]
+		delete(before, device.ID)
+		switch {
+		case !ok:
+			fmt.Printf("+ %s %s %s (version %d)\n", device.ID, device.Type, device.State, device.Version)
+		case previous.State != device.State || previous.Room != device.Room || previous.Version != device.Version:
+			fmt.Printf("~ %s %s: %s (version %d) -> %s (version %d)\n", device.ID, device.Type,
+				previous.State, previous.Version, device.State, device.Version)
+		default:
+			continue
+		}
+		changes++
+	}
+	for _, device := range current {
+		if _, removed := before[device.ID]; removed {
+			fmt.Printf("- %s %s %s (version %d)\n", device.ID, device.Type, device.State, device.Version)
+			changes++
+		}
+	}
+	fmt.Printf("%d of %d devices would change\n", changes, len(current))
+	return nil
+}
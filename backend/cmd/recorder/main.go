@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"smart-home-assistant/internal"
+	"time"
+)
+
+func main() {
+	// Load the application configuration
+	config, err := internal.LoadAppConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	path := config.Recorder.File
+	if path == "" {
+		path = "recordings/device_events.ndjson"
+	}
+	filters := config.Recorder.Filters
+	if len(filters) == 0 {
+		filters = []string{"#"}
+	}
+	for _, filter := range filters {
+		if err := internal.ValidateRoutingKeyFilter(filter); err != nil {
+			log.Fatalf("Invalid recorder filter: %v", err)
+		}
+	}
+	flushInterval := config.Recorder.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+
+	// Recordings are appended to, so restarting the recorder does not lose what was captured
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Fatalf("Failed to create recording directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		log.Fatalf("Failed to open recording: %v", err)
+	}
+	defer file.Close()
+	recorder := internal.NewRecorder(file)
+
+	// Connect to RabbitMQ using values from the config
+	conn, err := internal.ConnectRabbitMQ(
+		config.RabbitMQ.User,
+		config.RabbitMQ.Password,
+		config.RabbitMQ.Host,
+		config.RabbitMQ.VHost,
+	)
+	if err != nil {
+		log.Fatalf("Failed to connect to RabbitMQ: %v", err)
+	}
+	defer conn.Close()
+
+	client, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to create RabbitMQ client: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.CreateTopicExchange("device_events"); err != nil {
+		log.Fatalf("Failed to create exchange: %v", err)
+	}
+	// A queue of its own, so recording does not take events from the pipeline's consumers
+	queue, err := client.CreateTemporaryQueue()
+	if err != nil {
+		log.Fatalf("Failed to create queue: %v", err)
+	}
+	for _, filter := range filters {
+		if err := client.CreateBinding(queue.Name, filter, "device_events"); err != nil {
+			log.Fatalf("Failed to create binding: %v", err)
+		}
+	}
+	messages, err := client.ConsumeEvent(queue.Name)
+	if err != nil {
+		log.Fatalf("Failed to consume device events: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	log.Printf("Recording %v from device_events to %s", filters, path)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := recorder.Flush(); err != nil {
+				log.Printf("Failed to flush recording: %v", err)
+			}
+			log.Printf("Recorded %d events to %s", recorder.Count(), path)
+			return
+		case <-ticker.C:
+			if err := recorder.Flush(); err != nil {
+				log.Printf("Failed to flush recording: %v", err)
+			}
+		case msg, ok := <-messages:
+			if !ok {
+				if err := recorder.Flush(); err != nil {
+					log.Printf("Failed to flush recording: %v", err)
+				}
+				log.Fatalf("Lost the RabbitMQ channel after recording %d events", recorder.Count())
+			}
+			if err := recorder.Record(msg); err != nil {
+				log.Printf("Failed to record event: %v", err)
+			}
+		}
+	}
+}
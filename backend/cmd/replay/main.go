@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"smart-home-assistant/internal"
+	"strings"
+	"time"
+)
+
+// stringList collects the values of a flag given several times.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func main() {
+	var filters, remaps stringList
+	speed := flag.Float64("speed", 1, "Replay speed: 1 is real time, 10 ten times faster, 0 as fast as possible")
+	exchange := flag.String("exchange", "", "Publish on this exchange instead of the recorded one")
+	flag.Var(&filters, "filter", "Only replay events matching this routing key pattern, may be repeated")
+	flag.Var(&remaps, "remap", "Replace a recorded device ID, as <recorded>=<new>, may be repeated")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: replay [flags] <recording.ndjson>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	remap := make(map[string]string)
+	for _, value := range remaps {
+		from, to, ok := strings.Cut(value, "=")
+		if !ok {
+			log.Fatalf("Invalid remapping %q, expected <recorded>=<new>", value)
+		}
+		remap[from] = to
+	}
+
+	// Load the application configuration
+	config, err := internal.LoadAppConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to open recording: %v", err)
+	}
+	defer file.Close()
+
+	// Connect to RabbitMQ using values from the config
+	conn, err := internal.ConnectRabbitMQ(
+		config.RabbitMQ.User,
+		config.RabbitMQ.Password,
+		config.RabbitMQ.Host,
+		config.RabbitMQ.VHost,
+	)
+	if err != nil {
+		log.Fatalf("Failed to connect to RabbitMQ: %v", err)
+	}
+	defer conn.Close()
+
+	client, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to create RabbitMQ client: %v", err)
+	}
+	defer client.Close()
+
+	replayer, err := internal.NewReplayer(client, internal.ReplayOptions{
+		Speed:    *speed,
+		Filters:  filters,
+		Remap:    remap,
+		Exchange: *exchange,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create replayer: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	log.Printf("Replaying %s at speed %g", flag.Arg(0), *speed)
+	result, err := replayer.Replay(ctx, file)
+	log.Printf("Replayed %d events recorded from %s to %s, skipped %d, %d unroutable",
+		result.Replayed, result.FirstRecord.Format(time.DateTime), result.LastRecord.Format(time.DateTime), result.Skipped, result.Unroutable)
+	if err != nil && ctx.Err() == nil {
+		log.Fatalf("Failed to replay recording: %v", err)
+	}
+}
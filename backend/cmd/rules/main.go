@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log"
+	"smart-home-assistant/internal"
+)
+
+func main() {
+	// Load the application configuration
+	config, err := internal.LoadAppConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Connect to RabbitMQ using values from the config
+	conn, err := internal.ConnectRabbitMQ(
+		config.RabbitMQ.User,
+		config.RabbitMQ.Password,
+		config.RabbitMQ.Host,
+		config.RabbitMQ.VHost,
+	)
+	if err != nil {
+		log.Fatalf("Failed to connect to RabbitMQ: %v", err)
+	}
+	defer conn.Close()
+
+	// Commands are published on their own channel, so waiting for confirms does not hold up deliveries
+	publishClient, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to create RabbitMQ client: %v", err)
+	}
+	defer publishClient.Close()
+
+	consumeClient, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to create RabbitMQ client: %v", err)
+	}
+	defer consumeClient.Close()
+
+	if err := publishClient.CreateTopicExchange("device_events"); err != nil {
+		log.Fatalf("Failed to create exchange: %v", err)
+	}
+
+	// Connect to PostgreSQL, where rules, scenes and device states are stored
+	dbClient, err := internal.ConnectPostgreSQL(*config)
+	if err != nil {
+		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+	}
+	defer dbClient.Close()
+
+	if err := dbClient.Migrate(); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	engine := internal.NewRuleEngine(dbClient, publishClient)
+
+	// Receive every device event, rules filter them by routing key
+	queueName := config.Rules.Queue
+	if queueName == "" {
+		queueName = "rules_queue"
+	}
+	queue, err := consumeClient.CreateQueue(queueName)
+	if err != nil {
+		log.Fatalf("Failed to create queue: %v", err)
+	}
+	err = consumeClient.CreateBinding(queue.Name, "device.#", "device_events")
+	if err != nil {
+		log.Fatalf("Failed to create binding: %v", err)
+	}
+
+	messages, err := consumeClient.ConsumeEventWithAck(queue.Name)
+	if err != nil {
+		log.Fatalf("Failed to consume events: %v", err)
+	}
+
+	if config.Rules.MetricsPort != "" {
+		health := internal.NewHealth(config.Health.Timeout)
+		health.Add("rabbitmq", consumeClient.Check)
+		health.Add("postgres", dbClient.Ping)
+		internal.ServeMetrics(config.Rules.MetricsPort, health)
+	}
+
+	log.Printf("Applying rules to device events from queue %s", queue.Name)
+	engine.Run(context.Background(), messages)
+}
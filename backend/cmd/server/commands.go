@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"smart-home-assistant/internal"
+	"strings"
+	"time"
+)
+
+// commandHandler asks a registered device to change its state. The command is published on
+// device_events and the device reports the new state with a device event once applied.
+func commandHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	var request struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.State == "" {
+		http.Error(w, "Invalid command format", http.StatusBadRequest)
+		return
+	}
+
+	messageID, err := sendCommand(r.Context(), dbClient, r.PathValue("id"), request.State)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"id": messageID})
+}
+
+// sendCommand publishes a command asking a device for state and returns its message ID.
+func sendCommand(ctx context.Context, dbClient *internal.PostgreSQLClient, deviceID, state string) (string, error) {
+	command, err := newCommand(ctx, dbClient, deviceID, state)
+	if err != nil {
+		return "", err
+	}
+	return publishCommand(ctx, command)
+}
+
+// newCommand returns the command asking a registered device for state, failing when the caller may
+// not control the device.
+func newCommand(ctx context.Context, dbClient *internal.PostgreSQLClient, deviceID, state string) (internal.Command, error) {
+	if state == "" {
+		return internal.Command{}, &requestError{http.StatusBadRequest, "Invalid command format"}
+	}
+	if strings.ContainsAny(state, ".*# ") {
+		return internal.Command{}, &requestError{http.StatusBadRequest, "State must not contain '.', '*', '#' or spaces"}
+	}
+
+	device, err := dbClient.GetDevice(deviceID)
+	if err != nil {
+		return internal.Command{}, &requestError{http.StatusInternalServerError, "Failed to get device"}
+	}
+	if device == nil {
+		return internal.Command{}, &requestError{http.StatusNotFound, "Device not found"}
+	}
+	if err := checkAccess(ctx, internal.ActionControl, *device, state); err != nil {
+		return internal.Command{}, err
+	}
+	return internal.Command{DeviceID: device.ID, DeviceType: device.Type, State: state, Timestamp: time.Now()}, nil
+}
+
+// publishCommand publishes a command on device_events and returns its message ID.
+func publishCommand(ctx context.Context, command internal.Command) (string, error) {
+	msg := internal.CreateCommandMessage(command)
+	publishCtx, cancel := context.WithTimeout(ctx, confirmTimeout)
+	defer cancel()
+	err := publisher.Send(publishCtx, "device_events", internal.CommandRoutingKey(command.DeviceType, command.DeviceID), msg)
+	if err != nil {
+		log.Printf("Failed to publish command for device %s: %v", command.DeviceID, err)
+		status, message := publishErrorStatus(err)
+		return "", &requestError{status, message}
+	}
+
+	log.Printf("Command %s sent to device %s", command.State, command.DeviceID)
+	return msg.MessageId, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"smart-home-assistant/internal"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandHandler(t *testing.T) {
+	setup()
+	defer teardown()
+
+	recorder := &recordingPublisher{}
+	original := publisher
+	publisher = recorder
+	defer func() { publisher = original }()
+
+	require.NoError(t, testDB.InsertDevice(internal.Device{ID: "command-1", Type: "lamp", State: "off"}))
+
+	req := httptest.NewRequest(http.MethodPost, "/devices/command-1/commands", bytes.NewBufferString(`{"state":"on"}`))
+	req.SetPathValue("id", "command-1")
+	w := httptest.NewRecorder()
+	commandHandler(w, req, testDB)
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	require.Len(t, recorder.routingKeys, 1)
+	assert.Equal(t, "command.lamp.command-1", recorder.routingKeys[0])
+
+	req = httptest.NewRequest(http.MethodPost, "/devices/missing/commands", bytes.NewBufferString(`{"state":"on"}`))
+	req.SetPathValue("id", "missing")
+	w = httptest.NewRecorder()
+	commandHandler(w, req, testDB)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/devices/command-1/commands", bytes.NewBufferString(`{"state":"on.off"}`))
+	req.SetPathValue("id", "command-1")
+	w = httptest.NewRecorder()
+	commandHandler(w, req, testDB)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Len(t, recorder.routingKeys, 1, "rejected commands should not be published")
+}
+
+func TestDeleteDeviceHandler(t *testing.T) {
+	setup()
+	defer teardown()
+
+	recorder := &recordingPublisher{}
+	original := publisher
+	publisher = recorder
+	defer func() { publisher = original }()
+
+	require.NoError(t, testDB.InsertDevice(internal.Device{ID: "delete-2", Type: "plug", State: "off"}))
+
+	req := httptest.NewRequest(http.MethodDelete, "/devices/delete-2", nil)
+	req.SetPathValue("id", "delete-2")
+	w := httptest.NewRecorder()
+	deleteDeviceHandler(w, req, testDB)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, []string{"registry.deleted.plug.delete-2"}, recorder.routingKeys, "the deletion should be announced")
+	device, err := testDB.GetDevice("delete-2")
+	require.NoError(t, err)
+	assert.Nil(t, device)
+
+	w = httptest.NewRecorder()
+	deleteDeviceHandler(w, req, testDB)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
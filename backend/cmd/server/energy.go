@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"smart-home-assistant/internal"
+	"time"
+)
+
+// maxEnergyRange bounds the time range of an energy report
+const maxEnergyRange = 400 * 24 * time.Hour
+
+// parseEnergyQuery reads the period and time range of an energy report, defaulting to daily
+// buckets over the last 30 days.
+func parseEnergyQuery(w http.ResponseWriter, r *http.Request) (string, time.Time, time.Time, bool) {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = internal.PeriodDaily
+	}
+	if !internal.ValidPeriod(period) {
+		http.Error(w, "Invalid period, expected daily, weekly or monthly", http.StatusBadRequest)
+		return "", time.Time{}, time.Time{}, false
+	}
+
+	var err error
+	to := time.Now()
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid to, expected RFC 3339", http.StatusBadRequest)
+			return "", time.Time{}, time.Time{}, false
+		}
+	}
+	from := to.Add(-30 * 24 * time.Hour)
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid from, expected RFC 3339", http.StatusBadRequest)
+			return "", time.Time{}, time.Time{}, false
+		}
+	}
+	if !from.Before(to) || to.Sub(from) > maxEnergyRange {
+		http.Error(w, "from must be before to and at most 400 days earlier", http.StatusBadRequest)
+		return "", time.Time{}, time.Time{}, false
+	}
+	return period, from, to, true
+}
+
+func deviceEnergyHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient, calculator *internal.EnergyCalculator) {
+	device, err := dbClient.GetDevice(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Failed to get device", http.StatusInternalServerError)
+		return
+	}
+	if device == nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if !authorize(w, r, internal.ActionRead, *device, "") {
+		return
+	}
+
+	period, from, to, ok := parseEnergyQuery(w, r)
+	if !ok {
+		return
+	}
+	report, err := calculator.DeviceReport(dbClient, *device, period, from, to)
+	if err != nil {
+		log.Printf("Failed to compute energy of device %s: %v", device.ID, err)
+		http.Error(w, "Failed to compute energy report", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func roomEnergyHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient, calculator *internal.EnergyCalculator) {
+	period, from, to, ok := parseEnergyQuery(w, r)
+	if !ok {
+		return
+	}
+
+	devices, err := dbClient.ListDevices()
+	if err != nil {
+		http.Error(w, "Failed to list devices", http.StatusInternalServerError)
+		return
+	}
+
+	// Only the devices of the room the caller is allowed to read are included
+	room := r.PathValue("room")
+	var roomDevices []internal.Device
+	for _, device := range devices {
+		if device.Room != room {
+			continue
+		}
+		if accessControl != nil {
+			ok, err := accessControl.CanRead(r.Context(), device)
+			if err != nil {
+				log.Printf("Failed to check access: %v", err)
+				http.Error(w, "Failed to check access", http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				continue
+			}
+		}
+		roomDevices = append(roomDevices, device)
+	}
+	if len(roomDevices) == 0 {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	report, err := calculator.RoomReport(dbClient, room, roomDevices, period, from, to)
+	if err != nil {
+		log.Printf("Failed to compute energy of room %s: %v", room, err)
+		http.Error(w, "Failed to compute energy report", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEnergyQuery(t *testing.T) {
+	w := httptest.NewRecorder()
+	period, from, to, ok := parseEnergyQuery(w, httptest.NewRequest(http.MethodGet, "/energy/devices/ac1", nil))
+	assert.True(t, ok)
+	assert.Equal(t, "daily", period, "reports should default to daily buckets")
+	assert.Equal(t, 30*24*time.Hour, to.Sub(from), "reports should default to the last 30 days")
+
+	w = httptest.NewRecorder()
+	_, from, to, ok = parseEnergyQuery(w, httptest.NewRequest(http.MethodGet,
+		"/energy/devices/ac1?period=monthly&from=2024-01-01T00:00:00Z&to=2024-04-01T00:00:00Z", nil))
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), from)
+	assert.Equal(t, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), to)
+
+	w = httptest.NewRecorder()
+	_, _, _, ok = parseEnergyQuery(w, httptest.NewRequest(http.MethodGet, "/energy/devices/ac1?period=hourly", nil))
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "unknown periods should be rejected")
+
+	w = httptest.NewRecorder()
+	_, _, _, ok = parseEnergyQuery(w, httptest.NewRequest(http.MethodGet,
+		"/energy/devices/ac1?from=2020-01-01T00:00:00Z&to=2024-01-01T00:00:00Z", nil))
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "ranges longer than 400 days should be rejected")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"smart-home-assistant/devicepb"
+	"smart-home-assistant/internal"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcScopes are the scopes the DeviceService methods require, the same as their HTTP routes.
+var grpcScopes = map[string]string{
+	devicepb.DeviceService_RegisterDevice_FullMethodName: internal.ScopeDevicesWrite,
+	devicepb.DeviceService_GetDevice_FullMethodName:      internal.ScopeDevicesRead,
+	devicepb.DeviceService_ListDevices_FullMethodName:    internal.ScopeDevicesRead,
+	devicepb.DeviceService_PublishEvent_FullMethodName:   internal.ScopeEventsPublish,
+	devicepb.DeviceService_SendCommand_FullMethodName:    internal.ScopeEventsPublish,
+	devicepb.DeviceService_WatchEvents_FullMethodName:    internal.ScopeDevicesRead,
+}
+
+// deviceService serves the gRPC DeviceService with the same store, access checks and validation as
+// the HTTP handlers.
+type deviceService struct {
+	devicepb.UnimplementedDeviceServiceServer
+	dbClient *internal.PostgreSQLClient
+	bus      *internal.EventBus
+	devices  deviceLookup // Registered devices the events of WatchEvents are checked against
+}
+
+// newGRPCServer creates a gRPC server for the DeviceService that authenticates calls like the HTTP routes.
+func newGRPCServer(auth *internal.Authenticator, service *deviceService) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(auth.UnaryInterceptor(grpcScopes)),
+		grpc.ChainStreamInterceptor(auth.StreamInterceptor(grpcScopes)),
+	)
+	devicepb.RegisterDeviceServiceServer(server, service)
+	return server
+}
+
+// grpcError translates the HTTP status of a failed request into a gRPC status.
+func grpcError(err error) error {
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	code := codes.Internal
+	switch reqErr.status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.Aborted
+	case http.StatusPreconditionFailed, http.StatusUnprocessableEntity:
+		code = codes.FailedPrecondition
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	case http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, reqErr.message)
+}
+
+func toProtoDevice(device internal.Device) *devicepb.Device {
+	pb := &devicepb.Device{
+		Id:      device.ID,
+		Type:    device.Type,
+		State:   device.State,
+		Room:    device.Room,
+		Version: device.Version,
+		Status:  device.Status,
+	}
+	if device.EventTime != nil {
+		pb.EventTime = timestamppb.New(*device.EventTime)
+	}
+	if device.LastSeenAt != nil {
+		pb.LastSeenAt = timestamppb.New(*device.LastSeenAt)
+	}
+	return pb
+}
+
+func (s *deviceService) RegisterDevice(ctx context.Context, req *devicepb.RegisterDeviceRequest) (*devicepb.Device, error) {
+	if req.GetDevice() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Invalid device format")
+	}
+	device := internal.Device{
+		ID:    req.Device.GetId(),
+		Type:  req.Device.GetType(),
+		State: req.Device.GetState(),
+		Room:  req.Device.GetRoom(),
+	}
+	if err := registerDevice(ctx, s.dbClient, device); err != nil {
+		return nil, grpcError(err)
+	}
+	if registered, err := s.dbClient.GetDevice(device.ID); err == nil && registered != nil {
+		device = *registered
+	}
+	return toProtoDevice(device), nil
+}
+
+func (s *deviceService) GetDevice(ctx context.Context, req *devicepb.GetDeviceRequest) (*devicepb.Device, error) {
+	device, err := findDevice(ctx, s.dbClient, req.GetId(), internal.ActionRead)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toProtoDevice(*device), nil
+}
+
+func (s *deviceService) ListDevices(ctx context.Context, req *devicepb.ListDevicesRequest) (*devicepb.ListDevicesResponse, error) {
+	devices, err := s.dbClient.ListDevices()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to list devices")
+	}
+	devices, err = readableDevices(ctx, devices)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	response := &devicepb.ListDevicesResponse{}
+	for _, device := range devices {
+		response.Devices = append(response.Devices, toProtoDevice(device))
+	}
+	return response, nil
+}
+
+func (s *deviceService) PublishEvent(ctx context.Context, req *devicepb.PublishEventRequest) (*devicepb.PublishEventResponse, error) {
+	device := internal.Device{
+		ID:    req.GetDeviceId(),
+		Type:  req.GetType(),
+		State: req.GetState(),
+		Room:  req.GetRoom(),
+	}
+	if req.EventTime != nil {
+		eventTime := req.EventTime.AsTime()
+		device.EventTime = &eventTime
+	}
+
+	messageID, updated, err := publishEvent(ctx, s.dbClient, device, req.GetExpectedVersion(), http.StatusConflict)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	response := &devicepb.PublishEventResponse{MessageId: messageID}
+	if updated != nil {
+		response.Version = updated.Version
+	}
+	return response, nil
+}
+
+func (s *deviceService) SendCommand(ctx context.Context, req *devicepb.SendCommandRequest) (*devicepb.SendCommandResponse, error) {
+	messageID, err := sendCommand(ctx, s.dbClient, req.GetDeviceId(), req.GetState())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &devicepb.SendCommandResponse{Id: messageID}, nil
+}
+
+// WatchEvents streams the events of the in-process bus the caller may read, starting with the buffered
+// events after last_event_id. Clients that fall behind are disconnected with Unavailable and resume
+// from their last event ID.
+func (s *deviceService) WatchEvents(req *devicepb.WatchEventsRequest, stream grpc.ServerStreamingServer[devicepb.Event]) error {
+	filter := req.GetFilter()
+	if filter == "" {
+		filter = "#"
+	}
+	sub, missed, err := s.bus.Subscribe(filter, req.GetLastEventId())
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid filter: %v", err)
+	}
+	defer s.bus.Unsubscribe(sub)
+
+	send := func(event internal.Event) error {
+		if !canReadEvent(stream.Context(), s.devices, event) {
+			return nil
+		}
+		return stream.Send(&devicepb.Event{
+			Id:          event.ID,
+			RoutingKey:  event.RoutingKey,
+			ContentType: event.ContentType,
+			Body:        []byte(event.Body),
+			Timestamp:   timestamppb.New(event.Timestamp),
+		})
+	}
+	for _, event := range missed {
+		if err := send(event); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, open := <-sub.C:
+			if !open {
+				log.Printf("Disconnecting slow gRPC client")
+				return status.Error(codes.Unavailable, "Too slow, resume with the last event ID")
+			}
+			if err := send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
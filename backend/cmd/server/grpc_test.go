@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"smart-home-assistant/devicepb"
+	"smart-home-assistant/internal"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestGRPCClient serves the DeviceService in memory without authentication.
+func newTestGRPCClient(t *testing.T, service *deviceService) devicepb.DeviceServiceClient {
+	return newAuthenticatedTestGRPCClient(t, &internal.Authenticator{}, service)
+}
+
+// newAuthenticatedTestGRPCClient serves the DeviceService in memory, authenticating calls with auth.
+func newAuthenticatedTestGRPCClient(t *testing.T, auth *internal.Authenticator, service *deviceService) devicepb.DeviceServiceClient {
+	listener := bufconn.Listen(1 << 20)
+	server := newGRPCServer(auth, service)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return devicepb.NewDeviceServiceClient(conn)
+}
+
+func TestGRPCError(t *testing.T) {
+	tests := []struct {
+		status int
+		code   codes.Code
+	}{
+		{http.StatusBadRequest, codes.InvalidArgument},
+		{http.StatusForbidden, codes.PermissionDenied},
+		{http.StatusNotFound, codes.NotFound},
+		{http.StatusConflict, codes.Aborted},
+		{http.StatusUnprocessableEntity, codes.FailedPrecondition},
+		{http.StatusServiceUnavailable, codes.Unavailable},
+		{http.StatusGatewayTimeout, codes.DeadlineExceeded},
+		{http.StatusInternalServerError, codes.Internal},
+	}
+	for _, tt := range tests {
+		err := grpcError(&requestError{tt.status, "failed"})
+		assert.Equal(t, tt.code, status.Code(err), "status %d", tt.status)
+		assert.Equal(t, "failed", status.Convert(err).Message())
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	bus := internal.NewEventBus(10, 10, internal.SlowClientDisconnect)
+	client := newTestGRPCClient(t, &deviceService{bus: bus})
+	seen := bus.Publish("device.light.off", "text/plain", []byte("{l1 light off }"), time.Now())
+	missed := bus.Publish("device.light.on", "text/plain", []byte("{l1 light on }"), time.Now())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.WatchEvents(ctx, &devicepb.WatchEventsRequest{Filter: "device.light.*", LastEventId: seen.ID})
+	require.NoError(t, err)
+
+	event, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, missed.ID, event.Id, "buffered events after the last event ID should be replayed")
+	assert.Equal(t, "{l1 light on }", string(event.Body))
+
+	require.Eventually(t, func() bool { return bus.Subscribers() == 1 }, 5*time.Second, 10*time.Millisecond)
+	bus.Publish("device.tv.on", "text/plain", []byte("{tv1 tv on }"), time.Now())
+	bus.Publish("device.light.off", "text/plain", []byte("{l1 light off }"), time.Now())
+	event, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "device.light.off", event.RoutingKey, "events not matching the filter should be skipped")
+
+	stream, err = client.WatchEvents(ctx, &devicepb.WatchEventsRequest{Filter: "device.#light"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// apiKeyMap is an APIKeyStore of principals by plaintext key.
+type apiKeyMap map[string]internal.Principal
+
+func (m apiKeyMap) FindAPIKey(keyHash string) (*internal.Principal, error) {
+	for key, principal := range m {
+		if internal.HashAPIKey(key) == keyHash {
+			return &principal, nil
+		}
+	}
+	return nil, nil
+}
+
+func TestWatchEventsFiltersUnreadableDevices(t *testing.T) {
+	accessControl = internal.NewAccessControl(internal.AppConfig{}, adultAccessStore{})
+	defer func() { accessControl = nil }()
+	var config internal.AppConfig
+	config.Auth.Enabled = true
+	auth, err := internal.NewAuthenticator(config, apiKeyMap{"key": {Subject: "lodger", Scopes: []string{internal.ScopeDevicesRead}}})
+	require.NoError(t, err)
+	devices := deviceMap{
+		"tv1":   {ID: "tv1", Type: "tv", Room: "living_room"},
+		"lock1": {ID: "lock1", Type: "door_lock", Room: "hall"},
+	}
+
+	bus := internal.NewEventBus(10, 10, internal.SlowClientDisconnect)
+	first := bus.Publish("device.tv.on", "text/plain", []byte("{tv1 tv on living_room}"), time.Now())
+	bus.Publish(internal.TelemetryRoutingKey("door_lock", "lock1"), "application/json", []byte(`{}`), time.Now())
+	bus.Publish("device.door_lock.locked", "text/plain", []byte("{lock1 door_lock locked hall}"), time.Now())
+	bus.Publish(internal.TelemetryRoutingKey("tv", "tv1"), "application/json", []byte(`{}`), time.Now())
+	client := newAuthenticatedTestGRPCClient(t, auth, &deviceService{bus: bus, devices: devices})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, internal.GRPCAPIKeyMetadata, "key")
+	stream, err := client.WatchEvents(ctx, &devicepb.WatchEventsRequest{LastEventId: first.ID})
+	require.NoError(t, err)
+
+	event, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "telemetry.tv.tv1", event.RoutingKey, "telemetry and events of the denied device should be skipped")
+}
+
+func TestDeviceServiceGRPC(t *testing.T) {
+	setup()
+	defer teardown()
+
+	recorder := &recordingPublisher{}
+	original := publisher
+	publisher = recorder
+	defer func() { publisher = original }()
+
+	client := newTestGRPCClient(t, &deviceService{dbClient: testDB, bus: internal.NewEventBus(10, 10, "")})
+	ctx := context.Background()
+
+	registered, err := client.RegisterDevice(ctx, &devicepb.RegisterDeviceRequest{Device: &devicepb.Device{Id: "grpc-1", Type: "lamp", State: "off", Room: "hall"}})
+	require.NoError(t, err)
+	assert.Equal(t, "hall", registered.Room)
+
+	published, err := client.PublishEvent(ctx, &devicepb.PublishEventRequest{DeviceId: "grpc-1", Type: "lamp", State: "on"})
+	require.NoError(t, err)
+	assert.NotEmpty(t, published.MessageId)
+
+	device, err := client.GetDevice(ctx, &devicepb.GetDeviceRequest{Id: "grpc-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "on", device.State)
+	assert.Equal(t, published.Version, device.Version)
+
+	_, err = client.PublishEvent(ctx, &devicepb.PublishEventRequest{DeviceId: "grpc-1", Type: "lamp", State: "off", ExpectedVersion: device.Version + 10})
+	assert.Equal(t, codes.Aborted, status.Code(err), "updates of an outdated version should conflict")
+
+	command, err := client.SendCommand(ctx, &devicepb.SendCommandRequest{DeviceId: "grpc-1", State: "off"})
+	require.NoError(t, err)
+	assert.NotEmpty(t, command.Id)
+	assert.Contains(t, recorder.routingKeys, "command.lamp.grpc-1")
+
+	_, err = client.SendCommand(ctx, &devicepb.SendCommandRequest{DeviceId: "grpc-1", State: "on.off"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.GetDevice(ctx, &devicepb.GetDeviceRequest{Id: "missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	devices, err := client.ListDevices(ctx, &devicepb.ListDevicesRequest{})
+	require.NoError(t, err)
+	assert.NotEmpty(t, devices.Devices)
+}
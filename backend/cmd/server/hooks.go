@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"smart-home-assistant/internal"
+	"time"
+)
+
+// maxHookBodySize limits the payloads accepted from inbound hook sources.
+const maxHookBodySize = 1 << 20
+
+// hookHandler translates the payload of a third-party platform into device events and publishes them
+// on device_events. Sources authenticate with the signature configured for them instead of API keys.
+func hookHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient, hooks *internal.HookSources) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHookBodySize))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	source := r.PathValue("source")
+	events, found, err := hooks.Translate(source, r.Header, body)
+	switch {
+	case !found:
+		http.Error(w, "Unknown hook source", http.StatusNotFound)
+		return
+	case errors.Is(err, internal.ErrHookSignature):
+		log.Printf("Rejected hook from %s: %v", source, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	published := 0
+	for _, event := range events {
+		registered, err := dbClient.GetDevice(event.Device.ID)
+		if err != nil {
+			http.Error(w, "Failed to get device", http.StatusInternalServerError)
+			return
+		}
+		ok, err := publishHookEvent(r.Context(), dbClient, event, registered)
+		if err != nil && !errors.Is(err, internal.ErrNotPublished) {
+			log.Printf("Failed to record hook event for device %s: %v", event.Device.ID, err)
+			http.Error(w, "Failed to update device state", http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to publish hook event for device %s: %v", event.Device.ID, err)
+			status, message := publishErrorStatus(err)
+			http.Error(w, message, status)
+			return
+		}
+		if ok {
+			published++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"received": len(events), "published": published})
+}
+
+// publishHookEvent records the device state of a translated event and publishes it once recorded,
+// under the type and room of the registered device. Events of devices that are not registered, older
+// than the current state or from the future are skipped. It reports whether the event was published.
+func publishHookEvent(ctx context.Context, recorder internal.StateRecorder, event internal.HookEvent, registered *internal.Device) (bool, error) {
+	if registered == nil {
+		log.Printf("Skipped hook event for unregistered device %s", event.Device.ID)
+		return false, nil
+	}
+	device := event.Device
+	device.Type = registered.Type
+	device.Room = registered.Room
+	eventTime := event.EventTime
+	if eventTime.IsZero() {
+		eventTime = time.Now()
+	}
+
+	msg := internal.CreateDeviceEvent(device, eventTime)
+	if event.MessageID != "" {
+		msg.MessageId = event.MessageID
+	}
+	sendCtx, cancel := context.WithTimeout(ctx, confirmTimeout)
+	defer cancel()
+	err := internal.PublishDeviceState(sendCtx, recorder, publisher, device, msg, eventTime, 0)
+	if errors.Is(err, internal.ErrStaleEvent) || errors.Is(err, internal.ErrFutureEvent) {
+		log.Printf("Skipped hook event for device %s: %v", device.ID, err)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"smart-home-assistant/internal"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stateRecorder records the states of device events in memory.
+type stateRecorder map[string]string
+
+func (r stateRecorder) RecordStateChange(deviceID, state, messageID string, eventTime time.Time, expectedVersion int64) (bool, error) {
+	r[deviceID] = state
+	return true, nil
+}
+
+func TestPublishHookEvent(t *testing.T) {
+	recorder := &recordingPublisher{}
+	original := publisher
+	publisher = recorder
+	defer func() { publisher = original }()
+
+	states := stateRecorder{}
+	registered := &internal.Device{ID: "lock1", Type: "lock", State: "locked", Room: "hall"}
+	event := internal.HookEvent{Device: internal.Device{ID: "lock1", Type: "lamp", State: "unlocked", Room: "garden"}}
+	published, err := publishHookEvent(context.Background(), states, event, registered)
+	require.NoError(t, err)
+	assert.True(t, published)
+	require.Len(t, recorder.routingKeys, 1)
+	assert.Equal(t, "device.lock.unlocked", recorder.routingKeys[0], "the registered type should be used")
+	assert.Equal(t, "{lock1 lock unlocked hall}", string(recorder.messages[0].Body), "the registered room should be used")
+	assert.Equal(t, "unlocked", states["lock1"])
+
+	event = internal.HookEvent{Device: internal.Device{ID: "unknown1", Type: "lamp", State: "on"}}
+	published, err = publishHookEvent(context.Background(), states, event, nil)
+	require.NoError(t, err)
+	assert.False(t, published, "events of unregistered devices should be skipped")
+	assert.Len(t, recorder.routingKeys, 1)
+	assert.NotContains(t, states, "unknown1")
+}
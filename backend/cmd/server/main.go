@@ -3,13 +3,168 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"smart-home-assistant/api"
 	"smart-home-assistant/internal"
+	"strconv"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-var rabbitClient internal.RabbitClient // Global RabbitMQ client for publishing
+var publisher internal.Publisher          // Global publisher pool, safe for concurrent requests
+var accessControl *internal.AccessControl // Role based access control, nil when not configured
+var confirmTimeout = 5 * time.Second      // How long a request waits for the broker to confirm a publish
+
+// publishErrorStatus maps an error returned by Publisher.Send to an HTTP status code and message.
+func publishErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, internal.ErrUnroutable):
+		return http.StatusUnprocessableEntity, "No queue is bound for the event routing key"
+	case errors.Is(err, internal.ErrPublishNacked), errors.Is(err, internal.ErrPoolBusy):
+		return http.StatusServiceUnavailable, "Event was rejected by the broker or no channel was available"
+	case errors.Is(err, internal.ErrConfirmTimeout):
+		return http.StatusGatewayTimeout, "Timed out waiting for the broker to confirm the event"
+	default:
+		return http.StatusBadGateway, "Failed to publish event"
+	}
+}
+
+// deviceETag returns the entity tag of a device, derived from its version.
+func deviceETag(device internal.Device) string {
+	return fmt.Sprintf(`"%d"`, device.Version)
+}
+
+// parseETag returns the device version of an entity tag sent in If-Match.
+func parseETag(etag string) (int64, bool) {
+	etag = strings.Trim(strings.TrimPrefix(strings.TrimSpace(etag), "W/"), `"`)
+	version, err := strconv.ParseInt(etag, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// requestError is a failed request with the HTTP status it is answered with. The gRPC service maps
+// the status to a gRPC code, so both APIs fail the same way.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// writeError replies with the status of a requestError, or 500 for other errors.
+func writeError(w http.ResponseWriter, err error) {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		http.Error(w, reqErr.message, reqErr.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// checkAccess checks that the caller may perform action on device, failing with 403 when access is denied.
+func checkAccess(ctx context.Context, action string, device internal.Device, state string) error {
+	if accessControl == nil {
+		return nil
+	}
+
+	err := accessControl.Authorize(ctx, action, device, state)
+	if errors.Is(err, internal.ErrAccessDenied) {
+		return &requestError{http.StatusForbidden, err.Error()}
+	}
+	if err != nil {
+		log.Printf("Failed to check access: %v", err)
+		return &requestError{http.StatusInternalServerError, "Failed to check access"}
+	}
+	return nil
+}
+
+// authorize checks that the caller may perform action on device, replying 403 when access is denied.
+func authorize(w http.ResponseWriter, r *http.Request, action string, device internal.Device, state string) bool {
+	if err := checkAccess(r.Context(), action, device, state); err != nil {
+		writeError(w, err)
+		return false
+	}
+	return true
+}
+
+// findDevice returns a registered device the caller may perform action on, failing with 404 when it is
+// not registered.
+func findDevice(ctx context.Context, dbClient *internal.PostgreSQLClient, deviceID, action string) (*internal.Device, error) {
+	device, err := dbClient.GetDevice(deviceID)
+	if err != nil {
+		return nil, &requestError{http.StatusInternalServerError, "Failed to get device"}
+	}
+	if device == nil {
+		return nil, &requestError{http.StatusNotFound, "Device not found"}
+	}
+	if err := checkAccess(ctx, action, *device, ""); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// registerDevice registers a device, or updates its room, and announces it. The state of a registered
+// device only changes through published events, so they are versioned and recorded before consumers see them.
+func registerDevice(ctx context.Context, dbClient *internal.PostgreSQLClient, device internal.Device) error {
+	registered, err := dbClient.GetDevice(device.ID)
+	if err != nil {
+		return &requestError{http.StatusInternalServerError, "Failed to get device"}
+	}
+	// Updating a device needs access to it where it is registered as well as in its new room
+	if registered != nil {
+		if err := checkAccess(ctx, internal.ActionManage, *registered, ""); err != nil {
+			return err
+		}
+		if device.State != registered.State {
+			return &requestError{http.StatusConflict, "Device is already registered, publish an event to change its state"}
+		}
+	}
+	if err := checkAccess(ctx, internal.ActionManage, device, ""); err != nil {
+		return err
+	}
+	if err := dbClient.InsertDevice(device); err != nil {
+		return &requestError{http.StatusInternalServerError, "Failed to save device"}
+	}
+
+	log.Printf("Device registered: %v", device)
+	publishRegistryEvent(ctx, internal.RegistryCreated, device)
+	return nil
+}
+
+// readableDevices filters devices down to the ones the caller is allowed to read.
+func readableDevices(ctx context.Context, devices []internal.Device) ([]internal.Device, error) {
+	if accessControl == nil {
+		return devices, nil
+	}
+	readable := []internal.Device{}
+	for _, device := range devices {
+		ok, err := accessControl.CanRead(ctx, device)
+		if err != nil {
+			log.Printf("Failed to check access: %v", err)
+			return nil, &requestError{http.StatusInternalServerError, "Failed to check access"}
+		}
+		if ok {
+			readable = append(readable, device)
+		}
+	}
+	return readable, nil
+}
+
+// openAPIHandler serves the OpenAPI document describing every route of the server
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(api.OpenAPI)
+}
 
 func registerDeviceHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
 	var device internal.Device
@@ -19,14 +174,81 @@ func registerDeviceHandler(w http.ResponseWriter, r *http.Request, dbClient *int
 		return
 	}
 
-	err = dbClient.InsertDevice(device)
+	if err := registerDevice(r.Context(), dbClient, device); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func deleteDeviceHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	device, err := findDevice(r.Context(), dbClient, r.PathValue("id"), internal.ActionManage)
 	if err != nil {
-		http.Error(w, "Failed to save device", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	log.Printf("Device registered: %v", device)
-	w.WriteHeader(http.StatusCreated)
+	deleted, err := dbClient.DeleteDevice(device.ID)
+	if err != nil {
+		http.Error(w, "Failed to delete device", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Device deleted: %s", device.ID)
+	publishRegistryEvent(r.Context(), internal.RegistryDeleted, *device)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// publishRegistryEvent announces a registered or deleted device, e.g. to Home Assistant discovery. The
+// registry is already changed, so failures are only logged.
+func publishRegistryEvent(ctx context.Context, action string, device internal.Device) {
+	ctx, cancel := context.WithTimeout(ctx, confirmTimeout)
+	defer cancel()
+	routingKey := internal.RegistryRoutingKey(action, device.Type, device.ID)
+	err := publisher.Send(ctx, "device_events", routingKey, internal.CreateRegistryEvent(device))
+	if err != nil && !errors.Is(err, internal.ErrUnroutable) {
+		log.Printf("Failed to publish registry event for device %s: %v", device.ID, err)
+	}
+}
+
+func getDeviceHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	device, err := findDevice(r.Context(), dbClient, r.PathValue("id"), internal.ActionRead)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	etag := deviceETag(*device)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(device)
+}
+
+func listDevicesHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	devices, err := dbClient.ListDevices()
+	if err != nil {
+		http.Error(w, "Failed to list devices", http.StatusInternalServerError)
+		return
+	}
+
+	// Only list the devices the caller is allowed to read
+	devices, err = readableDevices(r.Context(), devices)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
 }
 
 func publishEventHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
@@ -37,21 +259,132 @@ func publishEventHandler(w http.ResponseWriter, r *http.Request, dbClient *inter
 		return
 	}
 
-	routingKey := fmt.Sprintf("device.%s.%s", device.Type, device.State)
-	err = rabbitClient.Send(context.TODO(), "device_events", routingKey, internal.CreateMessage(fmt.Sprintf("%v", device)))
+	// Updates can be made conditional on the device version, sent as If-Match or in the payload
+	expectedVersion := device.Version
+	conflictStatus := http.StatusConflict
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != "*" {
+		version, ok := parseETag(ifMatch)
+		if !ok {
+			http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+			return
+		}
+		expectedVersion = version
+		conflictStatus = http.StatusPreconditionFailed
+	}
+
+	_, updated, err := publishEvent(r.Context(), dbClient, device, expectedVersion, conflictStatus)
 	if err != nil {
-		http.Error(w, "Failed to publish event", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
+	if updated != nil {
+		w.Header().Set("ETag", deviceETag(*updated))
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	err = dbClient.UpdateDeviceState(device.ID, device.State)
+// publishEvent records a device state and publishes its event once the state is committed, failing
+// with conflictStatus when the device is not at expectedVersion. It returns the message ID and the
+// updated device, which is nil when it could not be read back.
+func publishEvent(ctx context.Context, dbClient *internal.PostgreSQLClient, device internal.Device, expectedVersion int64, conflictStatus int) (string, *internal.Device, error) {
+	eventTime := time.Now()
+	if device.EventTime != nil {
+		eventTime = *device.EventTime
+	}
+
+	registered, err := dbClient.GetDevice(device.ID)
 	if err != nil {
-		http.Error(w, "Failed to update device state", http.StatusInternalServerError)
-		return
+		return "", nil, &requestError{http.StatusInternalServerError, "Failed to get device"}
+	}
+
+	// Check access against the registered device, and publish with its type and room, so the payload
+	// cannot spoof them
+	if registered != nil {
+		if device.Type != "" && device.Type != registered.Type {
+			return "", nil, &requestError{http.StatusBadRequest, "Device type does not match the registered device"}
+		}
+		device.Type, device.Room = registered.Type, registered.Room
+	}
+	if err := checkAccess(ctx, internal.ActionControl, device, device.State); err != nil {
+		return "", nil, err
+	}
+	if expectedVersion != 0 && registered == nil {
+		return "", nil, &requestError{conflictStatus, internal.ErrVersionConflict.Error()}
+	}
+
+	// The version and event time are checked while the device is locked, before anything is published
+	publishCtx, cancel := context.WithTimeout(ctx, confirmTimeout)
+	defer cancel()
+	msg := internal.CreateDeviceEvent(device, eventTime)
+	if messageID, ok := internal.IdempotentMessageID(ctx); ok {
+		msg.MessageId = messageID
+	}
+	err = internal.PublishDeviceState(publishCtx, dbClient, publisher, device, msg, eventTime, expectedVersion)
+	switch {
+	case errors.Is(err, internal.ErrVersionConflict):
+		return "", nil, &requestError{conflictStatus, err.Error()}
+	case errors.Is(err, internal.ErrStaleEvent):
+		return "", nil, &requestError{http.StatusConflict, err.Error()}
+	case errors.Is(err, internal.ErrFutureEvent):
+		return "", nil, &requestError{http.StatusBadRequest, err.Error()}
+	case errors.Is(err, internal.ErrNotPublished):
+		log.Printf("Failed to publish event for device %s: %v", device.ID, err)
+		status, message := publishErrorStatus(err)
+		return "", nil, &requestError{status, message}
+	case err != nil:
+		return "", nil, &requestError{http.StatusInternalServerError, "Failed to update device state"}
 	}
 
 	log.Printf("Event published and state updated for device: %s", device.Type)
-	w.WriteHeader(http.StatusOK)
+	updated, err := dbClient.GetDevice(device.ID)
+	if err != nil {
+		updated = nil
+	}
+	return msg.MessageId, updated, nil
+}
+
+func heartbeatHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	device, err := findDevice(r.Context(), dbClient, r.PathValue("id"), internal.ActionControl)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	cameOnline, err := dbClient.TouchDevice(device.ID, time.Now())
+	if err != nil {
+		http.Error(w, "Failed to record heartbeat", http.StatusInternalServerError)
+		return
+	}
+	if cameOnline {
+		log.Printf("Device %s is online", device.ID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deviceHistoryHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	device, err := findDevice(r.Context(), dbClient, r.PathValue("id"), internal.ActionRead)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	history, err := dbClient.ListStateHistory(device.ID, limit)
+	if err != nil {
+		http.Error(w, "Failed to get device history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
 }
 
 func main() {
@@ -73,12 +406,79 @@ func main() {
 	}
 	defer conn.Close()
 
-	// Initialize RabbitMQ client
-	rabbitClient, err = internal.NewRabbitMQClient(conn)
+	// Publish on a pool of confirm-mode channels, one per concurrent request
+	poolConns := []*amqp.Connection{conn}
+	for len(poolConns) < appConfig.RabbitMQ.PoolConnections {
+		poolConn, err := internal.ConnectRabbitMQ(
+			appConfig.RabbitMQ.User,
+			appConfig.RabbitMQ.Password,
+			appConfig.RabbitMQ.Host,
+			appConfig.RabbitMQ.VHost,
+		)
+		if err != nil {
+			log.Fatalf("Failed to connect to RabbitMQ: %v", err)
+		}
+		defer poolConn.Close()
+		poolConns = append(poolConns, poolConn)
+	}
+	poolSize := appConfig.RabbitMQ.PoolSize
+	if poolSize <= 0 {
+		poolSize = 8
+	}
+	publisherPool, err := internal.NewPublisherPool(poolConns, poolSize)
+	if err != nil {
+		log.Fatalf("Failed to initialize RabbitMQ publisher pool: %v", err)
+	}
+	defer publisherPool.Close()
+	publisher = publisherPool
+	if appConfig.RabbitMQ.ConfirmTimeout > 0 {
+		confirmTimeout = appConfig.RabbitMQ.ConfirmTimeout
+	}
+
+	// Feed every device event into the in-process bus used by streaming clients
+	eventBus := internal.NewEventBus(
+		appConfig.Stream.ReplayBufferSize,
+		appConfig.Stream.ClientBufferSize,
+		appConfig.Stream.SlowClientPolicy,
+	)
+	streamClient, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to initialize RabbitMQ client for streaming: %v", err)
+	}
+	defer streamClient.Close()
+
+	streamQueue, err := streamClient.CreateTemporaryQueue()
+	if err != nil {
+		log.Fatalf("Failed to create stream queue: %v", err)
+	}
+	err = streamClient.CreateBinding(streamQueue.Name, "#", "device_events")
+	if err != nil {
+		log.Fatalf("Failed to bind stream queue: %v", err)
+	}
+	streamMessages, err := streamClient.ConsumeEvent(streamQueue.Name)
 	if err != nil {
-		log.Fatalf("Failed to initialize RabbitMQ client: %v", err)
+		log.Fatalf("Failed to consume stream queue: %v", err)
+	}
+	go eventBus.Feed(streamMessages)
+
+	// Declare the exchange alerts are published on for the notifier
+	if err := streamClient.CreateTopicExchange(internal.NotificationExchange); err != nil {
+		log.Fatalf("Failed to create notifications exchange: %v", err)
+	}
+
+	// Keep a replayable history of device events in a stream
+	if appConfig.History.Enabled {
+		history, err := internal.MirrorToHistory(*appConfig, streamClient)
+		if err != nil {
+			log.Fatalf("Failed to mirror device events to the history stream: %v", err)
+		}
+		log.Printf("Mirroring device events to stream %s", history.Name)
+	}
+
+	heartbeat := appConfig.Stream.HeartbeatInterval
+	if heartbeat <= 0 {
+		heartbeat = 15 * time.Second
 	}
-	defer rabbitClient.Close()
 
 	// Connect to PostgreSQL using configuration
 	dbClient, err := internal.ConnectPostgreSQL(*appConfig)
@@ -87,15 +487,259 @@ func main() {
 	}
 	defer dbClient.Close()
 
-	// Set up HTTP handlers
-	http.HandleFunc("/devices", func(w http.ResponseWriter, r *http.Request) {
+	// Bring the schema up to date before serving requests
+	if err := dbClient.Migrate(); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	// Record device heartbeats and mark silent devices offline
+	watchdog := internal.NewWatchdog(*appConfig, dbClient, publisher)
+	heartbeatClient, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to initialize RabbitMQ client for heartbeats: %v", err)
+	}
+	defer heartbeatClient.Close()
+
+	heartbeatQueue, err := heartbeatClient.CreateQueue("heartbeat_queue")
+	if err != nil {
+		log.Fatalf("Failed to create heartbeat queue: %v", err)
+	}
+	err = heartbeatClient.CreateBinding(heartbeatQueue.Name, "heartbeat.#", "device_events")
+	if err != nil {
+		log.Fatalf("Failed to bind heartbeat queue: %v", err)
+	}
+	heartbeatMessages, err := heartbeatClient.ConsumeEventWithAck(heartbeatQueue.Name)
+	if err != nil {
+		log.Fatalf("Failed to consume heartbeat queue: %v", err)
+	}
+	go watchdog.ConsumeHeartbeats(heartbeatMessages)
+	go watchdog.Run(context.Background())
+
+	// Authenticate requests with API keys stored in PostgreSQL or JWT bearer tokens
+	auth, err := internal.NewAuthenticator(*appConfig, dbClient)
+	if err != nil {
+		log.Fatalf("Failed to initialize authentication: %v", err)
+	}
+	if !auth.Enabled {
+		log.Println("Authentication is disabled, all requests are accepted")
+	}
+
+	// Evaluate household roles and permissions for authenticated requests
+	accessControl = internal.NewAccessControl(*appConfig, dbClient)
+
+	// Compute consumption from power telemetry or the configured wattage per state
+	energy, err := internal.NewEnergyCalculator(*appConfig)
+	if err != nil {
+		log.Fatalf("Failed to initialize energy reports: %v", err)
+	}
+
+	// Replay the original response to retried requests carrying an Idempotency-Key
+	idempotency := internal.NewIdempotency(*appConfig, dbClient)
+	go func() {
+		for range time.Tick(time.Hour) {
+			if err := idempotency.Purge(); err != nil {
+				log.Printf("Failed to purge idempotency keys: %v", err)
+			}
+		}
+	}()
+
+	// Expose connection pool statistics alongside the request and publish metrics
+	if err := internal.RegisterDBMetrics(dbClient); err != nil {
+		log.Fatalf("Failed to register database metrics: %v", err)
+	}
+	http.Handle("GET /metrics", internal.MetricsHandler())
+
+	// Liveness only shows the process is serving, readiness checks every dependency
+	health := internal.NewHealth(appConfig.Health.Timeout)
+	health.Add("rabbitmq", publisherPool.Check)
+	health.Add("rabbitmq_stream", streamClient.Check)
+	health.Add("rabbitmq_heartbeats", heartbeatClient.Check)
+	health.Add("postgres", dbClient.Ping)
+	health.Add("migrations", dbClient.CheckMigrations)
+	http.HandleFunc("GET /healthz", health.LivenessHandler)
+	http.HandleFunc("GET /readyz", health.ReadinessHandler)
+	http.HandleFunc("GET /openapi.json", openAPIHandler)
+
+	// handle registers an instrumented route that requires the given scope
+	handle := func(pattern, scope string, handler http.HandlerFunc) {
+		http.HandleFunc(pattern, internal.InstrumentHandler(pattern, auth.Require(scope, handler)))
+	}
+
+	// Set up HTTP handlers, each route requires its own scope
+	handle("POST /devices", internal.ScopeDevicesWrite, idempotency.Wrap("POST /devices", func(w http.ResponseWriter, r *http.Request) {
 		registerDeviceHandler(w, r, dbClient)
+	}))
+
+	handle("GET /devices", internal.ScopeDevicesRead, func(w http.ResponseWriter, r *http.Request) {
+		listDevicesHandler(w, r, dbClient)
+	})
+
+	handle("GET /devices/{id}", internal.ScopeDevicesRead, func(w http.ResponseWriter, r *http.Request) {
+		getDeviceHandler(w, r, dbClient)
+	})
+
+	handle("DELETE /devices/{id}", internal.ScopeDevicesWrite, func(w http.ResponseWriter, r *http.Request) {
+		deleteDeviceHandler(w, r, dbClient)
 	})
 
-	http.HandleFunc("/publish", func(w http.ResponseWriter, r *http.Request) {
+	handle("POST /devices/{id}/commands", internal.ScopeEventsPublish, func(w http.ResponseWriter, r *http.Request) {
+		commandHandler(w, r, dbClient)
+	})
+
+	handle("GET /devices/{id}/history", internal.ScopeDevicesRead, func(w http.ResponseWriter, r *http.Request) {
+		deviceHistoryHandler(w, r, dbClient)
+	})
+
+	handle("POST /devices/{id}/heartbeat", internal.ScopeEventsPublish, func(w http.ResponseWriter, r *http.Request) {
+		heartbeatHandler(w, r, dbClient)
+	})
+
+	handle("POST /publish", internal.ScopeEventsPublish, idempotency.Wrap("POST /publish", func(w http.ResponseWriter, r *http.Request) {
 		publishEventHandler(w, r, dbClient)
+	}))
+
+	handle("POST /telemetry", internal.ScopeEventsPublish, idempotency.Wrap("POST /telemetry", func(w http.ResponseWriter, r *http.Request) {
+		publishTelemetryHandler(w, r, dbClient)
+	}))
+
+	handle("GET /devices/{id}/telemetry", internal.ScopeDevicesRead, func(w http.ResponseWriter, r *http.Request) {
+		listReadingsHandler(w, r, dbClient)
 	})
 
+	handle("GET /devices/{id}/telemetry/aggregate", internal.ScopeDevicesRead, func(w http.ResponseWriter, r *http.Request) {
+		aggregateReadingsHandler(w, r, dbClient)
+	})
+
+	handle("GET /energy/devices/{id}", internal.ScopeDevicesRead, func(w http.ResponseWriter, r *http.Request) {
+		deviceEnergyHandler(w, r, dbClient, energy)
+	})
+
+	handle("GET /energy/rooms/{room}", internal.ScopeDevicesRead, func(w http.ResponseWriter, r *http.Request) {
+		roomEnergyHandler(w, r, dbClient, energy)
+	})
+
+	handle("GET /events/stream", internal.ScopeDevicesRead, func(w http.ResponseWriter, r *http.Request) {
+		streamEventsHandler(w, r, eventBus, dbClient, heartbeat)
+	})
+
+	handle("GET /ws", internal.ScopeDevicesRead, func(w http.ResponseWriter, r *http.Request) {
+		websocketHandler(w, r, eventBus, dbClient, heartbeat)
+	})
+
+	handle("POST /users", internal.ScopeUsersAdmin, func(w http.ResponseWriter, r *http.Request) {
+		createUserHandler(w, r, dbClient)
+	})
+
+	handle("POST /users/{id}/permissions", internal.ScopeUsersAdmin, func(w http.ResponseWriter, r *http.Request) {
+		createPermissionHandler(w, r, dbClient)
+	})
+
+	handle("GET /users/{id}/permissions", internal.ScopeUsersAdmin, func(w http.ResponseWriter, r *http.Request) {
+		listPermissionsHandler(w, r, dbClient)
+	})
+
+	handle("GET /audit", internal.ScopeUsersAdmin, func(w http.ResponseWriter, r *http.Request) {
+		listAuditHandler(w, r, dbClient)
+	})
+
+	handle("POST /notifications", internal.ScopeEventsPublish, idempotency.Wrap("POST /notifications", sendNotificationHandler))
+
+	handle("GET /notifications", internal.ScopeNotificationsRead, func(w http.ResponseWriter, r *http.Request) {
+		listNotificationDeliveriesHandler(w, r, dbClient)
+	})
+
+	handle("GET /users/{id}/notification-preferences", internal.ScopeNotificationsRead, func(w http.ResponseWriter, r *http.Request) {
+		listNotificationPreferencesHandler(w, r, dbClient)
+	})
+
+	handle("PUT /users/{id}/notification-preferences", internal.ScopeNotificationsWrite, func(w http.ResponseWriter, r *http.Request) {
+		replaceNotificationPreferencesHandler(w, r, dbClient)
+	})
+
+	handle("POST /webhooks", internal.ScopeWebhooksManage, func(w http.ResponseWriter, r *http.Request) {
+		createWebhookHandler(w, r, dbClient)
+	})
+
+	handle("GET /webhooks", internal.ScopeWebhooksManage, func(w http.ResponseWriter, r *http.Request) {
+		listWebhooksHandler(w, r, dbClient)
+	})
+
+	handle("GET /webhooks/{id}", internal.ScopeWebhooksManage, func(w http.ResponseWriter, r *http.Request) {
+		getWebhookHandler(w, r, dbClient)
+	})
+
+	handle("PUT /webhooks/{id}", internal.ScopeWebhooksManage, func(w http.ResponseWriter, r *http.Request) {
+		updateWebhookHandler(w, r, dbClient)
+	})
+
+	handle("DELETE /webhooks/{id}", internal.ScopeWebhooksManage, func(w http.ResponseWriter, r *http.Request) {
+		deleteWebhookHandler(w, r, dbClient)
+	})
+
+	handle("GET /webhooks/{id}/deliveries", internal.ScopeWebhooksManage, func(w http.ResponseWriter, r *http.Request) {
+		listWebhookDeliveriesHandler(w, r, dbClient)
+	})
+
+	handle("GET /scenes", internal.ScopeDevicesRead, func(w http.ResponseWriter, r *http.Request) {
+		listScenesHandler(w, r, dbClient)
+	})
+
+	handle("GET /scenes/{name}", internal.ScopeDevicesRead, func(w http.ResponseWriter, r *http.Request) {
+		getSceneHandler(w, r, dbClient)
+	})
+
+	handle("PUT /scenes/{name}", internal.ScopeDevicesWrite, func(w http.ResponseWriter, r *http.Request) {
+		putSceneHandler(w, r, dbClient)
+	})
+
+	handle("DELETE /scenes/{name}", internal.ScopeDevicesWrite, func(w http.ResponseWriter, r *http.Request) {
+		deleteSceneHandler(w, r, dbClient)
+	})
+
+	handle("POST /scenes/{name}/activate", internal.ScopeEventsPublish, func(w http.ResponseWriter, r *http.Request) {
+		activateSceneHandler(w, r, dbClient)
+	})
+
+	handle("GET /rules", internal.ScopeDevicesRead, func(w http.ResponseWriter, r *http.Request) {
+		listRulesHandler(w, r, dbClient)
+	})
+
+	handle("GET /rules/{name}", internal.ScopeDevicesRead, func(w http.ResponseWriter, r *http.Request) {
+		getRuleHandler(w, r, dbClient)
+	})
+
+	handle("PUT /rules/{name}", internal.ScopeDevicesWrite, func(w http.ResponseWriter, r *http.Request) {
+		putRuleHandler(w, r, dbClient)
+	})
+
+	handle("DELETE /rules/{name}", internal.ScopeDevicesWrite, func(w http.ResponseWriter, r *http.Request) {
+		deleteRuleHandler(w, r, dbClient)
+	})
+
+	// Third-party platforms are authenticated by the signature configured for their source
+	hooks, err := internal.NewHookSources(*appConfig)
+	if err != nil {
+		log.Fatalf("Failed to load hook sources: %v", err)
+	}
+	http.HandleFunc("POST /hooks/{source}", internal.InstrumentHandler("POST /hooks/{source}", func(w http.ResponseWriter, r *http.Request) {
+		hookHandler(w, r, dbClient, hooks)
+	}))
+
+	// Serve the same device API over gRPC for internal services
+	if appConfig.Server.GRPCPort != "" {
+		listener, err := net.Listen("tcp", ":"+appConfig.Server.GRPCPort)
+		if err != nil {
+			log.Fatalf("Failed to listen for gRPC: %v", err)
+		}
+		grpcServer := newGRPCServer(auth, &deviceService{dbClient: dbClient, bus: eventBus, devices: dbClient})
+		go func() {
+			log.Printf("Starting gRPC server on :%s...", appConfig.Server.GRPCPort)
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Fatalf("gRPC server failed: %v", err)
+			}
+		}()
+	}
+
 	// Start HTTP server
 	log.Println("Starting server on :8080...")
 	if err := http.ListenAndServe(":8080", nil); err != nil {
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -63,13 +65,16 @@ func TestRegisterDeviceHandler(t *testing.T) {
 	t.Log("Starting TestRegisterDeviceHandler")
 
 	device := internal.Device{ID: "1", Type: "light", State: "off"}
+	_, err := testDB.DeleteDevice(device.ID) // Left over by an earlier run
+	assert.NoError(t, err, "should delete the device of an earlier run")
 	body, err := json.Marshal(device)
 	assert.NoError(t, err, "should marshal device to JSON")
 
 	req := httptest.NewRequest(http.MethodPost, "/devices", bytes.NewBuffer(body))
 	w := httptest.NewRecorder()
 
-	// Inject the testDB dependency
+	// Inject the testDB dependency, registrations are announced on device_events
+	publisher = testRabbitClient
 	registerDeviceHandler(w, req, testDB)
 
 	res := w.Result()
@@ -85,6 +90,16 @@ func TestRegisterDeviceHandler(t *testing.T) {
 	assert.Equal(t, device.Type, fetchedDevice.Type, "device Type should match")
 	assert.Equal(t, device.State, fetchedDevice.State, "device State should match")
 
+	// Registering again may move the device, but its state only changes through events
+	body, err = json.Marshal(internal.Device{ID: device.ID, Type: device.Type, State: "on"})
+	assert.NoError(t, err, "should marshal device to JSON")
+	w = httptest.NewRecorder()
+	registerDeviceHandler(w, httptest.NewRequest(http.MethodPost, "/devices", bytes.NewBuffer(body)), testDB)
+	assert.Equal(t, http.StatusConflict, w.Result().StatusCode, "expected status code 409 for a state change")
+	fetchedDevice, err = testDB.GetDevice(device.ID)
+	assert.NoError(t, err, "should fetch the device without error")
+	assert.Equal(t, device.State, fetchedDevice.State, "device State should be kept")
+
 	t.Log("TestRegisterDeviceHandler completed successfully")
 }
 
@@ -102,7 +117,7 @@ func TestPublishEventHandler(t *testing.T) {
 	w := httptest.NewRecorder()
 
 	// Inject test dependencies
-	rabbitClient = testRabbitClient // Ensure rabbitClient matches testRabbitClient's type
+	publisher = testRabbitClient // RabbitClient publishes with confirms like the pool
 
 	publishEventHandler(w, req, testDB)
 
@@ -117,5 +132,103 @@ func TestPublishEventHandler(t *testing.T) {
 	assert.NotNil(t, updatedDevice, "expected device to be found")
 	assert.Equal(t, device.State, updatedDevice.State, "device State should be updated")
 
+	// The type cannot be changed by the payload
+	body, err = json.Marshal(internal.Device{ID: device.ID, Type: "door_lock", State: "unlocked"})
+	assert.NoError(t, err, "should marshal device to JSON")
+	w = httptest.NewRecorder()
+	publishEventHandler(w, httptest.NewRequest(http.MethodPost, "/publish", bytes.NewBuffer(body)), testDB)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode, "expected status code 400 for a spoofed type")
+
 	t.Log("TestPublishEventHandler completed successfully")
 }
+
+func TestGetDeviceHandler(t *testing.T) {
+	setup()
+	defer teardown()
+
+	device := internal.Device{ID: "2", Type: "tv", State: "off"}
+	err := testDB.InsertDevice(device)
+	assert.NoError(t, err, "should insert device")
+
+	req := httptest.NewRequest(http.MethodGet, "/devices/2", nil)
+	req.SetPathValue("id", device.ID)
+	w := httptest.NewRecorder()
+
+	getDeviceHandler(w, req, testDB)
+
+	res := w.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode, "expected status code 200 for OK")
+
+	var fetchedDevice internal.Device
+	err = json.NewDecoder(res.Body).Decode(&fetchedDevice)
+	assert.NoError(t, err, "should decode device from response")
+	assert.Equal(t, device, fetchedDevice, "device should match")
+
+	// Unknown devices are reported as not found
+	req = httptest.NewRequest(http.MethodGet, "/devices/missing", nil)
+	req.SetPathValue("id", "missing")
+	w = httptest.NewRecorder()
+
+	getDeviceHandler(w, req, testDB)
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode, "expected status code 404 for unknown device")
+}
+
+func TestCreateUserHandler(t *testing.T) {
+	setup()
+	defer teardown()
+
+	user := internal.User{ID: "kid1", Name: "Kid", Role: internal.RoleChild}
+	body, err := json.Marshal(user)
+	assert.NoError(t, err, "should marshal user to JSON")
+
+	req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+
+	createUserHandler(w, req, testDB)
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode, "expected status code 201 for created")
+
+	fetchedUser, err := testDB.GetUser(user.ID)
+	assert.NoError(t, err, "should fetch the user without error")
+	assert.NotNil(t, fetchedUser, "expected user to be found")
+	assert.Equal(t, user.Role, fetchedUser.Role, "user Role should match")
+
+	// Unknown roles are rejected
+	req = httptest.NewRequest(http.MethodPost, "/users", bytes.NewBufferString(`{"id":"x","role":"admin"}`))
+	w = httptest.NewRecorder()
+
+	createUserHandler(w, req, testDB)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode, "expected status code 400 for an unknown role")
+}
+
+func TestPublishErrorStatus(t *testing.T) {
+	status, _ := publishErrorStatus(&internal.UnroutableError{RoutingKey: "device.lamp.on"})
+	assert.Equal(t, http.StatusUnprocessableEntity, status, "unroutable events should be rejected as unprocessable")
+
+	status, _ = publishErrorStatus(internal.ErrPublishNacked)
+	assert.Equal(t, http.StatusServiceUnavailable, status, "nacked events should report the broker as unavailable")
+
+	status, _ = publishErrorStatus(fmt.Errorf("%w: context deadline exceeded", internal.ErrPoolBusy))
+	assert.Equal(t, http.StatusServiceUnavailable, status, "publishes without a free channel should report the broker as unavailable")
+
+	status, _ = publishErrorStatus(fmt.Errorf("%w: context deadline exceeded", internal.ErrConfirmTimeout))
+	assert.Equal(t, http.StatusGatewayTimeout, status, "confirm timeouts should be reported as gateway timeouts")
+
+	status, _ = publishErrorStatus(errors.New("channel closed"))
+	assert.Equal(t, http.StatusBadGateway, status, "other publish errors should be reported as bad gateway")
+}
+
+func TestParseETag(t *testing.T) {
+	etag := deviceETag(internal.Device{Version: 7})
+	assert.Equal(t, `"7"`, etag, "the ETag should be the quoted device version")
+
+	version, ok := parseETag(etag)
+	assert.True(t, ok)
+	assert.Equal(t, int64(7), version, "an ETag should parse back to its version")
+
+	version, ok = parseETag(`W/"7"`)
+	assert.True(t, ok, "weak ETags should be accepted")
+	assert.Equal(t, int64(7), version)
+
+	_, ok = parseETag(`"abc"`)
+	assert.False(t, ok, "ETags that are not versions should be rejected")
+}
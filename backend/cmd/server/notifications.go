@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"smart-home-assistant/internal"
+	"strconv"
+	"time"
+)
+
+// authorizeUser checks that the caller is the given user or may administer users.
+func authorizeUser(w http.ResponseWriter, r *http.Request, userID string) bool {
+	if principal, ok := internal.PrincipalFromContext(r.Context()); ok && userID != "" && principal.Subject == userID {
+		return true
+	}
+	return authorize(w, r, internal.ActionAdmin, internal.Device{}, "")
+}
+
+func sendNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	var notification internal.Notification
+	if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+		http.Error(w, "Invalid notification format", http.StatusBadRequest)
+		return
+	}
+	if err := notification.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if notification.ID == "" {
+		notification.ID = internal.NewMessageID()
+	}
+	if notification.Timestamp.IsZero() {
+		notification.Timestamp = time.Now()
+	}
+
+	msg, err := internal.CreateNotificationMessage(notification)
+	if err != nil {
+		http.Error(w, "Invalid notification format", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), confirmTimeout)
+	defer cancel()
+	routingKey := internal.NotificationRoutingKey(notification.Severity)
+	if err := publisher.Send(ctx, internal.NotificationExchange, routingKey, msg); err != nil {
+		log.Printf("Failed to publish notification %s: %v", notification.ID, err)
+		status, message := publishErrorStatus(err)
+		http.Error(w, message, status)
+		return
+	}
+
+	// Notifications are delivered asynchronously by the notifier
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(notification)
+}
+
+func listNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	userID := r.PathValue("id")
+	if !authorizeUser(w, r, userID) {
+		return
+	}
+
+	preferences, err := dbClient.ListNotificationPreferences(userID)
+	if err != nil {
+		http.Error(w, "Failed to list notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preferences)
+}
+
+func replaceNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	userID := r.PathValue("id")
+	var preferences []internal.NotificationPreference
+	if err := json.NewDecoder(r.Body).Decode(&preferences); err != nil {
+		http.Error(w, "Invalid notification preferences format", http.StatusBadRequest)
+		return
+	}
+	channels := make(map[string]bool)
+	for i := range preferences {
+		if err := preferences[i].Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if channels[preferences[i].Channel] {
+			http.Error(w, "Each channel may only be configured once", http.StatusBadRequest)
+			return
+		}
+		channels[preferences[i].Channel] = true
+		preferences[i].UserID = userID
+	}
+
+	if !authorizeUser(w, r, userID) {
+		return
+	}
+
+	user, err := dbClient.GetUser(userID)
+	if err != nil {
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if err := dbClient.ReplaceNotificationPreferences(userID, preferences); err != nil {
+		http.Error(w, "Failed to save notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preferences)
+}
+
+func listNotificationDeliveriesHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	query := r.URL.Query()
+	userID := query.Get("user_id")
+	if !authorizeUser(w, r, userID) {
+		return
+	}
+
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	deliveries, err := dbClient.ListNotificationDeliveries(userID, query.Get("status"), limit)
+	if err != nil {
+		http.Error(w, "Failed to list notification deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
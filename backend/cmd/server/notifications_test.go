@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"smart-home-assistant/internal"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendNotificationHandler(t *testing.T) {
+	recorder := &recordingPublisher{}
+	original := publisher
+	publisher = recorder
+	defer func() { publisher = original }()
+
+	body := `{"user_id":"alice","severity":"critical","title":"Water leak","device_id":"bathroom1"}`
+	w := httptest.NewRecorder()
+	sendNotificationHandler(w, httptest.NewRequest(http.MethodPost, "/notifications", bytes.NewBufferString(body)))
+
+	assert.Equal(t, http.StatusAccepted, w.Code, "notifications should be accepted for asynchronous delivery")
+	require.Len(t, recorder.routingKeys, 1)
+	assert.Equal(t, "notification.critical", recorder.routingKeys[0])
+
+	var sent internal.Notification
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sent))
+	assert.NotEmpty(t, sent.ID, "an ID should be assigned to the notification")
+	assert.Equal(t, sent.ID, recorder.messages[0].MessageId)
+
+	w = httptest.NewRecorder()
+	sendNotificationHandler(w, httptest.NewRequest(http.MethodPost, "/notifications", bytes.NewBufferString(`{"severity":"urgent","title":"x"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "unknown severities should be rejected")
+	assert.Len(t, recorder.routingKeys, 1, "rejected notifications should not be published")
+}
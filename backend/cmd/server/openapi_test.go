@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"smart-home-assistant/api"
+	"smart-home-assistant/internal"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scopeConstants resolves the scope constants passed to handle in main.go.
+var scopeConstants = map[string]string{
+	"ScopeDevicesRead":        internal.ScopeDevicesRead,
+	"ScopeDevicesWrite":       internal.ScopeDevicesWrite,
+	"ScopeEventsPublish":      internal.ScopeEventsPublish,
+	"ScopeUsersAdmin":         internal.ScopeUsersAdmin,
+	"ScopeNotificationsRead":  internal.ScopeNotificationsRead,
+	"ScopeNotificationsWrite": internal.ScopeNotificationsWrite,
+	"ScopeWebhooksManage":     internal.ScopeWebhooksManage,
+}
+
+// registeredRoutes parses main.go and returns the pattern of every route it registers with the scope
+// it requires, empty for public routes.
+func registeredRoutes(t *testing.T) map[string]string {
+	file, err := parser.ParseFile(token.NewFileSet(), "main.go", nil, 0)
+	require.NoError(t, err)
+
+	routes := make(map[string]string)
+	ast.Inspect(file, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+		if !ok || len(call.Args) < 2 {
+			return true
+		}
+		var name string
+		switch fun := call.Fun.(type) {
+		case *ast.Ident:
+			name = fun.Name
+		case *ast.SelectorExpr:
+			if pkg, ok := fun.X.(*ast.Ident); ok {
+				name = pkg.Name + "." + fun.Sel.Name
+			}
+		}
+		if name != "handle" && name != "http.HandleFunc" && name != "http.Handle" {
+			return true
+		}
+		literal, ok := call.Args[0].(*ast.BasicLit)
+		if !ok || literal.Kind != token.STRING {
+			return true
+		}
+		pattern, err := strconv.Unquote(literal.Value)
+		require.NoError(t, err)
+
+		scope := ""
+		if name == "handle" {
+			selector, ok := call.Args[1].(*ast.SelectorExpr)
+			require.True(t, ok, "scope of %s should be an internal constant", pattern)
+			scope, ok = scopeConstants[selector.Sel.Name]
+			require.True(t, ok, "unknown scope %s of %s", selector.Sel.Name, pattern)
+		}
+		routes[pattern] = scope
+		return true
+	})
+	return routes
+}
+
+func loadDocument(t *testing.T) *api.Document {
+	doc, err := api.Load()
+	require.NoError(t, err)
+	return doc
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := loadDocument(t)
+	routes := registeredRoutes(t)
+
+	var registered []string
+	for pattern := range routes {
+		registered = append(registered, pattern)
+	}
+	sort.Strings(registered)
+	assert.Equal(t, doc.Routes(), registered, "every route should be documented, and every documented route served")
+
+	for pattern, scope := range routes {
+		method, path, _ := strings.Cut(pattern, " ")
+		operation, ok := doc.Paths[path][strings.ToLower(method)]
+		if !ok {
+			continue
+		}
+		assert.Equal(t, scope, operation.Scope, "documented scope of %s", pattern)
+		assert.NotEmpty(t, operation.OperationID, "operationId of %s", pattern)
+	}
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	doc := loadDocument(t)
+	types := map[string]any{
+		"Device":                 internal.Device{},
+		"StateChange":            internal.StateChange{},
+		"Reading":                internal.Reading{},
+		"Aggregate":              internal.Aggregate{},
+		"EnergyBucket":           internal.EnergyBucket{},
+		"EnergyReport":           internal.EnergyReport{},
+		"User":                   internal.User{},
+		"Permission":             internal.Permission{},
+		"AuditEntry":             internal.AuditEntry{},
+		"Notification":           internal.Notification{},
+		"NotificationPreference": internal.NotificationPreference{},
+		"NotificationDelivery":   internal.NotificationDelivery{},
+		"WebhookSubscription":    internal.WebhookSubscription{},
+		"WebhookDelivery":        internal.WebhookDelivery{},
+		"Scene":                  internal.Scene{},
+		"SceneAction":            internal.SceneAction{},
+		"SceneCommand":           internal.SceneCommand{},
+		"Rule":                   internal.Rule{},
+		"Event":                  internal.Event{},
+		"CheckResult":            internal.CheckResult{},
+		"HealthReport":           internal.HealthReport{},
+	}
+	for name, value := range types {
+		assert.NoError(t, doc.CheckType(name, reflect.TypeOf(value)))
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	openAPIHandler(rr, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	var served map[string]any
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &served))
+	assert.Equal(t, "3.0.3", served["openapi"])
+}
+
+// TestHandlersReturnDocumentedStatus runs the handlers on requests they answer without a database and
+// checks the status they reply with is documented for the operation.
+func TestHandlersReturnDocumentedStatus(t *testing.T) {
+	doc := loadDocument(t)
+
+	recorder := &recordingPublisher{}
+	original := publisher
+	publisher = recorder
+	defer func() { publisher = original }()
+
+	tests := []struct {
+		pattern string
+		target  string
+		body    string
+		handler http.HandlerFunc
+		status  int
+	}{
+		{"POST /devices", "/devices", "{", func(w http.ResponseWriter, r *http.Request) { registerDeviceHandler(w, r, nil) }, http.StatusBadRequest},
+		{"POST /publish", "/publish", "{", func(w http.ResponseWriter, r *http.Request) { publishEventHandler(w, r, nil) }, http.StatusBadRequest},
+		{"POST /devices/{id}/commands", "/devices/tv1/commands", "{", func(w http.ResponseWriter, r *http.Request) { commandHandler(w, r, nil) }, http.StatusBadRequest},
+		{"POST /telemetry", "/telemetry", `{"device_id":"t1"}`, func(w http.ResponseWriter, r *http.Request) { publishTelemetryHandler(w, r, nil) }, http.StatusBadRequest},
+		{"POST /users", "/users", "{", func(w http.ResponseWriter, r *http.Request) { createUserHandler(w, r, nil) }, http.StatusBadRequest},
+		{"POST /users/{id}/permissions", "/users/kid/permissions", `{"action":"read"}`, func(w http.ResponseWriter, r *http.Request) { createPermissionHandler(w, r, nil) }, http.StatusBadRequest},
+		{"POST /notifications", "/notifications", `{"severity":"loud","title":"Door"}`, sendNotificationHandler, http.StatusBadRequest},
+		{"POST /notifications", "/notifications", `{"severity":"info","title":"Door"}`, sendNotificationHandler, http.StatusAccepted},
+		{"PUT /users/{id}/notification-preferences", "/users/kid/notification-preferences", "{", func(w http.ResponseWriter, r *http.Request) { replaceNotificationPreferencesHandler(w, r, nil) }, http.StatusBadRequest},
+		{"POST /webhooks", "/webhooks", `{"url":"ftp://example.com"}`, func(w http.ResponseWriter, r *http.Request) { createWebhookHandler(w, r, nil) }, http.StatusBadRequest},
+		{"GET /webhooks/{id}", "/webhooks/abc", "", func(w http.ResponseWriter, r *http.Request) { getWebhookHandler(w, r, nil) }, http.StatusNotFound},
+		{"PUT /webhooks/{id}", "/webhooks/1", "{", func(w http.ResponseWriter, r *http.Request) { updateWebhookHandler(w, r, nil) }, http.StatusBadRequest},
+		{"DELETE /webhooks/{id}", "/webhooks/0", "", func(w http.ResponseWriter, r *http.Request) { deleteWebhookHandler(w, r, nil) }, http.StatusNotFound},
+		{"PUT /scenes/{name}", "/scenes/movie_night", "{", func(w http.ResponseWriter, r *http.Request) { putSceneHandler(w, r, nil) }, http.StatusBadRequest},
+		{"PUT /scenes/{name}", "/scenes/movie_night", `{"actions":[]}`, func(w http.ResponseWriter, r *http.Request) { putSceneHandler(w, r, nil) }, http.StatusBadRequest},
+		{"PUT /rules/{name}", "/rules/lights_on_motion", `{"trigger":"device.#motion","scene":"lights_on"}`, func(w http.ResponseWriter, r *http.Request) { putRuleHandler(w, r, nil) }, http.StatusBadRequest},
+		{"GET /events/stream", "/events/stream?filter=device.%23light", "", func(w http.ResponseWriter, r *http.Request) {
+			streamEventsHandler(w, r, internal.NewEventBus(1, 1, ""), nil, 0)
+		}, http.StatusBadRequest},
+		{"GET /openapi.json", "/openapi.json", "", openAPIHandler, http.StatusOK},
+	}
+	for _, tt := range tests {
+		method, _, _ := strings.Cut(tt.pattern, " ")
+		mux := http.NewServeMux()
+		mux.HandleFunc(tt.pattern, tt.handler)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, tt.target, strings.NewReader(tt.body)))
+		require.Equal(t, tt.status, rr.Code, "%s %s: %s", method, tt.target, rr.Body.String())
+
+		path, _, _ := strings.Cut(tt.target, "?")
+		template, operation, ok := doc.Match(method, path)
+		require.True(t, ok, "%s %s should be documented", method, path)
+		_, documented := operation.Responses[strconv.Itoa(rr.Code)]
+		assert.True(t, documented, "status %d of %s %s should be documented", rr.Code, method, template)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"smart-home-assistant/internal"
+)
+
+func listRulesHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	rules, err := dbClient.ListRules()
+	if err != nil {
+		http.Error(w, "Failed to list rules", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+func getRuleHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	rule, err := dbClient.GetRule(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, "Failed to get rule", http.StatusInternalServerError)
+		return
+	}
+	if rule == nil {
+		http.Error(w, "Rule not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// putRuleHandler creates or replaces the rule named in the path. Rules are enabled unless the request
+// disables them.
+func putRuleHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	rule := internal.Rule{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid rule format", http.StatusBadRequest)
+		return
+	}
+	rule.Name = r.PathValue("name")
+	if err := rule.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !authorize(w, r, internal.ActionAdmin, internal.Device{}, "") {
+		return
+	}
+
+	scene, err := dbClient.GetScene(rule.Scene)
+	if err != nil {
+		http.Error(w, "Failed to get scene", http.StatusInternalServerError)
+		return
+	}
+	if scene == nil {
+		http.Error(w, "Scene of the rule does not exist", http.StatusBadRequest)
+		return
+	}
+
+	if err := dbClient.PutRule(&rule); err != nil {
+		http.Error(w, "Failed to save rule", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Rule %s saved, %s activates scene %s", rule.Name, rule.Trigger, rule.Scene)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+func deleteRuleHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	if !authorize(w, r, internal.ActionAdmin, internal.Device{}, "") {
+		return
+	}
+
+	deleted, err := dbClient.DeleteRule(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, "Failed to delete rule", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Rule not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
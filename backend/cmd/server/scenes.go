@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"smart-home-assistant/internal"
+)
+
+func listScenesHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	scenes, err := dbClient.ListScenes()
+	if err != nil {
+		http.Error(w, "Failed to list scenes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scenes)
+}
+
+func getSceneHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	scene, err := dbClient.GetScene(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, "Failed to get scene", http.StatusInternalServerError)
+		return
+	}
+	if scene == nil {
+		http.Error(w, "Scene not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scene)
+}
+
+// putSceneHandler creates or replaces the scene named in the path.
+func putSceneHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	var scene internal.Scene
+	if err := json.NewDecoder(r.Body).Decode(&scene); err != nil {
+		http.Error(w, "Invalid scene format", http.StatusBadRequest)
+		return
+	}
+	scene.Name = r.PathValue("name")
+	if err := scene.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !authorize(w, r, internal.ActionAdmin, internal.Device{}, "") {
+		return
+	}
+
+	if err := dbClient.PutScene(&scene); err != nil {
+		http.Error(w, "Failed to save scene", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Scene %s saved with %d actions", scene.Name, len(scene.Actions))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scene)
+}
+
+func deleteSceneHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	if !authorize(w, r, internal.ActionAdmin, internal.Device{}, "") {
+		return
+	}
+
+	deleted, err := dbClient.DeleteScene(r.PathValue("name"))
+	if errors.Is(err, internal.ErrSceneInUse) {
+		http.Error(w, "Scene is activated by a rule, delete the rule first", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete scene", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Scene not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// activateSceneHandler sends the commands of a scene and replies with their message IDs.
+func activateSceneHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	commands, err := activateScene(r.Context(), dbClient, r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(commands)
+}
+
+// activateScene publishes a command for every action of a scene. The caller must be allowed to control
+// each device before any command is sent; when a publish fails, the commands before it stay sent.
+func activateScene(ctx context.Context, dbClient *internal.PostgreSQLClient, name string) ([]internal.SceneCommand, error) {
+	scene, err := dbClient.GetScene(name)
+	if err != nil {
+		return nil, &requestError{http.StatusInternalServerError, "Failed to get scene"}
+	}
+	if scene == nil {
+		return nil, &requestError{http.StatusNotFound, "Scene not found"}
+	}
+
+	commands := make([]internal.Command, 0, len(scene.Actions))
+	for _, action := range scene.Actions {
+		command, err := newCommand(ctx, dbClient, action.DeviceID, action.State)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, command)
+	}
+
+	sent := make([]internal.SceneCommand, 0, len(commands))
+	for _, command := range commands {
+		messageID, err := publishCommand(ctx, command)
+		if err != nil {
+			return nil, err
+		}
+		sent = append(sent, internal.SceneCommand{DeviceID: command.DeviceID, State: command.State, ID: messageID})
+	}
+	log.Printf("Scene %s activated", scene.Name)
+	return sent, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"smart-home-assistant/internal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Clients falling this far behind on a WebSocket write are disconnected.
+const websocketWriteTimeout = 10 * time.Second
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// subscribe registers a bus subscription from the request's "filter" query parameter and last event ID.
+func subscribe(w http.ResponseWriter, r *http.Request, bus *internal.EventBus) (*internal.Subscription, []internal.Event, bool) {
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		filter = "#"
+	}
+
+	// Browsers cannot set headers on WebSocket requests, so the ID may also come from the query string
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		var err error
+		lastID, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return nil, nil, false
+		}
+	}
+
+	sub, missed, err := bus.Subscribe(filter, lastID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filter: %v", err), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	return sub, missed, true
+}
+
+// deviceLookup looks up registered devices; PostgreSQLClient is one.
+type deviceLookup interface {
+	GetDevice(deviceID string) (*internal.Device, error)
+}
+
+// eventDevice returns the device an event on device_events is about, taken from the body of device
+// events and from the routing key of commands, heartbeats, registry events and telemetry.
+func eventDevice(event internal.Event) internal.Device {
+	parts := strings.Split(event.RoutingKey, ".")
+	switch parts[0] {
+	case "device":
+		device, err := internal.ParseDeviceEvent(amqp.Delivery{RoutingKey: event.RoutingKey, Body: []byte(event.Body)})
+		if err == nil {
+			return device
+		}
+	case "command", "heartbeat", "registry", "telemetry":
+		if len(parts) >= 3 {
+			return internal.Device{ID: parts[len(parts)-1], Type: parts[len(parts)-2]}
+		}
+	}
+	return internal.Device{}
+}
+
+// canReadEvent reports whether the caller may read the device an event is about. The registered
+// device is checked, so events cannot claim another room; events whose device cannot be identified or
+// whose access cannot be checked are not streamed.
+func canReadEvent(ctx context.Context, devices deviceLookup, event internal.Event) bool {
+	if accessControl == nil {
+		return true
+	}
+	device := eventDevice(event)
+	if device.ID == "" {
+		return false
+	}
+	registered, err := devices.GetDevice(device.ID)
+	if err != nil {
+		log.Printf("Failed to get device %s of event %d: %v", device.ID, event.ID, err)
+		return false
+	}
+	if registered != nil {
+		device = *registered
+	}
+	allowed, err := accessControl.CanRead(ctx, device)
+	if err != nil {
+		log.Printf("Failed to check access to event %d: %v", event.ID, err)
+		return false
+	}
+	return allowed
+}
+
+// streamEventsHandler streams the device events the caller may read as Server-Sent Events.
+func streamEventsHandler(w http.ResponseWriter, r *http.Request, bus *internal.EventBus, dbClient deviceLookup, heartbeat time.Duration) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sub, missed, ok := subscribe(w, r, bus)
+	if !ok {
+		return
+	}
+	defer bus.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	writeEvent := func(event internal.Event) error {
+		if !canReadEvent(r.Context(), dbClient, event) {
+			return nil
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: device_event\ndata: %s\n\n", event.ID, data)
+		return err
+	}
+
+	for _, event := range missed {
+		if err := writeEvent(event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, open := <-sub.C:
+			if !open {
+				// Disconnected for falling behind, the client reconnects with its Last-Event-ID
+				log.Printf("Disconnecting slow SSE client %s", r.RemoteAddr)
+				return
+			}
+			if err := writeEvent(event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// websocketHandler streams the device events the caller may read as JSON text messages over a WebSocket.
+func websocketHandler(w http.ResponseWriter, r *http.Request, bus *internal.EventBus, dbClient deviceLookup, heartbeat time.Duration) {
+	sub, missed, ok := subscribe(w, r, bus)
+	if !ok {
+		return
+	}
+	defer bus.Unsubscribe(sub)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade WebSocket connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Read until the client goes away so control frames are processed and closes are noticed
+	closed := make(chan struct{})
+	conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	writeEvent := func(event internal.Event) error {
+		if !canReadEvent(r.Context(), dbClient, event) {
+			return nil
+		}
+		conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+		return conn.WriteJSON(event)
+	}
+
+	for _, event := range missed {
+		if err := writeEvent(event); err != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case event, open := <-sub.C:
+			if !open {
+				log.Printf("Disconnecting slow WebSocket client %s", r.RemoteAddr)
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"),
+					time.Now().Add(time.Second))
+				return
+			}
+			if err := writeEvent(event); err != nil {
+				return
+			}
+		case <-ticker.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteTimeout))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
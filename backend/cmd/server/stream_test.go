@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"smart-home-assistant/internal"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForSubscribers waits until the bus has the expected number of subscribers.
+func waitForSubscribers(t *testing.T, bus *internal.EventBus, n int) {
+	require.Eventually(t, func() bool { return bus.Subscribers() == n }, time.Second, 10*time.Millisecond)
+}
+
+func TestStreamEventsHandler(t *testing.T) {
+	bus := internal.NewEventBus(10, 10, internal.SlowClientDisconnect)
+	earlier := bus.Publish("device.tv.on", "application/json", []byte(`{"id":"tv1"}`), time.Now())
+	bus.Publish("device.tv.off", "application/json", []byte(`{"id":"tv1"}`), time.Now())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		streamEventsHandler(w, r, bus, nil, 50*time.Millisecond)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events/stream?filter=device.tv.%23", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "1")
+
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err, "should connect to the stream")
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	waitForSubscribers(t, bus, 1)
+	bus.Publish("device.heater.on", "application/json", []byte(`{"id":"heater1"}`), time.Now())
+	bus.Publish("device.tv.on", "application/json", []byte(`{"id":"tv1"}`), time.Now())
+
+	// Read the replayed event, the live event and at least one heartbeat
+	var ids []string
+	var events []internal.Event
+	heartbeat := false
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() && (len(events) < 2 || !heartbeat) {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		case strings.HasPrefix(line, "data: "):
+			var event internal.Event
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+			events = append(events, event)
+		case line == ": heartbeat":
+			heartbeat = true
+		}
+	}
+
+	require.Len(t, events, 2)
+	assert.Greater(t, events[0].ID, earlier.ID, "only events after Last-Event-ID should be replayed")
+	assert.Equal(t, "device.tv.off", events[0].RoutingKey)
+	assert.Equal(t, "device.tv.on", events[1].RoutingKey, "filtered out events should not be streamed")
+	assert.Equal(t, []string{"2", "4"}, ids)
+	assert.True(t, heartbeat, "heartbeats should be sent")
+
+	cancel()
+	waitForSubscribers(t, bus, 0)
+}
+
+func TestStreamEventsHandlerRejectsInvalidFilter(t *testing.T) {
+	bus := internal.NewEventBus(10, 10, internal.SlowClientDisconnect)
+
+	req := httptest.NewRequest(http.MethodGet, "/events/stream?filter=device..on", nil)
+	w := httptest.NewRecorder()
+	streamEventsHandler(w, req, bus, nil, time.Second)
+
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+	assert.Equal(t, 0, bus.Subscribers())
+}
+
+func TestWebsocketHandler(t *testing.T) {
+	bus := internal.NewEventBus(10, 10, internal.SlowClientDisconnect)
+	bus.Publish("device.tv.on", "application/json", []byte(`{"id":"tv1"}`), time.Now())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		websocketHandler(w, r, bus, nil, time.Second)
+	}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?filter=device.*.on&last_event_id=0"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err, "should open a WebSocket")
+	defer conn.Close()
+
+	waitForSubscribers(t, bus, 1)
+	bus.Publish("device.tv.off", "application/json", []byte(`{"id":"tv1"}`), time.Now())
+	bus.Publish("device.heater.on", "application/json", []byte(`{"id":"heater1"}`), time.Now())
+
+	var event internal.Event
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	require.NoError(t, conn.ReadJSON(&event), "should receive an event")
+	assert.Equal(t, "device.heater.on", event.RoutingKey)
+	assert.Equal(t, `{"id":"heater1"}`, event.Body)
+
+	conn.Close()
+	waitForSubscribers(t, bus, 0)
+}
+
+// guestAccessStore grants the guest reading a single device.
+type guestAccessStore struct{}
+
+func (guestAccessStore) GetUser(userID string) (*internal.User, error) {
+	return &internal.User{ID: userID, Role: internal.RoleGuest}, nil
+}
+
+func (guestAccessStore) ListPermissions(userID string) ([]internal.Permission, error) {
+	return []internal.Permission{{UserID: userID, DeviceID: "tv1", Action: internal.ActionRead, Allow: true}}, nil
+}
+
+func (guestAccessStore) InsertAuditEntry(entry internal.AuditEntry) error { return nil }
+
+// adultAccessStore denies the adult reading a single device.
+type adultAccessStore struct{}
+
+func (adultAccessStore) GetUser(userID string) (*internal.User, error) {
+	return &internal.User{ID: userID, Role: internal.RoleAdult}, nil
+}
+
+func (adultAccessStore) ListPermissions(userID string) ([]internal.Permission, error) {
+	return []internal.Permission{{UserID: userID, DeviceID: "lock1", Action: internal.ActionRead, Allow: false}}, nil
+}
+
+func (adultAccessStore) InsertAuditEntry(entry internal.AuditEntry) error { return nil }
+
+// deviceMap is a deviceLookup of registered devices.
+type deviceMap map[string]internal.Device
+
+func (m deviceMap) GetDevice(deviceID string) (*internal.Device, error) {
+	device, ok := m[deviceID]
+	if !ok {
+		return nil, nil
+	}
+	return &device, nil
+}
+
+func TestStreamEventsHandlerFiltersUnreadableDevices(t *testing.T) {
+	accessControl = internal.NewAccessControl(internal.AppConfig{}, guestAccessStore{})
+	defer func() { accessControl = nil }()
+	devices := deviceMap{
+		"tv1":   {ID: "tv1", Type: "tv", Room: "living_room"},
+		"lock1": {ID: "lock1", Type: "door_lock", Room: "hall"},
+	}
+
+	bus := internal.NewEventBus(10, 10, internal.SlowClientDisconnect)
+	bus.Publish("device.tv.standby", "text/plain", []byte("{tv1 tv standby living_room}"), time.Now())
+	bus.Publish("device.door_lock.unlocked", "text/plain", []byte("{lock1 door_lock unlocked hall}"), time.Now())
+	bus.Publish("device.tv.on", "text/plain", []byte("{tv1 tv on living_room}"), time.Now())
+	bus.Publish(internal.CommandRoutingKey("door_lock", "lock1"), "application/json", []byte(`{}`), time.Now())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(internal.WithPrincipal(r.Context(), internal.Principal{Subject: "nan"}))
+		streamEventsHandler(w, r, bus, devices, time.Minute)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events/stream", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "1")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	waitForSubscribers(t, bus, 1)
+	bus.Publish("device.door_lock.locked", "text/plain", []byte("{lock1 door_lock locked hall}"), time.Now())
+	bus.Publish(internal.TelemetryRoutingKey("door_lock", "lock1"), "application/json", []byte(`{}`), time.Now())
+	bus.Publish("alerts.smoke", "text/plain", []byte("smoke"), time.Now())
+	bus.Publish("device.tv.off", "text/plain", []byte("{tv1 tv off living_room}"), time.Now())
+	bus.Publish(internal.TelemetryRoutingKey("tv", "tv1"), "application/json", []byte(`{}`), time.Now())
+
+	var routingKeys []string
+	scanner := bufio.NewScanner(res.Body)
+	for len(routingKeys) < 3 && scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			var event internal.Event
+			require.NoError(t, json.Unmarshal([]byte(data), &event))
+			routingKeys = append(routingKeys, event.RoutingKey)
+		}
+	}
+	assert.Equal(t, []string{"device.tv.on", "device.tv.off", "telemetry.tv.tv1"}, routingKeys,
+		"events of devices the guest cannot read, or of no device, should be skipped")
+}
+
+func TestEventDevice(t *testing.T) {
+	assert.Equal(t, internal.Device{ID: "tv1", Type: "tv", State: "on", Room: "living_room"},
+		eventDevice(internal.Event{RoutingKey: "device.tv.on", Body: "{tv1 tv on living_room}"}))
+	assert.Equal(t, internal.Device{ID: "lock1", Type: "door_lock"},
+		eventDevice(internal.Event{RoutingKey: internal.RegistryRoutingKey(internal.RegistryCreated, "door_lock", "lock1")}))
+	assert.Equal(t, internal.Device{ID: "lock1", Type: "door_lock"},
+		eventDevice(internal.Event{RoutingKey: internal.HeartbeatRoutingKey("door_lock", "lock1")}))
+	assert.Equal(t, internal.Device{ID: "m1", Type: "meter"},
+		eventDevice(internal.Event{RoutingKey: internal.TelemetryRoutingKey("meter", "m1")}))
+	assert.Equal(t, internal.Device{}, eventDevice(internal.Event{RoutingKey: "alerts.smoke"}))
+}
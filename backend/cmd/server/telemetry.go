@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"smart-home-assistant/internal"
+	"strconv"
+	"time"
+)
+
+// Limits of the telemetry query endpoints
+const (
+	defaultReadingLimit = 1000
+	maxReadingLimit     = 10000
+	maxAggregateBuckets = 10000
+)
+
+func publishTelemetryHandler(w http.ResponseWriter, r *http.Request, dbClient deviceLookup) {
+	var reading internal.Reading
+	if err := json.NewDecoder(r.Body).Decode(&reading); err != nil {
+		http.Error(w, "Invalid reading format", http.StatusBadRequest)
+		return
+	}
+	if reading.Timestamp.IsZero() {
+		reading.Timestamp = time.Now()
+	}
+	if err := reading.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Readings are published with the registered type, and only for devices the caller controls
+	registered, err := dbClient.GetDevice(reading.DeviceID)
+	if err != nil {
+		http.Error(w, "Failed to get device", http.StatusInternalServerError)
+		return
+	}
+	if registered == nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if reading.DeviceType != registered.Type {
+		http.Error(w, "Device type does not match the registered device", http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, internal.ActionControl, *registered, "") {
+		return
+	}
+
+	msg, err := internal.CreateTelemetryMessage(reading)
+	if err != nil {
+		http.Error(w, "Invalid reading format", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), confirmTimeout)
+	defer cancel()
+	routingKey := internal.TelemetryRoutingKey(reading.DeviceType, reading.DeviceID)
+	if err := publisher.Send(ctx, internal.TelemetryExchange, routingKey, msg); err != nil {
+		log.Printf("Failed to publish reading for device %s: %v", reading.DeviceID, err)
+		status, message := publishErrorStatus(err)
+		http.Error(w, message, status)
+		return
+	}
+
+	// Readings are stored asynchronously by the telemetry consumer
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// telemetryQuery holds the parameters shared by the telemetry query endpoints.
+type telemetryQuery struct {
+	device *internal.Device
+	metric string
+	from   time.Time
+	to     time.Time
+}
+
+// parseTelemetryQuery reads the metric and time range of a telemetry query, replying with an error
+// when they are invalid or the caller may not read the device. The range defaults to the last 24 hours.
+func parseTelemetryQuery(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) (telemetryQuery, bool) {
+	device, err := dbClient.GetDevice(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Failed to get device", http.StatusInternalServerError)
+		return telemetryQuery{}, false
+	}
+	if device == nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return telemetryQuery{}, false
+	}
+	if !authorize(w, r, internal.ActionRead, *device, "") {
+		return telemetryQuery{}, false
+	}
+
+	query := telemetryQuery{device: device, metric: r.URL.Query().Get("metric"), to: time.Now()}
+	if query.metric == "" {
+		http.Error(w, "metric is required", http.StatusBadRequest)
+		return telemetryQuery{}, false
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if query.to, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid to, expected RFC 3339", http.StatusBadRequest)
+			return telemetryQuery{}, false
+		}
+	}
+	query.from = query.to.Add(-24 * time.Hour)
+	if value := r.URL.Query().Get("from"); value != "" {
+		if query.from, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid from, expected RFC 3339", http.StatusBadRequest)
+			return telemetryQuery{}, false
+		}
+	}
+	if !query.from.Before(query.to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return telemetryQuery{}, false
+	}
+	return query, true
+}
+
+func listReadingsHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	query, ok := parseTelemetryQuery(w, r, dbClient)
+	if !ok {
+		return
+	}
+
+	limit := defaultReadingLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxReadingLimit {
+			http.Error(w, fmt.Sprintf("Invalid limit, expected 1 to %d", maxReadingLimit), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	readings, err := dbClient.ListReadings(query.device.ID, query.metric, query.from, query.to, limit)
+	if err != nil {
+		log.Printf("Failed to list readings: %v", err)
+		http.Error(w, "Failed to list readings", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(readings)
+}
+
+func aggregateReadingsHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	query, ok := parseTelemetryQuery(w, r, dbClient)
+	if !ok {
+		return
+	}
+
+	interval := 5 * time.Minute
+	if value := r.URL.Query().Get("interval"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < time.Second {
+			http.Error(w, "Invalid interval, expected a duration of at least 1s", http.StatusBadRequest)
+			return
+		}
+		interval = parsed
+	}
+	if query.to.Sub(query.from)/interval > maxAggregateBuckets {
+		http.Error(w, "Too many intervals, use a longer interval or a shorter range", http.StatusBadRequest)
+		return
+	}
+
+	aggregates, err := dbClient.AggregateReadings(query.device.ID, query.metric, query.from, query.to, interval)
+	if err != nil {
+		log.Printf("Failed to aggregate readings: %v", err)
+		http.Error(w, "Failed to aggregate readings", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aggregates)
+}
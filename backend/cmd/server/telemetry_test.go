@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingPublisher records the routing keys of published messages.
+type recordingPublisher struct {
+	routingKeys []string
+	messages    []amqp091.Publishing
+}
+
+func (p *recordingPublisher) Send(ctx context.Context, exchange, routingKey string, msg amqp091.Publishing) error {
+	p.routingKeys = append(p.routingKeys, routingKey)
+	p.messages = append(p.messages, msg)
+	return nil
+}
+
+func TestPublishTelemetryHandler(t *testing.T) {
+	recorder := &recordingPublisher{}
+	original := publisher
+	publisher = recorder
+	defer func() { publisher = original }()
+
+	body := `{"device_id":"kitchen1","device_type":"thermometer","metric":"temperature","value":21.5,"unit":"C"}`
+	w := httptest.NewRecorder()
+	devices := deviceMap{"kitchen1": {ID: "kitchen1", Type: "thermometer"}}
+	publishTelemetryHandler(w, httptest.NewRequest(http.MethodPost, "/telemetry", bytes.NewBufferString(body)), devices)
+
+	assert.Equal(t, http.StatusAccepted, w.Code, "readings should be accepted for asynchronous storage")
+	require.Len(t, recorder.routingKeys, 1)
+	assert.Equal(t, "telemetry.thermometer.kitchen1", recorder.routingKeys[0])
+	assert.Equal(t, "application/json", recorder.messages[0].ContentType)
+
+	w = httptest.NewRecorder()
+	publishTelemetryHandler(w, httptest.NewRequest(http.MethodPost, "/telemetry", bytes.NewBufferString(`{"device_id":"kitchen1"}`)), devices)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "incomplete readings should be rejected")
+
+	w = httptest.NewRecorder()
+	spoofed := `{"device_id":"kitchen1","device_type":"door_lock","metric":"open","value":1}`
+	publishTelemetryHandler(w, httptest.NewRequest(http.MethodPost, "/telemetry", bytes.NewBufferString(spoofed)), devices)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "readings under another type should be rejected")
+
+	w = httptest.NewRecorder()
+	unknown := `{"device_id":"cellar1","device_type":"thermometer","metric":"temperature","value":12}`
+	publishTelemetryHandler(w, httptest.NewRequest(http.MethodPost, "/telemetry", bytes.NewBufferString(unknown)), devices)
+	assert.Equal(t, http.StatusNotFound, w.Code, "readings of unregistered devices should be rejected")
+	assert.Len(t, recorder.routingKeys, 1, "rejected readings should not be published")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"smart-home-assistant/internal"
+	"strconv"
+)
+
+func createUserHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	var user internal.User
+	err := json.NewDecoder(r.Body).Decode(&user)
+	if err != nil || user.ID == "" || !user.Role.Valid() {
+		http.Error(w, "Invalid user format", http.StatusBadRequest)
+		return
+	}
+
+	if !authorize(w, r, internal.ActionAdmin, internal.Device{}, "") {
+		return
+	}
+
+	err = dbClient.InsertUser(user)
+	if err != nil {
+		http.Error(w, "Failed to save user", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User saved: %s (%s)", user.ID, user.Role)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func createPermissionHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	var permission internal.Permission
+	err := json.NewDecoder(r.Body).Decode(&permission)
+	if err != nil {
+		http.Error(w, "Invalid permission format", http.StatusBadRequest)
+		return
+	}
+	permission.UserID = r.PathValue("id")
+
+	validAction := permission.Action == internal.ActionRead || permission.Action == internal.ActionControl
+	if !validAction || (permission.DeviceID == "") == (permission.Room == "") {
+		http.Error(w, "Permission needs a read or control action and exactly one of device_id or room", http.StatusBadRequest)
+		return
+	}
+
+	if !authorize(w, r, internal.ActionAdmin, internal.Device{}, "") {
+		return
+	}
+
+	user, err := dbClient.GetUser(permission.UserID)
+	if err != nil {
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	permission.ID, err = dbClient.InsertPermission(permission)
+	if err != nil {
+		http.Error(w, "Failed to save permission", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(permission)
+}
+
+func listPermissionsHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	if !authorize(w, r, internal.ActionAdmin, internal.Device{}, "") {
+		return
+	}
+
+	permissions, err := dbClient.ListPermissions(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Failed to list permissions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(permissions)
+}
+
+func listAuditHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	if !authorize(w, r, internal.ActionAdmin, internal.Device{}, "") {
+		return
+	}
+
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	entries, err := dbClient.ListAuditEntries(limit)
+	if err != nil {
+		http.Error(w, "Failed to list audit entries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
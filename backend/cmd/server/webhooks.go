@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"smart-home-assistant/internal"
+	"strconv"
+)
+
+// webhookSubscriptionID parses the subscription ID in the path, replying 404 when it is invalid.
+func webhookSubscriptionID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Webhook subscription not found", http.StatusNotFound)
+		return 0, false
+	}
+	return id, true
+}
+
+func createWebhookHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	var subscription internal.WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		http.Error(w, "Invalid webhook subscription format", http.StatusBadRequest)
+		return
+	}
+	if subscription.Filter == "" {
+		subscription.Filter = "#"
+	}
+	if err := subscription.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !authorize(w, r, internal.ActionAdmin, internal.Device{}, "") {
+		return
+	}
+
+	if subscription.Secret == "" {
+		subscription.Secret = internal.NewWebhookSecret()
+	}
+	subscription.Enabled = true
+	subscription.ConsecutiveFailures = 0
+	subscription.DisabledAt = nil
+	if err := dbClient.InsertWebhookSubscription(&subscription); err != nil {
+		http.Error(w, "Failed to save webhook subscription", http.StatusInternalServerError)
+		return
+	}
+
+	// The secret is only returned once, the subscriber needs it to verify signatures
+	log.Printf("Webhook subscription %d saved for %s", subscription.ID, subscription.Filter)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(subscription)
+}
+
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	if !authorize(w, r, internal.ActionAdmin, internal.Device{}, "") {
+		return
+	}
+
+	subscriptions, err := dbClient.ListWebhookSubscriptions()
+	if err != nil {
+		http.Error(w, "Failed to list webhook subscriptions", http.StatusInternalServerError)
+		return
+	}
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+func getWebhookHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	id, ok := webhookSubscriptionID(w, r)
+	if !ok || !authorize(w, r, internal.ActionAdmin, internal.Device{}, "") {
+		return
+	}
+
+	subscription, err := dbClient.GetWebhookSubscription(id)
+	if err != nil {
+		http.Error(w, "Failed to get webhook subscription", http.StatusInternalServerError)
+		return
+	}
+	if subscription == nil {
+		http.Error(w, "Webhook subscription not found", http.StatusNotFound)
+		return
+	}
+	subscription.Secret = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscription)
+}
+
+func updateWebhookHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	id, ok := webhookSubscriptionID(w, r)
+	if !ok {
+		return
+	}
+	var subscription internal.WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		http.Error(w, "Invalid webhook subscription format", http.StatusBadRequest)
+		return
+	}
+	subscription.ID = id
+	if subscription.Filter == "" {
+		subscription.Filter = "#"
+	}
+	if err := subscription.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !authorize(w, r, internal.ActionAdmin, internal.Device{}, "") {
+		return
+	}
+
+	updated, err := dbClient.UpdateWebhookSubscription(subscription)
+	if err != nil {
+		http.Error(w, "Failed to update webhook subscription", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		http.Error(w, "Webhook subscription not found", http.StatusNotFound)
+		return
+	}
+	getWebhookHandler(w, r, dbClient)
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	id, ok := webhookSubscriptionID(w, r)
+	if !ok || !authorize(w, r, internal.ActionAdmin, internal.Device{}, "") {
+		return
+	}
+
+	deleted, err := dbClient.DeleteWebhookSubscription(id)
+	if err != nil {
+		http.Error(w, "Failed to delete webhook subscription", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Webhook subscription not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request, dbClient *internal.PostgreSQLClient) {
+	id, ok := webhookSubscriptionID(w, r)
+	if !ok || !authorize(w, r, internal.ActionAdmin, internal.Device{}, "") {
+		return
+	}
+
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	subscription, err := dbClient.GetWebhookSubscription(id)
+	if err != nil {
+		http.Error(w, "Failed to get webhook subscription", http.StatusInternalServerError)
+		return
+	}
+	if subscription == nil {
+		http.Error(w, "Webhook subscription not found", http.StatusNotFound)
+		return
+	}
+
+	deliveries, err := dbClient.ListWebhookDeliveries(id, limit)
+	if err != nil {
+		http.Error(w, "Failed to list webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
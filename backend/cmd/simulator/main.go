@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"smart-home-assistant/internal"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func main() {
+	// Load the application configuration
+	config, err := internal.LoadAppConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	var scenario *internal.Scenario
+	if config.Simulator.Scenario != "" {
+		if scenario, err = internal.LoadScenario(config.Simulator.Scenario); err != nil {
+			log.Fatalf("Failed to load scenario: %v", err)
+		}
+	}
+
+	// Connect to RabbitMQ using values from the config
+	conn, err := internal.ConnectRabbitMQ(
+		config.RabbitMQ.User,
+		config.RabbitMQ.Password,
+		config.RabbitMQ.Host,
+		config.RabbitMQ.VHost,
+	)
+	if err != nil {
+		log.Fatalf("Failed to connect to RabbitMQ: %v", err)
+	}
+	defer conn.Close()
+
+	// Publish concurrently on a pool of confirm-mode channels, like the server
+	poolSize := config.Simulator.PoolSize
+	if poolSize <= 0 {
+		poolSize = config.RabbitMQ.PoolSize
+	}
+	if poolSize <= 0 {
+		poolSize = 8
+	}
+	pool, err := internal.NewPublisherPool([]*amqp.Connection{conn}, poolSize)
+	if err != nil {
+		log.Fatalf("Failed to initialize RabbitMQ publisher pool: %v", err)
+	}
+	defer pool.Close()
+
+	consumeClient, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to create RabbitMQ client: %v", err)
+	}
+	defer consumeClient.Close()
+
+	if err := consumeClient.CreateTopicExchange("device_events"); err != nil {
+		log.Fatalf("Failed to create exchange: %v", err)
+	}
+
+	// Registering the devices makes them visible to the API, so commands can be sent to them
+	var registry internal.DeviceRegistry
+	if config.Simulator.Register {
+		dbClient, err := internal.ConnectPostgreSQL(*config)
+		if err != nil {
+			log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+		}
+		defer dbClient.Close()
+		registry = dbClient
+	}
+
+	simulator, err := internal.NewSimulator(*config, pool, registry, scenario)
+	if err != nil {
+		log.Fatalf("Failed to create simulator: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if config.Simulator.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Simulator.Duration)
+		defer cancel()
+	}
+
+	if err := simulator.Register(ctx); err != nil {
+		log.Fatalf("Failed to register simulated devices: %v", err)
+	}
+
+	// Apply the commands sent to the simulated devices
+	queueName := config.Simulator.Queue
+	if queueName == "" {
+		queueName = "simulator_queue"
+	}
+	queue, err := consumeClient.CreateQueue(queueName)
+	if err != nil {
+		log.Fatalf("Failed to create queue: %v", err)
+	}
+	if err := consumeClient.CreateBinding(queue.Name, "command.#", "device_events"); err != nil {
+		log.Fatalf("Failed to create binding: %v", err)
+	}
+	if err := consumeClient.ApplyQos(16, false); err != nil {
+		log.Fatalf("Failed to set QoS: %v", err)
+	}
+	commands, err := consumeClient.ConsumeEventWithAck(queue.Name)
+	if err != nil {
+		log.Fatalf("Failed to consume commands: %v", err)
+	}
+	go simulator.HandleCommands(ctx, commands)
+
+	// Measure end-to-end latency on a queue of its own, so the pipeline's consumers are not affected
+	measureClient, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to create RabbitMQ client: %v", err)
+	}
+	defer measureClient.Close()
+	latencyQueue, err := measureClient.CreateTemporaryQueue()
+	if err != nil {
+		log.Fatalf("Failed to create queue: %v", err)
+	}
+	if err := measureClient.CreateBinding(latencyQueue.Name, "device.#", "device_events"); err != nil {
+		log.Fatalf("Failed to create binding: %v", err)
+	}
+	deliveries, err := measureClient.ConsumeEvent(latencyQueue.Name)
+	if err != nil {
+		log.Fatalf("Failed to consume device events: %v", err)
+	}
+	go simulator.MeasureDeliveries(deliveries)
+
+	reportInterval := config.Simulator.ReportInterval
+	if reportInterval <= 0 {
+		reportInterval = 10 * time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(reportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				log.Printf("Simulator %s", simulator.Stats().Report())
+			}
+		}
+	}()
+
+	log.Printf("Simulating %d devices, applying commands from queue %s", len(simulator.Devices()), queue.Name)
+	simulator.Run(ctx)
+	log.Printf("Simulation finished %s", simulator.Stats().Report())
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"smart-home-assistant/internal"
+	"time"
+)
+
+func main() {
+	// Load the application configuration
+	config, err := internal.LoadAppConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Connect to RabbitMQ using values from the config
+	conn, err := internal.ConnectRabbitMQ(
+		config.RabbitMQ.User,
+		config.RabbitMQ.Password,
+		config.RabbitMQ.Host,
+		config.RabbitMQ.VHost,
+	)
+	if err != nil {
+		log.Fatalf("Failed to connect to RabbitMQ: %v", err)
+	}
+	defer conn.Close()
+
+	client, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to create RabbitMQ client: %v", err)
+	}
+	defer client.Close()
+
+	// Connect to PostgreSQL, where readings are stored
+	dbClient, err := internal.ConnectPostgreSQL(*config)
+	if err != nil {
+		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+	}
+	defer dbClient.Close()
+
+	if err := dbClient.Migrate(); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	// Receive the readings of every device, e.g. "telemetry.thermometer.kitchen1"
+	queueName := config.Telemetry.Queue
+	if queueName == "" {
+		queueName = "telemetry_queue"
+	}
+	queue, err := client.CreateQueue(queueName)
+	if err != nil {
+		log.Fatalf("Failed to create queue: %v", err)
+	}
+	err = client.CreateBinding(queue.Name, "telemetry.#", internal.TelemetryExchange)
+	if err != nil {
+		log.Fatalf("Failed to create binding: %v", err)
+	}
+
+	// Allow a full batch to be delivered before it is acknowledged
+	batcher := internal.NewTelemetryBatcher(dbClient, config.Telemetry.BatchSize, config.Telemetry.FlushInterval)
+	batchSize := config.Telemetry.BatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	if err := client.ApplyQos(2*batchSize, false); err != nil {
+		log.Fatalf("Failed to set QoS: %v", err)
+	}
+
+	messages, err := client.ConsumeEventWithAck(queue.Name)
+	if err != nil {
+		log.Fatalf("Failed to consume telemetry: %v", err)
+	}
+
+	if config.Telemetry.MetricsPort != "" {
+		health := internal.NewHealth(config.Health.Timeout)
+		health.Add("rabbitmq", client.Check)
+		health.Add("postgres", dbClient.Ping)
+		internal.ServeMetrics(config.Telemetry.MetricsPort, health)
+	}
+
+	// Drop expired partitions and readings once an hour
+	go func() {
+		for ; ; time.Sleep(time.Hour) {
+			dropped, err := dbClient.ApplyTelemetryRetention(config.Telemetry.Retention, config.Telemetry.Policies, time.Now())
+			if err != nil {
+				log.Printf("Failed to apply telemetry retention: %v", err)
+			} else if dropped > 0 {
+				log.Printf("Dropped %d expired telemetry partitions", dropped)
+			}
+		}
+	}()
+
+	log.Printf("Storing telemetry from queue %s", queue.Name)
+	batcher.Run(messages)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log"
+	"smart-home-assistant/internal"
+)
+
+func main() {
+	// Load the application configuration
+	config, err := internal.LoadAppConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Connect to RabbitMQ using values from the config
+	conn, err := internal.ConnectRabbitMQ(
+		config.RabbitMQ.User,
+		config.RabbitMQ.Password,
+		config.RabbitMQ.Host,
+		config.RabbitMQ.VHost,
+	)
+	if err != nil {
+		log.Fatalf("Failed to connect to RabbitMQ: %v", err)
+	}
+	defer conn.Close()
+
+	client, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to create RabbitMQ client: %v", err)
+	}
+	defer client.Close()
+
+	// Connect to PostgreSQL, where subscriptions and deliveries are stored
+	dbClient, err := internal.ConnectPostgreSQL(*config)
+	if err != nil {
+		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+	}
+	defer dbClient.Close()
+
+	if err := dbClient.Migrate(); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	dispatcher := internal.NewWebhookDispatcher(*config, dbClient)
+
+	// Receive every device event, subscriptions filter them by routing key
+	queueName := config.Webhooks.Queue
+	if queueName == "" {
+		queueName = "webhooks_queue"
+	}
+	queue, err := client.CreateQueue(queueName)
+	if err != nil {
+		log.Fatalf("Failed to create queue: %v", err)
+	}
+	err = client.CreateBinding(queue.Name, "#", "device_events")
+	if err != nil {
+		log.Fatalf("Failed to create binding: %v", err)
+	}
+
+	// Deliver up to Webhooks.Concurrency events at the same time
+	if err := client.ApplyQos(dispatcher.Concurrency(), false); err != nil {
+		log.Fatalf("Failed to set QoS: %v", err)
+	}
+
+	messages, err := client.ConsumeEventWithAck(queue.Name)
+	if err != nil {
+		log.Fatalf("Failed to consume events: %v", err)
+	}
+
+	if config.Webhooks.MetricsPort != "" {
+		health := internal.NewHealth(config.Health.Timeout)
+		health.Add("rabbitmq", client.Check)
+		health.Add("postgres", dbClient.Ping)
+		internal.ServeMetrics(config.Webhooks.MetricsPort, health)
+	}
+
+	log.Printf("Delivering webhooks from queue %s", queue.Name)
+	dispatcher.Run(context.Background(), messages)
+}
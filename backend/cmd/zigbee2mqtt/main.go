@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+	"smart-home-assistant/internal"
+)
+
+func main() {
+	// Load the application configuration
+	config, err := internal.LoadAppConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Devices found in the Zigbee2MQTT inventory are registered in PostgreSQL
+	dbClient, err := internal.ConnectPostgreSQL(*config)
+	if err != nil {
+		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+	}
+	defer dbClient.Close()
+
+	// Connect to RabbitMQ using values from the config
+	conn, err := internal.ConnectRabbitMQ(
+		config.RabbitMQ.User,
+		config.RabbitMQ.Password,
+		config.RabbitMQ.Host,
+		config.RabbitMQ.VHost,
+	)
+	if err != nil {
+		log.Fatalf("Failed to connect to RabbitMQ: %v", err)
+	}
+	defer conn.Close()
+
+	// Publish and consume on separate channels, so waiting for confirms does not hold up deliveries
+	publishClient, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to create RabbitMQ client: %v", err)
+	}
+	defer publishClient.Close()
+
+	consumeClient, err := internal.NewRabbitMQClient(conn)
+	if err != nil {
+		log.Fatalf("Failed to create RabbitMQ client: %v", err)
+	}
+	defer consumeClient.Close()
+
+	if err := publishClient.CreateTopicExchange("device_events"); err != nil {
+		log.Fatalf("Failed to create exchange: %v", err)
+	}
+
+	adapter := internal.NewZigbeeAdapter(*config, publishClient, dbClient)
+	if err := adapter.Connect(); err != nil {
+		log.Fatalf("Failed to connect to MQTT broker: %v", err)
+	}
+	defer adapter.Close()
+
+	// Receive the commands, the adapter skips the ones for devices that are not in the inventory
+	queueName := config.Zigbee2MQTT.Queue
+	if queueName == "" {
+		queueName = "zigbee2mqtt_queue"
+	}
+	queue, err := consumeClient.CreateQueue(queueName)
+	if err != nil {
+		log.Fatalf("Failed to create queue: %v", err)
+	}
+	if err := consumeClient.CreateBinding(queue.Name, "command.#", "device_events"); err != nil {
+		log.Fatalf("Failed to create binding: %v", err)
+	}
+
+	if err := consumeClient.ApplyQos(16, false); err != nil {
+		log.Fatalf("Failed to set QoS: %v", err)
+	}
+
+	messages, err := consumeClient.ConsumeEventWithAck(queue.Name)
+	if err != nil {
+		log.Fatalf("Failed to consume commands: %v", err)
+	}
+
+	if config.Zigbee2MQTT.MetricsPort != "" {
+		health := internal.NewHealth(config.Health.Timeout)
+		health.Add("postgres", dbClient.Ping)
+		health.Add("rabbitmq", consumeClient.Check)
+		health.Add("mqtt", adapter.Check)
+		internal.ServeMetrics(config.Zigbee2MQTT.MetricsPort, health)
+	}
+
+	log.Printf("Sending commands from queue %s to Zigbee2MQTT on %s", queue.Name, config.MQTT.Broker)
+	adapter.Run(context.Background(), messages)
+}
@@ -1,9 +1,6 @@
 CREATE DATABASE smart_home_assistant;
-CREATE TABLE devices (
-    device_id VARCHAR PRIMARY KEY,
-    type VARCHAR NOT NULL,
-    state VARCHAR NOT NULL
-);
+
+-- Tables are created by the server on startup from internal/migrations
 
 CREATE USER your_user WITH PASSWORD 'your_password';
 GRANT ALL PRIVILEGES ON DATABASE smart_home_assistant TO your_user;
@@ -0,0 +1,4 @@
+// Package devicepb contains the protobuf messages and gRPC stubs of DeviceService.
+package devicepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative devices.proto
@@ -0,0 +1,353 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Role is the household role of a user.
+type Role string
+
+const (
+	RoleOwner Role = "owner" // Full access, manages users and permissions
+	RoleAdult Role = "adult" // Reads, controls and registers all devices
+	RoleChild Role = "child" // Reads and controls devices within the configured limits
+	RoleGuest Role = "guest" // Only the devices or rooms explicitly granted, until the access expires
+)
+
+// Valid reports whether r is one of the known roles.
+func (r Role) Valid() bool {
+	switch r {
+	case RoleOwner, RoleAdult, RoleChild, RoleGuest:
+		return true
+	}
+	return false
+}
+
+// Actions checked by the access control.
+const (
+	ActionRead    = "read"    // Read device information
+	ActionControl = "control" // Change a device state
+	ActionManage  = "manage"  // Register and delete devices
+	ActionAdmin   = "admin"   // Manage users and permissions
+)
+
+// ErrAccessDenied is returned when a user is not allowed to perform an action.
+var ErrAccessDenied = errors.New("access denied")
+
+// User is a household member, identified by the subject of their credentials.
+type User struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Role      Role       `json:"role"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Access ends at this time, used for guests
+}
+
+// Permission grants or denies a user an action on a single device or on every device in a room.
+type Permission struct {
+	ID        int64      `json:"id"`
+	UserID    string     `json:"user_id"`
+	DeviceID  string     `json:"device_id,omitempty"`
+	Room      string     `json:"room,omitempty"`
+	Action    string     `json:"action"` // ActionRead or ActionControl, control implies read
+	Allow     bool       `json:"allow"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// AuditEntry records an access control decision.
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	UserID    string    `json:"user_id"`
+	Action    string    `json:"action"`
+	DeviceID  string    `json:"device_id,omitempty"`
+	State     string    `json:"state,omitempty"`
+	Allowed   bool      `json:"allowed"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AccessStore provides the users and permissions evaluated by AccessControl.
+type AccessStore interface {
+	GetUser(userID string) (*User, error)
+	ListPermissions(userID string) ([]Permission, error)
+	InsertAuditEntry(entry AuditEntry) error
+}
+
+// AccessControl evaluates role based access for the principal of a request.
+type AccessControl struct {
+	store  AccessStore
+	limits []AccessLimit
+	now    func() time.Time
+}
+
+// NewAccessControl creates an AccessControl using the limits from the Access configuration.
+func NewAccessControl(config AppConfig, store AccessStore) *AccessControl {
+	return &AccessControl{
+		store:  store,
+		limits: config.Access.Limits,
+		now:    time.Now,
+	}
+}
+
+// Authorize checks whether the principal in ctx may perform action on device, setting state for ActionControl.
+// Denials are recorded in the audit log. Requests without a principal (authentication disabled) are allowed.
+func (ac *AccessControl) Authorize(ctx context.Context, action string, device Device, state string) error {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	allowed, reason, err := ac.check(principal.Subject, action, device, state)
+	if err != nil {
+		return err
+	}
+	if allowed {
+		return nil
+	}
+
+	entry := AuditEntry{
+		UserID:   principal.Subject,
+		Action:   action,
+		DeviceID: device.ID,
+		State:    state,
+		Allowed:  false,
+		Reason:   reason,
+	}
+	if err := ac.store.InsertAuditEntry(entry); err != nil {
+		log.Printf("Failed to record access denial for %s: %v", principal.Subject, err)
+	}
+	return fmt.Errorf("%w: %s", ErrAccessDenied, reason)
+}
+
+// CanRead reports whether the principal in ctx may read device, without recording denials.
+func (ac *AccessControl) CanRead(ctx context.Context, device Device) (bool, error) {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return true, nil
+	}
+	allowed, _, err := ac.check(principal.Subject, ActionRead, device, "")
+	return allowed, err
+}
+
+// check evaluates the rules for a user and returns the decision with its reason.
+func (ac *AccessControl) check(userID, action string, device Device, state string) (bool, string, error) {
+	user, err := ac.store.GetUser(userID)
+	if err != nil {
+		return false, "", err
+	}
+	if user == nil {
+		return false, "unknown user", nil
+	}
+
+	now := ac.now()
+	if user.ExpiresAt != nil && !now.Before(*user.ExpiresAt) {
+		return false, "access expired", nil
+	}
+
+	switch {
+	case user.Role == RoleOwner:
+		return true, "owner", nil
+	case action == ActionAdmin:
+		return false, "only owners can manage users", nil
+	case action == ActionManage && user.Role != RoleAdult:
+		return false, fmt.Sprintf("role %s cannot register devices", user.Role), nil
+	}
+
+	permissions, err := ac.store.ListPermissions(userID)
+	if err != nil {
+		return false, "", err
+	}
+
+	// Managing a device changes it, so whatever denies controlling it denies managing it as well
+	checked := action
+	if action == ActionManage {
+		checked = ActionControl
+	}
+
+	// Explicit denials win over grants, grants win over the role defaults
+	granted := false
+	for _, permission := range permissions {
+		if !permission.matches(checked, device, now) {
+			continue
+		}
+		if !permission.Allow {
+			return false, "denied by permission", nil
+		}
+		granted = true
+	}
+	if action == ActionManage {
+		return true, "adult", nil
+	}
+	if !granted && user.Role == RoleGuest {
+		return false, "no permission granted", nil
+	}
+
+	if action == ActionControl {
+		if reason, ok := ac.withinLimits(user.Role, device.Type, state); !ok {
+			return false, reason, nil
+		}
+	}
+	return true, "allowed", nil
+}
+
+// matches reports whether the permission applies to the action on device at the given time.
+func (p Permission) matches(action string, device Device, now time.Time) bool {
+	if p.ExpiresAt != nil && !now.Before(*p.ExpiresAt) {
+		return false
+	}
+	if p.Action != action && !p.implies(action) {
+		return false
+	}
+	if p.DeviceID != "" {
+		return p.DeviceID == device.ID
+	}
+	return p.Room != "" && p.Room == device.Room
+}
+
+// implies reports whether the permission also covers action: granting control grants reading, and
+// denying reading denies control, while denying control leaves reading allowed.
+func (p Permission) implies(action string) bool {
+	if p.Allow {
+		return p.Action == ActionControl && action == ActionRead
+	}
+	return p.Action == ActionRead && action == ActionControl
+}
+
+// withinLimits checks state against the configured limits for the role and device type.
+func (ac *AccessControl) withinLimits(role Role, deviceType, state string) (string, bool) {
+	for _, limit := range ac.limits {
+		if Role(limit.Role) != role || limit.DeviceType != deviceType {
+			continue
+		}
+		if slices.Contains(limit.DeniedStates, state) {
+			return fmt.Sprintf("role %s cannot set %s to %s", role, deviceType, state), false
+		}
+
+		value, err := strconv.ParseFloat(state, 64)
+		if err != nil {
+			continue // Numeric limits only apply to numeric states
+		}
+		if (limit.Min != nil && value < *limit.Min) || (limit.Max != nil && value > *limit.Max) {
+			return fmt.Sprintf("%s %s is outside the limits for role %s", deviceType, state, role), false
+		}
+	}
+	return "", true
+}
+
+// InsertUser adds or replaces a user.
+func (p *PostgreSQLClient) InsertUser(user User) error {
+	query := `INSERT INTO users (user_id, name, role, expires_at) VALUES ($1, $2, $3, $4)
+              ON CONFLICT (user_id) DO UPDATE SET name = EXCLUDED.name, role = EXCLUDED.role, expires_at = EXCLUDED.expires_at`
+
+	_, err := p.DB.Exec(query, user.ID, user.Name, string(user.Role), user.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert user: %w", err)
+	}
+	return nil
+}
+
+// GetUser retrieves a user by ID.
+func (p *PostgreSQLClient) GetUser(userID string) (*User, error) {
+	query := `SELECT user_id, name, role, expires_at FROM users WHERE user_id = $1`
+	row := p.DB.QueryRow(query, userID)
+
+	var user User
+	var expiresAt sql.NullTime
+	err := row.Scan(&user.ID, &user.Name, &user.Role, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No user found
+		}
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if expiresAt.Valid {
+		user.ExpiresAt = &expiresAt.Time
+	}
+	return &user, nil
+}
+
+// InsertPermission adds a permission for a user and returns its ID.
+func (p *PostgreSQLClient) InsertPermission(permission Permission) (int64, error) {
+	query := `INSERT INTO permissions (user_id, device_id, room, action, allow, expires_at)
+              VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, $5, $6) RETURNING id`
+
+	var id int64
+	err := p.DB.QueryRow(query, permission.UserID, permission.DeviceID, permission.Room,
+		permission.Action, permission.Allow, permission.ExpiresAt).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert permission: %w", err)
+	}
+	return id, nil
+}
+
+// ListPermissions retrieves the permissions of a user.
+func (p *PostgreSQLClient) ListPermissions(userID string) ([]Permission, error) {
+	query := `SELECT id, user_id, COALESCE(device_id, ''), COALESCE(room, ''), action, allow, expires_at
+              FROM permissions WHERE user_id = $1 ORDER BY id`
+	rows, err := p.DB.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list permissions: %w", err)
+	}
+	defer rows.Close()
+
+	permissions := []Permission{}
+	for rows.Next() {
+		var permission Permission
+		var expiresAt sql.NullTime
+		err := rows.Scan(&permission.ID, &permission.UserID, &permission.DeviceID, &permission.Room,
+			&permission.Action, &permission.Allow, &expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan permission: %w", err)
+		}
+		if expiresAt.Valid {
+			permission.ExpiresAt = &expiresAt.Time
+		}
+		permissions = append(permissions, permission)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list permissions: %w", err)
+	}
+	return permissions, nil
+}
+
+// InsertAuditEntry appends an entry to the audit trail.
+func (p *PostgreSQLClient) InsertAuditEntry(entry AuditEntry) error {
+	query := `INSERT INTO audit_log (user_id, action, device_id, state, allowed, reason) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := p.DB.Exec(query, entry.UserID, entry.Action, entry.DeviceID, entry.State, entry.Allowed, entry.Reason)
+	if err != nil {
+		return fmt.Errorf("failed to insert audit entry: %w", err)
+	}
+	return nil
+}
+
+// ListAuditEntries retrieves the most recent audit entries, newest first.
+func (p *PostgreSQLClient) ListAuditEntries(limit int) ([]AuditEntry, error) {
+	query := `SELECT id, user_id, action, device_id, state, allowed, reason, created_at
+              FROM audit_log ORDER BY id DESC LIMIT $1`
+	rows, err := p.DB.Query(query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit entries: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		err := rows.Scan(&entry.ID, &entry.UserID, &entry.Action, &entry.DeviceID, &entry.State,
+			&entry.Allowed, &entry.Reason, &entry.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list audit entries: %w", err)
+	}
+	return entries, nil
+}
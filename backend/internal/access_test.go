@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockAccessStore is an in-memory AccessStore recording audit entries.
+type mockAccessStore struct {
+	users       map[string]User
+	permissions map[string][]Permission
+	audit       []AuditEntry
+}
+
+func (m *mockAccessStore) GetUser(userID string) (*User, error) {
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, nil
+	}
+	return &user, nil
+}
+
+func (m *mockAccessStore) ListPermissions(userID string) ([]Permission, error) {
+	return m.permissions[userID], nil
+}
+
+func (m *mockAccessStore) InsertAuditEntry(entry AuditEntry) error {
+	m.audit = append(m.audit, entry)
+	return nil
+}
+
+func newTestAccessControl(now time.Time) (*AccessControl, *mockAccessStore) {
+	low, high := 18.0, 24.0
+	var config AppConfig
+	config.Access.Limits = []AccessLimit{
+		{Role: "child", DeviceType: "alarm", DeniedStates: []string{"disarmed"}},
+		{Role: "child", DeviceType: "thermostat", Min: &low, Max: &high},
+	}
+
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	store := &mockAccessStore{
+		users: map[string]User{
+			"mum":         {ID: "mum", Role: RoleOwner},
+			"dad":         {ID: "dad", Role: RoleAdult},
+			"kid":         {ID: "kid", Role: RoleChild},
+			"teen":        {ID: "teen", Role: RoleChild},
+			"lodger":      {ID: "lodger", Role: RoleAdult},
+			"nan":         {ID: "nan", Role: RoleGuest, ExpiresAt: &future},
+			"old-visitor": {ID: "old-visitor", Role: RoleGuest, ExpiresAt: &past},
+		},
+		permissions: map[string][]Permission{
+			"kid":  {{UserID: "kid", DeviceID: "tv1", Action: ActionControl, Allow: false}},
+			"teen": {{UserID: "teen", DeviceID: "thermo1", Action: ActionRead, Allow: false}},
+			"lodger": {
+				{UserID: "lodger", DeviceID: "tv1", Action: ActionControl, Allow: false},
+				{UserID: "lodger", Room: "hall", Action: ActionRead, Allow: false},
+			},
+			"nan": {
+				{UserID: "nan", Room: "living_room", Action: ActionControl, Allow: true},
+				{UserID: "nan", DeviceID: "heater1", Action: ActionControl, Allow: true, ExpiresAt: &past},
+			},
+		},
+	}
+
+	ac := NewAccessControl(config, store)
+	ac.now = func() time.Time { return now }
+	return ac, store
+}
+
+func asUser(userID string) context.Context {
+	return WithPrincipal(context.Background(), Principal{Subject: userID})
+}
+
+func TestAuthorize(t *testing.T) {
+	ac, store := newTestAccessControl(time.Now())
+
+	alarm := Device{ID: "alarm1", Type: "alarm", Room: "hall"}
+	thermostat := Device{ID: "thermo1", Type: "thermostat", Room: "living_room"}
+	tv := Device{ID: "tv1", Type: "tv", Room: "living_room"}
+	heater := Device{ID: "heater1", Type: "heater", Room: "bedroom"}
+
+	tests := []struct {
+		name    string
+		user    string
+		action  string
+		device  Device
+		state   string
+		allowed bool
+	}{
+		{"owner disarms alarm", "mum", ActionControl, alarm, "disarmed", true},
+		{"owner manages users", "mum", ActionAdmin, Device{}, "", true},
+		{"adult disarms alarm", "dad", ActionControl, alarm, "disarmed", true},
+		{"adult registers device", "dad", ActionManage, tv, "", true},
+		{"adult cannot manage users", "dad", ActionAdmin, Device{}, "", false},
+		{"child arms alarm", "kid", ActionControl, alarm, "armed", true},
+		{"child cannot disarm alarm", "kid", ActionControl, alarm, "disarmed", false},
+		{"child sets thermostat within limits", "kid", ActionControl, thermostat, "21", true},
+		{"child cannot set thermostat above limit", "kid", ActionControl, thermostat, "30", false},
+		{"child cannot set thermostat below limit", "kid", ActionControl, thermostat, "10", false},
+		{"child denied device by permission", "kid", ActionControl, tv, "on", false},
+		{"child cannot register device", "kid", ActionManage, tv, "", false},
+		{"guest controls granted room", "nan", ActionControl, tv, "on", true},
+		{"guest reads granted room", "nan", ActionRead, thermostat, "", true},
+		{"guest cannot use ungranted device", "nan", ActionRead, alarm, "", false},
+		{"guest grant expired", "nan", ActionControl, heater, "on", false},
+		{"expired guest", "old-visitor", ActionRead, tv, "", false},
+		{"unknown user", "stranger", ActionRead, tv, "", false},
+		{"child denied control still reads device", "kid", ActionRead, tv, "", true},
+		{"child denied reading cannot control device", "teen", ActionControl, thermostat, "21", false},
+		{"child denied reading cannot read device", "teen", ActionRead, thermostat, "", false},
+		{"adult denied control cannot manage device", "lodger", ActionManage, tv, "", false},
+		{"adult denied reading room cannot manage device in it", "lodger", ActionManage, alarm, "", false},
+		{"adult with denials manages other devices", "lodger", ActionManage, heater, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ac.Authorize(asUser(tt.user), tt.action, tt.device, tt.state)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, ErrAccessDenied), "expected access denied, got %v", err)
+			}
+		})
+	}
+
+	// Every denial is recorded in the audit trail
+	denied := 0
+	for _, tt := range tests {
+		if !tt.allowed {
+			denied++
+		}
+	}
+	require.Len(t, store.audit, denied, "each denial should be audited")
+	assert.Equal(t, "kid", store.audit[1].UserID)
+	assert.Equal(t, "disarmed", store.audit[1].State)
+	assert.False(t, store.audit[1].Allowed)
+}
+
+func TestAuthorizeWithoutPrincipal(t *testing.T) {
+	ac, store := newTestAccessControl(time.Now())
+
+	err := ac.Authorize(context.Background(), ActionControl, Device{ID: "alarm1", Type: "alarm"}, "disarmed")
+	assert.NoError(t, err, "requests without a principal are not subject to access control")
+	assert.Empty(t, store.audit)
+}
+
+func TestGuestAccessExpires(t *testing.T) {
+	now := time.Now()
+	ac, _ := newTestAccessControl(now)
+	tv := Device{ID: "tv1", Type: "tv", Room: "living_room"}
+
+	ok, err := ac.CanRead(asUser("nan"), tv)
+	require.NoError(t, err)
+	assert.True(t, ok, "guest should have access before expiry")
+
+	ac.now = func() time.Time { return now.Add(2 * time.Hour) }
+	ok, err = ac.CanRead(asUser("nan"), tv)
+	require.NoError(t, err)
+	assert.False(t, ok, "guest access should expire automatically")
+}
+
+func TestUserPermissionsAndAudit(t *testing.T) {
+	expiresAt := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	user := User{ID: "guest-" + time.Now().Format("150405.000000"), Name: "Visitor", Role: RoleGuest, ExpiresAt: &expiresAt}
+	err := testDB.InsertUser(user)
+	require.NoError(t, err, "Failed to insert user")
+
+	fetchedUser, err := testDB.GetUser(user.ID)
+	require.NoError(t, err, "Failed to get user")
+	require.NotNil(t, fetchedUser, "Expected user to be found")
+	assert.Equal(t, user.Role, fetchedUser.Role, "Role should match")
+	require.NotNil(t, fetchedUser.ExpiresAt, "Expiry should be stored")
+	assert.True(t, expiresAt.Equal(*fetchedUser.ExpiresAt), "Expiry should match")
+
+	_, err = testDB.InsertPermission(Permission{UserID: user.ID, Room: "kitchen", Action: ActionControl, Allow: true})
+	require.NoError(t, err, "Failed to insert permission")
+
+	permissions, err := testDB.ListPermissions(user.ID)
+	require.NoError(t, err, "Failed to list permissions")
+	require.Len(t, permissions, 1, "Expected one permission")
+	assert.Equal(t, "kitchen", permissions[0].Room, "Room should match")
+	assert.Empty(t, permissions[0].DeviceID, "Device should be empty for room permissions")
+
+	err = testDB.InsertAuditEntry(AuditEntry{UserID: user.ID, Action: ActionControl, DeviceID: "alarm1", State: "disarmed", Reason: "test"})
+	require.NoError(t, err, "Failed to insert audit entry")
+
+	entries, err := testDB.ListAuditEntries(1)
+	require.NoError(t, err, "Failed to list audit entries")
+	require.Len(t, entries, 1, "Expected one audit entry")
+	assert.Equal(t, user.ID, entries[0].UserID, "Newest audit entry should be returned first")
+}
@@ -0,0 +1,273 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lib/pq"
+)
+
+// Scopes enforced by the HTTP server.
+const (
+	ScopeDevicesRead        = "devices:read"
+	ScopeDevicesWrite       = "devices:write"
+	ScopeEventsPublish      = "events:publish"
+	ScopeUsersAdmin         = "users:admin"
+	ScopeNotificationsRead  = "notifications:read"
+	ScopeNotificationsWrite = "notifications:write"
+	ScopeWebhooksManage     = "webhooks:manage"
+)
+
+// Scopes lists every scope an API key can be granted.
+var Scopes = []string{
+	ScopeDevicesRead, ScopeDevicesWrite, ScopeEventsPublish, ScopeUsersAdmin,
+	ScopeNotificationsRead, ScopeNotificationsWrite, ScopeWebhooksManage,
+}
+
+// APIKeyHeader is the request header carrying an API key.
+const APIKeyHeader = "X-API-Key"
+
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject string   // API key name or JWT subject
+	Scopes  []string // Granted scopes
+}
+
+// HasScope reports whether the principal was granted the given scope.
+func (p Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the principal.
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the principal stored by the auth middleware, if any.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// APIKeyStore looks up API keys by the SHA-256 hash of their plaintext value.
+type APIKeyStore interface {
+	FindAPIKey(keyHash string) (*Principal, error)
+}
+
+// Authenticator validates API keys and JWT bearer tokens on incoming requests.
+type Authenticator struct {
+	Enabled  bool
+	keys     APIKeyStore
+	method   jwt.SigningMethod
+	key      interface{} // []byte for HS256, *rsa.PublicKey for RS256
+	issuer   string
+	audience string
+}
+
+// NewAuthenticator builds an Authenticator from the Auth configuration, reading any key files it references.
+func NewAuthenticator(config AppConfig, keys APIKeyStore) (*Authenticator, error) {
+	authConfig := config.Auth
+	a := &Authenticator{
+		Enabled:  authConfig.Enabled,
+		keys:     keys,
+		issuer:   authConfig.JWT.Issuer,
+		audience: authConfig.JWT.Audience,
+	}
+
+	switch strings.ToUpper(authConfig.JWT.Algorithm) {
+	case "":
+		// JWT validation disabled, only API keys are accepted
+	case "HS256":
+		secret, err := os.ReadFile(authConfig.JWT.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWT secret file: %w", err)
+		}
+		a.method = jwt.SigningMethodHS256
+		a.key = []byte(strings.TrimSpace(string(secret)))
+	case "RS256":
+		pem, err := os.ReadFile(authConfig.JWT.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWT public key file: %w", err)
+		}
+		publicKey, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse JWT public key: %w", err)
+		}
+		a.method = jwt.SigningMethodRS256
+		a.key = publicKey
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", authConfig.JWT.Algorithm)
+	}
+	return a, nil
+}
+
+// Authenticate resolves the principal from the X-API-Key header or an Authorization bearer token.
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	return a.AuthenticateCredentials(r.Header.Get(APIKeyHeader), r.Header.Get("Authorization"))
+}
+
+// AuthenticateCredentials resolves the principal from an API key or, when it is empty, from the value
+// of an Authorization header.
+func (a *Authenticator) AuthenticateCredentials(key, header string) (*Principal, error) {
+	if key != "" {
+		if a.keys == nil {
+			return nil, ErrInvalidCredentials
+		}
+		principal, err := a.keys.FindAPIKey(HashAPIKey(key))
+		if err != nil {
+			return nil, err
+		}
+		if principal == nil {
+			return nil, ErrInvalidCredentials
+		}
+		return principal, nil
+	}
+
+	if header == "" {
+		return nil, ErrMissingCredentials
+	}
+	token, found := strings.CutPrefix(header, "Bearer ")
+	if !found || a.method == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return a.parseToken(token)
+}
+
+// tokenClaims are the JWT claims understood by HomeBunny; scopes use the space separated OAuth "scope" claim.
+type tokenClaims struct {
+	Scope string `json:"scope"`
+	jwt.RegisteredClaims
+}
+
+func (a *Authenticator) parseToken(token string) (*Principal, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{a.method.Alg()}),
+		jwt.WithExpirationRequired(),
+	}
+	if a.issuer != "" {
+		options = append(options, jwt.WithIssuer(a.issuer))
+	}
+	if a.audience != "" {
+		options = append(options, jwt.WithAudience(a.audience))
+	}
+
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return a.key, nil
+	}, options...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	return &Principal{Subject: claims.Subject, Scopes: strings.Fields(claims.Scope)}, nil
+}
+
+// Require wraps a handler so it is only called for requests authenticated with the given scope.
+func (a *Authenticator) Require(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled {
+			next(w, r)
+			return
+		}
+
+		principal, err := a.Authenticate(r)
+		if err != nil {
+			if !errors.Is(err, ErrMissingCredentials) && !errors.Is(err, ErrInvalidCredentials) {
+				log.Printf("Authentication failed: %v", err)
+				http.Error(w, "Failed to authenticate request", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="homebunny"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !principal.HasScope(scope) {
+			http.Error(w, fmt.Sprintf("Missing scope %s", scope), http.StatusForbidden)
+			return
+		}
+
+		next(w, r.WithContext(WithPrincipal(r.Context(), *principal)))
+	}
+}
+
+// HashAPIKey returns the hex encoded SHA-256 hash under which an API key is stored.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateAPIKey returns a new random API key in plaintext.
+func GenerateAPIKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	return "hb_" + hex.EncodeToString(buf), nil
+}
+
+// CreateAPIKey stores a new API key with the given scopes and returns its plaintext value.
+// The plaintext is not persisted and cannot be recovered later.
+func (p *PostgreSQLClient) CreateAPIKey(name string, scopes []string) (string, error) {
+	key, err := GenerateAPIKey()
+	if err != nil {
+		return "", err
+	}
+
+	query := `INSERT INTO api_keys (name, key_hash, scopes) VALUES ($1, $2, $3)`
+	_, err = p.DB.Exec(query, name, HashAPIKey(key), pq.Array(scopes))
+	if err != nil {
+		return "", fmt.Errorf("failed to insert API key: %w", err)
+	}
+	return key, nil
+}
+
+// FindAPIKey looks up a non-revoked API key by its hash.
+func (p *PostgreSQLClient) FindAPIKey(keyHash string) (*Principal, error) {
+	query := `SELECT name, scopes FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL`
+	row := p.DB.QueryRow(query, keyHash)
+
+	var principal Principal
+	err := row.Scan(&principal.Subject, pq.Array(&principal.Scopes))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Unknown or revoked key
+		}
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+	return &principal, nil
+}
+
+// RevokeAPIKey revokes the API key with the given name. It reports false when no active key has the name.
+func (p *PostgreSQLClient) RevokeAPIKey(name string) (bool, error) {
+	query := `UPDATE api_keys SET revoked_at = NOW() WHERE name = $1 AND revoked_at IS NULL`
+	result, err := p.DB.Exec(query, name)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	return revoked > 0, nil
+}
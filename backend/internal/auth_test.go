@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockKeyStore is an in-memory APIKeyStore keyed by hash.
+type mockKeyStore map[string]Principal
+
+func (m mockKeyStore) FindAPIKey(keyHash string) (*Principal, error) {
+	p, ok := m[keyHash]
+	if !ok {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+// newTestAuthenticator writes the secret to a temp file and builds an HS256 Authenticator.
+func newTestAuthenticator(t *testing.T, secret string, keys APIKeyStore) *Authenticator {
+	secretFile := filepath.Join(t.TempDir(), "jwt_secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte(secret+"\n"), 0600))
+
+	var config AppConfig
+	config.Auth.Enabled = true
+	config.Auth.JWT.Algorithm = "HS256"
+	config.Auth.JWT.SecretFile = secretFile
+	config.Auth.JWT.Issuer = "homebunny"
+	config.Auth.JWT.Audience = "homebunny-api"
+
+	auth, err := NewAuthenticator(config, keys)
+	require.NoError(t, err, "should create authenticator")
+	return auth
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, claims tokenClaims) string {
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	require.NoError(t, err, "should sign token")
+	return token
+}
+
+func validClaims(scope string) tokenClaims {
+	return tokenClaims{
+		Scope: scope,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "kay",
+			Issuer:    "homebunny",
+			Audience:  jwt.ClaimStrings{"homebunny-api"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+}
+
+// serve runs the request through a handler protected by the given scope and returns the status code.
+func serve(auth *Authenticator, scope string, req *http.Request) int {
+	w := httptest.NewRecorder()
+	auth.Require(scope, func(w http.ResponseWriter, r *http.Request) {
+		_, ok := PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusTeapot)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})(w, req)
+	return w.Result().StatusCode
+}
+
+func TestRequireHS256Token(t *testing.T) {
+	auth := newTestAuthenticator(t, "s3cr3t", nil)
+
+	tests := []struct {
+		name   string
+		claims func() tokenClaims
+		secret string
+		status int
+	}{
+		{"valid token", func() tokenClaims { return validClaims("devices:read events:publish") }, "s3cr3t", http.StatusOK},
+		{"missing scope", func() tokenClaims { return validClaims("devices:read") }, "s3cr3t", http.StatusForbidden},
+		{"wrong secret", func() tokenClaims { return validClaims("events:publish") }, "other", http.StatusUnauthorized},
+		{"wrong audience", func() tokenClaims {
+			c := validClaims("events:publish")
+			c.Audience = jwt.ClaimStrings{"someone-else"}
+			return c
+		}, "s3cr3t", http.StatusUnauthorized},
+		{"wrong issuer", func() tokenClaims {
+			c := validClaims("events:publish")
+			c.Issuer = "evil"
+			return c
+		}, "s3cr3t", http.StatusUnauthorized},
+		{"expired", func() tokenClaims {
+			c := validClaims("events:publish")
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+			return c
+		}, "s3cr3t", http.StatusUnauthorized},
+		{"no expiry", func() tokenClaims {
+			c := validClaims("events:publish")
+			c.ExpiresAt = nil
+			return c
+		}, "s3cr3t", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/publish", nil)
+			req.Header.Set("Authorization", "Bearer "+signToken(t, jwt.SigningMethodHS256, []byte(tt.secret), tt.claims()))
+			assert.Equal(t, tt.status, serve(auth, ScopeEventsPublish, req))
+		})
+	}
+}
+
+func TestRequireRS256Token(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "should generate RSA key")
+	der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	require.NoError(t, err, "should marshal public key")
+
+	keyFile := filepath.Join(t.TempDir(), "jwt_public.pem")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+
+	var config AppConfig
+	config.Auth.Enabled = true
+	config.Auth.JWT.Algorithm = "RS256"
+	config.Auth.JWT.PublicKeyFile = keyFile
+	auth, err := NewAuthenticator(config, nil)
+	require.NoError(t, err, "should create authenticator")
+
+	req := httptest.NewRequest(http.MethodGet, "/devices", nil)
+	req.Header.Set("Authorization", "Bearer "+signToken(t, jwt.SigningMethodRS256, privateKey, validClaims(ScopeDevicesRead)))
+	assert.Equal(t, http.StatusOK, serve(auth, ScopeDevicesRead, req))
+
+	// An HS256 token signed with the public key must not be accepted
+	req = httptest.NewRequest(http.MethodGet, "/devices", nil)
+	req.Header.Set("Authorization", "Bearer "+signToken(t, jwt.SigningMethodHS256, der, validClaims(ScopeDevicesRead)))
+	assert.Equal(t, http.StatusUnauthorized, serve(auth, ScopeDevicesRead, req))
+}
+
+func TestRequireAPIKey(t *testing.T) {
+	key, err := GenerateAPIKey()
+	require.NoError(t, err, "should generate API key")
+
+	keys := mockKeyStore{
+		HashAPIKey(key): {Subject: "producer", Scopes: []string{ScopeDevicesWrite}},
+	}
+	auth := newTestAuthenticator(t, "s3cr3t", keys)
+
+	req := httptest.NewRequest(http.MethodPost, "/devices", nil)
+	req.Header.Set(APIKeyHeader, key)
+	assert.Equal(t, http.StatusOK, serve(auth, ScopeDevicesWrite, req), "known key with scope should pass")
+
+	req = httptest.NewRequest(http.MethodPost, "/publish", nil)
+	req.Header.Set(APIKeyHeader, key)
+	assert.Equal(t, http.StatusForbidden, serve(auth, ScopeEventsPublish, req), "known key without scope should be forbidden")
+
+	req = httptest.NewRequest(http.MethodPost, "/devices", nil)
+	req.Header.Set(APIKeyHeader, "hb_unknown")
+	assert.Equal(t, http.StatusUnauthorized, serve(auth, ScopeDevicesWrite, req), "unknown key should be rejected")
+
+	req = httptest.NewRequest(http.MethodPost, "/devices", nil)
+	assert.Equal(t, http.StatusUnauthorized, serve(auth, ScopeDevicesWrite, req), "missing credentials should be rejected")
+}
+
+func TestRequireDisabled(t *testing.T) {
+	auth, err := NewAuthenticator(AppConfig{}, nil)
+	require.NoError(t, err, "should create authenticator")
+
+	w := httptest.NewRecorder()
+	auth.Require(ScopeDevicesWrite, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})(w, httptest.NewRequest(http.MethodPost, "/devices", nil))
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode, "disabled auth should let requests through")
+}
+
+func TestCreateAndFindAPIKey(t *testing.T) {
+	name := "test-key-" + time.Now().Format("150405.000000")
+	key, err := testDB.CreateAPIKey(name, []string{ScopeDevicesRead, ScopeEventsPublish})
+	require.NoError(t, err, "Failed to create API key")
+
+	principal, err := testDB.FindAPIKey(HashAPIKey(key))
+	require.NoError(t, err, "Failed to find API key")
+	require.NotNil(t, principal, "Expected API key to be found")
+	assert.Equal(t, name, principal.Subject, "Subject should be the key name")
+	assert.ElementsMatch(t, []string{ScopeDevicesRead, ScopeEventsPublish}, principal.Scopes, "Scopes should match")
+
+	revoked, err := testDB.RevokeAPIKey(name)
+	require.NoError(t, err, "Failed to revoke API key")
+	assert.True(t, revoked, "Active API key should be revoked")
+
+	principal, err = testDB.FindAPIKey(HashAPIKey(key))
+	require.NoError(t, err, "Failed to look up revoked API key")
+	assert.Nil(t, principal, "Revoked API key should not be found")
+
+	revoked, err = testDB.RevokeAPIKey(name)
+	require.NoError(t, err)
+	assert.False(t, revoked, "Revoking a revoked API key should report false")
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Command asks a device to change its state. Devices report the change with a device event once applied.
+type Command struct {
+	DeviceID   string    `json:"device_id"`
+	DeviceType string    `json:"device_type"`
+	State      string    `json:"state"` // Requested state
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// CommandRoutingKey returns the routing key commands for a device are published with.
+func CommandRoutingKey(deviceType, deviceID string) string {
+	return fmt.Sprintf("command.%s.%s", deviceType, deviceID)
+}
+
+// CreateCommandMessage encodes a command as a JSON message.
+func CreateCommandMessage(command Command) amqp.Publishing {
+	body, _ := json.Marshal(command)
+	return amqp.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+		MessageId:   NewMessageID(),
+		Timestamp:   command.Timestamp,
+		Headers:     amqp.Table{DeviceIDHeader: command.DeviceID},
+	}
+}
+
+// ParseCommand decodes a command message, taking the device from the routing key when the body does
+// not name it.
+func ParseCommand(msg amqp.Delivery) (Command, error) {
+	var command Command
+	if err := json.Unmarshal(msg.Body, &command); err != nil {
+		return Command{}, fmt.Errorf("error decoding command: %w", err)
+	}
+	parts := strings.Split(msg.RoutingKey, ".")
+	if len(parts) == 3 && parts[0] == "command" {
+		if command.DeviceType == "" {
+			command.DeviceType = parts[1]
+		}
+		if command.DeviceID == "" {
+			command.DeviceID = parts[2]
+		}
+	}
+	if command.DeviceID == "" || command.State == "" {
+		return Command{}, fmt.Errorf("command on %s needs a device and a state", msg.RoutingKey)
+	}
+	if command.Timestamp.IsZero() {
+		command.Timestamp = msg.Timestamp
+	}
+	return command, nil
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCommand(t *testing.T) {
+	sent := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	msg := CreateCommandMessage(Command{DeviceID: "tv1", DeviceType: "tv", State: "off", Timestamp: sent})
+	assert.Equal(t, "tv1", msg.Headers[DeviceIDHeader])
+
+	command, err := ParseCommand(amqp.Delivery{RoutingKey: CommandRoutingKey("tv", "tv1"), Body: msg.Body})
+	require.NoError(t, err)
+	assert.Equal(t, Command{DeviceID: "tv1", DeviceType: "tv", State: "off", Timestamp: sent}, command)
+
+	command, err = ParseCommand(amqp.Delivery{RoutingKey: "command.lamp.lamp1", Body: []byte(`{"state":"on"}`)})
+	require.NoError(t, err)
+	assert.Equal(t, "lamp1", command.DeviceID, "the device should be taken from the routing key")
+	assert.Equal(t, "lamp", command.DeviceType)
+
+	_, err = ParseCommand(amqp.Delivery{RoutingKey: "command.lamp.lamp1", Body: []byte(`{}`)})
+	assert.Error(t, err)
+}
+
+func TestParseRegistryEvent(t *testing.T) {
+	device := Device{ID: "tv1", Type: "tv", State: "off", Room: "living_room"}
+	msg := CreateRegistryEvent(device)
+	action, parsed, err := ParseRegistryEvent(amqp.Delivery{RoutingKey: RegistryRoutingKey(RegistryDeleted, "tv", "tv1"), Body: msg.Body})
+	require.NoError(t, err)
+	assert.Equal(t, RegistryDeleted, action)
+	assert.Equal(t, device, parsed)
+
+	_, _, err = ParseRegistryEvent(amqp.Delivery{RoutingKey: "device.tv.off", Body: msg.Body})
+	assert.Error(t, err)
+}
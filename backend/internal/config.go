@@ -1,5 +1,14 @@
 package internal
 
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
 // AppConfig holds configuration for the entire application.
 type AppConfig struct {
 	RabbitMQ struct {
@@ -7,6 +16,10 @@ type AppConfig struct {
 		Password string `yaml:"Password"`
 		Host     string `yaml:"Host"`
 		VHost    string `yaml:"VHost"`
+
+		ConfirmTimeout  time.Duration `yaml:"ConfirmTimeout"`  // How long a publish waits for the broker confirm, e.g. "5s"
+		PoolSize        int           `yaml:"PoolSize"`        // Confirm-mode channels publishing concurrently, default 8
+		PoolConnections int           `yaml:"PoolConnections"` // Connections the publisher channels are spread over, default 1
 	} `yaml:"RabbitMQ"`
 
 	Database struct {
@@ -18,15 +31,319 @@ type AppConfig struct {
 	} `yaml:"Database"`
 
 	Server struct {
-		Port string `yaml:"Port"`
+		Port     string `yaml:"Port"`
+		GRPCPort string `yaml:"GRPCPort"` // DeviceService is only served when set
 	} `yaml:"Server"`
 
+	Health struct {
+		Timeout time.Duration `yaml:"Timeout"` // Deadline for each readiness check, e.g. "2s"
+	} `yaml:"Health"`
+
+	Stream struct {
+		ReplayBufferSize  int           `yaml:"ReplayBufferSize"`  // Events kept for Last-Event-ID resume
+		ClientBufferSize  int           `yaml:"ClientBufferSize"`  // Events queued per client before the slow client policy applies
+		SlowClientPolicy  string        `yaml:"SlowClientPolicy"`  // "disconnect" or "drop"
+		HeartbeatInterval time.Duration `yaml:"HeartbeatInterval"` // e.g. "15s"
+	} `yaml:"Stream"`
+
+	Auth struct {
+		Enabled bool `yaml:"Enabled"`
+		JWT     struct {
+			Algorithm     string `yaml:"Algorithm"`     // HS256 or RS256
+			SecretFile    string `yaml:"SecretFile"`    // Shared secret used for HS256
+			PublicKeyFile string `yaml:"PublicKeyFile"` // PEM encoded public key used for RS256
+			Issuer        string `yaml:"Issuer"`
+			Audience      string `yaml:"Audience"`
+		} `yaml:"JWT"`
+	} `yaml:"Auth"`
+
+	Access struct {
+		Limits []AccessLimit `yaml:"Limits"`
+	} `yaml:"Access"`
+
+	Idempotency struct {
+		Window time.Duration `yaml:"Window"` // How long responses to Idempotency-Key requests are kept, default 24h
+		Lease  time.Duration `yaml:"Lease"`  // How long a request may hold its key before it is taken as abandoned, default 1m
+	} `yaml:"Idempotency"`
+
 	Producer struct {
 		Queue string `yaml:"Queue"`
 	} `yaml:"Producer"`
 
 	Consumer struct {
-		Queue        string `yaml:"Queue"`
-		PrefetchCount int   `yaml:"PrefetchCount"`
+		Queue         string        `yaml:"Queue"`
+		PrefetchCount int           `yaml:"PrefetchCount"`
+		MetricsPort   string        `yaml:"MetricsPort"` // Port serving /metrics, /healthz and /readyz, disabled when empty
+		Dedup         string        `yaml:"Dedup"`       // "memory", "postgres" or empty to process duplicates
+		DedupSize     int           `yaml:"DedupSize"`   // Message IDs remembered by the in-memory deduplicator
+		DedupWindow   time.Duration `yaml:"DedupWindow"` // How long the postgres deduplicator keeps message IDs, default 24h
 	} `yaml:"Consumer"`
-}
\ No newline at end of file
+
+	Telemetry struct {
+		Queue         string               `yaml:"Queue"`
+		BatchSize     int                  `yaml:"BatchSize"`     // Readings inserted at once, default 500
+		FlushInterval time.Duration        `yaml:"FlushInterval"` // Longest time a reading waits for its batch, default 1s
+		Retention     time.Duration        `yaml:"Retention"`     // Daily partitions older than this are dropped, keep forever when 0
+		Policies      []TelemetryRetention `yaml:"Policies"`      // Shorter retention for some device types or metrics
+		MetricsPort   string               `yaml:"MetricsPort"`
+	} `yaml:"Telemetry"`
+
+	Presence struct {
+		DefaultTimeout    time.Duration     `yaml:"DefaultTimeout"`    // Silence after which a device is offline, default 5m
+		Timeouts          []PresenceTimeout `yaml:"Timeouts"`          // Timeouts of device types that report less often
+		CheckInterval     time.Duration     `yaml:"CheckInterval"`     // How often the watchdog looks for silent devices, default 30s
+		HeartbeatInterval time.Duration     `yaml:"HeartbeatInterval"` // How often the consumer sends heartbeats for DEVICE_ID, default 1m
+	} `yaml:"Presence"`
+
+	Notifier struct {
+		Queue               string        `yaml:"Queue"`
+		Timezone            string        `yaml:"Timezone"`            // IANA zone of the quiet hours, default UTC
+		RateLimit           int           `yaml:"RateLimit"`           // Notifications sent per user and channel within RateWindow, unlimited when 0
+		RateWindow          time.Duration `yaml:"RateWindow"`          // default 1h
+		DedupWindow         time.Duration `yaml:"DedupWindow"`         // Alerts with the same dedup key are sent once within it, default 1h
+		SendTimeout         time.Duration `yaml:"SendTimeout"`         // Deadline of each email or webhook, default 10s
+		WebhookAllowedHosts []string      `yaml:"WebhookAllowedHosts"` // Webhook hosts that may resolve to internal addresses
+		MetricsPort         string        `yaml:"MetricsPort"`
+		SMTP                struct {
+			Host     string `yaml:"Host"` // Email is disabled when empty
+			Port     string `yaml:"Port"`
+			Username string `yaml:"Username"`
+			Password string `yaml:"Password"`
+			From     string `yaml:"From"`
+		} `yaml:"SMTP"`
+	} `yaml:"Notifier"`
+
+	Webhooks struct {
+		Queue          string        `yaml:"Queue"`
+		MaxAttempts    int           `yaml:"MaxAttempts"`    // Attempts per event and subscription, default 5
+		InitialBackoff time.Duration `yaml:"InitialBackoff"` // Delay before the first retry, doubled for each further retry, default 1s
+		MaxBackoff     time.Duration `yaml:"MaxBackoff"`     // default 1m
+		DisableAfter   int           `yaml:"DisableAfter"`   // Consecutive failed events after which a subscription is disabled, never when 0
+		Timeout        time.Duration `yaml:"Timeout"`        // Deadline of each request, default 10s
+		Concurrency    int           `yaml:"Concurrency"`    // Events delivered at the same time, default 8
+		MetricsPort    string        `yaml:"MetricsPort"`
+	} `yaml:"Webhooks"`
+
+	Rules struct {
+		Queue       string `yaml:"Queue"` // Device events matched against the rules, default "rules_queue"
+		MetricsPort string `yaml:"MetricsPort"`
+	} `yaml:"Rules"`
+
+	MQTT struct {
+		Broker         string        `yaml:"Broker"` // e.g. "tcp://localhost:1883"
+		ClientID       string        `yaml:"ClientID"`
+		Username       string        `yaml:"Username"`
+		Password       string        `yaml:"Password"`
+		TopicPrefix    string        `yaml:"TopicPrefix"`    // Device states are bridged on <prefix>/<type>/<id>/state, default "homebunny"
+		QoS            byte          `yaml:"QoS"`            // QoS of subscriptions and published states, 0, 1 or 2
+		Retain         bool          `yaml:"Retain"`         // Publish states retained, so new subscribers get the last known state
+		IngestRetained bool          `yaml:"IngestRetained"` // Also publish retained states received on (re)subscribing as device events
+		Queue          string        `yaml:"Queue"`
+		Timeout        time.Duration `yaml:"Timeout"` // Deadline of each connect and publish, default 10s
+		MetricsPort    string        `yaml:"MetricsPort"`
+
+		HomeAssistant struct {
+			Enabled         bool              `yaml:"Enabled"`         // Publish MQTT discovery entries for registered devices
+			DiscoveryPrefix string            `yaml:"DiscoveryPrefix"` // default "homeassistant"
+			Components      map[string]string `yaml:"Components"`      // Component by device type: switch, light, climate or sensor
+		} `yaml:"HomeAssistant"`
+	} `yaml:"MQTT"`
+
+	Zigbee2MQTT struct {
+		BaseTopic   string            `yaml:"BaseTopic"` // default "zigbee2mqtt"
+		ClientID    string            `yaml:"ClientID"`
+		Types       map[string]string `yaml:"Types"` // Device type by Zigbee model, overriding the type guessed from its exposes
+		Queue       string            `yaml:"Queue"`
+		MetricsPort string            `yaml:"MetricsPort"`
+	} `yaml:"Zigbee2MQTT"`
+
+	Simulator struct {
+		Devices        int             `yaml:"Devices"`        // Virtual devices, spread over Types by weight, default 10
+		Types          []SimulatedType `yaml:"Types"`          // Markov models of the device types, DefaultSimulatedTypes when empty
+		Scenario       string          `yaml:"Scenario"`       // YAML file of scripted steps replacing the Markov models, optional
+		IDPrefix       string          `yaml:"IDPrefix"`       // Device IDs are <prefix>-<type>-<n>, default "sim"
+		Seed           int64           `yaml:"Seed"`           // Repeats a run when set, random when 0
+		Duration       time.Duration   `yaml:"Duration"`       // Stops the run after it, runs until interrupted when 0
+		CommandDelay   time.Duration   `yaml:"CommandDelay"`   // How long a device takes to apply a command
+		SkipTelemetry  bool            `yaml:"SkipTelemetry"`  // Only publish device events
+		Register       bool            `yaml:"Register"`       // Register the devices and record their states in PostgreSQL
+		PoolSize       int             `yaml:"PoolSize"`       // Concurrent publishes, default RabbitMQ.PoolSize
+		ReportInterval time.Duration   `yaml:"ReportInterval"` // How often the statistics are logged, default 10s
+		Queue          string          `yaml:"Queue"`          // Commands for the simulated devices
+	} `yaml:"Simulator"`
+
+	Recorder struct {
+		File          string        `yaml:"File"`          // Newline-delimited JSON recording, appended to
+		Filters       []string      `yaml:"Filters"`       // Routing key patterns to record, every event when empty
+		FlushInterval time.Duration `yaml:"FlushInterval"` // How often recorded events are written out, default 1s
+	} `yaml:"Recorder"`
+
+	History struct {
+		Enabled          bool          `yaml:"Enabled"`          // Mirror device_events into a RabbitMQ stream
+		Stream           string        `yaml:"Stream"`           // Name of the stream, default "device_events_stream"
+		Bindings         []string      `yaml:"Bindings"`         // Routing key patterns mirrored, every event when empty
+		MaxAge           string        `yaml:"MaxAge"`           // How long events are kept, e.g. "7D"
+		MaxLengthBytes   int64         `yaml:"MaxLengthBytes"`   // Size events are kept up to, unlimited when 0
+		SegmentSizeBytes int64         `yaml:"SegmentSizeBytes"` // Size of the segment files, the broker default when 0
+		Prefetch         int           `yaml:"Prefetch"`         // Unacknowledged messages per consumer, default 100
+		CommitInterval   time.Duration `yaml:"CommitInterval"`   // How often consumers store their offset, default 5s
+	} `yaml:"History"`
+
+	Hooks struct {
+		Sources []HookSource `yaml:"Sources"` // Third-party platforms posting to /hooks/{source}
+	} `yaml:"Hooks"`
+
+	Energy struct {
+		Wattage     []DeviceWattage `yaml:"Wattage"`     // Estimated draw of devices without a power meter
+		Tariffs     []Tariff        `yaml:"Tariffs"`     // First matching tariff applies, the last one should match any time
+		Currency    string          `yaml:"Currency"`    // e.g. "EUR"
+		Timezone    string          `yaml:"Timezone"`    // IANA zone for tariff times and report periods, default UTC
+		PowerMetric string          `yaml:"PowerMetric"` // Telemetry metric in watts, default "power"
+	} `yaml:"Energy"`
+}
+
+// LoadConfigFile loads the configuration from the YAML file at path, rejecting unknown settings.
+func LoadConfigFile(path string) (*AppConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	var config AppConfig
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+	return &config, nil
+}
+
+// Validate reports every setting the services would reject when starting with the configuration.
+func (c AppConfig) Validate() error {
+	var errs []error
+	if _, err := NewAuthenticator(c, nil); err != nil {
+		errs = append(errs, fmt.Errorf("Auth: %w", err))
+	}
+	for _, limit := range c.Access.Limits {
+		if !Role(limit.Role).Valid() {
+			errs = append(errs, fmt.Errorf("Access.Limits: unknown role %q", limit.Role))
+		}
+		if limit.Min != nil && limit.Max != nil && *limit.Min > *limit.Max {
+			errs = append(errs, fmt.Errorf("Access.Limits: Min of %s %s is above Max", limit.Role, limit.DeviceType))
+		}
+	}
+	switch c.Stream.SlowClientPolicy {
+	case "", SlowClientDisconnect, SlowClientDrop:
+	default:
+		errs = append(errs, fmt.Errorf("Stream.SlowClientPolicy: expected %q or %q, got %q", SlowClientDisconnect, SlowClientDrop, c.Stream.SlowClientPolicy))
+	}
+	switch c.Consumer.Dedup {
+	case "", "memory", "postgres":
+	default:
+		errs = append(errs, fmt.Errorf("Consumer.Dedup: expected \"memory\" or \"postgres\", got %q", c.Consumer.Dedup))
+	}
+	if c.Notifier.Timezone != "" {
+		if _, err := time.LoadLocation(c.Notifier.Timezone); err != nil {
+			errs = append(errs, fmt.Errorf("Notifier.Timezone: %w", err))
+		}
+	}
+	if c.MQTT.QoS > 2 {
+		errs = append(errs, fmt.Errorf("MQTT.QoS: expected 0, 1 or 2, got %d", c.MQTT.QoS))
+	}
+	for deviceType, component := range c.MQTT.HomeAssistant.Components {
+		switch component {
+		case HomeAssistantSwitch, HomeAssistantLight, HomeAssistantClimate, HomeAssistantSensor:
+		default:
+			errs = append(errs, fmt.Errorf("MQTT.HomeAssistant.Components: unsupported component %q for %s", component, deviceType))
+		}
+	}
+	for _, simulated := range c.Simulator.Types {
+		if err := simulated.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("Simulator.Types: %w", err))
+		}
+	}
+	for _, filter := range c.Recorder.Filters {
+		if err := ValidateRoutingKeyFilter(filter); err != nil {
+			errs = append(errs, fmt.Errorf("Recorder.Filters: %w", err))
+		}
+	}
+	for _, binding := range c.History.Bindings {
+		if err := ValidateRoutingKeyFilter(binding); err != nil {
+			errs = append(errs, fmt.Errorf("History.Bindings: %w", err))
+		}
+	}
+	if err := validateMaxAge(c.History.MaxAge); err != nil {
+		errs = append(errs, fmt.Errorf("History.MaxAge: %w", err))
+	}
+	if _, err := NewHookSources(c); err != nil {
+		errs = append(errs, fmt.Errorf("Hooks: %w", err))
+	}
+	if _, err := NewEnergyCalculator(c); err != nil {
+		errs = append(errs, fmt.Errorf("Energy: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// AccessLimit restricts the states a role may set on devices of a given type.
+type AccessLimit struct {
+	Role         string   `yaml:"Role"`
+	DeviceType   string   `yaml:"DeviceType"`
+	DeniedStates []string `yaml:"DeniedStates"` // States the role may never set (e.g., "disarmed")
+	Min          *float64 `yaml:"Min"`          // Lowest numeric state allowed (e.g., thermostat setpoint)
+	Max          *float64 `yaml:"Max"`          // Highest numeric state allowed
+}
+
+// TelemetryRetention keeps the readings matching DeviceType and Metric (empty matches any) for Retention.
+type TelemetryRetention struct {
+	DeviceType string        `yaml:"DeviceType"`
+	Metric     string        `yaml:"Metric"`
+	Retention  time.Duration `yaml:"Retention"`
+}
+
+// DeviceWattage is the estimated power draw of a device type in a state.
+type DeviceWattage struct {
+	DeviceType string  `yaml:"DeviceType"`
+	State      string  `yaml:"State"`
+	Watts      float64 `yaml:"Watts"`
+}
+
+// Tariff is an electricity price, optionally limited to a time of day and days of the week.
+type Tariff struct {
+	Name        string   `yaml:"Name"`
+	PricePerKWh float64  `yaml:"PricePerKWh"`
+	From        string   `yaml:"From"` // Local time the tariff starts, e.g. "22:00"; empty for all day
+	To          string   `yaml:"To"`   // Local time the tariff ends, may be before From to span midnight
+	Days        []string `yaml:"Days"` // Weekdays the tariff applies on, e.g. ["Saturday", "Sunday"]; empty for every day
+}
+
+// PresenceTimeout is the silence after which devices of a type are considered offline.
+type PresenceTimeout struct {
+	DeviceType string        `yaml:"DeviceType"`
+	Timeout    time.Duration `yaml:"Timeout"`
+}
+
+// HookSource maps the payloads a third-party platform posts to /hooks/{Name} to device events. Fields
+// starting with "$" are paths into the payload (e.g. "$.device.id" or "$.data[0].value"), others are
+// literal values.
+type HookSource struct {
+	Name       string            `yaml:"Name"`
+	Signature  HookSignature     `yaml:"Signature"`
+	Events     string            `yaml:"Events"` // Path of an array of events the other paths are relative to, the payload is a single event when empty
+	DeviceID   string            `yaml:"DeviceID"`
+	DeviceType string            `yaml:"DeviceType"`
+	State      string            `yaml:"State"`
+	States     map[string]string `yaml:"States"`    // Translates vendor states, e.g. {"1": "on"}
+	Timestamp  string            `yaml:"Timestamp"` // RFC 3339 or Unix seconds or milliseconds, optional
+	EventID    string            `yaml:"EventID"`   // Identifies redelivered events, optional
+}
+
+// HookSignature describes how an inbound hook source signs its requests.
+type HookSignature struct {
+	Method     string `yaml:"Method"`   // "hmac-sha256", "hmac-sha1", "token" or "none"
+	Header     string `yaml:"Header"`   // e.g. "X-Hub-Signature-256"
+	Prefix     string `yaml:"Prefix"`   // Stripped from the header value, e.g. "sha256="
+	Encoding   string `yaml:"Encoding"` // "hex" (default) or "base64" for HMAC signatures
+	Secret     string `yaml:"Secret"`
+	SecretFile string `yaml:"SecretFile"` // Read instead of Secret when set
+}
@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	config, err := LoadConfigFile("../config/config.yaml")
+	require.NoError(t, err)
+	assert.NoError(t, config.Validate(), "the shipped configuration should be valid")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("Server:\n  Prot: \"8080\"\n"), 0o600))
+	_, err = LoadConfigFile(path)
+	assert.ErrorContains(t, err, "field Prot not found", "misspelled settings should be rejected")
+}
+
+func TestConfigValidate(t *testing.T) {
+	var config AppConfig
+	assert.NoError(t, config.Validate(), "an empty configuration uses the defaults")
+
+	config.Auth.JWT.Algorithm = "none"
+	config.Access.Limits = []AccessLimit{{Role: "teen", DeviceType: "tv"}}
+	config.Stream.SlowClientPolicy = "block"
+	config.MQTT.QoS = 3
+	config.MQTT.HomeAssistant.Components = map[string]string{"fan": "cover"}
+	config.Hooks.Sources = []HookSource{{Name: "acme", Signature: HookSignature{Method: "md5"}}}
+	config.Energy.Timezone = "Mars/Olympus"
+	config.History.MaxAge = "7 days"
+
+	err := config.Validate()
+	require.Error(t, err)
+	for _, setting := range []string{"Auth:", "Access.Limits:", "Stream.SlowClientPolicy:", "MQTT.QoS:", "MQTT.HomeAssistant.Components:", "Hooks:", "Energy:", "History.MaxAge:"} {
+		assert.Contains(t, err.Error(), setting)
+	}
+}
@@ -2,12 +2,25 @@ package internal
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
+// Errors returned by conditional device updates.
+var (
+	ErrVersionConflict = errors.New("device version does not match")
+	ErrStaleEvent      = errors.New("event is older than the current device state")
+	ErrFutureEvent     = errors.New("event time is too far in the future")
+)
+
+// MaxEventTimeSkew is how far ahead of the clock an event time may be. Later events are rejected, as
+// they would make every following event of the device stale.
+const MaxEventTimeSkew = time.Minute
+
 // PostgreSQLClient represents the client to interact with PostgreSQL.
 type PostgreSQLClient struct {
 	DB *sql.DB
@@ -37,35 +50,77 @@ func (p *PostgreSQLClient) Close() error {
 	return p.DB.Close()
 }
 
-// InsertDevice adds a new device to the database.
+// InsertDevice adds a new device to the database, or updates the room of a registered one, and stores
+// the registration in the event store. The state of a registered device is kept, it only changes through
+// RecordStateChange.
 func (p *PostgreSQLClient) InsertDevice(device Device) error {
-	query := `INSERT INTO devices (device_id, type, state) VALUES ($1, $2, $3)
-              ON CONFLICT (device_id) DO UPDATE SET state = EXCLUDED.state`
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin device insert: %w", err)
+	}
+	defer tx.Rollback()
 
-	_, err := p.DB.Exec(query, device.ID, device.Type, device.State)
+	// The upsert locks the device, so concurrent registrations get consecutive versions
+	query := `INSERT INTO devices (device_id, type, state, room) VALUES ($1, $2, $3, $4)
+              ON CONFLICT (device_id) DO UPDATE SET room = EXCLUDED.room, version = devices.version + 1
+              RETURNING type, state, version`
+	event := StoredEvent{Type: EventDeviceRegistered, DeviceID: device.ID, Room: device.Room}
+	err = tx.QueryRow(query, device.ID, device.Type, device.State, device.Room).Scan(&event.DeviceType, &event.State, &event.Version)
 	if err != nil {
 		return fmt.Errorf("failed to insert device: %w", err)
 	}
+	if _, err := appendEvent(tx, event); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit device insert: %w", err)
+	}
 	return nil
 }
 
-// UpdateDeviceState updates a device's state.
+// UpdateDeviceState updates a device's state, without recording it in the state history.
 func (p *PostgreSQLClient) UpdateDeviceState(deviceID, state string) error {
-	query := `UPDATE devices SET state = $1 WHERE device_id = $2`
-	_, err := p.DB.Exec(query, state, deviceID)
+	tx, err := p.DB.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to update device state: %w", err)
+		return fmt.Errorf("failed to begin device update: %w", err)
+	}
+	defer tx.Rollback()
+
+	event := StoredEvent{Type: EventDeviceStateChanged, DeviceID: deviceID, State: state}
+	query := `SELECT type, state, room, version + 1 FROM devices WHERE device_id = $1 FOR UPDATE`
+	err = tx.QueryRow(query, deviceID).Scan(&event.DeviceType, &event.PreviousState, &event.Room, &event.Version)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get device state: %w", err)
+	}
+	if err := applyDeviceEvent(tx, event); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit device update: %w", err)
 	}
 	return nil
 }
 
+// applyDeviceEvent stores an event and applies it to the devices, in the caller's transaction.
+func applyDeviceEvent(tx *sql.Tx, event StoredEvent) error {
+	stored, err := appendEvent(tx, event)
+	if err != nil {
+		return err
+	}
+	return DeviceProjection{}.Apply(tx, stored)
+}
+
 // GetDevice retrieves a device's information.
 func (p *PostgreSQLClient) GetDevice(deviceID string) (*Device, error) {
-	query := `SELECT device_id, type, state FROM devices WHERE device_id = $1`
+	query := `SELECT device_id, type, state, room, version, event_time, presence, last_seen_at FROM devices WHERE device_id = $1`
 	row := p.DB.QueryRow(query, deviceID)
 
 	var device Device
-	err := row.Scan(&device.ID, &device.Type, &device.State)
+	err := row.Scan(&device.ID, &device.Type, &device.State, &device.Room, &device.Version, &device.EventTime,
+		&device.Status, &device.LastSeenAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // No device found
@@ -74,3 +129,200 @@ func (p *PostgreSQLClient) GetDevice(deviceID string) (*Device, error) {
 	}
 	return &device, nil
 }
+
+// DeleteDevice removes a device and its state history. It reports false when the device does not exist.
+func (p *PostgreSQLClient) DeleteDevice(deviceID string) (bool, error) {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin device delete: %w", err)
+	}
+	defer tx.Rollback()
+
+	event := StoredEvent{Type: EventDeviceDeleted, DeviceID: deviceID}
+	query := `SELECT type, state, room, version FROM devices WHERE device_id = $1 FOR UPDATE`
+	err = tx.QueryRow(query, deviceID).Scan(&event.DeviceType, &event.PreviousState, &event.Room, &event.Version)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to delete device: %w", err)
+	}
+	if err := applyDeviceEvent(tx, event); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit device delete: %w", err)
+	}
+	return true, nil
+}
+
+// ListDevices retrieves all registered devices.
+func (p *PostgreSQLClient) ListDevices() ([]Device, error) {
+	query := `SELECT device_id, type, state, room, version, event_time, presence, last_seen_at FROM devices ORDER BY device_id`
+	rows, err := p.DB.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var device Device
+		if err := rows.Scan(&device.ID, &device.Type, &device.State, &device.Room, &device.Version, &device.EventTime,
+			&device.Status, &device.LastSeenAt); err != nil {
+			return nil, fmt.Errorf("failed to scan device: %w", err)
+		}
+		devices = append(devices, device)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+	return devices, nil
+}
+
+// StateChange is a transition of a device from one state to another.
+type StateChange struct {
+	DeviceID      string    `json:"device_id"`
+	PreviousState string    `json:"previous_state"`
+	State         string    `json:"state"`
+	MessageID     string    `json:"message_id"`
+	ChangedAt     time.Time `json:"changed_at"`
+}
+
+// RecordStateChange updates a device's state and appends the transition to its history. When
+// expectedVersion is not zero the update only applies to that version of the device, otherwise it
+// returns ErrVersionConflict. Events older than the one that set the current state return ErrStaleEvent,
+// and events more than MaxEventTimeSkew ahead of the clock ErrFutureEvent.
+// Accepted events are appended to the event store. Messages it already stored are accepted without
+// checking them again, so a retry of an event whose publish failed can still be published.
+// It reports false without changing anything when the device is unknown, the message was already
+// recorded or the device already is in the state, so repeated events never show up as duplicate transitions.
+func (p *PostgreSQLClient) RecordStateChange(deviceID, state, messageID string, eventTime time.Time, expectedVersion int64) (bool, error) {
+	if eventTime.After(time.Now().Add(MaxEventTimeSkew)) {
+		return false, ErrFutureEvent
+	}
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin state change: %w", err)
+	}
+	defer tx.Rollback()
+
+	var current, deviceType, room string
+	var version int64
+	var currentEventTime sql.NullTime
+	query := `SELECT type, state, room, version, event_time FROM devices WHERE device_id = $1 FOR UPDATE`
+	err = tx.QueryRow(query, deviceID).Scan(&deviceType, &current, &room, &version, &currentEventTime)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get device state: %w", err)
+	}
+
+	// A retried event was already checked and recorded, even if the device changed since
+	var recorded bool
+	query = `SELECT EXISTS (SELECT 1 FROM device_event_store WHERE message_id = $1)`
+	if err := tx.QueryRow(query, messageID).Scan(&recorded); err != nil {
+		return false, fmt.Errorf("failed to check for recorded event: %w", err)
+	}
+	if recorded {
+		return false, nil
+	}
+	if expectedVersion != 0 && expectedVersion != version {
+		return false, ErrVersionConflict
+	}
+	if currentEventTime.Valid && eventTime.Before(currentEventTime.Time) {
+		return false, ErrStaleEvent
+	}
+
+	// Events that repeat the current state are stored too, later events must still be ordered after them
+	changed := current != state
+	if changed {
+		version++
+	}
+	event := StoredEvent{
+		Type:          EventDeviceStateChanged,
+		DeviceID:      deviceID,
+		DeviceType:    deviceType,
+		PreviousState: current,
+		State:         state,
+		Room:          room,
+		Version:       version,
+		MessageID:     messageID,
+		EventTime:     &eventTime,
+	}
+	err = applyDeviceEvent(tx, event)
+	if errors.Is(err, errDuplicateEvent) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit state change: %w", err)
+	}
+	return changed, nil
+}
+
+// ListStateHistory retrieves the most recent state changes of a device, newest first.
+func (p *PostgreSQLClient) ListStateHistory(deviceID string, limit int) ([]StateChange, error) {
+	query := `SELECT device_id, previous_state, state, message_id, changed_at FROM device_state_history
+              WHERE device_id = $1 ORDER BY changed_at DESC, id DESC LIMIT $2`
+	rows, err := p.DB.Query(query, deviceID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list state history: %w", err)
+	}
+	defer rows.Close()
+
+	changes := []StateChange{}
+	for rows.Next() {
+		var change StateChange
+		err := rows.Scan(&change.DeviceID, &change.PreviousState, &change.State, &change.MessageID, &change.ChangedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan state change: %w", err)
+		}
+		changes = append(changes, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list state history: %w", err)
+	}
+	return changes, nil
+}
+
+// StateTimeline retrieves the state a device was in at from and its state changes between from and to, oldest first.
+func (p *PostgreSQLClient) StateTimeline(deviceID string, from, to time.Time) (string, []StateChange, error) {
+	query := `SELECT device_id, previous_state, state, message_id, changed_at FROM device_state_history
+              WHERE device_id = $1 AND changed_at >= $2 AND changed_at < $3 ORDER BY changed_at, id`
+	rows, err := p.DB.Query(query, deviceID, from, to)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to list state changes: %w", err)
+	}
+	defer rows.Close()
+
+	changes := []StateChange{}
+	for rows.Next() {
+		var change StateChange
+		err := rows.Scan(&change.DeviceID, &change.PreviousState, &change.State, &change.MessageID, &change.ChangedAt)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to scan state change: %w", err)
+		}
+		changes = append(changes, change)
+	}
+	if err := rows.Err(); err != nil {
+		return "", nil, fmt.Errorf("failed to list state changes: %w", err)
+	}
+
+	// The state at from was set by the last change before it, otherwise the next change started from it
+	var initial string
+	query = `SELECT COALESCE(
+                 (SELECT state FROM device_state_history WHERE device_id = $1 AND changed_at < $2
+                  ORDER BY changed_at DESC, id DESC LIMIT 1),
+                 (SELECT previous_state FROM device_state_history WHERE device_id = $1 AND changed_at >= $2
+                  ORDER BY changed_at, id LIMIT 1),
+                 (SELECT state FROM devices WHERE device_id = $1),
+                 '')`
+	if err := p.DB.QueryRow(query, deviceID, from).Scan(&initial); err != nil {
+		return "", nil, fmt.Errorf("failed to get device state: %w", err)
+	}
+	return initial, changes, nil
+}
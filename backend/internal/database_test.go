@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"testing"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
@@ -29,7 +30,7 @@ func TestMain(m *testing.M) {
 	}
 	defer testDB.Close()
 
-	// Create the devices table
+	// Create the tables used by the tests
 	if err := createTestTable(); err != nil {
 		log.Fatalf("Failed to create test table: %v", err)
 	}
@@ -38,23 +39,18 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
-// createTestTable creates the devices table for testing
+// createTestTable creates the tables used by the tests by applying the migrations
 func createTestTable() error {
-	query := `
-	CREATE TABLE IF NOT EXISTS devices (
-		device_id VARCHAR PRIMARY KEY,
-		type VARCHAR NOT NULL,
-		state VARCHAR NOT NULL
-	);`
-	_, err := testDB.DB.Exec(query)
-	return err
+	return testDB.Migrate()
 }
 
 func TestInsertDevice(t *testing.T) {
 	device := Device{ID: "1", Type: "light", State: "off"}
+	_, err := testDB.DeleteDevice(device.ID) // Left over by an earlier run
+	require.NoError(t, err)
 
 	// Attempt to insert the device
-	err := testDB.InsertDevice(device)
+	err = testDB.InsertDevice(device)
 	require.NoError(t, err, "Failed to insert device")
 
 	// Verify the device was inserted
@@ -66,6 +62,14 @@ func TestInsertDevice(t *testing.T) {
 	assert.Equal(t, device.ID, fetchedDevice.ID, "Device ID should match")
 	assert.Equal(t, device.Type, fetchedDevice.Type, "Device Type should match")
 	assert.Equal(t, device.State, fetchedDevice.State, "Device State should match")
+
+	// Registering again moves the device and keeps its state
+	err = testDB.InsertDevice(Device{ID: device.ID, Type: device.Type, State: "on", Room: "hall"})
+	require.NoError(t, err, "Failed to register device again")
+	fetchedDevice, err = testDB.GetDevice(device.ID)
+	require.NoError(t, err, "Failed to get device")
+	assert.Equal(t, "hall", fetchedDevice.Room, "Device Room should be updated")
+	assert.Equal(t, device.State, fetchedDevice.State, "Device State should be kept")
 }
 
 func TestUpdateDeviceState(t *testing.T) {
@@ -100,3 +104,96 @@ func TestGetDevice(t *testing.T) {
 	assert.Equal(t, device.Type, fetchedDevice.Type, "Device Type should match")
 	assert.Equal(t, device.State, fetchedDevice.State, "Device State should match")
 }
+
+func TestListDevices(t *testing.T) {
+	device := Device{ID: "4", Type: "tv", State: "on"}
+	err := testDB.InsertDevice(device)
+	require.NoError(t, err, "Failed to insert device for list test")
+
+	devices, err := testDB.ListDevices()
+	require.NoError(t, err, "Failed to list devices")
+
+	// The listed devices should include the inserted device
+	assert.Contains(t, devices, device, "Listed devices should contain the inserted device")
+}
+
+func TestDeleteDevice(t *testing.T) {
+	device := Device{ID: "delete-1", Type: "plug", State: "off"}
+	require.NoError(t, testDB.InsertDevice(device))
+	_, err := testDB.RecordStateChange(device.ID, "on", NewMessageID(), time.Now(), 0)
+	require.NoError(t, err)
+
+	deleted, err := testDB.DeleteDevice(device.ID)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+
+	fetchedDevice, err := testDB.GetDevice(device.ID)
+	require.NoError(t, err)
+	assert.Nil(t, fetchedDevice, "Deleted device should not be found")
+	history, err := testDB.ListStateHistory(device.ID, 10)
+	require.NoError(t, err)
+	assert.Empty(t, history, "History should be deleted with the device")
+
+	deleted, err = testDB.DeleteDevice(device.ID)
+	require.NoError(t, err)
+	assert.False(t, deleted)
+}
+
+func TestRecordStateChange(t *testing.T) {
+	device := Device{ID: "history-" + NewMessageID(), Type: "lamp", State: "off"}
+	require.NoError(t, testDB.InsertDevice(device))
+	first, second := NewMessageID(), NewMessageID()
+
+	recorded, err := testDB.RecordStateChange(device.ID, "on", first, time.Now(), 0)
+	require.NoError(t, err)
+	assert.True(t, recorded, "a new state should be recorded")
+
+	recorded, err = testDB.RecordStateChange(device.ID, "on", first, time.Now(), 0)
+	require.NoError(t, err)
+	assert.False(t, recorded, "a repeated event should not be recorded")
+
+	recorded, err = testDB.RecordStateChange(device.ID, "on", second, time.Now(), 0)
+	require.NoError(t, err)
+	assert.False(t, recorded, "an event without a transition should not be recorded")
+
+	history, err := testDB.ListStateHistory(device.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, history, 1, "the history should have no duplicate transitions")
+	assert.Equal(t, "off", history[0].PreviousState)
+	assert.Equal(t, "on", history[0].State)
+
+	fetched, err := testDB.GetDevice(device.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "on", fetched.State, "the device state should be updated")
+}
+
+func TestRecordStateChangeIsConditional(t *testing.T) {
+	device := Device{ID: "versioned-" + NewMessageID(), Type: "lamp", State: "off"}
+	require.NoError(t, testDB.InsertDevice(device))
+	fetched, err := testDB.GetDevice(device.ID)
+	require.NoError(t, err)
+	now := time.Now()
+
+	_, err = testDB.RecordStateChange(device.ID, "on", NewMessageID(), now, fetched.Version+1)
+	assert.ErrorIs(t, err, ErrVersionConflict, "an update of another version should be rejected")
+
+	messageID := NewMessageID()
+	recorded, err := testDB.RecordStateChange(device.ID, "on", messageID, now, fetched.Version)
+	require.NoError(t, err)
+	assert.True(t, recorded, "an update of the current version should apply")
+	recorded, err = testDB.RecordStateChange(device.ID, "on", messageID, now, fetched.Version)
+	require.NoError(t, err, "a retry of a recorded update should not conflict with its own version")
+	assert.False(t, recorded, "a retry should not be recorded twice")
+
+	_, err = testDB.RecordStateChange(device.ID, "off", NewMessageID(), now.Add(-time.Minute), 0)
+	assert.ErrorIs(t, err, ErrStaleEvent, "an event older than the current state should be discarded")
+	_, err = testDB.RecordStateChange(device.ID, "off", NewMessageID(), now.Add(24*time.Hour), 0)
+	assert.ErrorIs(t, err, ErrFutureEvent, "an event from the future should be rejected")
+
+	updated, err := testDB.GetDevice(device.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "on", updated.State)
+	assert.Equal(t, fetched.Version+1, updated.Version, "every change should increment the version")
+	require.NotNil(t, updated.EventTime)
+	assert.WithinDuration(t, now, *updated.EventTime, time.Millisecond)
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Deduplicator remembers the message IDs a consumer has processed, so redelivered or republished
+// events can be skipped.
+type Deduplicator interface {
+	// MarkProcessed records messageID and reports whether it had been recorded before.
+	MarkProcessed(messageID string) (duplicate bool, err error)
+}
+
+// LRUDeduplicator keeps the most recent message IDs in memory. Duplicates older than its capacity
+// and duplicates received across restarts are not detected.
+type LRUDeduplicator struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // Most recently seen first
+	seen     map[string]*list.Element
+}
+
+// NewLRUDeduplicator creates an LRUDeduplicator remembering up to capacity message IDs.
+func NewLRUDeduplicator(capacity int) *LRUDeduplicator {
+	if capacity <= 0 {
+		capacity = 10000
+	}
+	return &LRUDeduplicator{capacity: capacity, order: list.New(), seen: make(map[string]*list.Element)}
+}
+
+// MarkProcessed records messageID, evicting the least recently seen ID when full.
+func (d *LRUDeduplicator) MarkProcessed(messageID string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if element, ok := d.seen[messageID]; ok {
+		d.order.MoveToFront(element)
+		return true, nil
+	}
+	d.seen[messageID] = d.order.PushFront(messageID)
+	if d.order.Len() > d.capacity {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.seen, oldest.Value.(string))
+	}
+	return false, nil
+}
+
+// PostgresDeduplicator records processed message IDs in PostgreSQL, per consumer, so duplicates
+// are detected across restarts and replicas.
+type PostgresDeduplicator struct {
+	db       *PostgreSQLClient
+	consumer string
+}
+
+// NewPostgresDeduplicator creates a PostgresDeduplicator for the named consumer.
+func NewPostgresDeduplicator(db *PostgreSQLClient, consumer string) *PostgresDeduplicator {
+	return &PostgresDeduplicator{db: db, consumer: consumer}
+}
+
+// MarkProcessed inserts messageID, reporting a duplicate when it is already present.
+func (d *PostgresDeduplicator) MarkProcessed(messageID string) (bool, error) {
+	query := `INSERT INTO processed_messages (consumer, message_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	result, err := d.db.DB.Exec(query, d.consumer, messageID)
+	if err != nil {
+		return false, fmt.Errorf("failed to mark message processed: %w", err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to mark message processed: %w", err)
+	}
+	return inserted == 0, nil
+}
+
+// Purge forgets the message IDs processed before the given time.
+func (d *PostgresDeduplicator) Purge(before time.Time) (int64, error) {
+	query := `DELETE FROM processed_messages WHERE consumer = $1 AND processed_at < $2`
+	result, err := d.db.DB.Exec(query, d.consumer, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge processed messages: %w", err)
+	}
+	return result.RowsAffected()
+}
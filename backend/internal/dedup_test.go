@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUDeduplicator(t *testing.T) {
+	dedup := NewLRUDeduplicator(2)
+
+	duplicate, _ := dedup.MarkProcessed("a")
+	assert.False(t, duplicate, "the first delivery is not a duplicate")
+	duplicate, _ = dedup.MarkProcessed("a")
+	assert.True(t, duplicate, "a redelivery should be detected")
+
+	dedup.MarkProcessed("b")
+	dedup.MarkProcessed("a") // Refreshes a, so b is evicted next
+	dedup.MarkProcessed("c")
+
+	duplicate, _ = dedup.MarkProcessed("a")
+	assert.True(t, duplicate, "recently seen IDs should be kept")
+	duplicate, _ = dedup.MarkProcessed("b")
+	assert.False(t, duplicate, "the least recently seen ID should be evicted")
+}
+
+func TestPostgresDeduplicator(t *testing.T) {
+	messageID := NewMessageID()
+	dedup := NewPostgresDeduplicator(testDB, "tv_queue")
+
+	duplicate, err := dedup.MarkProcessed(messageID)
+	require.NoError(t, err)
+	assert.False(t, duplicate)
+
+	duplicate, err = dedup.MarkProcessed(messageID)
+	require.NoError(t, err)
+	assert.True(t, duplicate, "a redelivery should be detected")
+
+	duplicate, err = NewPostgresDeduplicator(testDB, "lights_queue").MarkProcessed(messageID)
+	require.NoError(t, err)
+	assert.False(t, duplicate, "consumers should not share processed messages")
+}
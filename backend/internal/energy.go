@@ -0,0 +1,354 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Report periods of the energy endpoints.
+const (
+	PeriodDaily   = "daily"
+	PeriodWeekly  = "weekly" // Weeks start on Monday
+	PeriodMonthly = "monthly"
+)
+
+// Sources of the consumption of a device.
+const (
+	EnergySourceMeter    = "meter"    // Integrated from power telemetry
+	EnergySourceEstimate = "estimate" // Estimated from the state history and the configured wattage
+	EnergySourceNone     = "none"     // Neither telemetry nor a wattage is available
+)
+
+// PowerSegment is a period during which a device drew a constant power.
+type PowerSegment struct {
+	Start time.Time
+	End   time.Time
+	Watts float64
+}
+
+// EnergyBucket is the consumption and cost of one report period.
+type EnergyBucket struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	KWh   float64   `json:"kwh"`
+	Cost  float64   `json:"cost"`
+}
+
+// EnergyReport is the consumption of a device or a room over a time range.
+type EnergyReport struct {
+	DeviceID  string         `json:"device_id,omitempty"`
+	Room      string         `json:"room,omitempty"`
+	Source    string         `json:"source,omitempty"` // Set for devices
+	Period    string         `json:"period"`
+	From      time.Time      `json:"from"`
+	To        time.Time      `json:"to"`
+	Currency  string         `json:"currency,omitempty"`
+	TotalKWh  float64        `json:"total_kwh"`
+	TotalCost float64        `json:"total_cost"`
+	Buckets   []EnergyBucket `json:"buckets,omitempty"`
+	Devices   []EnergyReport `json:"devices,omitempty"` // Totals of each device of a room
+}
+
+// EnergySource provides the data consumption is computed from.
+type EnergySource interface {
+	ListReadings(deviceID, metric string, from, to time.Time, limit int) ([]Reading, error)
+	StateTimeline(deviceID string, from, to time.Time) (string, []StateChange, error)
+}
+
+// tariffRule is a Tariff with its times parsed.
+type tariffRule struct {
+	Tariff
+	from, to int // Minutes after midnight, -1 when the tariff applies all day
+	days     map[time.Weekday]bool
+}
+
+// matches reports whether the tariff applies at the local time t.
+func (r tariffRule) matches(t time.Time) bool {
+	if len(r.days) > 0 && !r.days[t.Weekday()] {
+		return false
+	}
+	if r.from < 0 {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if r.from <= r.to {
+		return minute >= r.from && minute < r.to
+	}
+	return minute >= r.from || minute < r.to // Spans midnight
+}
+
+// EnergyCalculator computes the consumption and cost of devices.
+type EnergyCalculator struct {
+	wattage     map[string]map[string]float64 // Device type to state to watts
+	tariffs     []tariffRule
+	boundaries  []int // Minutes after midnight at which the applicable tariff may change
+	location    *time.Location
+	currency    string
+	powerMetric string
+}
+
+// NewEnergyCalculator creates an EnergyCalculator from the Energy configuration.
+func NewEnergyCalculator(config AppConfig) (*EnergyCalculator, error) {
+	energyConfig := config.Energy
+	c := &EnergyCalculator{
+		wattage:     make(map[string]map[string]float64),
+		location:    time.UTC,
+		currency:    energyConfig.Currency,
+		powerMetric: energyConfig.PowerMetric,
+	}
+	if c.powerMetric == "" {
+		c.powerMetric = "power"
+	}
+	if energyConfig.Timezone != "" {
+		location, err := time.LoadLocation(energyConfig.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid energy timezone: %w", err)
+		}
+		c.location = location
+	}
+
+	for _, wattage := range energyConfig.Wattage {
+		if c.wattage[wattage.DeviceType] == nil {
+			c.wattage[wattage.DeviceType] = make(map[string]float64)
+		}
+		c.wattage[wattage.DeviceType][wattage.State] = wattage.Watts
+	}
+
+	boundaries := map[int]bool{0: true}
+	for _, tariff := range energyConfig.Tariffs {
+		rule := tariffRule{Tariff: tariff, from: -1, to: -1}
+		if tariff.From != "" || tariff.To != "" {
+			var err error
+			if rule.from, err = parseClock(tariff.From); err != nil {
+				return nil, fmt.Errorf("invalid start of tariff %s: %w", tariff.Name, err)
+			}
+			if rule.to, err = parseClock(tariff.To); err != nil {
+				return nil, fmt.Errorf("invalid end of tariff %s: %w", tariff.Name, err)
+			}
+			boundaries[rule.from] = true
+			boundaries[rule.to] = true
+		}
+		if len(tariff.Days) > 0 {
+			rule.days = make(map[time.Weekday]bool)
+			for _, day := range tariff.Days {
+				weekday, ok := parseWeekday(day)
+				if !ok {
+					return nil, fmt.Errorf("invalid day %q of tariff %s", day, tariff.Name)
+				}
+				rule.days[weekday] = true
+			}
+		}
+		c.tariffs = append(c.tariffs, rule)
+	}
+	for minute := range boundaries {
+		c.boundaries = append(c.boundaries, minute)
+	}
+	sort.Ints(c.boundaries)
+	return c, nil
+}
+
+// parseClock parses a "HH:MM" time of day into minutes after midnight.
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseWeekday(value string) (time.Weekday, bool) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(day.String(), value) {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+// ValidPeriod reports whether period is one of the report periods.
+func ValidPeriod(period string) bool {
+	return period == PeriodDaily || period == PeriodWeekly || period == PeriodMonthly
+}
+
+// Watts returns the configured power draw of a device type in a state.
+func (c *EnergyCalculator) Watts(deviceType, state string) float64 {
+	return c.wattage[deviceType][state]
+}
+
+// price returns the price per kWh at t, zero when no tariff applies.
+func (c *EnergyCalculator) price(t time.Time) float64 {
+	local := t.In(c.location)
+	for _, tariff := range c.tariffs {
+		if tariff.matches(local) {
+			return tariff.PricePerKWh
+		}
+	}
+	return 0
+}
+
+// nextBoundary returns the first time after t at which the tariff or the report period may change.
+func (c *EnergyCalculator) nextBoundary(t time.Time) time.Time {
+	local := t.In(c.location)
+	for day := 0; day <= 1; day++ {
+		for _, minute := range c.boundaries {
+			boundary := time.Date(local.Year(), local.Month(), local.Day()+day, minute/60, minute%60, 0, 0, c.location)
+			if boundary.After(t) {
+				return boundary
+			}
+		}
+	}
+	return time.Date(local.Year(), local.Month(), local.Day()+2, 0, 0, 0, 0, c.location)
+}
+
+// periodStart returns the start of the report period containing t.
+func (c *EnergyCalculator) periodStart(t time.Time, period string) time.Time {
+	local := t.In(c.location)
+	switch period {
+	case PeriodWeekly:
+		offset := (int(local.Weekday()) + 6) % 7 // Days since Monday
+		return time.Date(local.Year(), local.Month(), local.Day()-offset, 0, 0, 0, 0, c.location)
+	case PeriodMonthly:
+		return time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, c.location)
+	default:
+		return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, c.location)
+	}
+}
+
+// nextPeriod returns the start of the report period after the one starting at start.
+func (c *EnergyCalculator) nextPeriod(start time.Time, period string) time.Time {
+	switch period {
+	case PeriodWeekly:
+		return time.Date(start.Year(), start.Month(), start.Day()+7, 0, 0, 0, 0, c.location)
+	case PeriodMonthly:
+		return time.Date(start.Year(), start.Month()+1, 1, 0, 0, 0, 0, c.location)
+	default:
+		return time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, c.location)
+	}
+}
+
+// Buckets splits the consumption of segments between from and to into report periods, pricing each
+// part with the tariff that applied at the time.
+func (c *EnergyCalculator) Buckets(segments []PowerSegment, period string, from, to time.Time) []EnergyBucket {
+	var buckets []EnergyBucket
+	for start := c.periodStart(from, period); start.Before(to); start = c.nextPeriod(start, period) {
+		bucket := EnergyBucket{Start: start, End: c.nextPeriod(start, period)}
+		if bucket.Start.Before(from) {
+			bucket.Start = from
+		}
+		if bucket.End.After(to) {
+			bucket.End = to
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	for _, segment := range segments {
+		start, end := segment.Start, segment.End
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+
+		index := 0
+		for cursor := start; cursor.Before(end); {
+			next := c.nextBoundary(cursor)
+			if next.After(end) {
+				next = end
+			}
+			for index < len(buckets)-1 && !cursor.Before(buckets[index].End) {
+				index++
+			}
+			kwh := segment.Watts * next.Sub(cursor).Hours() / 1000
+			buckets[index].KWh += kwh
+			buckets[index].Cost += kwh * c.price(cursor)
+			cursor = next
+		}
+	}
+	return buckets
+}
+
+// SegmentsFromReadings turns power readings into segments, each reading holding until the next one
+// or until to.
+func SegmentsFromReadings(readings []Reading, to time.Time) []PowerSegment {
+	segments := make([]PowerSegment, 0, len(readings))
+	for i, reading := range readings {
+		end := to
+		if i+1 < len(readings) {
+			end = readings[i+1].Timestamp
+		}
+		segments = append(segments, PowerSegment{Start: reading.Timestamp, End: end, Watts: reading.Value})
+	}
+	return segments
+}
+
+// SegmentsFromStates turns a state timeline into segments using the configured wattage of deviceType.
+func (c *EnergyCalculator) SegmentsFromStates(deviceType, initial string, changes []StateChange, from, to time.Time) []PowerSegment {
+	segments := make([]PowerSegment, 0, len(changes)+1)
+	start, state := from, initial
+	for _, change := range changes {
+		segments = append(segments, PowerSegment{Start: start, End: change.ChangedAt, Watts: c.Watts(deviceType, state)})
+		start, state = change.ChangedAt, change.State
+	}
+	return append(segments, PowerSegment{Start: start, End: to, Watts: c.Watts(deviceType, state)})
+}
+
+// DeviceReport computes the consumption of a device from its power telemetry, or estimates it from
+// its state history when it has no meter.
+func (c *EnergyCalculator) DeviceReport(source EnergySource, device Device, period string, from, to time.Time) (EnergyReport, error) {
+	report := EnergyReport{DeviceID: device.ID, Period: period, From: from, To: to, Currency: c.currency}
+
+	readings, err := source.ListReadings(device.ID, c.powerMetric, from, to, 0)
+	if err != nil {
+		return EnergyReport{}, err
+	}
+
+	var segments []PowerSegment
+	switch {
+	case len(readings) > 0:
+		report.Source = EnergySourceMeter
+		segments = SegmentsFromReadings(readings, to)
+	case len(c.wattage[device.Type]) > 0:
+		report.Source = EnergySourceEstimate
+		initial, changes, err := source.StateTimeline(device.ID, from, to)
+		if err != nil {
+			return EnergyReport{}, err
+		}
+		segments = c.SegmentsFromStates(device.Type, initial, changes, from, to)
+	default:
+		report.Source = EnergySourceNone
+	}
+
+	report.Buckets = c.Buckets(segments, period, from, to)
+	for _, bucket := range report.Buckets {
+		report.TotalKWh += bucket.KWh
+		report.TotalCost += bucket.Cost
+	}
+	return report, nil
+}
+
+// RoomReport sums the consumption of the devices of a room.
+func (c *EnergyCalculator) RoomReport(source EnergySource, room string, devices []Device, period string, from, to time.Time) (EnergyReport, error) {
+	report := EnergyReport{Room: room, Period: period, From: from, To: to, Currency: c.currency}
+	report.Buckets = c.Buckets(nil, period, from, to)
+	report.Devices = []EnergyReport{}
+
+	for _, device := range devices {
+		deviceReport, err := c.DeviceReport(source, device, period, from, to)
+		if err != nil {
+			return EnergyReport{}, err
+		}
+		for i, bucket := range deviceReport.Buckets {
+			report.Buckets[i].KWh += bucket.KWh
+			report.Buckets[i].Cost += bucket.Cost
+		}
+		report.TotalKWh += deviceReport.TotalKWh
+		report.TotalCost += deviceReport.TotalCost
+
+		deviceReport.Buckets = nil
+		report.Devices = append(report.Devices, deviceReport)
+	}
+	return report, nil
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEnergySource serves fixed readings and state timelines per device.
+type fakeEnergySource struct {
+	readings map[string][]Reading
+	initial  map[string]string
+	changes  map[string][]StateChange
+}
+
+func (f *fakeEnergySource) ListReadings(deviceID, metric string, from, to time.Time, limit int) ([]Reading, error) {
+	return f.readings[deviceID], nil
+}
+
+func (f *fakeEnergySource) StateTimeline(deviceID string, from, to time.Time) (string, []StateChange, error) {
+	return f.initial[deviceID], f.changes[deviceID], nil
+}
+
+func energyConfig() AppConfig {
+	var config AppConfig
+	config.Energy.Currency = "EUR"
+	config.Energy.Wattage = []DeviceWattage{
+		{DeviceType: "air_conditioner", State: "cooling", Watts: 1200},
+		{DeviceType: "heater", State: "on", Watts: 2000},
+	}
+	config.Energy.Tariffs = []Tariff{
+		{Name: "off-peak", PricePerKWh: 0.10, From: "22:00", To: "07:00"},
+		{Name: "weekend", PricePerKWh: 0.15, Days: []string{"Saturday", "Sunday"}},
+		{Name: "standard", PricePerKWh: 0.30},
+	}
+	return config
+}
+
+func TestEnergyEstimatedFromStates(t *testing.T) {
+	calculator, err := NewEnergyCalculator(energyConfig())
+	require.NoError(t, err)
+
+	// Monday 2024-05-06, cooling from 06:00 to 08:00 crosses the end of the off-peak tariff
+	from := time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+	source := &fakeEnergySource{
+		initial: map[string]string{"ac1": "off"},
+		changes: map[string][]StateChange{"ac1": {
+			{State: "cooling", ChangedAt: from.Add(6 * time.Hour)},
+			{State: "off", ChangedAt: from.Add(8 * time.Hour)},
+		}},
+	}
+
+	report, err := calculator.DeviceReport(source, Device{ID: "ac1", Type: "air_conditioner"}, PeriodDaily, from, to)
+	require.NoError(t, err)
+	assert.Equal(t, EnergySourceEstimate, report.Source)
+	assert.InDelta(t, 2.4, report.TotalKWh, 1e-9, "2 hours at 1200 W")
+	assert.InDelta(t, 1.2*0.10+1.2*0.30, report.TotalCost, 1e-9, "each hour should be priced with its own tariff")
+	require.Len(t, report.Buckets, 1)
+	assert.Equal(t, "EUR", report.Currency)
+}
+
+func TestEnergyFromMeter(t *testing.T) {
+	calculator, err := NewEnergyCalculator(energyConfig())
+	require.NoError(t, err)
+
+	// Saturday 2024-05-11 12:00, weekend tariff
+	from := time.Date(2024, 5, 11, 12, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	source := &fakeEnergySource{readings: map[string][]Reading{"heater1": {
+		{Value: 1000, Timestamp: from},
+		{Value: 3000, Timestamp: from.Add(30 * time.Minute)},
+	}}}
+
+	report, err := calculator.DeviceReport(source, Device{ID: "heater1", Type: "heater"}, PeriodDaily, from, to)
+	require.NoError(t, err)
+	assert.Equal(t, EnergySourceMeter, report.Source, "telemetry should be preferred over estimates")
+	assert.InDelta(t, 2.0, report.TotalKWh, 1e-9, "half an hour at 1 kW and half an hour at 3 kW")
+	assert.InDelta(t, 2.0*0.15, report.TotalCost, 1e-9)
+}
+
+func TestEnergyBucketsPerPeriod(t *testing.T) {
+	calculator, err := NewEnergyCalculator(energyConfig())
+	require.NoError(t, err)
+
+	// Wednesday 2024-05-01 to Monday 2024-06-03, heater on all the time
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)
+	segments := []PowerSegment{{Start: from, End: to, Watts: 1000}}
+
+	monthly := calculator.Buckets(segments, PeriodMonthly, from, to)
+	require.Len(t, monthly, 2)
+	assert.InDelta(t, 31*24.0, monthly[0].KWh, 1e-6)
+	assert.InDelta(t, 2*24.0, monthly[1].KWh, 1e-6)
+
+	weekly := calculator.Buckets(segments, PeriodWeekly, from, to)
+	require.Len(t, weekly, 5)
+	assert.Equal(t, from, weekly[0].Start, "the first week should be clipped to the range")
+	assert.Equal(t, time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC), weekly[1].Start, "weeks should start on Monday")
+	assert.InDelta(t, 5*24.0, weekly[0].KWh, 1e-6)
+
+	daily := calculator.Buckets(segments, PeriodDaily, from, to)
+	assert.Len(t, daily, 33)
+}
+
+func TestEnergyRoomReport(t *testing.T) {
+	calculator, err := NewEnergyCalculator(energyConfig())
+	require.NoError(t, err)
+
+	from := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	source := &fakeEnergySource{initial: map[string]string{"ac1": "cooling", "heater1": "on", "tv1": "on"}}
+	devices := []Device{
+		{ID: "ac1", Type: "air_conditioner"},
+		{ID: "heater1", Type: "heater"},
+		{ID: "tv1", Type: "tv"},
+	}
+
+	report, err := calculator.RoomReport(source, "living_room", devices, PeriodDaily, from, to)
+	require.NoError(t, err)
+	assert.InDelta(t, 3.2, report.TotalKWh, 1e-9, "the room should sum its devices")
+	require.Len(t, report.Devices, 3)
+	assert.Equal(t, EnergySourceNone, report.Devices[2].Source, "devices without meter or wattage should be reported")
+}
+
+func TestEnergyCalculatorRejectsInvalidTariffs(t *testing.T) {
+	config := energyConfig()
+	config.Energy.Tariffs = []Tariff{{Name: "night", From: "25:00", To: "07:00"}}
+	_, err := NewEnergyCalculator(config)
+	assert.Error(t, err)
+
+	config = energyConfig()
+	config.Energy.Tariffs = []Tariff{{Name: "weekend", Days: []string{"Caturday"}}}
+	_, err = NewEnergyCalculator(config)
+	assert.Error(t, err)
+}
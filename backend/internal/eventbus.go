@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Policies applied to subscribers that cannot keep up with the event rate.
+const (
+	SlowClientDisconnect = "disconnect" // Close the subscription, the client resumes with its last event ID
+	SlowClientDrop       = "drop"       // Skip events until the subscriber has room again
+)
+
+// Event is a device event as delivered to streaming clients.
+type Event struct {
+	ID          uint64    `json:"id"`
+	RoutingKey  string    `json:"routing_key"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        string    `json:"body"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// EventBus fans out events to in-process subscribers and keeps a short replay buffer.
+// Publish never blocks, so a slow subscriber cannot stall the AMQP consumer feeding the bus.
+type EventBus struct {
+	mu          sync.Mutex
+	nextID      uint64
+	replay      []Event // Ring buffer of the most recent events
+	replayStart int     // Index of the oldest event in replay
+	replaySize  int
+	clientSize  int
+	policy      string
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives the events matching its routing key filter.
+type Subscription struct {
+	C      <-chan Event
+	ch     chan Event
+	filter string
+	closed bool
+}
+
+// NewEventBus creates a bus replaying up to replaySize events, buffering clientSize events per subscriber.
+func NewEventBus(replaySize, clientSize int, policy string) *EventBus {
+	if replaySize <= 0 {
+		replaySize = 1000
+	}
+	if clientSize <= 0 {
+		clientSize = 64
+	}
+	if policy != SlowClientDrop {
+		policy = SlowClientDisconnect
+	}
+	return &EventBus{
+		nextID:      1,
+		replay:      make([]Event, 0, replaySize),
+		replaySize:  replaySize,
+		clientSize:  clientSize,
+		policy:      policy,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish assigns the next event ID, stores the event for replay and delivers it to matching subscribers.
+func (b *EventBus) Publish(routingKey, contentType string, body []byte, timestamp time.Time) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	event := Event{
+		ID:          b.nextID,
+		RoutingKey:  routingKey,
+		ContentType: contentType,
+		Body:        string(body),
+		Timestamp:   timestamp,
+	}
+	b.nextID++
+
+	if len(b.replay) < b.replaySize {
+		b.replay = append(b.replay, event)
+	} else {
+		b.replay[b.replayStart] = event
+		b.replayStart = (b.replayStart + 1) % b.replaySize
+	}
+
+	for sub := range b.subscribers {
+		if !MatchRoutingKey(sub.filter, routingKey) {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			if b.policy == SlowClientDrop {
+				continue
+			}
+			b.closeLocked(sub)
+		}
+	}
+	return event
+}
+
+// Feed publishes every delivery onto the bus until the channel is closed.
+func (b *EventBus) Feed(messages <-chan amqp.Delivery) {
+	for msg := range messages {
+		timestamp := msg.Timestamp
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+		b.Publish(msg.RoutingKey, msg.ContentType, msg.Body, timestamp)
+	}
+}
+
+// Send publishes a message onto the bus, so the bus can stand in for a Publisher, e.g. to replay a
+// recording in process. The exchange is ignored.
+func (b *EventBus) Send(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	timestamp := msg.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	b.Publish(routingKey, msg.ContentType, msg.Body, timestamp)
+	return nil
+}
+
+// Subscribe registers a subscriber for events matching filter. Buffered events newer than lastEventID
+// are returned for replay; pass 0 to only receive new events.
+func (b *EventBus) Subscribe(filter string, lastEventID uint64) (*Subscription, []Event, error) {
+	if err := ValidateRoutingKeyFilter(filter); err != nil {
+		return nil, nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var missed []Event
+	if lastEventID > 0 {
+		for i := 0; i < len(b.replay); i++ {
+			event := b.replay[(b.replayStart+i)%len(b.replay)]
+			if event.ID > lastEventID && MatchRoutingKey(filter, event.RoutingKey) {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	ch := make(chan Event, b.clientSize)
+	sub := &Subscription{C: ch, ch: ch, filter: filter}
+	b.subscribers[sub] = struct{}{}
+	return sub, missed, nil
+}
+
+// Unsubscribe removes the subscriber and closes its channel.
+func (b *EventBus) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closeLocked(sub)
+}
+
+func (b *EventBus) closeLocked(sub *Subscription) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(b.subscribers, sub)
+	close(sub.ch)
+}
+
+// Subscribers returns the number of active subscribers.
+func (b *EventBus) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
+
+// ValidateRoutingKeyFilter checks that filter is a valid topic binding pattern.
+func ValidateRoutingKeyFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("routing key filter must not be empty")
+	}
+	for _, word := range strings.Split(filter, ".") {
+		if word == "" {
+			return fmt.Errorf("routing key filter %q has an empty word", filter)
+		}
+		if strings.ContainsAny(word, "*#") && len(word) > 1 {
+			return fmt.Errorf("routing key filter %q mixes wildcards with text", filter)
+		}
+	}
+	return nil
+}
+
+// MatchRoutingKey reports whether key matches the topic exchange pattern, where "*" matches exactly
+// one word and "#" matches zero or more words (e.g., "device.tv.#" matches "device.tv.on").
+func MatchRoutingKey(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case "#":
+			for i := 0; i <= len(key); i++ {
+				if matchWords(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(key) == 0 {
+				return false
+			}
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
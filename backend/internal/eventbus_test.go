@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchRoutingKey(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"#", "device.tv.on", true},
+		{"device.tv.#", "device.tv.on", true},
+		{"device.tv.#", "device.tv", true},
+		{"device.tv.#", "device.heater.on", false},
+		{"device.*.on", "device.tv.on", true},
+		{"device.*.on", "device.tv.off", false},
+		{"device.*", "device.tv.on", false},
+		{"*.tv.*", "device.tv.on", true},
+		{"device.#.on", "device.tv.on", true},
+		{"device.#.on", "device.on", true},
+		{"device.tv.on", "device.tv.on", true},
+		{"device.tv.on", "device.tv.off", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.match, MatchRoutingKey(tt.pattern, tt.key), "pattern %s with key %s", tt.pattern, tt.key)
+	}
+}
+
+func TestValidateRoutingKeyFilter(t *testing.T) {
+	assert.NoError(t, ValidateRoutingKeyFilter("device.*.#"))
+	assert.Error(t, ValidateRoutingKeyFilter(""))
+	assert.Error(t, ValidateRoutingKeyFilter("device..on"))
+	assert.Error(t, ValidateRoutingKeyFilter("device.tv*"))
+}
+
+func TestEventBusFiltersAndReplays(t *testing.T) {
+	bus := NewEventBus(3, 10, SlowClientDisconnect)
+
+	sub, missed, err := bus.Subscribe("device.tv.#", 0)
+	require.NoError(t, err, "should subscribe")
+	assert.Empty(t, missed, "new subscribers without a last event ID get no replay")
+
+	now := time.Now()
+	bus.Publish("device.tv.on", "application/json", []byte(`{"id":"tv1"}`), now)
+	bus.Publish("device.heater.on", "application/json", []byte(`{"id":"heater1"}`), now)
+	bus.Publish("device.tv.off", "application/json", []byte(`{"id":"tv1"}`), now)
+
+	first := <-sub.C
+	second := <-sub.C
+	assert.Equal(t, "device.tv.on", first.RoutingKey)
+	assert.Equal(t, "device.tv.off", second.RoutingKey, "non-matching events should be filtered out")
+	assert.Greater(t, second.ID, first.ID, "event IDs should increase")
+
+	// Resuming after the first event replays the remaining matching events
+	resumed, missed, err := bus.Subscribe("device.tv.#", first.ID)
+	require.NoError(t, err, "should resume")
+	require.Len(t, missed, 1)
+	assert.Equal(t, second.ID, missed[0].ID)
+	bus.Unsubscribe(resumed)
+
+	// The replay buffer only keeps the most recent events
+	bus.Publish("device.tv.on", "", nil, now)
+	bus.Publish("device.tv.on", "", nil, now)
+	_, missed, err = bus.Subscribe("#", 1)
+	require.NoError(t, err)
+	assert.Len(t, missed, 3, "replay should be limited to the buffer size")
+	assert.Equal(t, uint64(3), missed[0].ID, "oldest events should be evicted first")
+}
+
+func TestEventBusDisconnectsSlowClients(t *testing.T) {
+	bus := NewEventBus(10, 2, SlowClientDisconnect)
+	sub, _, err := bus.Subscribe("#", 0)
+	require.NoError(t, err)
+
+	// Publishing never blocks, even when the subscriber does not read
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			bus.Publish(fmt.Sprintf("device.tv.%d", i), "", nil, time.Now())
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publishing blocked on a slow subscriber")
+	}
+
+	received := 0
+	for range sub.C {
+		received++
+	}
+	assert.Equal(t, 2, received, "buffered events should be delivered before the channel closes")
+	assert.Equal(t, 0, bus.Subscribers(), "slow subscriber should be removed")
+}
+
+func TestEventBusDropsForSlowClients(t *testing.T) {
+	bus := NewEventBus(10, 2, SlowClientDrop)
+	sub, _, err := bus.Subscribe("#", 0)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		bus.Publish(fmt.Sprintf("device.tv.%d", i), "", nil, time.Now())
+	}
+	assert.Equal(t, 1, bus.Subscribers(), "slow subscriber should stay connected")
+
+	assert.Equal(t, "device.tv.0", (<-sub.C).RoutingKey)
+	assert.Equal(t, "device.tv.1", (<-sub.C).RoutingKey)
+
+	bus.Publish("device.tv.5", "", nil, time.Now())
+	assert.Equal(t, "device.tv.5", (<-sub.C).RoutingKey, "events after catching up should be delivered")
+}
@@ -0,0 +1,467 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Types of the events in the device event store.
+const (
+	EventDeviceRegistered   = "registered"
+	EventDeviceStateChanged = "state_changed"
+	EventDeviceDeleted      = "deleted"
+	EventDeviceImported     = "imported" // Snapshot of a device registered before the event store existed
+)
+
+// StoredEvent is an entry of the append-only device event store. Its position orders it after every
+// event stored before it.
+type StoredEvent struct {
+	Position      int64      `json:"position"`
+	Type          string     `json:"type"`
+	DeviceID      string     `json:"device_id"`
+	DeviceType    string     `json:"device_type"`
+	PreviousState string     `json:"previous_state,omitempty"`
+	State         string     `json:"state,omitempty"`
+	Room          string     `json:"room,omitempty"`
+	Version       int64      `json:"version"`              // Version of the device after the event
+	MessageID     string     `json:"message_id,omitempty"` // Device event the change came from, if any
+	EventTime     *time.Time `json:"event_time,omitempty"`
+	RecordedAt    time.Time  `json:"recorded_at"`
+}
+
+// errDuplicateEvent is returned by appendEvent when an event with the same message ID is stored already.
+var errDuplicateEvent = errors.New("event is already stored")
+
+// appendEvent stores an event in the transaction that applies it, so the store and the devices never
+// disagree.
+func appendEvent(tx *sql.Tx, event StoredEvent) (StoredEvent, error) {
+	query := `INSERT INTO device_event_store
+                  (event_type, device_id, device_type, previous_state, state, room, version, message_id, event_time)
+              VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9)
+              ON CONFLICT (message_id) DO NOTHING
+              RETURNING position, recorded_at`
+	err := tx.QueryRow(query, event.Type, event.DeviceID, event.DeviceType, event.PreviousState, event.State,
+		event.Room, event.Version, event.MessageID, event.EventTime).Scan(&event.Position, &event.RecordedAt)
+	if err == sql.ErrNoRows {
+		return event, errDuplicateEvent
+	}
+	if err != nil {
+		return event, fmt.Errorf("failed to append device event: %w", err)
+	}
+	return event, nil
+}
+
+const storedEventColumns = `position, event_type, device_id, device_type, previous_state, state, room, version,
+    COALESCE(message_id, ''), event_time, recorded_at`
+
+func scanStoredEvents(rows *sql.Rows) ([]StoredEvent, error) {
+	defer rows.Close()
+	events := []StoredEvent{}
+	for rows.Next() {
+		var event StoredEvent
+		err := rows.Scan(&event.Position, &event.Type, &event.DeviceID, &event.DeviceType, &event.PreviousState,
+			&event.State, &event.Room, &event.Version, &event.MessageID, &event.EventTime, &event.RecordedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan device event: %w", err)
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read device events: %w", err)
+	}
+	return events, nil
+}
+
+// ReadEvents returns up to limit events after position, oldest first. Events of transactions that
+// started before a still running one are held back, so a later read never returns an event positioned
+// before the last one returned.
+func (p *PostgreSQLClient) ReadEvents(ctx context.Context, after int64, limit int) ([]StoredEvent, error) {
+	query := `SELECT ` + storedEventColumns + ` FROM device_event_store
+              WHERE position > $1 AND transaction_id < pg_snapshot_xmin(pg_current_snapshot())
+              ORDER BY position LIMIT $2`
+	rows, err := p.DB.QueryContext(ctx, query, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device events: %w", err)
+	}
+	return scanStoredEvents(rows)
+}
+
+// ListDeviceEvents retrieves the stored events of a device, oldest first.
+func (p *PostgreSQLClient) ListDeviceEvents(deviceID string) ([]StoredEvent, error) {
+	query := `SELECT ` + storedEventColumns + ` FROM device_event_store WHERE device_id = $1 ORDER BY position`
+	rows, err := p.DB.Query(query, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list device events: %w", err)
+	}
+	return scanStoredEvents(rows)
+}
+
+// Projection builds a read model from the events of the device event store.
+type Projection interface {
+	Name() string                              // Key of the projection's checkpoint
+	Reset(tx *sql.Tx) error                    // Clears the read model before a rebuild
+	Apply(tx *sql.Tx, event StoredEvent) error // Applies the next event; must tolerate events applied twice
+}
+
+// ProjectionFinisher is implemented by projections that need a last step after a rebuild, e.g. to
+// restore data that does not come from events.
+type ProjectionFinisher interface {
+	Finish(tx *sql.Tx) error
+}
+
+// Checkpoint returns the position of the last event applied by a projection, 0 when it applied none.
+func (p *PostgreSQLClient) Checkpoint(ctx context.Context, name string) (int64, error) {
+	var position int64
+	err := p.DB.QueryRowContext(ctx, `SELECT position FROM projection_checkpoints WHERE name = $1`, name).Scan(&position)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to get projection checkpoint: %w", err)
+	}
+	return position, nil
+}
+
+// CatchUp applies the events stored after a projection's checkpoint in batches of batchSize, moving the
+// checkpoint in the transaction of each batch, and returns how many events it applied. Projections
+// applied inline, like DeviceProjection, are already current and must not be caught up.
+func (p *PostgreSQLClient) CatchUp(ctx context.Context, projection Projection, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	applied := 0
+	for {
+		n, err := p.catchUpBatch(ctx, projection, batchSize)
+		applied += n
+		if err != nil || n < batchSize {
+			return applied, err
+		}
+	}
+}
+
+func (p *PostgreSQLClient) catchUpBatch(ctx context.Context, projection Projection, batchSize int) (int, error) {
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin projection batch: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Locking the checkpoint keeps two instances from applying the same batch
+	_, err = tx.Exec(`INSERT INTO projection_checkpoints (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, projection.Name())
+	if err != nil {
+		return 0, fmt.Errorf("failed to create projection checkpoint: %w", err)
+	}
+	var position int64
+	err = tx.QueryRow(`SELECT position FROM projection_checkpoints WHERE name = $1 FOR UPDATE`, projection.Name()).Scan(&position)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get projection checkpoint: %w", err)
+	}
+
+	query := `SELECT ` + storedEventColumns + ` FROM device_event_store
+              WHERE position > $1 AND transaction_id < pg_snapshot_xmin(pg_current_snapshot())
+              ORDER BY position LIMIT $2`
+	rows, err := tx.Query(query, position, batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read device events: %w", err)
+	}
+	events, err := scanStoredEvents(rows)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+	for _, event := range events {
+		if err := projection.Apply(tx, event); err != nil {
+			return 0, fmt.Errorf("projection %s failed at position %d: %w", projection.Name(), event.Position, err)
+		}
+	}
+	if err := saveCheckpoint(tx, projection.Name(), events[len(events)-1].Position); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit projection batch: %w", err)
+	}
+	return len(events), nil
+}
+
+func saveCheckpoint(tx *sql.Tx, name string, position int64) error {
+	query := `INSERT INTO projection_checkpoints (name, position, updated_at) VALUES ($1, $2, NOW())
+              ON CONFLICT (name) DO UPDATE SET position = EXCLUDED.position, updated_at = EXCLUDED.updated_at`
+	if _, err := tx.Exec(query, name, position); err != nil {
+		return fmt.Errorf("failed to save projection checkpoint: %w", err)
+	}
+	return nil
+}
+
+// RebuildResult describes a projection rebuild.
+type RebuildResult struct {
+	Events   int   // Events applied
+	Position int64 // Position of the last event applied, the projection's new checkpoint
+}
+
+// Rebuild resets a projection and applies every stored event again, in a single transaction. Events
+// cannot be appended during a rebuild, so none are missed.
+func (p *PostgreSQLClient) Rebuild(ctx context.Context, projection Projection) (RebuildResult, error) {
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return RebuildResult{}, fmt.Errorf("failed to begin rebuild: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := rebuild(tx, projection)
+	if err != nil {
+		return result, err
+	}
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit rebuild: %w", err)
+	}
+	return result, nil
+}
+
+func rebuild(tx *sql.Tx, projection Projection) (RebuildResult, error) {
+	var result RebuildResult
+	if _, err := tx.Exec(`LOCK TABLE device_event_store IN EXCLUSIVE MODE`); err != nil {
+		return result, fmt.Errorf("failed to lock device event store: %w", err)
+	}
+	if err := projection.Reset(tx); err != nil {
+		return result, fmt.Errorf("failed to reset projection %s: %w", projection.Name(), err)
+	}
+
+	query := `SELECT ` + storedEventColumns + ` FROM device_event_store WHERE position > $1 ORDER BY position LIMIT 1000`
+	for {
+		rows, err := tx.Query(query, result.Position)
+		if err != nil {
+			return result, fmt.Errorf("failed to read device events: %w", err)
+		}
+		events, err := scanStoredEvents(rows)
+		if err != nil {
+			return result, err
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, event := range events {
+			if err := projection.Apply(tx, event); err != nil {
+				return result, fmt.Errorf("projection %s failed at position %d: %w", projection.Name(), event.Position, err)
+			}
+			result.Events++
+			result.Position = event.Position
+		}
+	}
+
+	if finisher, ok := projection.(ProjectionFinisher); ok {
+		if err := finisher.Finish(tx); err != nil {
+			return result, fmt.Errorf("failed to finish projection %s: %w", projection.Name(), err)
+		}
+	}
+	return result, saveCheckpoint(tx, projection.Name(), result.Position)
+}
+
+// RestoreDevices puts the devices back into the state they had at asOf by appending the events that
+// undo every change recorded since, so the store stays the source of truth and later rebuilds keep the
+// restored state. It returns the events appended.
+func (p *PostgreSQLClient) RestoreDevices(ctx context.Context, asOf time.Time) ([]StoredEvent, error) {
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin restore: %w", err)
+	}
+	defer tx.Rollback()
+
+	events, err := restoreDevices(tx, asOf)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit restore: %w", err)
+	}
+	return events, nil
+}
+
+func restoreDevices(tx *sql.Tx, asOf time.Time) ([]StoredEvent, error) {
+	if _, err := tx.Exec(`LOCK TABLE device_event_store IN EXCLUSIVE MODE`); err != nil {
+		return nil, fmt.Errorf("failed to lock device event store: %w", err)
+	}
+
+	// The last event of every device recorded until asOf holds the state it had then
+	query := `SELECT DISTINCT ON (device_id) ` + storedEventColumns + ` FROM device_event_store
+              WHERE recorded_at <= $1 ORDER BY device_id, position DESC`
+	rows, err := tx.Query(query, asOf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device events: %w", err)
+	}
+	last, err := scanStoredEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+	past := make(map[string]StoredEvent, len(last))
+	for _, event := range last {
+		if event.Type != EventDeviceDeleted {
+			past[event.DeviceID] = event
+		}
+	}
+
+	rows, err = tx.Query(`SELECT device_id, type, state, room, version FROM devices ORDER BY device_id FOR UPDATE`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+	defer rows.Close()
+	var current []Device
+	for rows.Next() {
+		var device Device
+		if err := rows.Scan(&device.ID, &device.Type, &device.State, &device.Room, &device.Version); err != nil {
+			return nil, fmt.Errorf("failed to scan device: %w", err)
+		}
+		current = append(current, device)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+
+	now := time.Now()
+	var undo []StoredEvent
+	for _, device := range current {
+		then, existed := past[device.ID]
+		delete(past, device.ID)
+		switch {
+		case !existed || then.DeviceType != device.Type:
+			undo = append(undo, StoredEvent{Type: EventDeviceDeleted, DeviceID: device.ID, DeviceType: device.Type,
+				PreviousState: device.State, Room: device.Room, Version: device.Version})
+			if existed {
+				undo = append(undo, StoredEvent{Type: EventDeviceRegistered, DeviceID: device.ID, DeviceType: then.DeviceType,
+					State: then.State, Room: then.Room, Version: 1})
+			}
+		case then.Room != device.Room:
+			undo = append(undo, StoredEvent{Type: EventDeviceRegistered, DeviceID: device.ID, DeviceType: device.Type,
+				State: then.State, Room: then.Room, Version: device.Version + 1})
+		case then.State != device.State:
+			undo = append(undo, StoredEvent{Type: EventDeviceStateChanged, DeviceID: device.ID, DeviceType: device.Type,
+				PreviousState: device.State, State: then.State, Room: device.Room, Version: device.Version + 1,
+				MessageID: NewMessageID(), EventTime: &now})
+		}
+	}
+	for _, then := range last {
+		if _, missing := past[then.DeviceID]; missing {
+			undo = append(undo, StoredEvent{Type: EventDeviceRegistered, DeviceID: then.DeviceID, DeviceType: then.DeviceType,
+				State: then.State, Room: then.Room, Version: 1})
+		}
+	}
+
+	appended := make([]StoredEvent, 0, len(undo))
+	for _, event := range undo {
+		stored, err := appendEvent(tx, event)
+		if err != nil {
+			return nil, err
+		}
+		if err := (DeviceProjection{}).Apply(tx, stored); err != nil {
+			return nil, err
+		}
+		appended = append(appended, stored)
+	}
+	return appended, nil
+}
+
+// PreviewDeviceRebuild returns the devices a rebuild of DeviceProjection would produce, or with a
+// non-zero asOf the devices RestoreDevices would produce, without changing them.
+func (p *PostgreSQLClient) PreviewDeviceRebuild(ctx context.Context, asOf time.Time) ([]Device, error) {
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin rebuild preview: %w", err)
+	}
+	defer tx.Rollback()
+
+	if asOf.IsZero() {
+		_, err = rebuild(tx, DeviceProjection{})
+	} else {
+		_, err = restoreDevices(tx, asOf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT device_id, type, state, room, version, event_time, presence, last_seen_at FROM devices ORDER BY device_id`
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var device Device
+		if err := rows.Scan(&device.ID, &device.Type, &device.State, &device.Room, &device.Version, &device.EventTime,
+			&device.Status, &device.LastSeenAt); err != nil {
+			return nil, fmt.Errorf("failed to scan device: %w", err)
+		}
+		devices = append(devices, device)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+	return devices, nil
+}
+
+// DeviceProjection maintains the devices table and the state history from the event store. It is
+// applied in the transaction of every device write, so it never lags behind the store; its checkpoint
+// records the position of its last rebuild.
+type DeviceProjection struct{}
+
+// Name returns the checkpoint key of the projection.
+func (DeviceProjection) Name() string {
+	return "devices"
+}
+
+// Reset removes every device and its history, keeping their presence aside, as it comes from heartbeats
+// rather than events.
+func (DeviceProjection) Reset(tx *sql.Tx) error {
+	query := `CREATE TEMPORARY TABLE device_presence_backup ON COMMIT DROP AS
+              SELECT device_id, presence, last_seen_at FROM devices`
+	if _, err := tx.Exec(query); err != nil {
+		return fmt.Errorf("failed to keep device presence: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM devices`); err != nil {
+		return fmt.Errorf("failed to delete devices: %w", err)
+	}
+	return nil
+}
+
+// Apply applies a device event to the devices table and the state history.
+func (DeviceProjection) Apply(tx *sql.Tx, event StoredEvent) error {
+	switch event.Type {
+	case EventDeviceRegistered, EventDeviceImported:
+		query := `INSERT INTO devices (device_id, type, state, room, version, event_time) VALUES ($1, $2, $3, $4, $5, $6)
+                  ON CONFLICT (device_id) DO UPDATE SET state = EXCLUDED.state, room = EXCLUDED.room,
+                  version = EXCLUDED.version, event_time = COALESCE(EXCLUDED.event_time, devices.event_time)`
+		_, err := tx.Exec(query, event.DeviceID, event.DeviceType, event.State, event.Room, event.Version, event.EventTime)
+		if err != nil {
+			return fmt.Errorf("failed to insert device: %w", err)
+		}
+	case EventDeviceStateChanged:
+		query := `UPDATE devices SET state = $1, version = $2, event_time = COALESCE($3, event_time) WHERE device_id = $4`
+		if _, err := tx.Exec(query, event.State, event.Version, event.EventTime, event.DeviceID); err != nil {
+			return fmt.Errorf("failed to update device state: %w", err)
+		}
+		if event.State == event.PreviousState || event.MessageID == "" || event.EventTime == nil {
+			return nil
+		}
+		query = `INSERT INTO device_state_history (device_id, previous_state, state, message_id, changed_at)
+                 VALUES ($1, $2, $3, $4, $5) ON CONFLICT (message_id) DO NOTHING`
+		_, err := tx.Exec(query, event.DeviceID, event.PreviousState, event.State, event.MessageID, *event.EventTime)
+		if err != nil {
+			return fmt.Errorf("failed to record state change: %w", err)
+		}
+	case EventDeviceDeleted:
+		if _, err := tx.Exec(`DELETE FROM devices WHERE device_id = $1`, event.DeviceID); err != nil {
+			return fmt.Errorf("failed to delete device: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown device event type %q", event.Type)
+	}
+	return nil
+}
+
+// Finish restores the presence of the devices that were kept.
+func (DeviceProjection) Finish(tx *sql.Tx) error {
+	query := `UPDATE devices SET presence = backup.presence, last_seen_at = backup.last_seen_at
+              FROM device_presence_backup backup WHERE devices.device_id = backup.device_id`
+	if _, err := tx.Exec(query); err != nil {
+		return fmt.Errorf("failed to restore device presence: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingProjection keeps the events applied to it in memory.
+type recordingProjection struct {
+	name   string
+	events []StoredEvent
+}
+
+func (r *recordingProjection) Name() string { return r.name }
+
+func (r *recordingProjection) Reset(tx *sql.Tx) error {
+	r.events = nil
+	return nil
+}
+
+func (r *recordingProjection) Apply(tx *sql.Tx, event StoredEvent) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func TestEventStoreRecordsWrites(t *testing.T) {
+	device := Device{ID: "store-" + NewMessageID(), Type: "lamp", State: "off", Room: "hall"}
+	require.NoError(t, testDB.InsertDevice(device))
+	first := NewMessageID()
+	_, err := testDB.RecordStateChange(device.ID, "on", first, time.Now(), 0)
+	require.NoError(t, err)
+	_, err = testDB.RecordStateChange(device.ID, "on", first, time.Now(), 0)
+	require.NoError(t, err)
+	_, err = testDB.RecordStateChange(device.ID, "on", NewMessageID(), time.Now(), 0)
+	require.NoError(t, err)
+	require.NoError(t, testDB.UpdateDeviceState(device.ID, "dimmed"))
+	_, err = testDB.DeleteDevice(device.ID)
+	require.NoError(t, err)
+
+	events, err := testDB.ListDeviceEvents(device.ID)
+	require.NoError(t, err)
+	require.Len(t, events, 5, "the repeated message should only be stored once")
+	type summary struct {
+		Type, PreviousState, State string
+		Version                    int64
+	}
+	var summaries []summary
+	for i, event := range events {
+		summaries = append(summaries, summary{event.Type, event.PreviousState, event.State, event.Version})
+		if i > 0 {
+			assert.Greater(t, event.Position, events[i-1].Position)
+		}
+	}
+	assert.Equal(t, []summary{
+		{EventDeviceRegistered, "", "off", 1},
+		{EventDeviceStateChanged, "off", "on", 2},
+		{EventDeviceStateChanged, "on", "on", 2},
+		{EventDeviceStateChanged, "on", "dimmed", 3},
+		{EventDeviceDeleted, "dimmed", "", 3},
+	}, summaries)
+	assert.Equal(t, first, events[1].MessageID)
+	assert.Equal(t, "hall", events[0].Room)
+
+	_, err = testDB.DB.Exec(`UPDATE device_event_store SET state = 'off' WHERE position = $1`, events[1].Position)
+	assert.Error(t, err, "stored events should not be changed")
+	_, err = testDB.DB.Exec(`DELETE FROM device_event_store WHERE position = $1`, events[1].Position)
+	assert.Error(t, err, "stored events should not be deleted")
+}
+
+func TestRebuildDevices(t *testing.T) {
+	device := Device{ID: "rebuild-" + NewMessageID(), Type: "lamp", State: "off"}
+	require.NoError(t, testDB.InsertDevice(device))
+	changedAt := time.Now().Truncate(time.Microsecond)
+	_, err := testDB.RecordStateChange(device.ID, "on", NewMessageID(), changedAt, 0)
+	require.NoError(t, err)
+	_, err = testDB.TouchDevice(device.ID, changedAt)
+	require.NoError(t, err)
+	expected, err := testDB.GetDevice(device.ID)
+	require.NoError(t, err)
+	history, err := testDB.ListStateHistory(device.ID, 10)
+	require.NoError(t, err)
+
+	// A bad write bypassing the event store
+	_, err = testDB.DB.Exec(`UPDATE devices SET state = 'broken', version = 42 WHERE device_id = $1`, device.ID)
+	require.NoError(t, err)
+	_, err = testDB.DB.Exec(`DELETE FROM device_state_history WHERE device_id = $1`, device.ID)
+	require.NoError(t, err)
+
+	result, err := testDB.Rebuild(context.Background(), DeviceProjection{})
+	require.NoError(t, err)
+	assert.Greater(t, result.Events, 0)
+	checkpoint, err := testDB.Checkpoint(context.Background(), "devices")
+	require.NoError(t, err)
+	assert.Equal(t, result.Position, checkpoint)
+
+	rebuilt, err := testDB.GetDevice(device.ID)
+	require.NoError(t, err)
+	require.NotNil(t, rebuilt)
+	assert.Equal(t, "on", rebuilt.State)
+	assert.Equal(t, expected.Version, rebuilt.Version)
+	assert.True(t, expected.EventTime.Equal(*rebuilt.EventTime))
+	assert.Equal(t, PresenceOnline, rebuilt.Status, "presence should survive the rebuild")
+	rebuiltHistory, err := testDB.ListStateHistory(device.ID, 10)
+	require.NoError(t, err)
+	assert.Equal(t, history, rebuiltHistory)
+}
+
+func TestPreviewDeviceRebuildAsOf(t *testing.T) {
+	device := Device{ID: "asof-" + NewMessageID(), Type: "lamp", State: "off"}
+	require.NoError(t, testDB.InsertDevice(device))
+	_, err := testDB.RecordStateChange(device.ID, "on", NewMessageID(), time.Now(), 0)
+	require.NoError(t, err)
+	var asOf time.Time
+	require.NoError(t, testDB.DB.QueryRow(`SELECT NOW()`).Scan(&asOf))
+	_, err = testDB.RecordStateChange(device.ID, "off", NewMessageID(), time.Now(), 0)
+	require.NoError(t, err)
+	later := Device{ID: "asof-later-" + NewMessageID(), Type: "lamp", State: "off"}
+	require.NoError(t, testDB.InsertDevice(later))
+
+	devices, err := testDB.PreviewDeviceRebuild(context.Background(), asOf)
+	require.NoError(t, err)
+	states := make(map[string]string)
+	for _, d := range devices {
+		states[d.ID] = d.State
+	}
+	assert.Equal(t, "on", states[device.ID], "the device should be in the state it had at the time")
+	assert.NotContains(t, states, later.ID, "devices registered later should not exist yet")
+
+	current, err := testDB.GetDevice(device.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "off", current.State, "a preview should not change the devices")
+}
+
+func TestRestoreDevices(t *testing.T) {
+	device := Device{ID: "restore-" + NewMessageID(), Type: "lamp", State: "off"}
+	require.NoError(t, testDB.InsertDevice(device))
+	_, err := testDB.RecordStateChange(device.ID, "on", NewMessageID(), time.Now(), 0)
+	require.NoError(t, err)
+	var asOf time.Time
+	require.NoError(t, testDB.DB.QueryRow(`SELECT NOW()`).Scan(&asOf))
+	_, err = testDB.RecordStateChange(device.ID, "off", NewMessageID(), time.Now(), 0)
+	require.NoError(t, err)
+	later := Device{ID: "restore-later-" + NewMessageID(), Type: "lamp", State: "off"}
+	require.NoError(t, testDB.InsertDevice(later))
+
+	events, err := testDB.RestoreDevices(context.Background(), asOf)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, EventDeviceStateChanged, events[0].Type)
+	assert.Equal(t, EventDeviceDeleted, events[1].Type)
+
+	restored, err := testDB.GetDevice(device.ID)
+	require.NoError(t, err)
+	require.NotNil(t, restored)
+	assert.Equal(t, "on", restored.State)
+	removed, err := testDB.GetDevice(later.ID)
+	require.NoError(t, err)
+	assert.Nil(t, removed, "devices registered later should be deleted")
+
+	// The compensating events are stored, so a full rebuild keeps the restored state
+	_, err = testDB.Rebuild(context.Background(), DeviceProjection{})
+	require.NoError(t, err)
+	rebuilt, err := testDB.GetDevice(device.ID)
+	require.NoError(t, err)
+	assert.Equal(t, restored.State, rebuilt.State)
+	assert.Equal(t, restored.Version, rebuilt.Version)
+	removed, err = testDB.GetDevice(later.ID)
+	require.NoError(t, err)
+	assert.Nil(t, removed)
+}
+
+func TestCatchUpProjection(t *testing.T) {
+	projection := &recordingProjection{name: "test-" + NewMessageID()}
+	applied, err := testDB.CatchUp(context.Background(), projection, 2)
+	require.NoError(t, err)
+	assert.Equal(t, len(projection.events), applied)
+	require.NotEmpty(t, projection.events)
+	checkpoint, err := testDB.Checkpoint(context.Background(), projection.name)
+	require.NoError(t, err)
+	assert.Equal(t, projection.events[len(projection.events)-1].Position, checkpoint)
+
+	device := Device{ID: "catchup-" + NewMessageID(), Type: "lamp", State: "off"}
+	require.NoError(t, testDB.InsertDevice(device))
+	projection.events = nil
+	applied, err = testDB.CatchUp(context.Background(), projection, 2)
+	require.NoError(t, err)
+	require.Equal(t, 1, applied, "only the new event should be applied")
+	assert.Equal(t, device.ID, projection.events[0].DeviceID)
+	assert.Greater(t, projection.events[0].Position, checkpoint)
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCUnaryInterceptor(t *testing.T) {
+	keys := mockKeyStore{HashAPIKey("reader-key"): {Subject: "reader", Scopes: []string{ScopeDevicesRead}}}
+	auth := newTestAuthenticator(t, "s3cr3t", keys)
+	interceptor := auth.UnaryInterceptor(map[string]string{"/test.Service/Get": ScopeDevicesRead, "/test.Service/Set": ScopeDevicesWrite})
+
+	call := func(method string, md metadata.MD) codes.Code {
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req any) (any, error) {
+			if _, ok := PrincipalFromContext(ctx); !ok {
+				return nil, status.Error(codes.Unknown, "no principal")
+			}
+			return nil, nil
+		})
+		return status.Code(err)
+	}
+
+	token := signToken(t, jwt.SigningMethodHS256, []byte("s3cr3t"), validClaims(ScopeDevicesWrite))
+	assert.Equal(t, codes.OK, call("/test.Service/Get", metadata.Pairs(GRPCAPIKeyMetadata, "reader-key")))
+	assert.Equal(t, codes.OK, call("/test.Service/Set", metadata.Pairs(GRPCAuthorizationMetadata, "Bearer "+token)))
+	assert.Equal(t, codes.PermissionDenied, call("/test.Service/Set", metadata.Pairs(GRPCAPIKeyMetadata, "reader-key")))
+	assert.Equal(t, codes.PermissionDenied, call("/test.Service/Other", metadata.Pairs(GRPCAPIKeyMetadata, "reader-key")), "methods without a scope should be denied")
+	assert.Equal(t, codes.Unauthenticated, call("/test.Service/Get", metadata.Pairs(GRPCAPIKeyMetadata, "wrong-key")))
+	assert.Equal(t, codes.Unauthenticated, call("/test.Service/Get", nil))
+
+	auth.Enabled = false
+	_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test.Service/Other"}, func(ctx context.Context, req any) (any, error) {
+		return nil, nil
+	})
+	assert.NoError(t, err, "calls should be accepted when authentication is disabled")
+}
@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status values reported by the health endpoints.
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// HealthCheck reports an error when a dependency is not usable.
+type HealthCheck func(ctx context.Context) error
+
+// CheckResult is the outcome of a single dependency check.
+type CheckResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// HealthReport is the JSON body returned by the readiness endpoint.
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Health runs the readiness checks of a process against its dependencies.
+type Health struct {
+	timeout time.Duration
+	names   []string
+	checks  map[string]HealthCheck
+}
+
+// NewHealth creates a Health whose checks each get at most timeout to complete.
+func NewHealth(timeout time.Duration) *Health {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	return &Health{timeout: timeout, checks: make(map[string]HealthCheck)}
+}
+
+// Add registers a named dependency check.
+func (h *Health) Add(name string, check HealthCheck) {
+	if _, exists := h.checks[name]; !exists {
+		h.names = append(h.names, name)
+	}
+	h.checks[name] = check
+}
+
+// Check runs all checks concurrently and reports the process as up only if every check passed.
+func (h *Health) Check(ctx context.Context) HealthReport {
+	report := HealthReport{Status: StatusUp, Checks: make(map[string]CheckResult, len(h.names))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range h.names {
+		wg.Add(1)
+		go func(name string, check HealthCheck) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := runCheck(checkCtx, check)
+			result := CheckResult{Status: StatusUp, Duration: time.Since(start).String()}
+			if err != nil {
+				result.Status = StatusDown
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+			if err != nil {
+				report.Status = StatusDown
+			}
+		}(name, h.checks[name])
+	}
+	wg.Wait()
+	return report
+}
+
+// runCheck runs check, giving up when ctx expires even if the check ignores its context.
+func runCheck(ctx context.Context, check HealthCheck) error {
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("check timed out: %w", ctx.Err())
+	}
+}
+
+// LivenessHandler reports that the process is running; it does not check dependencies.
+func (h *Health) LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": StatusUp})
+}
+
+// ReadinessHandler reports every dependency check, replying 503 if any of them is down.
+func (h *Health) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	report := h.Check(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != StatusUp {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Check reports whether the AMQP connection and channel of the client are open.
+func (rc RabbitClient) Check(ctx context.Context) error {
+	if rc.Conn == nil || !rc.ConnIsOpen() {
+		return errors.New("connection is closed")
+	}
+	if rc.Ch == nil || rc.ChannelIsClosed() {
+		return errors.New("channel is closed")
+	}
+	return nil
+}
+
+// Ping verifies the database connection is alive within the deadline of ctx.
+func (p *PostgreSQLClient) Ping(ctx context.Context) error {
+	if err := p.DB.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to ping PostgreSQL: %w", err)
+	}
+	return nil
+}
+
+// CheckMigrations reports an error listing the migrations that have not been applied yet.
+func (p *PostgreSQLClient) CheckMigrations(ctx context.Context) error {
+	pending, err := p.PendingMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		versions := make([]string, len(pending))
+		for i, migration := range pending {
+			versions[i] = migration.Version
+		}
+		return fmt.Errorf("pending migrations: %s", strings.Join(versions, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheck(t *testing.T) {
+	health := NewHealth(50 * time.Millisecond)
+	health.Add("rabbitmq", func(ctx context.Context) error { return nil })
+	health.Add("postgres", func(ctx context.Context) error { return errors.New("connection refused") })
+	health.Add("slow", func(ctx context.Context) error {
+		time.Sleep(time.Second) // Ignores its context
+		return nil
+	})
+
+	start := time.Now()
+	report := health.Check(context.Background())
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "slow checks should be cut off by the timeout")
+
+	assert.Equal(t, StatusDown, report.Status)
+	assert.Equal(t, StatusUp, report.Checks["rabbitmq"].Status)
+	assert.Equal(t, StatusDown, report.Checks["postgres"].Status)
+	assert.Equal(t, "connection refused", report.Checks["postgres"].Error)
+	assert.Equal(t, StatusDown, report.Checks["slow"].Status)
+	assert.Contains(t, report.Checks["slow"].Error, "timed out")
+}
+
+func TestReadinessHandler(t *testing.T) {
+	healthy := true
+	health := NewHealth(time.Second)
+	health.Add("rabbitmq", func(ctx context.Context) error {
+		if !healthy {
+			return errors.New("channel is closed")
+		}
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	health.ReadinessHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode, "ready when every check passes")
+
+	healthy = false
+	w = httptest.NewRecorder()
+	health.ReadinessHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode, "not ready when a check fails")
+
+	var report HealthReport
+	require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&report))
+	assert.Equal(t, StatusDown, report.Status)
+	assert.Equal(t, "channel is closed", report.Checks["rabbitmq"].Error, "each dependency should be reported")
+}
+
+func TestLivenessHandler(t *testing.T) {
+	health := NewHealth(time.Second)
+	health.Add("postgres", func(ctx context.Context) error { return errors.New("down") })
+
+	w := httptest.NewRecorder()
+	health.LivenessHandler(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode, "liveness should not depend on dependencies")
+}
+
+func TestRabbitClientCheckWithoutConnection(t *testing.T) {
+	assert.Error(t, RabbitClient{}.Check(context.Background()), "a client without a connection is not ready")
+}
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	require.NoError(t, err, "should load embedded migrations")
+	require.NotEmpty(t, migrations)
+
+	assert.Equal(t, "0001_devices", migrations[0].Version, "migrations should be ordered by version")
+	for i := 1; i < len(migrations); i++ {
+		assert.Less(t, migrations[i-1].Version, migrations[i].Version)
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	require.NoError(t, testDB.Migrate(), "applying migrations twice should succeed")
+	assert.NoError(t, testDB.CheckMigrations(context.Background()), "no migrations should be pending")
+	assert.NoError(t, testDB.Ping(context.Background()), "database should answer pings")
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Home Assistant components devices are discovered as.
+const (
+	HomeAssistantSwitch  = "switch"
+	HomeAssistantLight   = "light"
+	HomeAssistantClimate = "climate"
+	HomeAssistantSensor  = "sensor"
+)
+
+// Climate devices report states like "cooling", Home Assistant only knows its own HVAC modes.
+const (
+	climateModeStateTemplate   = "{{ {'cooling': 'cool', 'heating': 'heat', 'on': 'auto'}.get(value, value) }}"
+	climateModeCommandTemplate = "{{ {'cool': 'cooling', 'heat': 'heating', 'auto': 'on'}.get(value, value) }}"
+)
+
+// invalidObjectID matches the characters Home Assistant does not accept in object IDs.
+var invalidObjectID = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// HomeAssistant builds Home Assistant MQTT discovery entries for devices.
+type HomeAssistant struct {
+	discoveryPrefix string
+	prefix          string            // Prefix of the state and command topics
+	components      map[string]string // Component by device type, overriding the defaults
+}
+
+// NewHomeAssistant creates the discovery entries from the MQTT.HomeAssistant configuration.
+func NewHomeAssistant(config AppConfig) *HomeAssistant {
+	h := &HomeAssistant{
+		discoveryPrefix: config.MQTT.HomeAssistant.DiscoveryPrefix,
+		prefix:          config.MQTT.TopicPrefix,
+		components:      config.MQTT.HomeAssistant.Components,
+	}
+	if h.discoveryPrefix == "" {
+		h.discoveryPrefix = "homeassistant"
+	}
+	if h.prefix == "" {
+		h.prefix = "homebunny"
+	}
+	return h
+}
+
+// Component returns the Home Assistant component a device type is discovered as.
+func (h *HomeAssistant) Component(deviceType string) string {
+	if component, ok := h.components[deviceType]; ok {
+		return component
+	}
+	containsAny := func(words ...string) bool {
+		for _, word := range words {
+			if strings.Contains(deviceType, word) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case containsAny("light", "lamp", "bulb"):
+		return HomeAssistantLight
+	case containsAny("air_conditioner", "heater", "thermostat", "climate"):
+		return HomeAssistantClimate
+	case containsAny("sensor", "contact", "meter", "detector"):
+		return HomeAssistantSensor
+	default:
+		return HomeAssistantSwitch
+	}
+}
+
+// Discovery returns the topic and the config payload announcing a device to Home Assistant.
+func (h *HomeAssistant) Discovery(device Device) (string, []byte, error) {
+	if device.ID == "" || device.Type == "" {
+		return "", nil, errors.New("device ID and type are required")
+	}
+	objectID := invalidObjectID.ReplaceAllString(device.ID, "_")
+	component := h.Component(device.Type)
+	topic := fmt.Sprintf("%s/%s/homebunny/%s/config", h.discoveryPrefix, component, objectID)
+
+	stateTopic := MQTTStateTopic(h.prefix, device.Type, device.ID)
+	commandTopic := MQTTCommandTopic(h.prefix, device.Type, device.ID)
+	config := map[string]any{
+		"name":      nil, // Named after the device
+		"unique_id": "homebunny_" + objectID,
+		"object_id": objectID,
+		"device": map[string]any{
+			"identifiers":    []string{"homebunny_" + objectID},
+			"name":           device.ID,
+			"manufacturer":   "HomeBunny",
+			"model":          device.Type,
+			"suggested_area": device.Room,
+		},
+	}
+	switch component {
+	case HomeAssistantSwitch, HomeAssistantLight:
+		config["state_topic"] = stateTopic
+		config["command_topic"] = commandTopic
+		config["payload_on"] = "on"
+		config["payload_off"] = "off"
+		if component == HomeAssistantSwitch {
+			config["state_on"] = "on"
+			config["state_off"] = "off"
+		}
+	case HomeAssistantClimate:
+		config["modes"] = []string{"off", "auto", "cool", "heat"}
+		config["mode_state_topic"] = stateTopic
+		config["mode_state_template"] = climateModeStateTemplate
+		config["mode_command_topic"] = commandTopic
+		config["mode_command_template"] = climateModeCommandTemplate
+	case HomeAssistantSensor:
+		config["state_topic"] = stateTopic
+	default:
+		return "", nil, fmt.Errorf("unsupported Home Assistant component %q", component)
+	}
+
+	payload, err := json.Marshal(config)
+	if err != nil {
+		return "", nil, fmt.Errorf("error encoding discovery config: %w", err)
+	}
+	return topic, payload, nil
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHomeAssistantComponent(t *testing.T) {
+	var config AppConfig
+	config.MQTT.HomeAssistant.Components = map[string]string{"coffee_machine": HomeAssistantSwitch, "lamp": HomeAssistantSwitch}
+	homeAssistant := NewHomeAssistant(config)
+
+	assert.Equal(t, HomeAssistantLight, homeAssistant.Component("lightbulb"))
+	assert.Equal(t, HomeAssistantClimate, homeAssistant.Component("air_conditioner"))
+	assert.Equal(t, HomeAssistantSensor, homeAssistant.Component("door_contact"))
+	assert.Equal(t, HomeAssistantSwitch, homeAssistant.Component("tv"))
+	assert.Equal(t, HomeAssistantSwitch, homeAssistant.Component("lamp"), "configured components should override the defaults")
+}
+
+func TestHomeAssistantDiscovery(t *testing.T) {
+	homeAssistant := NewHomeAssistant(AppConfig{})
+
+	topic, payload, err := homeAssistant.Discovery(Device{ID: "tv.1", Type: "tv", Room: "living_room"})
+	require.NoError(t, err)
+	assert.Equal(t, "homeassistant/switch/homebunny/tv_1/config", topic)
+	var discovery map[string]any
+	require.NoError(t, json.Unmarshal(payload, &discovery))
+	assert.Equal(t, "homebunny_tv_1", discovery["unique_id"])
+	assert.Equal(t, "homebunny/tv/tv.1/state", discovery["state_topic"])
+	assert.Equal(t, "homebunny/tv/tv.1/set", discovery["command_topic"])
+	assert.Equal(t, "on", discovery["payload_on"])
+	assert.Equal(t, "living_room", discovery["device"].(map[string]any)["suggested_area"])
+
+	topic, payload, err = homeAssistant.Discovery(Device{ID: "ac1", Type: "air_conditioner"})
+	require.NoError(t, err)
+	assert.Equal(t, "homeassistant/climate/homebunny/ac1/config", topic)
+	discovery = nil
+	require.NoError(t, json.Unmarshal(payload, &discovery))
+	assert.Equal(t, "homebunny/air_conditioner/ac1/set", discovery["mode_command_topic"])
+	assert.Contains(t, discovery["mode_state_template"], "'cooling': 'cool'")
+
+	_, payload, err = homeAssistant.Discovery(Device{ID: "door1", Type: "door_contact"})
+	require.NoError(t, err)
+	discovery = nil
+	require.NoError(t, json.Unmarshal(payload, &discovery))
+	assert.NotContains(t, discovery, "command_topic", "sensors cannot be controlled")
+
+	_, _, err = homeAssistant.Discovery(Device{ID: "x"})
+	assert.Error(t, err)
+}
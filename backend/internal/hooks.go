@@ -0,0 +1,372 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signature verification methods of inbound hook sources.
+const (
+	HookSignatureHMACSHA256 = "hmac-sha256" // HMAC of the body with the secret
+	HookSignatureHMACSHA1   = "hmac-sha1"
+	HookSignatureToken      = "token" // The header carries the secret itself
+	HookSignatureNone       = "none"  // Must be configured explicitly
+)
+
+// ErrHookSignature is returned when an inbound hook request is not signed by its source.
+var ErrHookSignature = errors.New("invalid hook signature")
+
+// HookEvent is a device event translated from an inbound hook payload.
+type HookEvent struct {
+	Device    Device
+	EventTime time.Time // Zero when the payload has no timestamp
+	MessageID string    // Derived from the event ID of the payload, empty when it has none
+}
+
+// HookSources translates the payloads of the configured inbound hook sources into device events.
+type HookSources struct {
+	sources map[string]*hookSource
+}
+
+// hookSource is a HookSource with its secret loaded and its paths parsed.
+type hookSource struct {
+	HookSource
+	secret     []byte
+	events     jsonPath
+	deviceID   hookField
+	deviceType hookField
+	state      hookField
+	timestamp  hookField
+	eventID    hookField
+}
+
+// hookField is a mapping field, either a path into the payload or a literal value.
+type hookField struct {
+	path    jsonPath // nil for literals
+	literal string
+}
+
+// NewHookSources loads the inbound hook sources from the Hooks configuration.
+func NewHookSources(config AppConfig) (*HookSources, error) {
+	h := &HookSources{sources: make(map[string]*hookSource)}
+	for _, source := range config.Hooks.Sources {
+		if source.Name == "" || h.sources[source.Name] != nil {
+			return nil, fmt.Errorf("hook sources need a unique name, got %q", source.Name)
+		}
+		compiled, err := compileHookSource(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hook source %s: %w", source.Name, err)
+		}
+		h.sources[source.Name] = compiled
+	}
+	return h, nil
+}
+
+func compileHookSource(source HookSource) (*hookSource, error) {
+	s := &hookSource{HookSource: source}
+
+	switch source.Signature.Method {
+	case HookSignatureHMACSHA256, HookSignatureHMACSHA1, HookSignatureToken:
+		if source.Signature.Header == "" {
+			return nil, errors.New("signature header is required")
+		}
+		secret := source.Signature.Secret
+		if source.Signature.SecretFile != "" {
+			data, err := os.ReadFile(source.Signature.SecretFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read secret: %w", err)
+			}
+			secret = strings.TrimSpace(string(data))
+		}
+		if secret == "" {
+			return nil, errors.New("signature secret is required")
+		}
+		s.secret = []byte(secret)
+	case HookSignatureNone:
+	default:
+		return nil, fmt.Errorf("unknown signature method %q", source.Signature.Method)
+	}
+	switch source.Signature.Encoding {
+	case "", "hex", "base64":
+	default:
+		return nil, fmt.Errorf("unknown signature encoding %q", source.Signature.Encoding)
+	}
+
+	var err error
+	if source.Events != "" {
+		if s.events, err = parseJSONPath(source.Events); err != nil {
+			return nil, fmt.Errorf("invalid events path: %w", err)
+		}
+	}
+	fields := []struct {
+		value    string
+		field    *hookField
+		required bool
+	}{
+		{source.DeviceID, &s.deviceID, true},
+		{source.DeviceType, &s.deviceType, true},
+		{source.State, &s.state, true},
+		{source.Timestamp, &s.timestamp, false},
+		{source.EventID, &s.eventID, false},
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			if f.required {
+				return nil, errors.New("DeviceID, DeviceType and State are required")
+			}
+			continue
+		}
+		if *f.field, err = parseHookField(f.value); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// parseHookField parses a mapping field, a path when it starts with "$" and a literal otherwise.
+func parseHookField(value string) (hookField, error) {
+	if !strings.HasPrefix(value, "$") {
+		return hookField{literal: value}, nil
+	}
+	path, err := parseJSONPath(value)
+	if err != nil {
+		return hookField{}, fmt.Errorf("invalid path %q: %w", value, err)
+	}
+	return hookField{path: path}, nil
+}
+
+// extract returns the value of the field in document as a string, or "" when it is missing.
+func (f hookField) extract(document any) string {
+	if f.path == nil {
+		return f.literal
+	}
+	value, ok := f.path.lookup(document)
+	if !ok {
+		return ""
+	}
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return ""
+	}
+}
+
+// Translate verifies the signature of a payload sent by the named source and translates it into device
+// events. It reports false when the source is not configured, and returns ErrHookSignature when the
+// signature does not match.
+func (h *HookSources) Translate(name string, header http.Header, body []byte) ([]HookEvent, bool, error) {
+	source, ok := h.sources[name]
+	if !ok {
+		return nil, false, nil
+	}
+	if err := source.verify(header, body); err != nil {
+		return nil, true, err
+	}
+	events, err := source.translate(body)
+	return events, true, err
+}
+
+// verify checks the signature header of a request against its body.
+func (s *hookSource) verify(header http.Header, body []byte) error {
+	if s.Signature.Method == HookSignatureNone {
+		return nil
+	}
+	value := header.Get(s.Signature.Header)
+	if value == "" || !strings.HasPrefix(value, s.Signature.Prefix) {
+		return ErrHookSignature
+	}
+	value = strings.TrimPrefix(value, s.Signature.Prefix)
+
+	if s.Signature.Method == HookSignatureToken {
+		if subtle.ConstantTimeCompare([]byte(value), s.secret) != 1 {
+			return ErrHookSignature
+		}
+		return nil
+	}
+
+	var signature []byte
+	var err error
+	if s.Signature.Encoding == "base64" {
+		signature, err = base64.StdEncoding.DecodeString(value)
+	} else {
+		signature, err = hex.DecodeString(value)
+	}
+	if err != nil {
+		return ErrHookSignature
+	}
+	newHash := sha256.New
+	if s.Signature.Method == HookSignatureHMACSHA1 {
+		newHash = func() hash.Hash { return sha1.New() }
+	}
+	mac := hmac.New(newHash, s.secret)
+	mac.Write(body)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return ErrHookSignature
+	}
+	return nil
+}
+
+// translate maps a payload, or each element of its events array, to a device event.
+func (s *hookSource) translate(body []byte) ([]HookEvent, error) {
+	var document any
+	if err := json.Unmarshal(body, &document); err != nil {
+		return nil, fmt.Errorf("invalid JSON payload: %w", err)
+	}
+
+	items := []any{document}
+	if s.events != nil {
+		value, ok := s.events.lookup(document)
+		array, isArray := value.([]any)
+		if !ok || !isArray {
+			return nil, fmt.Errorf("payload has no events array at %s", s.Events)
+		}
+		items = array
+	}
+
+	events := make([]HookEvent, 0, len(items))
+	for i, item := range items {
+		event, err := s.translateEvent(item)
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %w", i, err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (s *hookSource) translateEvent(item any) (HookEvent, error) {
+	state := s.state.extract(item)
+	if mapped, ok := s.States[state]; ok {
+		state = mapped
+	}
+	event := HookEvent{Device: Device{
+		ID:    s.deviceID.extract(item),
+		Type:  s.deviceType.extract(item),
+		State: state,
+	}}
+	device := event.Device
+	if device.ID == "" || device.Type == "" || device.State == "" {
+		return HookEvent{}, errors.New("device ID, type and state are required")
+	}
+	if strings.ContainsAny(device.ID+device.Type+device.State, ".*#") {
+		return HookEvent{}, errors.New("device ID, type and state must not contain '.', '*' or '#'")
+	}
+
+	if value := s.timestamp.extract(item); value != "" {
+		eventTime, err := parseHookTime(value)
+		if err != nil {
+			return HookEvent{}, err
+		}
+		event.EventTime = eventTime
+	}
+	if eventID := s.eventID.extract(item); eventID != "" {
+		event.MessageID = "hook:" + s.Name + ":" + eventID // Redelivered payloads keep their message ID
+	}
+	return event, nil
+}
+
+// parseHookTime parses an RFC 3339 timestamp or Unix time in seconds or milliseconds.
+func parseHookTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+	}
+	if number > 1e12 {
+		return time.UnixMilli(int64(number)), nil
+	}
+	return time.Unix(0, int64(number*float64(time.Second))), nil
+}
+
+// jsonPath is a parsed JSONPath-like expression such as $.device.id, $.events[0] or $['device-id'],
+// made of object keys (string) and array indexes (int).
+type jsonPath []any
+
+// parseJSONPath parses an expression starting at the root "$", followed by ".key", "['key']" or "[index]".
+func parseJSONPath(expression string) (jsonPath, error) {
+	if !strings.HasPrefix(expression, "$") {
+		return nil, errors.New("path must start with $")
+	}
+	path := jsonPath{}
+	rest := expression[1:]
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, errors.New("empty key")
+			}
+			path = append(path, rest[:end])
+			rest = rest[end:]
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+			if end < 0 {
+				return nil, errors.New("unterminated key")
+			}
+			path = append(path, rest[2:end])
+			rest = rest[end+2:]
+		case rest[0] == '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, errors.New("unterminated index")
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index %q", rest[1:end])
+			}
+			path = append(path, index)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest)
+		}
+	}
+	return path, nil
+}
+
+// lookup returns the value at the path in a decoded JSON document.
+func (p jsonPath) lookup(document any) (any, bool) {
+	value := document
+	for _, step := range p {
+		switch step := step.(type) {
+		case string:
+			object, ok := value.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			if value, ok = object[step]; !ok {
+				return nil, false
+			}
+		case int:
+			array, ok := value.([]any)
+			if !ok || step >= len(array) {
+				return nil, false
+			}
+			value = array[step]
+		}
+	}
+	return value, value != nil
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func acmeHookSource() HookSource {
+	return HookSource{
+		Name:       "acme",
+		Signature:  HookSignature{Method: HookSignatureHMACSHA256, Header: "X-Acme-Signature", Prefix: "sha256=", Secret: "s3cr3t"},
+		Events:     "$.events",
+		DeviceID:   "$.device.serial",
+		DeviceType: "$.device.kind",
+		State:      "$.value",
+		States:     map[string]string{"1": "on", "0": "off"},
+		Timestamp:  "$.ts",
+		EventID:    "$.event_id",
+	}
+}
+
+func newTestHookSources(t *testing.T, sources ...HookSource) *HookSources {
+	var config AppConfig
+	config.Hooks.Sources = sources
+	hooks, err := NewHookSources(config)
+	require.NoError(t, err)
+	return hooks
+}
+
+func hmacSHA256(secret string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func TestJSONPath(t *testing.T) {
+	document := map[string]any{
+		"device":  map[string]any{"id": "p1", "dash-key": "x"},
+		"changes": []any{map[string]any{"value": 1.0}},
+	}
+	tests := []struct {
+		path  string
+		value any
+		found bool
+	}{
+		{"$.device.id", "p1", true},
+		{"$['device']['dash-key']", "x", true},
+		{"$.changes[0].value", 1.0, true},
+		{"$.changes[1].value", nil, false},
+		{"$.device.missing", nil, false},
+		{"$.device.id.deeper", nil, false},
+	}
+	for _, test := range tests {
+		path, err := parseJSONPath(test.path)
+		require.NoError(t, err, test.path)
+		value, found := path.lookup(document)
+		assert.Equal(t, test.found, found, test.path)
+		assert.Equal(t, test.value, value, test.path)
+	}
+
+	for _, invalid := range []string{"device.id", "$.", "$[x]", "$['open", "$x"} {
+		_, err := parseJSONPath(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestHookTranslate(t *testing.T) {
+	hooks := newTestHookSources(t, acmeHookSource())
+	body := []byte(`{"events":[
+		{"event_id":"e1","device":{"serial":"p1","kind":"plug"},"value":1,"ts":1714564800},
+		{"event_id":"e2","device":{"serial":"p2","kind":"plug"},"value":"0","ts":"2024-05-01T12:00:00Z"}]}`)
+	header := http.Header{}
+	header.Set("X-Acme-Signature", "sha256="+hex.EncodeToString(hmacSHA256("s3cr3t", body)))
+
+	events, found, err := hooks.Translate("acme", header, body)
+	require.NoError(t, err)
+	assert.True(t, found)
+	require.Len(t, events, 2)
+	assert.Equal(t, Device{ID: "p1", Type: "plug", State: "on"}, events[0].Device, "vendor states should be translated")
+	assert.True(t, time.Unix(1714564800, 0).Equal(events[0].EventTime))
+	assert.Equal(t, "hook:acme:e1", events[0].MessageID)
+	assert.Equal(t, "off", events[1].Device.State)
+	assert.True(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).Equal(events[1].EventTime))
+
+	_, found, _ = hooks.Translate("other", header, body)
+	assert.False(t, found, "unknown sources should not be found")
+
+	_, _, err = hooks.Translate("acme", header, []byte(`{"events":[]}`))
+	assert.ErrorIs(t, err, ErrHookSignature, "a signature of another body should be rejected")
+
+	unsigned := []byte(`{"events":[{"device":{"serial":"p.1","kind":"plug"},"value":1}]}`)
+	header.Set("X-Acme-Signature", "sha256="+hex.EncodeToString(hmacSHA256("s3cr3t", unsigned)))
+	_, _, err = hooks.Translate("acme", header, unsigned)
+	assert.Error(t, err, "device IDs that would break the routing key should be rejected")
+	assert.NotErrorIs(t, err, ErrHookSignature)
+}
+
+func TestHookSignatureMethods(t *testing.T) {
+	body := []byte(`{"id":"lamp1","on":true}`)
+	single := HookSource{DeviceID: "$.id", DeviceType: "lamp", State: "$.on", States: map[string]string{"true": "on"}}
+
+	base64Source := single
+	base64Source.Name = "base64"
+	base64Source.Signature = HookSignature{Method: HookSignatureHMACSHA256, Header: "X-Signature", Encoding: "base64", Secret: "key"}
+	tokenSource := single
+	tokenSource.Name = "token"
+	tokenSource.Signature = HookSignature{Method: HookSignatureToken, Header: "Authorization", Prefix: "Bearer ", Secret: "t0ken"}
+	openSource := single
+	openSource.Name = "open"
+	openSource.Signature = HookSignature{Method: HookSignatureNone}
+	hooks := newTestHookSources(t, base64Source, tokenSource, openSource)
+
+	header := http.Header{}
+	header.Set("X-Signature", base64.StdEncoding.EncodeToString(hmacSHA256("key", body)))
+	events, _, err := hooks.Translate("base64", header, body)
+	require.NoError(t, err)
+	assert.Equal(t, Device{ID: "lamp1", Type: "lamp", State: "on"}, events[0].Device, "literal fields should be used as is")
+
+	header.Set("Authorization", "Bearer t0ken")
+	_, _, err = hooks.Translate("token", header, body)
+	assert.NoError(t, err)
+	header.Set("Authorization", "Bearer wrong")
+	_, _, err = hooks.Translate("token", header, body)
+	assert.ErrorIs(t, err, ErrHookSignature)
+
+	_, _, err = hooks.Translate("open", http.Header{}, body)
+	assert.NoError(t, err)
+}
+
+func TestNewHookSourcesRejectsInvalidConfig(t *testing.T) {
+	var config AppConfig
+	missingSecret := acmeHookSource()
+	missingSecret.Signature.Secret = ""
+	noMethod := acmeHookSource()
+	noMethod.Signature = HookSignature{}
+	badPath := acmeHookSource()
+	badPath.DeviceID = "$.device[serial]"
+	noState := acmeHookSource()
+	noState.State = ""
+
+	for _, source := range []HookSource{missingSecret, noMethod, badPath, noState} {
+		config.Hooks.Sources = []HookSource{source}
+		_, err := NewHookSources(config)
+		assert.Error(t, err)
+	}
+
+	config.Hooks.Sources = []HookSource{acmeHookSource(), acmeHookSource()}
+	_, err := NewHookSources(config)
+	assert.Error(t, err, "source names should be unique")
+}
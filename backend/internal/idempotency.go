@@ -0,0 +1,248 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Headers used for idempotent requests.
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	defaultIdempotencyWindow = 24 * time.Hour
+	defaultIdempotencyLease  = time.Minute
+)
+
+// IdempotentResponse is the stored outcome of a request sent with an Idempotency-Key.
+type IdempotentResponse struct {
+	RequestHash string
+	StatusCode  int // 0 while the first request is still being handled
+	ContentType string
+	Body        []byte
+}
+
+// IdempotencyStore persists idempotency keys and the responses of their first request.
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey claims key for a new request. When the key was already used within
+	// window it returns the stored response instead and reserved is false. A reservation left without
+	// a response for longer than lease is abandoned and claimed again.
+	ReserveIdempotencyKey(scope, key, requestHash string, window, lease time.Duration) (existing *IdempotentResponse, reserved bool, err error)
+	CompleteIdempotencyKey(scope, key string, response IdempotentResponse) error
+	ReleaseIdempotencyKey(scope, key string) error
+	PurgeIdempotencyKeys(before time.Time) (int64, error)
+}
+
+// Idempotency replays the stored response of requests repeated with the same Idempotency-Key.
+type Idempotency struct {
+	store  IdempotencyStore
+	window time.Duration
+	lease  time.Duration
+}
+
+// NewIdempotency creates an Idempotency keeping responses for the configured window.
+func NewIdempotency(config AppConfig, store IdempotencyStore) *Idempotency {
+	window := config.Idempotency.Window
+	if window <= 0 {
+		window = defaultIdempotencyWindow
+	}
+	lease := config.Idempotency.Lease
+	if lease <= 0 {
+		lease = defaultIdempotencyLease
+	}
+	return &Idempotency{store: store, window: window, lease: lease}
+}
+
+// Wrap makes next idempotent for requests carrying an Idempotency-Key header. Keys are scoped to the
+// route and the authenticated caller. A repeat with the same body gets the original response, a repeat
+// with a different body is rejected with 422 and a repeat while the first request is still running
+// with 409, until the reservation is older than the lease and taken to be abandoned, e.g. by a crash.
+// Server errors are not stored so the request can be retried.
+func (i *Idempotency) Wrap(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(body)
+		requestHash := hex.EncodeToString(hash[:])
+
+		scope := route
+		if principal, ok := PrincipalFromContext(r.Context()); ok {
+			scope = route + " " + principal.Subject
+		}
+
+		existing, reserved, err := i.store.ReserveIdempotencyKey(scope, key, requestHash, i.window, i.lease)
+		if err != nil {
+			log.Printf("Failed to reserve idempotency key: %v", err)
+			http.Error(w, "Failed to check idempotency key", http.StatusInternalServerError)
+			return
+		}
+		if !reserved {
+			replay(w, existing, requestHash)
+			return
+		}
+
+		messageID := sha256.Sum256([]byte(scope + "\x00" + key))
+		ctx := context.WithValue(r.Context(), idempotentMessageIDKey{}, hex.EncodeToString(messageID[:16]))
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r.WithContext(ctx))
+
+		if recorder.status >= http.StatusInternalServerError {
+			if err := i.store.ReleaseIdempotencyKey(scope, key); err != nil {
+				log.Printf("Failed to release idempotency key: %v", err)
+			}
+			return
+		}
+		response := IdempotentResponse{
+			RequestHash: requestHash,
+			StatusCode:  recorder.status,
+			ContentType: recorder.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+		}
+		if err := i.store.CompleteIdempotencyKey(scope, key, response); err != nil {
+			log.Printf("Failed to store idempotent response: %v", err)
+			// Without its response the key would answer every retry with 409, so it is given up
+			if err := i.store.ReleaseIdempotencyKey(scope, key); err != nil {
+				log.Printf("Failed to release idempotency key: %v", err)
+			}
+		}
+	}
+}
+
+type idempotentMessageIDKey struct{}
+
+// IdempotentMessageID returns the message ID for the event published by a request carrying an
+// Idempotency-Key. It is derived from the key, so a retry of a request whose event was recorded but not
+// published is recognized as the same event and published without being recorded again.
+func IdempotentMessageID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(idempotentMessageIDKey{}).(string)
+	return id, ok
+}
+
+// Purge deletes the keys that are older than the window.
+func (i *Idempotency) Purge() error {
+	_, err := i.store.PurgeIdempotencyKeys(time.Now().Add(-i.window))
+	return err
+}
+
+// replay answers a repeated request from the stored response of the first one.
+func replay(w http.ResponseWriter, existing *IdempotentResponse, requestHash string) {
+	switch {
+	case existing.RequestHash != requestHash:
+		http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+	case existing.StatusCode == 0:
+		http.Error(w, "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+	default:
+		if existing.ContentType != "" {
+			w.Header().Set("Content-Type", existing.ContentType)
+		}
+		w.Header().Set(IdempotentReplayedHeader, "true")
+		w.WriteHeader(existing.StatusCode)
+		w.Write(existing.Body)
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of its status code and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// ReserveIdempotencyKey claims an idempotency key, replacing it when it is older than window, or when it
+// is a reservation without a response that is older than lease. created_at is when the key was reserved.
+func (p *PostgreSQLClient) ReserveIdempotencyKey(scope, key, requestHash string, window, lease time.Duration) (*IdempotentResponse, bool, error) {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to begin idempotency transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	_, err = tx.Exec(`DELETE FROM idempotency_keys WHERE scope = $1 AND idempotency_key = $2
+              AND (created_at < $3 OR (status_code IS NULL AND created_at < $4))`,
+		scope, key, now.Add(-window), now.Add(-lease))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to expire idempotency key: %w", err)
+	}
+
+	result, err := tx.Exec(`INSERT INTO idempotency_keys (scope, idempotency_key, request_hash) VALUES ($1, $2, $3)
+              ON CONFLICT (scope, idempotency_key) DO NOTHING`, scope, key, requestHash)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to reserve idempotency key: %w", err)
+	}
+	if inserted, _ := result.RowsAffected(); inserted == 1 {
+		if err := tx.Commit(); err != nil {
+			return nil, false, fmt.Errorf("failed to reserve idempotency key: %w", err)
+		}
+		return nil, true, nil
+	}
+
+	query := `SELECT request_hash, COALESCE(status_code, 0), content_type, COALESCE(body, '')
+              FROM idempotency_keys WHERE scope = $1 AND idempotency_key = $2`
+	var existing IdempotentResponse
+	err = tx.QueryRow(query, scope, key).Scan(&existing.RequestHash, &existing.StatusCode, &existing.ContentType, &existing.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+	return &existing, false, tx.Commit()
+}
+
+// CompleteIdempotencyKey stores the response of the request that reserved the key.
+func (p *PostgreSQLClient) CompleteIdempotencyKey(scope, key string, response IdempotentResponse) error {
+	query := `UPDATE idempotency_keys SET status_code = $3, content_type = $4, body = $5
+              WHERE scope = $1 AND idempotency_key = $2`
+	_, err := p.DB.Exec(query, scope, key, response.StatusCode, response.ContentType, response.Body)
+	if err != nil {
+		return fmt.Errorf("failed to complete idempotency key: %w", err)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets a key whose request failed, so it can be retried.
+func (p *PostgreSQLClient) ReleaseIdempotencyKey(scope, key string) error {
+	_, err := p.DB.Exec(`DELETE FROM idempotency_keys WHERE scope = $1 AND idempotency_key = $2`, scope, key)
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// PurgeIdempotencyKeys deletes idempotency keys created before the given time.
+func (p *PostgreSQLClient) PurgeIdempotencyKeys(before time.Time) (int64, error) {
+	result, err := p.DB.Exec(`DELETE FROM idempotency_keys WHERE created_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge idempotency keys: %w", err)
+	}
+	return result.RowsAffected()
+}
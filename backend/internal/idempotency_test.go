@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryIdempotencyStore keeps idempotency keys in memory for tests.
+type memoryIdempotencyStore struct {
+	mu          sync.Mutex
+	responses   map[string]IdempotentResponse
+	reservedAt  map[string]time.Time
+	completeErr error // Returned by CompleteIdempotencyKey when set
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{responses: make(map[string]IdempotentResponse), reservedAt: make(map[string]time.Time)}
+}
+
+func (m *memoryIdempotencyStore) ReserveIdempotencyKey(scope, key, requestHash string, window, lease time.Duration) (*IdempotentResponse, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.responses[scope+"|"+key]
+	abandoned := existing.StatusCode == 0 && time.Since(m.reservedAt[scope+"|"+key]) > lease
+	if ok && !abandoned {
+		return &existing, false, nil
+	}
+	m.responses[scope+"|"+key] = IdempotentResponse{RequestHash: requestHash}
+	m.reservedAt[scope+"|"+key] = time.Now()
+	return nil, true, nil
+}
+
+func (m *memoryIdempotencyStore) CompleteIdempotencyKey(scope, key string, response IdempotentResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.completeErr != nil {
+		return m.completeErr
+	}
+	m.responses[scope+"|"+key] = response
+	return nil
+}
+
+func (m *memoryIdempotencyStore) ReleaseIdempotencyKey(scope, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.responses, scope+"|"+key)
+	return nil
+}
+
+func (m *memoryIdempotencyStore) PurgeIdempotencyKeys(before time.Time) (int64, error) {
+	return 0, nil
+}
+
+// idempotentRequest sends body to handler with the given Idempotency-Key.
+func idempotentRequest(handler http.HandlerFunc, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/publish", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestIdempotencyReplaysResponse(t *testing.T) {
+	calls := 0
+	idempotency := NewIdempotency(AppConfig{}, newMemoryIdempotencyStore())
+	handler := idempotency.Wrap("POST /publish", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"tv1"}`))
+	})
+
+	first := idempotentRequest(handler, "key-1", `{"id":"tv1"}`)
+	second := idempotentRequest(handler, "key-1", `{"id":"tv1"}`)
+
+	assert.Equal(t, 1, calls, "a repeated request should not run the handler again")
+	assert.Equal(t, http.StatusCreated, second.Code)
+	assert.Equal(t, first.Body.String(), second.Body.String(), "the original response should be replayed")
+	assert.Equal(t, "application/json", second.Header().Get("Content-Type"))
+	assert.Equal(t, "true", second.Header().Get(IdempotentReplayedHeader))
+
+	idempotentRequest(handler, "", `{"id":"tv1"}`)
+	assert.Equal(t, 2, calls, "requests without a key should always run")
+}
+
+func TestIdempotencyRejectsDifferentRequest(t *testing.T) {
+	idempotency := NewIdempotency(AppConfig{}, newMemoryIdempotencyStore())
+	handler := idempotency.Wrap("POST /publish", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	idempotentRequest(handler, "key-1", `{"state":"on"}`)
+	w := idempotentRequest(handler, "key-1", `{"state":"off"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code, "a key reused with another body should be rejected")
+}
+
+func TestIdempotencyRetriesServerErrors(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	idempotency := NewIdempotency(AppConfig{}, newMemoryIdempotencyStore())
+	handler := idempotency.Wrap("POST /publish", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+
+	require.Equal(t, http.StatusServiceUnavailable, idempotentRequest(handler, "key-1", "{}").Code)
+	status = http.StatusOK
+	w := idempotentRequest(handler, "key-1", "{}")
+	assert.Equal(t, http.StatusOK, w.Code, "a failed request should run again when retried")
+	assert.Empty(t, w.Header().Get(IdempotentReplayedHeader))
+}
+
+func TestIdempotentMessageID(t *testing.T) {
+	var ids []string
+	idempotency := NewIdempotency(AppConfig{}, newMemoryIdempotencyStore())
+	handler := idempotency.Wrap("POST /publish", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := IdempotentMessageID(r.Context())
+		if ok {
+			ids = append(ids, id)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	idempotentRequest(handler, "key-1", "{}")
+	idempotentRequest(handler, "key-1", "{}")
+	idempotentRequest(handler, "key-2", "{}")
+	idempotentRequest(handler, "", "{}")
+	require.Len(t, ids, 3, "only requests with a key should get a message ID")
+	assert.Equal(t, ids[0], ids[1], "a retry should publish under the same message ID")
+	assert.NotEqual(t, ids[0], ids[2])
+}
+
+func TestIdempotencyConflictWhileInProgress(t *testing.T) {
+	store := newMemoryIdempotencyStore()
+	hash := sha256.Sum256([]byte("{}"))
+	_, reserved, err := store.ReserveIdempotencyKey("POST /publish", "key-1", hex.EncodeToString(hash[:]), time.Hour, time.Minute)
+	require.NoError(t, err)
+	require.True(t, reserved)
+
+	handler := NewIdempotency(AppConfig{}, store).Wrap("POST /publish", func(w http.ResponseWriter, r *http.Request) {})
+	w := idempotentRequest(handler, "key-1", "{}")
+	assert.Equal(t, http.StatusConflict, w.Code, "a repeat of a running request should be rejected")
+
+	// The request that reserved the key crashed, so the key is claimed again once the lease is over
+	store.reservedAt["POST /publish|key-1"] = time.Now().Add(-2 * time.Minute)
+	w = idempotentRequest(handler, "key-1", "{}")
+	assert.Equal(t, http.StatusOK, w.Code, "an abandoned reservation should not block retries")
+}
+
+func TestIdempotencyReleasesKeyWhenCompletionFails(t *testing.T) {
+	store := newMemoryIdempotencyStore()
+	store.completeErr = errors.New("database unavailable")
+	calls := 0
+	handler := NewIdempotency(AppConfig{}, store).Wrap("POST /publish", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	assert.Equal(t, http.StatusAccepted, idempotentRequest(handler, "key-1", "{}").Code)
+	store.completeErr = nil
+	assert.Equal(t, http.StatusAccepted, idempotentRequest(handler, "key-1", "{}").Code, "a retry should not be rejected as running")
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotencyKeysInPostgres(t *testing.T) {
+	scope, key := "POST /publish test", NewMessageID()
+
+	_, reserved, err := testDB.ReserveIdempotencyKey(scope, key, "hash", time.Hour, time.Minute)
+	require.NoError(t, err)
+	require.True(t, reserved, "a new key should be reserved")
+
+	existing, reserved, err := testDB.ReserveIdempotencyKey(scope, key, "hash", time.Hour, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, 0, existing.StatusCode, "the first request is still in progress")
+
+	response := IdempotentResponse{RequestHash: "hash", StatusCode: http.StatusOK, ContentType: "text/plain", Body: []byte("ok")}
+	require.NoError(t, testDB.CompleteIdempotencyKey(scope, key, response))
+	existing, _, err = testDB.ReserveIdempotencyKey(scope, key, "hash", time.Hour, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, response, *existing, "the stored response should be returned")
+
+	_, reserved, err = testDB.ReserveIdempotencyKey(scope, key, "hash", -time.Second, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, reserved, "an expired key should be reserved again")
+
+	_, reserved, err = testDB.ReserveIdempotencyKey(scope, key, "hash", time.Hour, -time.Second)
+	require.NoError(t, err)
+	assert.True(t, reserved, "an abandoned reservation should be reserved again")
+	require.NoError(t, testDB.CompleteIdempotencyKey(scope, key, response))
+	_, reserved, err = testDB.ReserveIdempotencyKey(scope, key, "hash", time.Hour, -time.Second)
+	require.NoError(t, err)
+	assert.False(t, reserved, "the lease should not expire stored responses")
+}
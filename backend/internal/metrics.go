@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	publishTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "homebunny_publish_total",
+		Help: "Messages published to RabbitMQ by exchange and result (ack, nack, returned, timeout, error).",
+	}, []string{"exchange", "result"})
+
+	publishConfirmSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "homebunny_publish_confirm_seconds",
+		Help:    "Time from publishing a message until the broker confirms it.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"exchange"})
+
+	publishReturnsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "homebunny_publish_returns_total",
+		Help: "Mandatory messages returned by the broker as unroutable.",
+	}, []string{"exchange"})
+
+	publisherPoolInUse = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "homebunny_publisher_pool_in_use",
+		Help: "Publisher pool channels currently used by a publish.",
+	})
+
+	publisherChannelsRecycledTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "homebunny_publisher_channels_recycled_total",
+		Help: "Publisher pool channels closed and reopened after an error.",
+	})
+
+	telemetryReadingsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "homebunny_telemetry_readings_total",
+		Help: "Telemetry readings stored in PostgreSQL.",
+	})
+
+	webhookDeliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "homebunny_webhook_deliveries_total",
+		Help: "Webhook delivery attempts by result (success, failure).",
+	}, []string{"result"})
+
+	mqttMessagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "homebunny_mqtt_bridged_messages_total",
+		Help: "Messages bridged between MQTT and RabbitMQ by direction (inbound, outbound) and result (success, failure, dropped).",
+	}, []string{"direction", "result"})
+
+	consumeSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "homebunny_consumer_processing_seconds",
+		Help:    "Time spent processing a consumed event by device type.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"device_type"})
+
+	consumeFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "homebunny_consumer_failures_total",
+		Help: "Consumed events that failed processing by device type.",
+	}, []string{"device_type"})
+
+	httpRequestSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "homebunny_http_request_duration_seconds",
+		Help:    "HTTP request latency by route, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+// observePublish records the outcome of a publish and, when confirmed, its confirm latency.
+func observePublish(exchange, result string, start time.Time) {
+	publishTotal.WithLabelValues(exchange, result).Inc()
+	if result == "ack" || result == "nack" || result == "returned" {
+		publishConfirmSeconds.WithLabelValues(exchange).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeWebhookDelivery counts a webhook delivery attempt that failed with err, if not nil.
+func observeWebhookDelivery(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	webhookDeliveriesTotal.WithLabelValues(result).Inc()
+}
+
+// observeMQTTMessage counts a message bridged in direction that failed with err, if not nil.
+func observeMQTTMessage(direction string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	mqttMessagesTotal.WithLabelValues(direction, result).Inc()
+}
+
+// ObserveConsume records how long processing an event for deviceType took and whether it failed.
+func ObserveConsume(deviceType string, start time.Time, err error) {
+	consumeSeconds.WithLabelValues(deviceType).Observe(time.Since(start).Seconds())
+	if err != nil {
+		consumeFailuresTotal.WithLabelValues(deviceType).Inc()
+	}
+}
+
+// RegisterDBMetrics exposes the connection pool statistics of the PostgreSQL client.
+func RegisterDBMetrics(p *PostgreSQLClient) error {
+	return prometheus.Register(collectors.NewDBStatsCollector(p.DB, "homebunny"))
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush event streams.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Flush forwards flushes so streaming handlers keep working when instrumented.
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack forwards connection takeovers so WebSocket upgrades keep working when instrumented.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// InstrumentHandler records the latency of requests to route, labelled with the method and status code.
+func InstrumentHandler(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+		httpRequestSeconds.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Observe(time.Since(start).Seconds())
+	}
+}
+
+// MetricsHandler serves the registered metrics in the Prometheus exposition format.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ServeMetrics starts a dedicated HTTP listener exposing /metrics on the given port,
+// along with the /healthz and /readyz probes when health is not nil.
+func ServeMetrics(port string, health *Health) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", MetricsHandler())
+	if health != nil {
+		mux.HandleFunc("GET /healthz", health.LivenessHandler)
+		mux.HandleFunc("GET /readyz", health.ReadinessHandler)
+	}
+	go func() {
+		log.Printf("Serving metrics on :%s/metrics", port)
+		if err := http.ListenAndServe(":"+port, mux); err != nil {
+			log.Printf("Metrics listener failed: %v", err)
+		}
+	}()
+}
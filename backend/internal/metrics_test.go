@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// histogramCount returns the number of observations recorded by the histogram with the given labels.
+func histogramCount(t *testing.T, h *prometheus.HistogramVec, labels ...string) uint64 {
+	var m dto.Metric
+	require.NoError(t, h.WithLabelValues(labels...).(prometheus.Metric).Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	before := histogramCount(t, httpRequestSeconds, "GET /devices/{id}", http.MethodGet, "404")
+
+	handler := InstrumentHandler("GET /devices/{id}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Device not found", http.StatusNotFound)
+	})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/devices/missing", nil))
+
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode, "status code should pass through")
+	assert.Equal(t, before+1, histogramCount(t, httpRequestSeconds, "GET /devices/{id}", http.MethodGet, "404"),
+		"request should be recorded under its route and status code")
+}
+
+func TestInstrumentHandlerKeepsFlusher(t *testing.T) {
+	handler := InstrumentHandler("GET /events/stream", func(w http.ResponseWriter, r *http.Request) {
+		_, ok := w.(http.Flusher)
+		assert.True(t, ok, "instrumented writer should support flushing")
+		_, ok = w.(http.Hijacker)
+		assert.True(t, ok, "instrumented writer should support hijacking")
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/events/stream", nil))
+}
+
+func TestObserveConsume(t *testing.T) {
+	failures := testutil.ToFloat64(consumeFailuresTotal.WithLabelValues("heater"))
+	processed := histogramCount(t, consumeSeconds, "heater")
+
+	ObserveConsume("heater", time.Now(), nil)
+	ObserveConsume("heater", time.Now(), errors.New("ack failed"))
+
+	assert.Equal(t, processed+2, histogramCount(t, consumeSeconds, "heater"), "every event should be timed")
+	assert.Equal(t, failures+1, testutil.ToFloat64(consumeFailuresTotal.WithLabelValues("heater")), "failures should be counted")
+}
+
+func TestMetricsHandler(t *testing.T) {
+	observePublish("device_events", "ack", time.Now())
+
+	w := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body, err := io.ReadAll(w.Result().Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `homebunny_publish_total{exchange="device_events",result="ack"}`)
+	assert.Contains(t, string(body), "homebunny_publish_confirm_seconds_bucket")
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Schema migrations applied in file name order, each exactly once.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a versioned schema change.
+type Migration struct {
+	Version string // File name without extension, e.g. "0001_devices"
+	SQL     string
+}
+
+// Migrations returns the embedded migrations in the order they are applied.
+func Migrations() ([]Migration, error) {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+	sort.Strings(names)
+
+	migrations := make([]Migration, 0, len(names))
+	for _, name := range names {
+		content, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", name, err)
+		}
+		version := strings.TrimSuffix(strings.TrimPrefix(name, "migrations/"), ".sql")
+		migrations = append(migrations, Migration{Version: version, SQL: string(content)})
+	}
+	return migrations, nil
+}
+
+// migrationLockID is the advisory lock key serializing migrations across instances.
+const migrationLockID = 7142024
+
+// Migrate applies every pending migration in its own transaction. An advisory lock ensures
+// that only one instance migrates at a time.
+func (p *PostgreSQLClient) Migrate() error {
+	ctx := context.Background()
+	conn, err := p.DB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection for migrations: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+                version VARCHAR PRIMARY KEY,
+                applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+              )`
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	pending, err := p.PendingMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range pending {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %s: %w", migration.Version, err)
+		}
+		if _, err := tx.Exec(migration.SQL); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %s: %w", migration.Version, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, migration.Version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %s: %w", migration.Version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %s: %w", migration.Version, err)
+		}
+		log.Printf("Applied migration %s", migration.Version)
+	}
+	return nil
+}
+
+// PendingMigrations returns the embedded migrations that have not been applied to the database yet.
+func (p *PostgreSQLClient) PendingMigrations(ctx context.Context) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.DB.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[string]bool)
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("failed to scan migration version: %w", err)
+		}
+		applied[version] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list applied migrations: %w", err)
+	}
+
+	var pending []Migration
+	for _, migration := range migrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
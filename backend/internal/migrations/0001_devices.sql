@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS devices (
+    device_id VARCHAR PRIMARY KEY,
+    type VARCHAR NOT NULL,
+    state VARCHAR NOT NULL
+);
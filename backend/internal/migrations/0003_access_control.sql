@@ -0,0 +1,30 @@
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS room VARCHAR NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS users (
+    user_id VARCHAR PRIMARY KEY, -- API key name or JWT subject
+    name VARCHAR NOT NULL,
+    role VARCHAR NOT NULL CHECK (role IN ('owner', 'adult', 'child', 'guest')),
+    expires_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+    id SERIAL PRIMARY KEY,
+    user_id VARCHAR NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    device_id VARCHAR,
+    room VARCHAR,
+    action VARCHAR NOT NULL CHECK (action IN ('read', 'control')),
+    allow BOOLEAN NOT NULL DEFAULT TRUE,
+    expires_at TIMESTAMPTZ,
+    CHECK ((device_id IS NULL) <> (room IS NULL))
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    user_id VARCHAR NOT NULL,
+    action VARCHAR NOT NULL,
+    device_id VARCHAR NOT NULL DEFAULT '',
+    state VARCHAR NOT NULL DEFAULT '',
+    allowed BOOLEAN NOT NULL,
+    reason VARCHAR NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
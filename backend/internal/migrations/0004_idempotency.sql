@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    scope VARCHAR NOT NULL, -- route and caller the key was sent by
+    idempotency_key VARCHAR NOT NULL,
+    request_hash CHAR(64) NOT NULL, -- hex encoded SHA-256 of the request body
+    status_code INTEGER, -- NULL while the first request is still being handled
+    content_type VARCHAR NOT NULL DEFAULT '',
+    body BYTEA,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (scope, idempotency_key)
+);
+
+CREATE TABLE IF NOT EXISTS processed_messages (
+    consumer VARCHAR NOT NULL,
+    message_id VARCHAR NOT NULL,
+    processed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (consumer, message_id)
+);
+
+CREATE TABLE IF NOT EXISTS device_state_history (
+    id BIGSERIAL PRIMARY KEY,
+    device_id VARCHAR NOT NULL REFERENCES devices (device_id) ON DELETE CASCADE,
+    previous_state VARCHAR NOT NULL,
+    state VARCHAR NOT NULL,
+    message_id VARCHAR NOT NULL UNIQUE, -- event that caused the transition
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS device_state_history_device_idx ON device_state_history (device_id, changed_at);
@@ -0,0 +1,2 @@
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1; -- incremented on every change
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS event_time TIMESTAMPTZ; -- time of the event that set the current state
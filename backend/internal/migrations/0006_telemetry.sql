@@ -0,0 +1,11 @@
+-- Partitioned by day, partitions are created on demand by the telemetry consumer and dropped by retention
+CREATE TABLE IF NOT EXISTS telemetry (
+    device_id VARCHAR NOT NULL,
+    device_type VARCHAR NOT NULL,
+    metric VARCHAR NOT NULL, -- e.g. "temperature", "humidity", "power"
+    value DOUBLE PRECISION NOT NULL,
+    unit VARCHAR NOT NULL DEFAULT '', -- e.g. "C", "%", "W"
+    recorded_at TIMESTAMPTZ NOT NULL
+) PARTITION BY RANGE (recorded_at);
+
+CREATE INDEX IF NOT EXISTS telemetry_device_metric_idx ON telemetry (device_id, metric, recorded_at);
@@ -0,0 +1,3 @@
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ; -- time of the latest heartbeat
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS presence VARCHAR NOT NULL DEFAULT 'unknown'
+    CHECK (presence IN ('unknown', 'online', 'offline'));
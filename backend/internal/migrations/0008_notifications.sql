@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id VARCHAR NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    channel VARCHAR NOT NULL, -- "email", "webhook" or "log"
+    address VARCHAR NOT NULL DEFAULT '', -- Email address or webhook URL
+    min_severity VARCHAR NOT NULL DEFAULT 'info' CHECK (min_severity IN ('info', 'warning', 'critical')),
+    quiet_from VARCHAR NOT NULL DEFAULT '', -- e.g. "22:00", no quiet hours when empty
+    quiet_to VARCHAR NOT NULL DEFAULT '',
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    PRIMARY KEY (user_id, channel)
+);
+
+CREATE TABLE IF NOT EXISTS notification_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    notification_id VARCHAR NOT NULL,
+    user_id VARCHAR NOT NULL,
+    channel VARCHAR NOT NULL,
+    severity VARCHAR NOT NULL,
+    title VARCHAR NOT NULL,
+    dedup_key VARCHAR NOT NULL,
+    status VARCHAR NOT NULL CHECK (status IN ('sent', 'failed', 'duplicate', 'quiet_hours', 'rate_limited')),
+    error VARCHAR NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS notification_deliveries_user_idx ON notification_deliveries (user_id, channel, created_at);
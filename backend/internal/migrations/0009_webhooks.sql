@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id SERIAL PRIMARY KEY,
+    url VARCHAR NOT NULL,
+    filter VARCHAR NOT NULL DEFAULT '#', -- Routing key pattern, e.g. "device.tv.#"
+    secret VARCHAR NOT NULL, -- Key of the HMAC-SHA256 signature sent with each delivery
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    consecutive_failures INTEGER NOT NULL DEFAULT 0,
+    disabled_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    subscription_id INTEGER NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+    message_id VARCHAR NOT NULL,
+    routing_key VARCHAR NOT NULL,
+    attempt INTEGER NOT NULL,
+    status_code INTEGER NOT NULL DEFAULT 0, -- 0 when no response was received
+    error VARCHAR NOT NULL DEFAULT '',
+    success BOOLEAN NOT NULL,
+    duration_ms INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_subscription_idx ON webhook_deliveries (subscription_id, created_at);
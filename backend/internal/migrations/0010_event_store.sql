@@ -0,0 +1,57 @@
+CREATE TABLE IF NOT EXISTS device_event_store (
+    position BIGSERIAL PRIMARY KEY,
+    event_type VARCHAR NOT NULL CHECK (event_type IN ('registered', 'state_changed', 'deleted', 'imported')),
+    device_id VARCHAR NOT NULL,
+    device_type VARCHAR NOT NULL,
+    previous_state VARCHAR NOT NULL DEFAULT '',
+    state VARCHAR NOT NULL DEFAULT '',
+    room VARCHAR NOT NULL DEFAULT '',
+    version BIGINT NOT NULL, -- version of the device after the event
+    message_id VARCHAR UNIQUE, -- device event the change came from, if any
+    event_time TIMESTAMPTZ,
+    recorded_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    transaction_id XID8 NOT NULL DEFAULT pg_current_xact_id() -- lets readers skip events of running transactions
+);
+
+CREATE INDEX IF NOT EXISTS device_event_store_device_idx ON device_event_store (device_id, position);
+
+CREATE OR REPLACE FUNCTION reject_device_event_store_change() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'device_event_store is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER device_event_store_append_only BEFORE UPDATE OR DELETE ON device_event_store
+    FOR EACH ROW EXECUTE FUNCTION reject_device_event_store_change();
+CREATE TRIGGER device_event_store_no_truncate BEFORE TRUNCATE ON device_event_store
+    FOR EACH STATEMENT EXECUTE FUNCTION reject_device_event_store_change();
+
+-- Devices registered before the store existed start with the state before their first recorded transition,
+-- replay their history, and end with a snapshot of their current state
+INSERT INTO device_event_store (event_type, device_id, device_type, previous_state, state, room, version, message_id, event_time)
+SELECT event_type, device_id, device_type, previous_state, state, room, version, message_id, event_time
+FROM (
+    SELECT d.device_id, 0 AS seq, 0::BIGINT AS history_id, 'registered' AS event_type, d.type AS device_type,
+           '' AS previous_state,
+           COALESCE((SELECT h.previous_state FROM device_state_history h WHERE h.device_id = d.device_id
+                     ORDER BY h.changed_at, h.id LIMIT 1), d.state) AS state,
+           d.room, 1::BIGINT AS version, NULL::VARCHAR AS message_id, NULL::TIMESTAMPTZ AS event_time
+    FROM devices d
+    UNION ALL
+    SELECT h.device_id, 1, h.id, 'state_changed', d.type, h.previous_state, h.state, d.room,
+           1 + ROW_NUMBER() OVER (PARTITION BY h.device_id ORDER BY h.changed_at, h.id), h.message_id, h.changed_at
+    FROM device_state_history h JOIN devices d ON d.device_id = h.device_id
+    UNION ALL
+    SELECT d.device_id, 2, 0, 'imported', d.type, '', d.state, d.room, d.version, NULL, d.event_time
+    FROM devices d
+) seed
+ORDER BY device_id, seq, event_time NULLS FIRST, history_id;
+
+CREATE TABLE IF NOT EXISTS projection_checkpoints (
+    name VARCHAR PRIMARY KEY,
+    position BIGINT NOT NULL DEFAULT 0, -- last event store position applied
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO projection_checkpoints (name, position)
+SELECT 'devices', COALESCE(MAX(position), 0) FROM device_event_store;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS stream_offsets (
+    stream VARCHAR NOT NULL,
+    consumer VARCHAR NOT NULL,
+    "offset" BIGINT NOT NULL, -- last offset the consumer processed
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (stream, consumer)
+);
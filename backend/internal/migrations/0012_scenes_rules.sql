@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS scenes (
+    name VARCHAR PRIMARY KEY,
+    actions JSONB NOT NULL, -- Device states to apply, e.g. [{"device_id": "tv1", "state": "off"}]
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS rules (
+    name VARCHAR PRIMARY KEY,
+    trigger VARCHAR NOT NULL, -- Routing key pattern of the device events activating the scene, e.g. "device.motion_sensor.detected"
+    device_id VARCHAR NOT NULL DEFAULT '', -- Only events of this device trigger the rule when set
+    scene VARCHAR NOT NULL REFERENCES scenes (name),
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS rules_scene_idx ON rules (scene);
@@ -0,0 +1,505 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// OriginHeader marks device events by where they entered the system, so the MQTT bridge does not send
+// events it published itself back to MQTT.
+const (
+	OriginHeader = "origin"
+	OriginMQTT   = "mqtt"
+)
+
+// mqttEchoWindow is how long the bridge expects its own publishes to come back on its subscription.
+const mqttEchoWindow = 30 * time.Second
+
+// MQTTStateTopic returns the topic the state of a device is bridged on.
+func MQTTStateTopic(prefix, deviceType, deviceID string) string {
+	return fmt.Sprintf("%s/%s/%s/state", prefix, deviceType, deviceID)
+}
+
+// MQTTCommandTopic returns the topic commands for a device are bridged on, e.g. from Home Assistant.
+func MQTTCommandTopic(prefix, deviceType, deviceID string) string {
+	return fmt.Sprintf("%s/%s/%s/set", prefix, deviceType, deviceID)
+}
+
+// Last level of the device topics.
+const (
+	MQTTStateChannel   = "state"
+	MQTTCommandChannel = "set"
+)
+
+// ParseMQTTTopic returns the device type, ID and channel of a <prefix>/<type>/<id>/<channel> topic,
+// where the channel is MQTTStateChannel or MQTTCommandChannel.
+func ParseMQTTTopic(prefix, topic string) (deviceType, deviceID, channel string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(topic, prefix+"/"), "/")
+	if !strings.HasPrefix(topic, prefix+"/") || len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", false
+	}
+	if parts[2] != MQTTStateChannel && parts[2] != MQTTCommandChannel {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+// mqttState is the JSON form of a state or command payload, devices may also send the bare state.
+type mqttState struct {
+	State string `json:"state"`
+	Room  string `json:"room,omitempty"`
+}
+
+// mqttConnection is a connection to the broker configured under MQTT. It subscribes again on every
+// reconnect, since subscriptions are lost with the session.
+type mqttConnection struct {
+	client     mqtt.Client
+	timeout    time.Duration
+	persistent bool // The broker keeps the session across reconnects
+
+	subscribed     chan struct{} // Closed once subscribed for the first time
+	subscribedOnce sync.Once
+
+	retries      int           // Retries of a failed message before the connection is reset
+	backoff      time.Duration // Delay before the first retry, doubling with every retry
+	reconnecting atomic.Bool
+	closed       atomic.Bool
+}
+
+// newMQTTConnection creates a connection for clientID that calls subscribe on every connect.
+// Messages are not acknowledged automatically, handlers call Ack once a message is handled.
+func newMQTTConnection(config AppConfig, clientID string, subscribe func(mqtt.Client) error) *mqttConnection {
+	c := &mqttConnection{timeout: config.MQTT.Timeout, subscribed: make(chan struct{}), retries: 3, backoff: 500 * time.Millisecond}
+	if c.timeout <= 0 {
+		c.timeout = 10 * time.Second
+	}
+
+	// A persistent session keeps the messages left unacknowledged after a failure, so the broker
+	// redelivers them when the client reconnects. It needs a stable client ID.
+	c.persistent = clientID != ""
+	options := mqtt.NewClientOptions().
+		AddBroker(config.MQTT.Broker).
+		SetClientID(clientID).
+		SetCleanSession(!c.persistent).
+		SetUsername(config.MQTT.Username).
+		SetPassword(config.MQTT.Password).
+		SetConnectTimeout(c.timeout).
+		SetAutoReconnect(true).
+		SetAutoAckDisabled(true).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			if err := subscribe(client); err != nil {
+				log.Printf("Failed to subscribe to MQTT topics: %v", err)
+				return
+			}
+			c.subscribedOnce.Do(func() { close(c.subscribed) })
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("Lost connection to MQTT broker: %v", err)
+		})
+	c.client = mqtt.NewClient(options)
+	return c
+}
+
+// redeliver reports whether a message that failed is left unacknowledged, so the broker redelivers it
+// when the persistent session reconnects. Without a client ID the session is discarded on reconnect
+// and the message with it, so it is counted as dropped instead.
+func (c *mqttConnection) redeliver(topic string) bool {
+	if c.persistent {
+		return true
+	}
+	log.Printf("Dropped MQTT message on %s, configure a client ID to have failed messages redelivered", topic)
+	mqttMessagesTotal.WithLabelValues("inbound", "dropped").Inc()
+	return false
+}
+
+// connect connects to the broker and waits for the first subscription.
+func (c *mqttConnection) connect() error {
+	token := c.client.Connect()
+	if !token.WaitTimeout(c.timeout) {
+		return errors.New("timed out connecting to MQTT broker")
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("error connecting to MQTT broker: %w", err)
+	}
+	select {
+	case <-c.subscribed:
+		return nil
+	case <-time.After(c.timeout):
+		return errors.New("timed out subscribing to MQTT topics")
+	}
+}
+
+func (c *mqttConnection) close() {
+	c.closed.Store(true)
+	c.client.Disconnect(250)
+}
+
+// handle runs ingest for a message and acknowledges it once it is handled, retrying failures with
+// backoff. Messages failing with a permanent error are acknowledged and dropped. A message that still
+// fails is left unacknowledged and the connection is reset, so the broker redelivers it right away
+// instead of holding it in flight, and blocking the messages after it, until some later reconnect.
+func (c *mqttConnection) handle(msg mqtt.Message, ingest func(ctx context.Context) error, permanent error) {
+	var err error
+	for retry := 0; ; retry++ {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		err = ingest(ctx)
+		cancel()
+		if err == nil || errors.Is(err, permanent) || retry == c.retries || c.closed.Load() {
+			break
+		}
+		log.Printf("Failed to handle MQTT message on %s, retrying: %v", msg.Topic(), err)
+		time.Sleep(c.backoff << retry)
+	}
+	if err != nil {
+		log.Printf("Failed to handle MQTT message on %s: %v", msg.Topic(), err)
+		if !errors.Is(err, permanent) && msg.Qos() > 0 && c.redeliver(msg.Topic()) {
+			c.reconnect() // Not acknowledged, so the broker redelivers the message on the new connection
+			return
+		}
+	}
+	msg.Ack()
+}
+
+// reconnect disconnects and connects again in the background, unless a reconnect is running already.
+func (c *mqttConnection) reconnect() {
+	if !c.reconnecting.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer c.reconnecting.Store(false)
+		// Disconnecting waits for the message handlers, so it cannot run in the handler itself
+		c.client.Disconnect(250)
+		for !c.closed.Load() {
+			err := c.connect()
+			if err == nil {
+				log.Printf("Reconnected to MQTT broker to have failed messages redelivered")
+				return
+			}
+			log.Printf("Failed to reconnect to MQTT broker: %v", err)
+			time.Sleep(c.timeout)
+		}
+	}()
+}
+
+// check reports whether the connection is open, for health checks.
+func (c *mqttConnection) check(ctx context.Context) error {
+	if !c.client.IsConnectionOpen() {
+		return errors.New("not connected to MQTT broker")
+	}
+	return nil
+}
+
+// subscribe subscribes to topics with their QoS and waits for the broker to confirm.
+func (c *mqttConnection) subscribe(client mqtt.Client, topics map[string]byte, handler mqtt.MessageHandler) error {
+	token := client.SubscribeMultiple(topics, handler)
+	if !token.WaitTimeout(c.timeout) {
+		return errors.New("timed out subscribing")
+	}
+	return token.Error()
+}
+
+// publish sends a message and waits until the broker accepted it at qos.
+func (c *mqttConnection) publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	token := c.client.Publish(topic, qos, retain, payload)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(c.timeout):
+		return errors.New("timed out publishing to MQTT broker")
+	}
+}
+
+// MQTTBridge forwards device states and commands published on MQTT to device_events and device events
+// and commands to MQTT. With Home Assistant enabled it also publishes discovery entries for devices.
+type MQTTBridge struct {
+	conn          *mqttConnection
+	publisher     Publisher
+	registry      DeviceStates   // Records the states received from MQTT, nil to only publish them
+	homeAssistant *HomeAssistant // nil when discovery is disabled
+	prefix        string
+	qos           byte
+	retain        bool
+	retained      bool // Ingest retained messages
+
+	mu     sync.Mutex
+	echoes map[string]time.Time // Expiry of states the bridge published, by topic and payload
+}
+
+// NewMQTTBridge creates a bridge to the broker configured under MQTT, recording device states in
+// registry and publishing device events with publisher. Connect must be called before it bridges anything.
+func NewMQTTBridge(config AppConfig, publisher Publisher, registry DeviceStates) *MQTTBridge {
+	b := &MQTTBridge{
+		publisher: publisher,
+		registry:  registry,
+		prefix:    config.MQTT.TopicPrefix,
+		qos:       config.MQTT.QoS,
+		retain:    config.MQTT.Retain,
+		retained:  config.MQTT.IngestRetained,
+		echoes:    make(map[string]time.Time),
+	}
+	if b.prefix == "" {
+		b.prefix = "homebunny"
+	}
+	if config.MQTT.HomeAssistant.Enabled {
+		b.homeAssistant = NewHomeAssistant(config)
+	}
+	if b.qos > 2 {
+		b.qos = 2
+	}
+	b.conn = newMQTTConnection(config, config.MQTT.ClientID, b.subscribe)
+	return b
+}
+
+// Connect connects to the MQTT broker and subscribes to the state and command topics.
+func (b *MQTTBridge) Connect() error {
+	return b.conn.connect()
+}
+
+// Close disconnects from the MQTT broker.
+func (b *MQTTBridge) Close() {
+	b.conn.close()
+}
+
+// Check reports whether the bridge is connected to the MQTT broker, for health checks.
+func (b *MQTTBridge) Check(ctx context.Context) error {
+	return b.conn.check(ctx)
+}
+
+func (b *MQTTBridge) subscribe(client mqtt.Client) error {
+	topics := map[string]byte{
+		MQTTStateTopic(b.prefix, "+", "+"):   b.qos,
+		MQTTCommandTopic(b.prefix, "+", "+"): b.qos,
+	}
+	if err := b.conn.subscribe(client, topics, b.handleMessage); err != nil {
+		return err
+	}
+	log.Printf("Bridging MQTT topics %s/+/+/{state,set} to device_events", b.prefix)
+	return nil
+}
+
+// handleMessage publishes a state or command received on MQTT to device_events.
+func (b *MQTTBridge) handleMessage(_ mqtt.Client, msg mqtt.Message) {
+	b.conn.handle(msg, func(ctx context.Context) error {
+		return b.Ingest(ctx, msg.Topic(), msg.Payload(), msg.Qos(), msg.Retained())
+	}, errInvalidMQTTState)
+}
+
+// errInvalidMQTTState is returned for messages that can never be bridged and are dropped.
+var errInvalidMQTTState = errors.New("invalid MQTT state")
+
+// Ingest records a state received on a state topic and publishes it as a device event, and publishes a
+// state received on a command topic as a command. With a registry, messages of devices that are not
+// registered under the type of the topic are dropped. Echoes of messages the bridge published itself are dropped, and so are
+// retained messages unless MQTT.IngestRetained is set.
+func (b *MQTTBridge) Ingest(ctx context.Context, topic string, payload []byte, qos byte, retained bool) error {
+	if b.takeEcho(topic, payload) || (retained && !b.retained) {
+		return nil
+	}
+
+	deviceType, deviceID, channel, ok := ParseMQTTTopic(b.prefix, topic)
+	if !ok {
+		return fmt.Errorf("%w: unexpected topic %s", errInvalidMQTTState, topic)
+	}
+	state := mqttState{State: strings.TrimSpace(string(payload))}
+	if strings.HasPrefix(state.State, "{") {
+		if err := json.Unmarshal(payload, &state); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidMQTTState, err)
+		}
+	}
+	device := Device{ID: deviceID, Type: deviceType, State: state.State, Room: state.Room}
+	if device.State == "" || strings.ContainsAny(device.Type+device.ID+device.State+device.Room, ".*# ") {
+		return fmt.Errorf("%w: %q", errInvalidMQTTState, payload)
+	}
+	if b.registry != nil {
+		// Only registered devices are bridged, under their registered type and room
+		registered, err := b.registry.GetDevice(device.ID)
+		if err != nil {
+			return err
+		}
+		if registered == nil {
+			return fmt.Errorf("%w: device %s is not registered", errInvalidMQTTState, device.ID)
+		}
+		if registered.Type != device.Type {
+			return fmt.Errorf("%w: device %s is a %s, not a %s", errInvalidMQTTState, device.ID, registered.Type, device.Type)
+		}
+		device.Room = registered.Room
+	}
+
+	eventTime := time.Now()
+	msg := CreateDeviceEvent(device, eventTime)
+	if channel == MQTTCommandChannel {
+		msg = CreateCommandMessage(Command{DeviceID: device.ID, DeviceType: device.Type, State: device.State, Timestamp: eventTime})
+	}
+	msg.Headers[OriginHeader] = OriginMQTT
+	if qos > 0 {
+		// Messages the device wants delivered at least once survive a RabbitMQ restart
+		msg.DeliveryMode = amqp.Persistent
+	}
+	if channel == MQTTCommandChannel {
+		err := b.publisher.Send(ctx, "device_events", CommandRoutingKey(device.Type, device.ID), msg)
+		observeMQTTMessage("inbound", err)
+		return err
+	}
+
+	// States are recorded like the ones of every other source before their event is published
+	err := PublishDeviceState(ctx, b.registry, b.publisher, device, msg, eventTime, 0)
+	if errors.Is(err, ErrStaleEvent) {
+		log.Printf("Skipped stale MQTT state of device %s", device.ID)
+		return nil
+	}
+	if err == nil || errors.Is(err, ErrNotPublished) {
+		observeMQTTMessage("inbound", err)
+	}
+	return err
+}
+
+// Run publishes device events to MQTT until messages is closed. Events are acknowledged once the MQTT
+// broker accepted them at the configured QoS and requeued when publishing failed.
+func (b *MQTTBridge) Run(ctx context.Context, messages <-chan amqp.Delivery) {
+	for msg := range messages {
+		if err := b.Forward(ctx, msg); err != nil {
+			log.Printf("Failed to bridge event %s to MQTT: %v", msg.MessageId, err)
+			time.Sleep(time.Second) // Do not spin while the broker is unreachable
+			if err := msg.Nack(false, true); err != nil {
+				log.Printf("Failed to requeue event: %v", err)
+			}
+			continue
+		}
+		if err := msg.Ack(false); err != nil {
+			log.Printf("Failed to acknowledge event: %v", err)
+		}
+	}
+}
+
+// Forward publishes the state of a device event to the state topic of its device and a command to
+// the command topic of its device. Registry events publish or remove Home Assistant discovery entries.
+// Messages that came from MQTT and other events are skipped.
+func (b *MQTTBridge) Forward(ctx context.Context, msg amqp.Delivery) error {
+	if origin, _ := msg.Headers[OriginHeader].(string); origin == OriginMQTT {
+		return nil
+	}
+
+	switch strings.SplitN(msg.RoutingKey, ".", 2)[0] {
+	case "device":
+		device, err := ParseDeviceEvent(msg)
+		if err != nil {
+			log.Printf("Skipping event %s: %v", msg.MessageId, err)
+			return nil
+		}
+		return b.publish(ctx, MQTTStateTopic(b.prefix, device.Type, device.ID), []byte(device.State), b.retain)
+	case "command":
+		command, err := ParseCommand(msg)
+		if err != nil {
+			log.Printf("Skipping command %s: %v", msg.MessageId, err)
+			return nil
+		}
+		// Commands are not retained, a device must not apply an old command when it reconnects
+		return b.publish(ctx, MQTTCommandTopic(b.prefix, command.DeviceType, command.DeviceID), []byte(command.State), false)
+	case "registry":
+		if b.homeAssistant == nil {
+			return nil
+		}
+		action, device, err := ParseRegistryEvent(msg)
+		if err != nil {
+			log.Printf("Skipping registry event %s: %v", msg.MessageId, err)
+			return nil
+		}
+		if action == RegistryDeleted {
+			return b.RemoveDiscovery(ctx, device)
+		}
+		return b.PublishDiscovery(ctx, device)
+	}
+	return nil
+}
+
+// PublishDiscovery publishes the Home Assistant discovery entry of a device, and its state so Home
+// Assistant does not wait for the next change.
+func (b *MQTTBridge) PublishDiscovery(ctx context.Context, device Device) error {
+	topic, payload, err := b.homeAssistant.Discovery(device)
+	if err != nil {
+		log.Printf("Skipping discovery of device %s: %v", device.ID, err)
+		return nil
+	}
+	if err := b.publish(ctx, topic, payload, true); err != nil {
+		return err
+	}
+	if device.State == "" || !b.retain {
+		return nil
+	}
+	return b.publish(ctx, MQTTStateTopic(b.prefix, device.Type, device.ID), []byte(device.State), true)
+}
+
+// RemoveDiscovery removes the Home Assistant discovery entry and the retained state of a device.
+func (b *MQTTBridge) RemoveDiscovery(ctx context.Context, device Device) error {
+	topic, _, err := b.homeAssistant.Discovery(device)
+	if err != nil {
+		log.Printf("Skipping discovery of device %s: %v", device.ID, err)
+		return nil
+	}
+	// An empty retained message deletes the retained one
+	if err := b.publish(ctx, topic, nil, true); err != nil {
+		return err
+	}
+	return b.publish(ctx, MQTTStateTopic(b.prefix, device.Type, device.ID), nil, true)
+}
+
+// SyncDiscovery publishes the discovery entries of all devices, for devices registered while the
+// bridge was not running.
+func (b *MQTTBridge) SyncDiscovery(ctx context.Context, devices []Device) error {
+	if b.homeAssistant == nil {
+		return nil
+	}
+	for _, device := range devices {
+		if err := b.PublishDiscovery(ctx, device); err != nil {
+			return err
+		}
+	}
+	log.Printf("Published Home Assistant discovery for %d devices", len(devices))
+	return nil
+}
+
+// publish sends a message to the MQTT broker and waits until it is accepted at the configured QoS.
+func (b *MQTTBridge) publish(ctx context.Context, topic string, payload []byte, retain bool) error {
+	if strings.HasPrefix(topic, b.prefix+"/") {
+		b.expectEcho(topic, payload)
+	}
+
+	err := b.conn.publish(ctx, topic, b.qos, retain, payload)
+	observeMQTTMessage("outbound", err)
+	return err
+}
+
+// expectEcho remembers a message the bridge publishes, since its own subscription receives it again.
+func (b *MQTTBridge) expectEcho(topic string, payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for key, expiry := range b.echoes {
+		if now.After(expiry) {
+			delete(b.echoes, key)
+		}
+	}
+	b.echoes[topic+"\x00"+string(payload)] = now.Add(mqttEchoWindow)
+}
+
+// takeEcho reports whether a received message is the echo of one the bridge published.
+func (b *MQTTBridge) takeEcho(topic string, payload []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := topic + "\x00" + string(payload)
+	expiry, ok := b.echoes[key]
+	delete(b.echoes, key)
+	return ok && time.Now().Before(expiry)
+}
@@ -0,0 +1,302 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// channelPublisher hands published messages to the test.
+type channelPublisher struct {
+	published chan publishedMessage
+}
+
+type publishedMessage struct {
+	routingKey string
+	msg        amqp.Publishing
+}
+
+func (p *channelPublisher) Send(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	p.published <- publishedMessage{routingKey, msg}
+	return nil
+}
+
+// startMQTTBroker runs an embedded MQTT broker for the duration of the test.
+func startMQTTBroker(t *testing.T) (*mochi.Server, string) {
+	server := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	listener := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	require.NoError(t, server.AddListener(listener))
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return server, "tcp://" + listener.Address()
+}
+
+func newTestBridge(t *testing.T, broker string, ingestRetained bool) (*MQTTBridge, *channelPublisher, *memoryRegistry) {
+	var config AppConfig
+	config.MQTT.Broker = broker
+	config.MQTT.ClientID = "bridge-" + NewMessageID()
+	config.MQTT.QoS = 1
+	config.MQTT.Retain = true
+	config.MQTT.IngestRetained = ingestRetained
+	config.MQTT.Timeout = 5 * time.Second
+	publisher := &channelPublisher{published: make(chan publishedMessage, 10)}
+	registry := &memoryRegistry{devices: map[string]Device{"p1": {ID: "p1", Type: "plug", State: "off", Room: "hall"}}}
+	bridge := NewMQTTBridge(config, publisher, registry)
+	require.NoError(t, bridge.Connect())
+	t.Cleanup(bridge.Close)
+	return bridge, publisher, registry
+}
+
+func receivePublished(t *testing.T, publisher *channelPublisher) publishedMessage {
+	select {
+	case published := <-publisher.published:
+		return published
+	case <-time.After(5 * time.Second):
+		t.Fatal("no device event was published")
+		return publishedMessage{}
+	}
+}
+
+func assertNothingPublished(t *testing.T, publisher *channelPublisher) {
+	select {
+	case published := <-publisher.published:
+		t.Fatalf("unexpected device event %s", published.routingKey)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMQTTTopics(t *testing.T) {
+	topic := MQTTStateTopic("homebunny", "plug", "p1")
+	assert.Equal(t, "homebunny/plug/p1/state", topic)
+
+	deviceType, deviceID, channel, ok := ParseMQTTTopic("homebunny", topic)
+	assert.True(t, ok)
+	assert.Equal(t, "plug", deviceType)
+	assert.Equal(t, "p1", deviceID)
+	assert.Equal(t, MQTTStateChannel, channel)
+
+	_, _, channel, ok = ParseMQTTTopic("homebunny", MQTTCommandTopic("homebunny", "plug", "p1"))
+	assert.True(t, ok)
+	assert.Equal(t, MQTTCommandChannel, channel)
+
+	for _, invalid := range []string{"other/plug/p1/state", "homebunny/plug/state", "homebunny/plug/p1/config", "homebunny//p1/state"} {
+		_, _, _, ok := ParseMQTTTopic("homebunny", invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestMQTTBridgeIngest(t *testing.T) {
+	server, broker := startMQTTBroker(t)
+	_, publisher, registry := newTestBridge(t, broker, false)
+
+	require.NoError(t, server.Publish("homebunny/plug/p1/state", []byte("on"), false, 1))
+	published := receivePublished(t, publisher)
+	assert.Equal(t, "device.plug.on", published.routingKey)
+	recorded, err := registry.GetDevice("p1")
+	require.NoError(t, err)
+	assert.Equal(t, "on", recorded.State, "states from MQTT should be recorded in the registry")
+	assert.Equal(t, "p1", published.msg.Headers[DeviceIDHeader])
+	assert.Equal(t, OriginMQTT, published.msg.Headers[OriginHeader], "events from MQTT should be marked to prevent loops")
+
+	require.NoError(t, server.Publish("homebunny/plug/p1/state", []byte(`{"state":"off","room":"kitchen"}`), false, 0))
+	published = receivePublished(t, publisher)
+	assert.Equal(t, "device.plug.off", published.routingKey)
+	assert.Equal(t, "{p1 plug off hall}", string(published.msg.Body), "the registered room should be kept")
+
+	require.NoError(t, server.Publish("homebunny/plug/p1/state", []byte("on.off"), false, 0))
+	assertNothingPublished(t, publisher)
+	require.NoError(t, server.Publish("homebunny/plug/p2/state", []byte("on"), false, 1))
+	assertNothingPublished(t, publisher)
+	require.NoError(t, server.Publish("homebunny/lamp/p1/state", []byte("on"), false, 1))
+	assertNothingPublished(t, publisher)
+	recorded, err = registry.GetDevice("p1")
+	require.NoError(t, err)
+	assert.Equal(t, "off", recorded.State, "states of unregistered devices or other types should be dropped")
+
+	require.NoError(t, server.Publish("homebunny/plug/p1/set", []byte("off"), false, 1))
+	published = receivePublished(t, publisher)
+	assert.Equal(t, "command.plug.p1", published.routingKey, "command topics should be translated into commands")
+	command, err := ParseCommand(amqp.Delivery{RoutingKey: published.routingKey, Body: published.msg.Body})
+	require.NoError(t, err)
+	assert.Equal(t, "off", command.State)
+	assert.Equal(t, OriginMQTT, published.msg.Headers[OriginHeader])
+}
+
+// flakyPublisher fails the first sends and hands the later ones to the test.
+type flakyPublisher struct {
+	channelPublisher
+	mu       sync.Mutex
+	failures int
+}
+
+func (p *flakyPublisher) Send(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("broker unavailable")
+	}
+	return p.channelPublisher.Send(ctx, exchange, routingKey, msg)
+}
+
+func TestMQTTBridgeRetriesFailedMessages(t *testing.T) {
+	for name, failures := range map[string]int{"retried": 2, "redelivered after a reconnect": 5} {
+		t.Run(name, func(t *testing.T) {
+			server, broker := startMQTTBroker(t)
+			var config AppConfig
+			config.MQTT.Broker = broker
+			config.MQTT.ClientID = "bridge-" + NewMessageID()
+			config.MQTT.QoS = 1
+			config.MQTT.Timeout = 5 * time.Second
+			publisher := &flakyPublisher{channelPublisher: channelPublisher{published: make(chan publishedMessage, 10)}, failures: failures}
+			bridge := NewMQTTBridge(config, publisher, nil)
+			bridge.conn.backoff = 10 * time.Millisecond
+			require.NoError(t, bridge.Connect())
+			t.Cleanup(bridge.Close)
+
+			require.NoError(t, server.Publish("homebunny/plug/p1/set", []byte("on"), false, 1))
+			published := receivePublished(t, &publisher.channelPublisher)
+			assert.Equal(t, "command.plug.p1", published.routingKey)
+			assertNothingPublished(t, &publisher.channelPublisher)
+		})
+	}
+}
+
+func TestMQTTBridgeRetainedStates(t *testing.T) {
+	server, broker := startMQTTBroker(t)
+	require.NoError(t, server.Publish("homebunny/plug/p1/state", []byte("on"), true, 1))
+
+	_, publisher, _ := newTestBridge(t, broker, false)
+	assertNothingPublished(t, publisher)
+
+	_, publisher, _ = newTestBridge(t, broker, true)
+	published := receivePublished(t, publisher)
+	assert.Equal(t, "device.plug.on", published.routingKey, "retained states should be ingested when configured")
+}
+
+func TestMQTTBridgeForward(t *testing.T) {
+	server, broker := startMQTTBroker(t)
+	bridge, publisher, _ := newTestBridge(t, broker, false)
+
+	received := make(chan packets.Packet, 10)
+	require.NoError(t, server.Subscribe("homebunny/#", 1, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+
+	msg := CreateDeviceEvent(Device{ID: "tv1", Type: "tv", State: "on", Room: "living_room"}, time.Now())
+	event := amqp.Delivery{RoutingKey: "device.tv.on", Headers: msg.Headers, Body: msg.Body, MessageId: msg.MessageId}
+	require.NoError(t, bridge.Forward(context.Background(), event))
+
+	select {
+	case pk := <-received:
+		assert.Equal(t, "homebunny/tv/tv1/state", pk.TopicName)
+		assert.Equal(t, "on", string(pk.Payload))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the state was not published to MQTT")
+	}
+	assertNothingPublished(t, publisher)
+
+	// A new subscriber gets the last known state
+	retained := make(chan packets.Packet, 1)
+	require.NoError(t, server.Subscribe("homebunny/tv/tv1/state", 2, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		retained <- pk
+	}))
+	select {
+	case pk := <-retained:
+		assert.Equal(t, "on", string(pk.Payload))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the state was not retained")
+	}
+
+	event.Headers[OriginHeader] = OriginMQTT
+	event.RoutingKey = "device.tv.off"
+	require.NoError(t, bridge.Forward(context.Background(), event))
+	select {
+	case pk := <-received:
+		t.Fatalf("events from MQTT should not be sent back, got %s", pk.Payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMQTTBridgeForwardsCommands(t *testing.T) {
+	server, broker := startMQTTBroker(t)
+	bridge, publisher, _ := newTestBridge(t, broker, false)
+
+	received := make(chan packets.Packet, 10)
+	require.NoError(t, server.Subscribe("homebunny/+/+/set", 1, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+
+	msg := CreateCommandMessage(Command{DeviceID: "ac1", DeviceType: "air_conditioner", State: "cooling", Timestamp: time.Now()})
+	command := amqp.Delivery{RoutingKey: CommandRoutingKey("air_conditioner", "ac1"), Headers: msg.Headers, Body: msg.Body}
+	require.NoError(t, bridge.Forward(context.Background(), command))
+
+	select {
+	case pk := <-received:
+		assert.Equal(t, "homebunny/air_conditioner/ac1/set", pk.TopicName)
+		assert.Equal(t, "cooling", string(pk.Payload))
+		assert.False(t, pk.FixedHeader.Retain, "commands should not be retained")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the command was not published to MQTT")
+	}
+	assertNothingPublished(t, publisher)
+}
+
+func TestMQTTBridgeHomeAssistantDiscovery(t *testing.T) {
+	server, broker := startMQTTBroker(t)
+	var config AppConfig
+	config.MQTT.Broker = broker
+	config.MQTT.ClientID = "bridge-" + NewMessageID()
+	config.MQTT.QoS = 1
+	config.MQTT.Retain = true
+	config.MQTT.HomeAssistant.Enabled = true
+	bridge := NewMQTTBridge(config, &channelPublisher{published: make(chan publishedMessage, 10)}, nil)
+	require.NoError(t, bridge.Connect())
+	t.Cleanup(bridge.Close)
+
+	device := Device{ID: "lamp1", Type: "lamp", State: "on", Room: "kitchen"}
+	msg := CreateRegistryEvent(device)
+	event := amqp.Delivery{RoutingKey: RegistryRoutingKey(RegistryCreated, device.Type, device.ID), Headers: msg.Headers, Body: msg.Body}
+	require.NoError(t, bridge.Forward(context.Background(), event))
+
+	retained := func(topic string) chan packets.Packet {
+		received := make(chan packets.Packet, 1)
+		require.NoError(t, server.Subscribe(topic, 1, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+			received <- pk
+		}))
+		return received
+	}
+	select {
+	case pk := <-retained("homeassistant/light/homebunny/lamp1/config"):
+		var discovery map[string]any
+		require.NoError(t, json.Unmarshal(pk.Payload, &discovery))
+		assert.Equal(t, "homebunny/lamp/lamp1/set", discovery["command_topic"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("the discovery entry was not retained")
+	}
+
+	event.RoutingKey = RegistryRoutingKey(RegistryDeleted, device.Type, device.ID)
+	require.NoError(t, bridge.Forward(context.Background(), event))
+	select {
+	case pk := <-retained("homeassistant/light/homebunny/lamp1/config"):
+		t.Fatalf("the discovery entry should be removed, got %s", pk.Payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// NotificationChannel sends a notification to an address, such as an email address or a URL.
+type NotificationChannel interface {
+	Send(ctx context.Context, address string, notification Notification) error
+}
+
+// NewNotificationChannels creates the channels configured for the notifier: "log" always, "webhook"
+// always and "email" when an SMTP host is configured.
+func NewNotificationChannels(config AppConfig) map[string]NotificationChannel {
+	channels := map[string]NotificationChannel{
+		"log":     LogChannel{},
+		"webhook": NewWebhookChannel(config.Notifier.SendTimeout, config.Notifier.WebhookAllowedHosts...),
+	}
+	smtpConfig := config.Notifier.SMTP
+	if smtpConfig.Host != "" {
+		channels["email"] = &EmailChannel{
+			Addr:     net.JoinHostPort(smtpConfig.Host, smtpConfig.Port),
+			From:     smtpConfig.From,
+			Username: smtpConfig.Username,
+			Password: smtpConfig.Password,
+		}
+	}
+	return channels
+}
+
+// LogChannel writes notifications to the log of the notifier, for local setups and desktop log viewers.
+type LogChannel struct{}
+
+// Send logs the notification.
+func (LogChannel) Send(ctx context.Context, address string, notification Notification) error {
+	log.Printf("[%s] %s: %s", strings.ToUpper(notification.Severity), notification.Title, notificationText(notification))
+	return nil
+}
+
+// WebhookChannel posts notifications as JSON to the URL of the recipient. Addresses are chosen by
+// users, so only https URLs are called, redirects are not followed, and hosts resolving to loopback,
+// private, link-local or otherwise internal addresses are refused unless they are allowed explicitly.
+type WebhookChannel struct {
+	Client *http.Client
+}
+
+// ErrWebhookAddress is returned for webhook URLs the notifier may not call.
+var ErrWebhookAddress = errors.New("webhook address not allowed")
+
+// ValidateWebhookAddress checks that address is an absolute https URL.
+func ValidateWebhookAddress(address string) error {
+	target, err := url.Parse(address)
+	if err != nil || target.Scheme != "https" || target.Hostname() == "" {
+		return fmt.Errorf("%w: must be an absolute https URL", ErrWebhookAddress)
+	}
+	return nil
+}
+
+// NewWebhookChannel creates a WebhookChannel whose requests time out after timeout. allowedHosts may
+// resolve to internal addresses, e.g. a Home Assistant instance on the local network.
+func NewWebhookChannel(timeout time.Duration, allowedHosts ...string) *WebhookChannel {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	dialer := &webhookDialer{allowed: make(map[string]bool)}
+	for _, host := range allowedHosts {
+		dialer.allowed[strings.ToLower(host)] = true
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // A proxy would dial the checked host itself
+	transport.DialContext = dialer.DialContext
+	return &WebhookChannel{Client: &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse // A redirect could point anywhere, it fails as a non-2xx answer
+		},
+	}}
+}
+
+// webhookDialer resolves the host itself and dials one of the checked addresses, so the name cannot
+// resolve to another address between the check and the connection.
+type webhookDialer struct {
+	net.Dialer
+	allowed map[string]bool
+}
+
+func (d *webhookDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	if !d.allowed[strings.ToLower(host)] {
+		for _, ip := range addrs {
+			if internalIP(ip.IP) {
+				return nil, fmt.Errorf("%w: %s resolves to internal address %s", ErrWebhookAddress, host, ip.IP)
+			}
+		}
+	}
+	return d.Dialer.DialContext(ctx, network, net.JoinHostPort(addrs[0].IP.String(), port))
+}
+
+// internalIP reports whether ip is not a public unicast address.
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// sharedAddressSpace is the carrier-grade NAT range 100.64.0.0/10, which net.IP does not count as private.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Send posts the notification to address, failing on any status other than 2xx.
+func (c *WebhookChannel) Send(ctx context.Context, address string, notification Notification) error {
+	if address == "" {
+		return errors.New("no webhook URL")
+	}
+	if err := ValidateWebhookAddress(address); err != nil {
+		return err
+	}
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("error encoding notification: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// EmailChannel sends notifications by email through an SMTP server, using STARTTLS when the server
+// offers it.
+type EmailChannel struct {
+	Addr     string // host:port of the SMTP server
+	From     string
+	Username string // No authentication when empty
+	Password string
+}
+
+// Send emails the notification to address.
+func (c *EmailChannel) Send(ctx context.Context, address string, notification Notification) error {
+	if address == "" {
+		return errors.New("no email address")
+	}
+	host, _, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP address: %w", err)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return fmt.Errorf("error connecting to SMTP server: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error greeting SMTP server: %w", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("error starting TLS: %w", err)
+		}
+	}
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, host)); err != nil {
+			return fmt.Errorf("error authenticating to SMTP server: %w", err)
+		}
+	}
+	if err := client.Mail(c.From); err != nil {
+		return fmt.Errorf("error sending email: %w", err)
+	}
+	if err := client.Rcpt(address); err != nil {
+		return fmt.Errorf("error sending email to %s: %w", address, err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("error sending email: %w", err)
+	}
+	if _, err := w.Write(emailMessage(c.From, address, notification)); err != nil {
+		return fmt.Errorf("error sending email: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error sending email: %w", err)
+	}
+	return client.Quit()
+}
+
+// emailMessage formats a notification as a plain text email.
+func emailMessage(from, to string, notification Notification) []byte {
+	date := notification.Timestamp
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: [%s] %s\r\n", notification.Severity, strings.NewReplacer("\r", " ", "\n", " ").Replace(notification.Title))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(notificationText(notification), "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
@@ -0,0 +1,446 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// NotificationExchange is the topic exchange notifications are published on.
+const NotificationExchange = "notifications"
+
+// Severities of notifications, in increasing order.
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical" // Delivered during quiet hours
+)
+
+var severityRank = map[string]int{SeverityInfo: 0, SeverityWarning: 1, SeverityCritical: 2}
+
+// Delivery statuses of a notification on a channel.
+const (
+	DeliverySent        = "sent"
+	DeliveryFailed      = "failed"
+	DeliveryDuplicate   = "duplicate"    // Same alert already sent within the dedup window
+	DeliveryQuietHours  = "quiet_hours"  // Suppressed during the quiet hours of the user
+	DeliveryRateLimited = "rate_limited" // Too many notifications sent to the user on the channel
+)
+
+// Notification is an alert sent to one user, or to every user with notification preferences.
+type Notification struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id,omitempty"` // Every user when empty
+	Severity  string    `json:"severity"`
+	Title     string    `json:"title"`
+	Message   string    `json:"message,omitempty"`
+	DeviceID  string    `json:"device_id,omitempty"`
+	DedupKey  string    `json:"dedup_key,omitempty"` // Alerts with the same key are sent once per dedup window, defaults to ID
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Validate reports an error when the notification cannot be delivered.
+func (n Notification) Validate() error {
+	if _, ok := severityRank[n.Severity]; !ok {
+		return errors.New("severity must be info, warning or critical")
+	}
+	if n.Title == "" {
+		return errors.New("title is required")
+	}
+	return nil
+}
+
+// NotificationRoutingKey returns the routing key notifications of a severity are published with.
+func NotificationRoutingKey(severity string) string {
+	return "notification." + severity
+}
+
+// CreateNotificationMessage encodes a notification as a JSON message.
+func CreateNotificationMessage(notification Notification) (amqp.Publishing, error) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return amqp.Publishing{}, fmt.Errorf("error encoding notification: %w", err)
+	}
+	return amqp.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+		MessageId:   notification.ID,
+		Timestamp:   notification.Timestamp,
+	}, nil
+}
+
+// ParseNotification decodes a notification message.
+func ParseNotification(msg amqp.Delivery) (Notification, error) {
+	var notification Notification
+	if err := json.Unmarshal(msg.Body, &notification); err != nil {
+		return Notification{}, fmt.Errorf("error decoding notification: %w", err)
+	}
+	if notification.ID == "" {
+		notification.ID = msg.MessageId
+	}
+	if notification.ID == "" {
+		notification.ID = NewMessageID()
+	}
+	if notification.Timestamp.IsZero() {
+		notification.Timestamp = msg.Timestamp
+	}
+	return notification, notification.Validate()
+}
+
+// NotificationPreference enables a channel for a user.
+type NotificationPreference struct {
+	UserID      string `json:"user_id"`
+	Channel     string `json:"channel"`           // "email", "webhook" or "log"
+	Address     string `json:"address,omitempty"` // Email address or webhook URL
+	MinSeverity string `json:"min_severity,omitempty"`
+	QuietFrom   string `json:"quiet_from,omitempty"` // Local time quiet hours start, e.g. "22:00"
+	QuietTo     string `json:"quiet_to,omitempty"`   // May be before QuietFrom to span midnight
+	Enabled     bool   `json:"enabled"`
+}
+
+// Validate reports an error when the preference is incomplete.
+func (p NotificationPreference) Validate() error {
+	if p.Channel == "" {
+		return errors.New("channel is required")
+	}
+	if _, ok := severityRank[p.MinSeverity]; p.MinSeverity != "" && !ok {
+		return errors.New("min_severity must be info, warning or critical")
+	}
+	if p.Channel == "webhook" {
+		if err := ValidateWebhookAddress(p.Address); err != nil {
+			return errors.New("address of a webhook must be an absolute https URL")
+		}
+	}
+	if (p.QuietFrom == "") != (p.QuietTo == "") {
+		return errors.New("quiet_from and quiet_to must be set together")
+	}
+	if p.QuietFrom != "" {
+		if _, err := parseClock(p.QuietFrom); err != nil {
+			return errors.New("quiet_from must be a time like 22:00")
+		}
+		if _, err := parseClock(p.QuietTo); err != nil {
+			return errors.New("quiet_to must be a time like 07:00")
+		}
+	}
+	return nil
+}
+
+// NotificationDelivery records the outcome of a notification on a channel.
+type NotificationDelivery struct {
+	ID             int64     `json:"id"`
+	NotificationID string    `json:"notification_id"`
+	UserID         string    `json:"user_id"`
+	Channel        string    `json:"channel"`
+	Severity       string    `json:"severity"`
+	Title          string    `json:"title"`
+	DedupKey       string    `json:"dedup_key"`
+	Status         string    `json:"status"`
+	Error          string    `json:"error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// NotificationStore provides the preferences and delivery log used by the Notifier.
+type NotificationStore interface {
+	// ListNotificationPreferences returns the preferences of a user, or of every user when userID is empty.
+	ListNotificationPreferences(userID string) ([]NotificationPreference, error)
+	// CountSentNotifications counts the notifications sent to a user on a channel since a time,
+	// only those with dedupKey unless it is empty.
+	CountSentNotifications(userID, channel, dedupKey string, since time.Time) (int, error)
+	InsertNotificationDelivery(delivery NotificationDelivery) error
+}
+
+// Notifier delivers notifications on the channels each user enabled, honouring their quiet hours,
+// a rate limit per user and channel, and suppressing repeated alerts.
+type Notifier struct {
+	store       NotificationStore
+	channels    map[string]NotificationChannel
+	location    *time.Location
+	rateLimit   int
+	rateWindow  time.Duration
+	dedupWindow time.Duration
+	sendTimeout time.Duration
+	now         func() time.Time
+}
+
+// NewNotifier creates a Notifier from the Notifier configuration, sending on the given channels by name.
+func NewNotifier(config AppConfig, store NotificationStore, channels map[string]NotificationChannel) (*Notifier, error) {
+	n := &Notifier{
+		store:       store,
+		channels:    channels,
+		location:    time.UTC,
+		rateLimit:   config.Notifier.RateLimit,
+		rateWindow:  config.Notifier.RateWindow,
+		dedupWindow: config.Notifier.DedupWindow,
+		sendTimeout: config.Notifier.SendTimeout,
+		now:         time.Now,
+	}
+	if n.rateWindow <= 0 {
+		n.rateWindow = time.Hour
+	}
+	if n.dedupWindow <= 0 {
+		n.dedupWindow = time.Hour
+	}
+	if n.sendTimeout <= 0 {
+		n.sendTimeout = 10 * time.Second
+	}
+	if config.Notifier.Timezone != "" {
+		location, err := time.LoadLocation(config.Notifier.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid notifier timezone: %w", err)
+		}
+		n.location = location
+	}
+	return n, nil
+}
+
+// Notify delivers a notification to its recipients and records the outcome on each of their channels.
+func (n *Notifier) Notify(ctx context.Context, notification Notification) ([]NotificationDelivery, error) {
+	preferences, err := n.store.ListNotificationPreferences(notification.UserID)
+	if err != nil {
+		return nil, err
+	}
+	dedupKey := notification.DedupKey
+	if dedupKey == "" {
+		dedupKey = notification.ID // Redelivered messages are not sent twice
+	}
+
+	var deliveries []NotificationDelivery
+	for _, preference := range preferences {
+		if !preference.Enabled || severityRank[notification.Severity] < severityRank[preference.MinSeverity] {
+			continue
+		}
+		delivery := NotificationDelivery{
+			NotificationID: notification.ID,
+			UserID:         preference.UserID,
+			Channel:        preference.Channel,
+			Severity:       notification.Severity,
+			Title:          notification.Title,
+			DedupKey:       dedupKey,
+		}
+		delivery.Status, delivery.Error = n.deliver(ctx, notification, preference, dedupKey)
+		if delivery.Status == DeliveryFailed {
+			log.Printf("Failed to notify %s on %s: %s", preference.UserID, preference.Channel, delivery.Error)
+		}
+
+		delivery.CreatedAt = n.now()
+		if err := n.store.InsertNotificationDelivery(delivery); err != nil {
+			if delivery.Status != DeliverySent {
+				return deliveries, err
+			}
+			// Requeueing would send it again, since the dedup check only sees recorded deliveries
+			log.Printf("Failed to record notification %s sent to %s on %s: %v", notification.ID, preference.UserID, preference.Channel, err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// deliver sends a notification on the channel of a preference unless it is suppressed, returning
+// the delivery status and error message.
+func (n *Notifier) deliver(ctx context.Context, notification Notification, preference NotificationPreference, dedupKey string) (string, string) {
+	channel, ok := n.channels[preference.Channel]
+	if !ok {
+		return DeliveryFailed, fmt.Sprintf("unknown channel %q", preference.Channel)
+	}
+
+	now := n.now()
+	if dedupKey != "" {
+		sent, err := n.store.CountSentNotifications(preference.UserID, preference.Channel, dedupKey, now.Add(-n.dedupWindow))
+		if err != nil {
+			return DeliveryFailed, err.Error()
+		}
+		if sent > 0 {
+			return DeliveryDuplicate, ""
+		}
+	}
+
+	if notification.Severity != SeverityCritical && n.quietHours(preference, now) {
+		return DeliveryQuietHours, ""
+	}
+
+	if n.rateLimit > 0 {
+		sent, err := n.store.CountSentNotifications(preference.UserID, preference.Channel, "", now.Add(-n.rateWindow))
+		if err != nil {
+			return DeliveryFailed, err.Error()
+		}
+		if sent >= n.rateLimit {
+			return DeliveryRateLimited, ""
+		}
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, n.sendTimeout)
+	defer cancel()
+	if err := channel.Send(sendCtx, preference.Address, notification); err != nil {
+		return DeliveryFailed, err.Error()
+	}
+	return DeliverySent, ""
+}
+
+// quietHours reports whether t falls in the quiet hours of a preference.
+func (n *Notifier) quietHours(preference NotificationPreference, t time.Time) bool {
+	from, err := parseClock(preference.QuietFrom)
+	if err != nil {
+		return false
+	}
+	to, err := parseClock(preference.QuietTo)
+	if err != nil {
+		return false
+	}
+	local := t.In(n.location)
+	minute := local.Hour()*60 + local.Minute()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to // Spans midnight
+}
+
+// Run delivers the notifications received on messages until the channel is closed. Messages are
+// acknowledged once their deliveries are recorded, and requeued when they could not be.
+func (n *Notifier) Run(ctx context.Context, messages <-chan amqp.Delivery) {
+	for msg := range messages {
+		notification, err := ParseNotification(msg)
+		if err != nil {
+			log.Printf("Discarding invalid notification: %v", err)
+			msg.Reject(false)
+			continue
+		}
+
+		deliveries, err := n.Notify(ctx, notification)
+		if err != nil {
+			log.Printf("Failed to deliver notification %s: %v", notification.ID, err)
+			msg.Nack(false, true)
+			continue
+		}
+		log.Printf("Notification %s handled with %d deliveries", notification.ID, len(deliveries))
+		msg.Ack(false)
+	}
+}
+
+// ListNotificationPreferences retrieves the notification preferences of a user, or of every user.
+func (p *PostgreSQLClient) ListNotificationPreferences(userID string) ([]NotificationPreference, error) {
+	query := `SELECT user_id, channel, address, min_severity, quiet_from, quiet_to, enabled
+              FROM notification_preferences WHERE $1::text = '' OR user_id = $1 ORDER BY user_id, channel`
+	rows, err := p.DB.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list notification preferences: %w", err)
+	}
+	defer rows.Close()
+
+	preferences := []NotificationPreference{}
+	for rows.Next() {
+		var preference NotificationPreference
+		err := rows.Scan(&preference.UserID, &preference.Channel, &preference.Address, &preference.MinSeverity,
+			&preference.QuietFrom, &preference.QuietTo, &preference.Enabled)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan notification preference: %w", err)
+		}
+		preferences = append(preferences, preference)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list notification preferences: %w", err)
+	}
+	return preferences, nil
+}
+
+// ReplaceNotificationPreferences replaces every notification preference of a user.
+func (p *PostgreSQLClient) ReplaceNotificationPreferences(userID string, preferences []NotificationPreference) error {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin preferences transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM notification_preferences WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete notification preferences: %w", err)
+	}
+	for _, preference := range preferences {
+		minSeverity := preference.MinSeverity
+		if minSeverity == "" {
+			minSeverity = SeverityInfo
+		}
+		query := `INSERT INTO notification_preferences (user_id, channel, address, min_severity, quiet_from, quiet_to, enabled)
+                  VALUES ($1, $2, $3, $4, $5, $6, $7)`
+		_, err := tx.Exec(query, userID, preference.Channel, preference.Address, minSeverity,
+			preference.QuietFrom, preference.QuietTo, preference.Enabled)
+		if err != nil {
+			return fmt.Errorf("failed to insert notification preference: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to save notification preferences: %w", err)
+	}
+	return nil
+}
+
+// CountSentNotifications counts the notifications sent to a user on a channel since a time.
+func (p *PostgreSQLClient) CountSentNotifications(userID, channel, dedupKey string, since time.Time) (int, error) {
+	query := `SELECT COUNT(*) FROM notification_deliveries
+              WHERE user_id = $1 AND channel = $2 AND status = 'sent' AND created_at >= $3
+              AND ($4::text = '' OR dedup_key = $4)`
+	var count int
+	err := p.DB.QueryRow(query, userID, channel, since, dedupKey).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count sent notifications: %w", err)
+	}
+	return count, nil
+}
+
+// InsertNotificationDelivery records the outcome of a notification on a channel.
+func (p *PostgreSQLClient) InsertNotificationDelivery(delivery NotificationDelivery) error {
+	query := `INSERT INTO notification_deliveries
+              (notification_id, user_id, channel, severity, title, dedup_key, status, error, created_at)
+              VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err := p.DB.Exec(query, delivery.NotificationID, delivery.UserID, delivery.Channel, delivery.Severity,
+		delivery.Title, delivery.DedupKey, delivery.Status, delivery.Error, delivery.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert notification delivery: %w", err)
+	}
+	return nil
+}
+
+// ListNotificationDeliveries retrieves the latest deliveries, optionally of a single user or status.
+func (p *PostgreSQLClient) ListNotificationDeliveries(userID, status string, limit int) ([]NotificationDelivery, error) {
+	query := `SELECT id, notification_id, user_id, channel, severity, title, dedup_key, status, error, created_at
+              FROM notification_deliveries
+              WHERE ($1::text = '' OR user_id = $1) AND ($2::text = '' OR status = $2)
+              ORDER BY created_at DESC, id DESC LIMIT $3`
+	rows, err := p.DB.Query(query, userID, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list notification deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := []NotificationDelivery{}
+	for rows.Next() {
+		var delivery NotificationDelivery
+		err := rows.Scan(&delivery.ID, &delivery.NotificationID, &delivery.UserID, &delivery.Channel, &delivery.Severity,
+			&delivery.Title, &delivery.DedupKey, &delivery.Status, &delivery.Error, &delivery.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan notification delivery: %w", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list notification deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// notificationText formats a notification as plain text.
+func notificationText(notification Notification) string {
+	var b strings.Builder
+	b.WriteString(notification.Message)
+	if notification.DeviceID != "" {
+		if b.Len() > 0 {
+			b.WriteString("\n\n")
+		}
+		fmt.Fprintf(&b, "Device: %s", notification.DeviceID)
+	}
+	return b.String()
+}
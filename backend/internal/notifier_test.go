@@ -0,0 +1,341 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryNotificationStore keeps preferences and deliveries in memory.
+type memoryNotificationStore struct {
+	preferences []NotificationPreference
+	deliveries  []NotificationDelivery
+	insertErr   error // Returned by InsertNotificationDelivery when set
+}
+
+func (m *memoryNotificationStore) ListNotificationPreferences(userID string) ([]NotificationPreference, error) {
+	var preferences []NotificationPreference
+	for _, preference := range m.preferences {
+		if userID == "" || preference.UserID == userID {
+			preferences = append(preferences, preference)
+		}
+	}
+	return preferences, nil
+}
+
+func (m *memoryNotificationStore) CountSentNotifications(userID, channel, dedupKey string, since time.Time) (int, error) {
+	count := 0
+	for _, delivery := range m.deliveries {
+		if delivery.UserID == userID && delivery.Channel == channel && delivery.Status == DeliverySent &&
+			!delivery.CreatedAt.Before(since) && (dedupKey == "" || delivery.DedupKey == dedupKey) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *memoryNotificationStore) InsertNotificationDelivery(delivery NotificationDelivery) error {
+	if m.insertErr != nil {
+		return m.insertErr
+	}
+	m.deliveries = append(m.deliveries, delivery)
+	return nil
+}
+
+// recordingChannel records the addresses notifications are sent to, failing with err.
+type recordingChannel struct {
+	sent []string
+	err  error
+}
+
+func (c *recordingChannel) Send(ctx context.Context, address string, notification Notification) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.sent = append(c.sent, address+" "+notification.Title)
+	return nil
+}
+
+func newTestNotifier(t *testing.T, store NotificationStore, channels map[string]NotificationChannel, now time.Time) *Notifier {
+	var config AppConfig
+	config.Notifier.RateLimit = 2
+	config.Notifier.RateWindow = time.Hour
+	config.Notifier.DedupWindow = 10 * time.Minute
+	notifier, err := NewNotifier(config, store, channels)
+	require.NoError(t, err)
+	notifier.now = func() time.Time { return now }
+	return notifier
+}
+
+func statuses(deliveries []NotificationDelivery) []string {
+	var result []string
+	for _, delivery := range deliveries {
+		result = append(result, delivery.Channel+":"+delivery.Status)
+	}
+	return result
+}
+
+func TestNotifierPreferences(t *testing.T) {
+	store := &memoryNotificationStore{preferences: []NotificationPreference{
+		{UserID: "alice", Channel: "log", Enabled: true},
+		{UserID: "alice", Channel: "email", Address: "alice@example.com", MinSeverity: SeverityWarning, Enabled: true},
+		{UserID: "bob", Channel: "log", Enabled: false},
+		{UserID: "bob", Channel: "pager", Enabled: true},
+	}}
+	logChannel, email := &recordingChannel{}, &recordingChannel{}
+	notifier := newTestNotifier(t, store, map[string]NotificationChannel{"log": logChannel, "email": email}, time.Now())
+
+	deliveries, err := notifier.Notify(context.Background(), Notification{ID: "1", Severity: SeverityInfo, Title: "Door opened"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log:sent", "pager:failed"}, statuses(deliveries),
+		"disabled channels and channels above the severity should be skipped, unknown channels should fail")
+	assert.Len(t, email.sent, 0)
+
+	deliveries, err = notifier.Notify(context.Background(), Notification{ID: "2", UserID: "alice", Severity: SeverityCritical, Title: "Smoke"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log:sent", "email:sent"}, statuses(deliveries))
+	assert.Equal(t, []string{"alice@example.com Smoke"}, email.sent)
+
+	email.err = errors.New("mailbox full")
+	deliveries, err = notifier.Notify(context.Background(), Notification{ID: "3", UserID: "alice", Severity: SeverityWarning, Title: "Window open"})
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	assert.Equal(t, DeliveryFailed, deliveries[1].Status)
+	assert.Equal(t, "mailbox full", deliveries[1].Error)
+}
+
+func TestNotifierDedupAndRateLimit(t *testing.T) {
+	store := &memoryNotificationStore{preferences: []NotificationPreference{{UserID: "alice", Channel: "log", Enabled: true}}}
+	channel := &recordingChannel{}
+	now := time.Now()
+	notifier := newTestNotifier(t, store, map[string]NotificationChannel{"log": channel}, now)
+
+	alert := Notification{ID: "1", Severity: SeverityWarning, Title: "Freezer warm", DedupKey: "freezer-temperature"}
+	deliveries, err := notifier.Notify(context.Background(), alert)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log:sent"}, statuses(deliveries))
+
+	alert.ID = "2"
+	deliveries, err = notifier.Notify(context.Background(), alert)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log:duplicate"}, statuses(deliveries), "a repeated alert should be suppressed")
+
+	deliveries, err = notifier.Notify(context.Background(), Notification{ID: "3", Severity: SeverityInfo, Title: "Washer done"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log:sent"}, statuses(deliveries))
+
+	deliveries, err = notifier.Notify(context.Background(), Notification{ID: "4", Severity: SeverityInfo, Title: "Dryer done"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log:rate_limited"}, statuses(deliveries), "the third notification within the window should be limited")
+	assert.Len(t, channel.sent, 2)
+
+	notifier.now = func() time.Time { return now.Add(11 * time.Minute) }
+	alert.ID = "5"
+	deliveries, err = notifier.Notify(context.Background(), alert)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log:rate_limited"}, statuses(deliveries), "the alert should no longer be a duplicate once the dedup window passed")
+}
+
+func TestNotifierKeepsSentNotificationsWhenRecordingFails(t *testing.T) {
+	store := &memoryNotificationStore{
+		preferences: []NotificationPreference{{UserID: "alice", Channel: "log", Enabled: true}},
+		insertErr:   errors.New("database unavailable"),
+	}
+	channel := &recordingChannel{}
+	notifier := newTestNotifier(t, store, map[string]NotificationChannel{"log": channel}, time.Now())
+
+	_, err := notifier.Notify(context.Background(), Notification{ID: "1", Severity: SeverityInfo, Title: "Hello"})
+	assert.NoError(t, err, "a sent notification should not be requeued and sent again")
+	assert.Len(t, channel.sent, 1)
+
+	channel.err = errors.New("unreachable")
+	_, err = notifier.Notify(context.Background(), Notification{ID: "2", Severity: SeverityInfo, Title: "Hello"})
+	assert.Error(t, err, "a failed delivery that was not recorded should be retried")
+}
+
+func TestNotifierQuietHours(t *testing.T) {
+	store := &memoryNotificationStore{preferences: []NotificationPreference{
+		{UserID: "alice", Channel: "log", QuietFrom: "22:00", QuietTo: "07:00", Enabled: true},
+	}}
+	night := time.Date(2024, 5, 1, 23, 30, 0, 0, time.UTC)
+	notifier := newTestNotifier(t, store, map[string]NotificationChannel{"log": &recordingChannel{}}, night)
+
+	deliveries, err := notifier.Notify(context.Background(), Notification{ID: "1", Severity: SeverityWarning, Title: "Window open"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log:quiet_hours"}, statuses(deliveries))
+
+	deliveries, err = notifier.Notify(context.Background(), Notification{ID: "2", Severity: SeverityCritical, Title: "Smoke"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log:sent"}, statuses(deliveries), "critical notifications should ignore quiet hours")
+
+	notifier.now = func() time.Time { return night.Add(8 * time.Hour) }
+	deliveries, err = notifier.Notify(context.Background(), Notification{ID: "3", Severity: SeverityWarning, Title: "Window open"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log:sent"}, statuses(deliveries))
+}
+
+func TestNotificationPreferenceValidate(t *testing.T) {
+	assert.NoError(t, NotificationPreference{Channel: "log", QuietFrom: "22:00", QuietTo: "07:00"}.Validate())
+	assert.Error(t, NotificationPreference{}.Validate())
+	assert.Error(t, NotificationPreference{Channel: "log", MinSeverity: "urgent"}.Validate())
+	assert.Error(t, NotificationPreference{Channel: "log", QuietFrom: "22:00"}.Validate())
+	assert.Error(t, NotificationPreference{Channel: "log", QuietFrom: "late", QuietTo: "07:00"}.Validate())
+	assert.NoError(t, NotificationPreference{Channel: "webhook", Address: "https://example.com/hook"}.Validate())
+	assert.Error(t, NotificationPreference{Channel: "webhook", Address: "http://example.com/hook"}.Validate())
+	assert.Error(t, NotificationPreference{Channel: "webhook", Address: "/hook"}.Validate())
+}
+
+func TestWebhookChannel(t *testing.T) {
+	var received Notification
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+		if received.Severity == SeverityCritical {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	trustTestServer := func(channel *WebhookChannel) {
+		channel.Client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	}
+
+	channel := NewWebhookChannel(time.Second, "127.0.0.1")
+	trustTestServer(channel)
+	err := channel.Send(context.Background(), server.URL, Notification{ID: "1", Severity: SeverityInfo, Title: "Hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", received.Title)
+
+	err = channel.Send(context.Background(), server.URL, Notification{ID: "2", Severity: SeverityCritical, Title: "Fail"})
+	assert.Error(t, err, "a failing webhook should be reported")
+	err = channel.Send(context.Background(), server.URL+"/redirect", Notification{ID: "3", Severity: SeverityInfo, Title: "Moved"})
+	assert.Error(t, err, "redirects should not be followed")
+	err = channel.Send(context.Background(), "http://example.com/hook", Notification{ID: "4", Severity: SeverityInfo})
+	assert.ErrorIs(t, err, ErrWebhookAddress, "plain http should be refused")
+
+	strict := NewWebhookChannel(time.Second)
+	trustTestServer(strict)
+	err = strict.Send(context.Background(), server.URL, Notification{ID: "5", Severity: SeverityInfo})
+	assert.ErrorIs(t, err, ErrWebhookAddress, "internal addresses should be refused unless allowed")
+	err = strict.Send(context.Background(), "https://localhost:1/hook", Notification{ID: "6", Severity: SeverityInfo})
+	assert.ErrorIs(t, err, ErrWebhookAddress)
+}
+
+func TestInternalIP(t *testing.T) {
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.10", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fe80::1", "fd00::1"} {
+		assert.True(t, internalIP(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"93.184.216.34", "2606:2800:220:1::"} {
+		assert.False(t, internalIP(net.ParseIP(ip)), ip)
+	}
+}
+
+// serveSMTP accepts a single SMTP session on listener and sends the received message on messages.
+func serveSMTP(listener net.Listener, messages chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP")
+	var data strings.Builder
+	inData := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if inData {
+			if line == ".\r\n" {
+				inData = false
+				messages <- data.String()
+				reply("250 OK")
+			} else {
+				data.WriteString(line)
+			}
+			continue
+		}
+		switch command := strings.ToUpper(strings.Fields(line)[0]); command {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "DATA":
+			inData = true
+			reply("354 Go ahead")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestEmailChannel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	messages := make(chan string, 1)
+	go serveSMTP(listener, messages)
+
+	channel := &EmailChannel{Addr: listener.Addr().String(), From: "homebunny@localhost"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	notification := Notification{ID: "1", Severity: SeverityCritical, Title: "Water leak", Message: "Bathroom floor is wet", DeviceID: "bathroom1"}
+	require.NoError(t, channel.Send(ctx, "alice@example.com", notification))
+
+	message := <-messages
+	assert.Contains(t, message, "To: alice@example.com\r\n")
+	assert.Contains(t, message, "Subject: [critical] Water leak\r\n")
+	assert.Contains(t, message, "Bathroom floor is wet\r\n\r\nDevice: bathroom1")
+}
+
+func TestNotificationsInPostgres(t *testing.T) {
+	userID := "notify-" + NewMessageID()
+	require.NoError(t, testDB.InsertUser(User{ID: userID, Name: "Notified", Role: RoleAdult}))
+
+	preferences := []NotificationPreference{
+		{Channel: "log", Enabled: true},
+		{Channel: "email", Address: "user@example.com", MinSeverity: SeverityWarning, QuietFrom: "22:00", QuietTo: "07:00", Enabled: true},
+	}
+	require.NoError(t, testDB.ReplaceNotificationPreferences(userID, preferences))
+	require.NoError(t, testDB.ReplaceNotificationPreferences(userID, preferences[1:]))
+	stored, err := testDB.ListNotificationPreferences(userID)
+	require.NoError(t, err)
+	require.Len(t, stored, 1, "preferences should be replaced")
+	assert.Equal(t, "user@example.com", stored[0].Address)
+	assert.Equal(t, "22:00", stored[0].QuietFrom)
+
+	now := time.Now()
+	delivery := NotificationDelivery{NotificationID: "n1", UserID: userID, Channel: "email", Severity: SeverityWarning,
+		Title: "Window open", DedupKey: "window", Status: DeliverySent, CreatedAt: now}
+	require.NoError(t, testDB.InsertNotificationDelivery(delivery))
+	delivery.Status = DeliveryQuietHours
+	require.NoError(t, testDB.InsertNotificationDelivery(delivery))
+
+	count, err := testDB.CountSentNotifications(userID, "email", "window", now.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, count, "only sent deliveries should be counted")
+	count, err = testDB.CountSentNotifications(userID, "email", "other", now.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	deliveries, err := testDB.ListNotificationDeliveries(userID, DeliveryQuietHours, 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, "Window open", deliveries[0].Title)
+}
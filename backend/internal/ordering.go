@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// EventOrder remembers the time of the latest event applied per device, so a consumer can discard
+// events that arrive after a newer event of the same device.
+type EventOrder struct {
+	mu     sync.Mutex
+	latest map[string]time.Time
+}
+
+// NewEventOrder creates an empty EventOrder.
+func NewEventOrder() *EventOrder {
+	return &EventOrder{latest: make(map[string]time.Time)}
+}
+
+// Accept reports whether an event of deviceID at eventTime is not older than the latest accepted
+// event of that device, recording it when it is accepted.
+func (o *EventOrder) Accept(deviceID string, eventTime time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if latest, ok := o.latest[deviceID]; ok && eventTime.Before(latest) {
+		return false
+	}
+	o.latest[deviceID] = eventTime
+	return true
+}
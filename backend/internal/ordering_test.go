@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventOrder(t *testing.T) {
+	order := NewEventOrder()
+	now := time.Now()
+
+	assert.True(t, order.Accept("tv1", now), "the first event of a device should be accepted")
+	assert.False(t, order.Accept("tv1", now.Add(-time.Second)), "an older event should be discarded")
+	assert.True(t, order.Accept("ac1", now.Add(-time.Second)), "devices should be ordered independently")
+	assert.True(t, order.Accept("tv1", now.Add(time.Second)), "a newer event should be accepted")
+	assert.False(t, order.Accept("tv1", now), "events older than the newest accepted one should be discarded")
+}
+
+func TestCreateDeviceEvent(t *testing.T) {
+	eventTime := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+	msg := CreateDeviceEvent(Device{ID: "tv1", Type: "tv", State: "on", Version: 3}, eventTime)
+
+	assert.NotEmpty(t, msg.MessageId)
+	assert.Equal(t, "{tv1 tv on }", string(msg.Body))
+	assert.Equal(t, "tv1", msg.Headers[DeviceIDHeader])
+
+	delivery := amqp.Delivery{Headers: msg.Headers, Timestamp: eventTime.Truncate(time.Second)}
+	assert.True(t, eventTime.Equal(EventTime(delivery)), "the event time should keep sub-second precision")
+	assert.Equal(t, delivery.Timestamp, EventTime(amqp.Delivery{Timestamp: delivery.Timestamp}),
+		"events without the header should fall back to the Timestamp property")
+}
@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Publisher publishes a message and waits for the broker to confirm it.
+type Publisher interface {
+	Send(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error
+}
+
+// publisherFunc adapts a function to the Publisher interface.
+type publisherFunc func(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error
+
+// Send calls f.
+func (f publisherFunc) Send(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	return f(ctx, exchange, routingKey, msg)
+}
+
+// Errors returned by PublisherPool when no channel can be used for a publish.
+var (
+	ErrPoolClosed = errors.New("publisher pool is closed")
+	ErrPoolBusy   = errors.New("no publisher channel available")
+)
+
+// pooledChannel is a confirm-mode channel owned by a PublisherPool.
+type pooledChannel interface {
+	Send(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error
+	ChannelIsClosed() bool
+	Close() error
+}
+
+// PublisherPool owns a fixed number of confirm-mode channels spread over one or more connections and
+// hands each publish its own channel, since a channel must not be shared by concurrent publishers.
+// Channels that fail are closed and reopened on their next use.
+type PublisherPool struct {
+	slots      chan *poolSlot
+	newChannel func(slot int) (pooledChannel, error)
+	conns      []*amqp.Connection
+
+	mu     sync.Mutex
+	closed bool
+}
+
+type poolSlot struct {
+	id int
+	ch pooledChannel // nil until opened or after being recycled
+}
+
+// NewPublisherPool opens size channels, assigned round robin to conns.
+func NewPublisherPool(conns []*amqp.Connection, size int) (*PublisherPool, error) {
+	if len(conns) == 0 {
+		return nil, errors.New("error creating publisher pool: no connections")
+	}
+	pool, err := newPublisherPool(size, func(slot int) (pooledChannel, error) {
+		return NewRabbitMQClient(conns[slot%len(conns)])
+	})
+	if err != nil {
+		return nil, err
+	}
+	pool.conns = conns
+	return pool, nil
+}
+
+func newPublisherPool(size int, newChannel func(slot int) (pooledChannel, error)) (*PublisherPool, error) {
+	if size <= 0 {
+		size = 1
+	}
+	pool := &PublisherPool{slots: make(chan *poolSlot, size), newChannel: newChannel}
+	for i := 0; i < size; i++ {
+		ch, err := newChannel(i)
+		if err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("error opening publisher channel %d: %w", i, err)
+		}
+		pool.slots <- &poolSlot{id: i, ch: ch}
+	}
+	return pool, nil
+}
+
+// Size returns the number of channels in the pool.
+func (p *PublisherPool) Size() int {
+	return cap(p.slots)
+}
+
+// Send publishes on a free channel of the pool, waiting for one while all are busy. Channels that
+// returned an error other than a nack or return are recycled, as their state is unknown.
+func (p *PublisherPool) Send(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	var slot *poolSlot
+	select {
+	case slot = <-p.slots:
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrPoolBusy, ctx.Err())
+	}
+	publisherPoolInUse.Inc()
+	defer p.release(slot)
+
+	if err := p.open(slot); err != nil {
+		return err
+	}
+
+	err := slot.ch.Send(ctx, exchange, routingKey, msg)
+	if err != nil && !errors.Is(err, ErrPublishNacked) && !errors.Is(err, ErrUnroutable) {
+		p.recycle(slot)
+	}
+	return err
+}
+
+// open makes sure the channel of slot is usable, reopening it when it was recycled or closed by the broker.
+func (p *PublisherPool) open(slot *poolSlot) error {
+	if slot.ch != nil && !slot.ch.ChannelIsClosed() {
+		return nil
+	}
+	if slot.ch != nil {
+		p.recycle(slot)
+	}
+
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		return ErrPoolClosed
+	}
+
+	ch, err := p.newChannel(slot.id)
+	if err != nil {
+		return fmt.Errorf("error reopening publisher channel %d: %w", slot.id, err)
+	}
+	slot.ch = ch
+	return nil
+}
+
+// recycle closes the channel of slot so the next publish on it opens a fresh one.
+func (p *PublisherPool) recycle(slot *poolSlot) {
+	if slot.ch == nil {
+		return
+	}
+	closeSlot(slot)
+	publisherChannelsRecycledTotal.Inc()
+}
+
+func closeSlot(slot *poolSlot) {
+	if slot.ch != nil {
+		slot.ch.Close()
+		slot.ch = nil
+	}
+}
+
+func (p *PublisherPool) release(slot *poolSlot) {
+	publisherPoolInUse.Dec()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		closeSlot(slot)
+	}
+	p.slots <- slot
+}
+
+// Check reports an error when the pool is closed or none of its connections is open.
+func (p *PublisherPool) Check(ctx context.Context) error {
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		return ErrPoolClosed
+	}
+	if len(p.conns) == 0 {
+		return nil
+	}
+	for _, conn := range p.conns {
+		if !conn.IsClosed() {
+			return nil
+		}
+	}
+	return errors.New("all publisher connections are closed")
+}
+
+// Close closes every idle channel; channels in use are closed when their publish completes.
+func (p *PublisherPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	var idle []*poolSlot
+	for len(p.slots) > 0 {
+		idle = append(idle, <-p.slots)
+	}
+	for _, slot := range idle {
+		closeSlot(slot)
+		p.slots <- slot
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeChannel records publishes and fails them with err.
+type fakeChannel struct {
+	mu       sync.Mutex
+	err      error
+	delay    time.Duration
+	closed   bool
+	sent     int
+	inFlight *int32
+	maxSeen  *int32
+}
+
+func (f *fakeChannel) Send(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	if f.inFlight != nil {
+		n := atomic.AddInt32(f.inFlight, 1)
+		defer atomic.AddInt32(f.inFlight, -1)
+		for {
+			max := atomic.LoadInt32(f.maxSeen)
+			if n <= max || atomic.CompareAndSwapInt32(f.maxSeen, max, n) {
+				break
+			}
+		}
+	}
+	time.Sleep(f.delay)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent++
+	return f.err
+}
+
+func (f *fakeChannel) ChannelIsClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *fakeChannel) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func TestPublisherPoolLimitsConcurrency(t *testing.T) {
+	var inFlight, maxSeen int32
+	pool, err := newPublisherPool(3, func(slot int) (pooledChannel, error) {
+		return &fakeChannel{delay: 10 * time.Millisecond, inFlight: &inFlight, maxSeen: &maxSeen}, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, pool.Size())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, pool.Send(context.Background(), "device_events", "device.lamp.on", amqp.Publishing{}))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(3), maxSeen, "each channel should serve one publish at a time")
+}
+
+func TestPublisherPoolRecyclesFailedChannels(t *testing.T) {
+	var opened []*fakeChannel
+	pool, err := newPublisherPool(1, func(slot int) (pooledChannel, error) {
+		ch := &fakeChannel{}
+		opened = append(opened, ch)
+		return ch, nil
+	})
+	require.NoError(t, err)
+
+	opened[0].err = ErrPublishNacked
+	assert.ErrorIs(t, pool.Send(context.Background(), "device_events", "device.lamp.on", amqp.Publishing{}), ErrPublishNacked)
+	assert.Len(t, opened, 1, "a nack leaves the channel usable")
+
+	opened[0].err = errors.New("channel/connection is not open")
+	assert.Error(t, pool.Send(context.Background(), "device_events", "device.lamp.on", amqp.Publishing{}))
+	assert.True(t, opened[0].closed, "a failed channel should be closed")
+
+	assert.NoError(t, pool.Send(context.Background(), "device_events", "device.lamp.on", amqp.Publishing{}))
+	require.Len(t, opened, 2, "the next publish should open a fresh channel")
+	assert.Equal(t, 1, opened[1].sent)
+}
+
+func TestPublisherPoolBusy(t *testing.T) {
+	pool, err := newPublisherPool(1, func(slot int) (pooledChannel, error) {
+		return &fakeChannel{delay: 200 * time.Millisecond}, nil
+	})
+	require.NoError(t, err)
+
+	go pool.Send(context.Background(), "device_events", "device.lamp.on", amqp.Publishing{})
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, pool.Send(ctx, "device_events", "device.lamp.on", amqp.Publishing{}), ErrPoolBusy,
+		"publishes should give up when no channel frees up in time")
+}
+
+func TestPublisherPoolClose(t *testing.T) {
+	ch := &fakeChannel{}
+	pool, err := newPublisherPool(1, func(slot int) (pooledChannel, error) { return ch, nil })
+	require.NoError(t, err)
+
+	require.NoError(t, pool.Close())
+	assert.True(t, ch.closed, "closing the pool should close its channels")
+	assert.ErrorIs(t, pool.Send(context.Background(), "device_events", "device.lamp.on", amqp.Publishing{}), ErrPoolClosed)
+	assert.ErrorIs(t, pool.Check(context.Background()), ErrPoolClosed)
+}
@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Presence of a device, derived from its heartbeats.
+const (
+	PresenceUnknown = "unknown" // No heartbeat received yet
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+// OfflineState is the state of the device events published when a device goes offline.
+const OfflineState = "offline"
+
+// Heartbeat announces that a device is alive.
+type Heartbeat struct {
+	DeviceID   string    `json:"device_id"`
+	DeviceType string    `json:"device_type"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// HeartbeatRoutingKey returns the routing key heartbeats of a device are published with.
+func HeartbeatRoutingKey(deviceType, deviceID string) string {
+	return fmt.Sprintf("heartbeat.%s.%s", deviceType, deviceID)
+}
+
+// CreateHeartbeatMessage encodes a heartbeat as a JSON message.
+func CreateHeartbeatMessage(heartbeat Heartbeat) amqp.Publishing {
+	body, _ := json.Marshal(heartbeat)
+	return amqp.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+		MessageId:   NewMessageID(),
+		Timestamp:   heartbeat.Timestamp,
+		Expiration:  "60000", // Heartbeats are worthless once they are late
+	}
+}
+
+// ParseHeartbeat decodes a heartbeat message, taking the device from the routing key when the body
+// does not name it.
+func ParseHeartbeat(msg amqp.Delivery) (Heartbeat, error) {
+	var heartbeat Heartbeat
+	if len(msg.Body) > 0 {
+		if err := json.Unmarshal(msg.Body, &heartbeat); err != nil {
+			return Heartbeat{}, fmt.Errorf("error decoding heartbeat: %w", err)
+		}
+	}
+	parts := strings.Split(msg.RoutingKey, ".")
+	if len(parts) == 3 && parts[0] == "heartbeat" {
+		if heartbeat.DeviceType == "" {
+			heartbeat.DeviceType = parts[1]
+		}
+		if heartbeat.DeviceID == "" {
+			heartbeat.DeviceID = parts[2]
+		}
+	}
+	if heartbeat.DeviceID == "" {
+		return Heartbeat{}, fmt.Errorf("heartbeat on %s does not name a device", msg.RoutingKey)
+	}
+	if heartbeat.Timestamp.IsZero() {
+		heartbeat.Timestamp = msg.Timestamp
+	}
+	if heartbeat.Timestamp.IsZero() {
+		heartbeat.Timestamp = time.Now()
+	}
+	return heartbeat, nil
+}
+
+// SendHeartbeats publishes a heartbeat for device every interval until ctx is done.
+func SendHeartbeats(ctx context.Context, publisher Publisher, device Device, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		heartbeat := Heartbeat{DeviceID: device.ID, DeviceType: device.Type, Timestamp: time.Now()}
+		err := publisher.Send(ctx, "device_events", HeartbeatRoutingKey(device.Type, device.ID), CreateHeartbeatMessage(heartbeat))
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Failed to send heartbeat for device %s: %v", device.ID, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PresenceStore keeps track of when devices were last seen, and records the offline state of devices
+// that went silent like any other state.
+type PresenceStore interface {
+	StateRecorder
+	TouchDevice(deviceID string, seenAt time.Time) (cameOnline bool, err error)
+	ListOnlineDevices() ([]Device, error)
+	MarkDeviceOffline(deviceID string, lastSeenAt time.Time) (bool, error)
+}
+
+// Watchdog marks devices offline once they have been silent for longer than the timeout of their
+// type, recording the offline state and publishing a device.<type>.offline event for each of them.
+type Watchdog struct {
+	store          PresenceStore
+	publisher      Publisher
+	defaultTimeout time.Duration
+	timeouts       map[string]time.Duration
+	interval       time.Duration
+}
+
+// NewWatchdog creates a Watchdog from the Presence configuration.
+func NewWatchdog(config AppConfig, store PresenceStore, publisher Publisher) *Watchdog {
+	w := &Watchdog{
+		store:          store,
+		publisher:      publisher,
+		defaultTimeout: config.Presence.DefaultTimeout,
+		timeouts:       make(map[string]time.Duration),
+		interval:       config.Presence.CheckInterval,
+	}
+	if w.defaultTimeout <= 0 {
+		w.defaultTimeout = 5 * time.Minute
+	}
+	if w.interval <= 0 {
+		w.interval = 30 * time.Second
+	}
+	for _, timeout := range config.Presence.Timeouts {
+		w.timeouts[timeout.DeviceType] = timeout.Timeout
+	}
+	return w
+}
+
+// Timeout returns how long devices of a type may be silent before they are offline.
+func (w *Watchdog) Timeout(deviceType string) time.Duration {
+	if timeout, ok := w.timeouts[deviceType]; ok && timeout > 0 {
+		return timeout
+	}
+	return w.defaultTimeout
+}
+
+// Run checks for silent devices every interval until ctx is done.
+func (w *Watchdog) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := w.Check(ctx, now); err != nil {
+				log.Printf("Failed to check device presence: %v", err)
+			}
+		}
+	}
+}
+
+// ConsumeHeartbeats records the heartbeats received on messages until the channel is closed.
+func (w *Watchdog) ConsumeHeartbeats(messages <-chan amqp.Delivery) {
+	for msg := range messages {
+		heartbeat, err := ParseHeartbeat(msg)
+		if err != nil {
+			log.Printf("Discarding invalid heartbeat: %v", err)
+			msg.Reject(false)
+			continue
+		}
+
+		cameOnline, err := w.store.TouchDevice(heartbeat.DeviceID, heartbeat.Timestamp)
+		if err != nil {
+			log.Printf("Failed to record heartbeat of device %s: %v", heartbeat.DeviceID, err)
+			msg.Nack(false, true)
+			continue
+		}
+		if cameOnline {
+			log.Printf("Device %s is online", heartbeat.DeviceID)
+		}
+		msg.Ack(false)
+	}
+}
+
+// Check marks the online devices that have been silent for too long at now as offline and returns them.
+func (w *Watchdog) Check(ctx context.Context, now time.Time) ([]Device, error) {
+	devices, err := w.store.ListOnlineDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	var offline []Device
+	for _, device := range devices {
+		if device.LastSeenAt == nil || now.Sub(*device.LastSeenAt) <= w.Timeout(device.Type) {
+			continue
+		}
+		// Another instance or a heartbeat arriving meanwhile may have changed the device
+		marked, err := w.store.MarkDeviceOffline(device.ID, *device.LastSeenAt)
+		if err != nil {
+			return offline, err
+		}
+		if !marked {
+			continue
+		}
+
+		device.Status = PresenceOffline
+		offline = append(offline, device)
+		log.Printf("Device %s is offline, last seen at %s", device.ID, device.LastSeenAt.Format(time.RFC3339))
+
+		// Recorded before it is published, so the registry and consumers agree on the state
+		event := Device{ID: device.ID, Type: device.Type, State: OfflineState, Room: device.Room}
+		err = PublishDeviceState(ctx, w.store, w.publisher, event, CreateDeviceEvent(event, now), now, 0)
+		if err != nil {
+			log.Printf("Failed to publish offline event for device %s: %v", device.ID, err)
+		}
+	}
+	return offline, nil
+}
+
+// TouchDevice records a heartbeat of a device and reports whether it was not online before.
+func (p *PostgreSQLClient) TouchDevice(deviceID string, seenAt time.Time) (bool, error) {
+	query := `UPDATE devices SET presence = 'online',
+                  last_seen_at = GREATEST(COALESCE(devices.last_seen_at, $2), $2)
+              FROM (SELECT presence FROM devices WHERE device_id = $1 FOR UPDATE) previous
+              WHERE devices.device_id = $1
+              RETURNING previous.presence`
+	var previous string
+	err := p.DB.QueryRow(query, deviceID, seenAt).Scan(&previous)
+	if err == sql.ErrNoRows {
+		return false, nil // Heartbeats of unregistered devices are ignored
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to record heartbeat: %w", err)
+	}
+	return previous != PresenceOnline, nil
+}
+
+// ListOnlineDevices retrieves the devices currently considered online.
+func (p *PostgreSQLClient) ListOnlineDevices() ([]Device, error) {
+	query := `SELECT device_id, type, room, last_seen_at FROM devices WHERE presence = 'online'`
+	rows, err := p.DB.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list online devices: %w", err)
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		device := Device{Status: PresenceOnline}
+		if err := rows.Scan(&device.ID, &device.Type, &device.Room, &device.LastSeenAt); err != nil {
+			return nil, fmt.Errorf("failed to scan device: %w", err)
+		}
+		devices = append(devices, device)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list online devices: %w", err)
+	}
+	return devices, nil
+}
+
+// MarkDeviceOffline marks a device offline unless it sent a heartbeat after lastSeenAt, reporting
+// whether it was marked.
+func (p *PostgreSQLClient) MarkDeviceOffline(deviceID string, lastSeenAt time.Time) (bool, error) {
+	query := `UPDATE devices SET presence = 'offline'
+              WHERE device_id = $1 AND presence = 'online' AND last_seen_at <= $2`
+	result, err := p.DB.Exec(query, deviceID, lastSeenAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to mark device offline: %w", err)
+	}
+	marked, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to mark device offline: %w", err)
+	}
+	return marked == 1, nil
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePresenceStore keeps the presence of devices in memory.
+type fakePresenceStore struct {
+	devices map[string]*Device
+}
+
+func (f *fakePresenceStore) TouchDevice(deviceID string, seenAt time.Time) (bool, error) {
+	device, ok := f.devices[deviceID]
+	if !ok {
+		return false, nil
+	}
+	cameOnline := device.Status != PresenceOnline
+	device.Status = PresenceOnline
+	device.LastSeenAt = &seenAt
+	return cameOnline, nil
+}
+
+func (f *fakePresenceStore) ListOnlineDevices() ([]Device, error) {
+	var devices []Device
+	for _, device := range f.devices {
+		if device.Status == PresenceOnline {
+			devices = append(devices, *device)
+		}
+	}
+	return devices, nil
+}
+
+func (f *fakePresenceStore) MarkDeviceOffline(deviceID string, lastSeenAt time.Time) (bool, error) {
+	device := f.devices[deviceID]
+	if device.Status != PresenceOnline || device.LastSeenAt.After(lastSeenAt) {
+		return false, nil
+	}
+	device.Status = PresenceOffline
+	return true, nil
+}
+
+func (f *fakePresenceStore) RecordStateChange(deviceID, state, messageID string, eventTime time.Time, expectedVersion int64) (bool, error) {
+	device, ok := f.devices[deviceID]
+	if !ok || device.State == state {
+		return false, nil
+	}
+	device.State = state
+	return true, nil
+}
+
+// fakePublisher records the routing keys of published messages.
+type fakePublisher struct {
+	routingKeys []string
+}
+
+func (f *fakePublisher) Send(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	f.routingKeys = append(f.routingKeys, routingKey)
+	return nil
+}
+
+func TestParseHeartbeat(t *testing.T) {
+	sent := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	msg := CreateHeartbeatMessage(Heartbeat{DeviceID: "door1", DeviceType: "door_contact", Timestamp: sent})
+	heartbeat, err := ParseHeartbeat(amqp.Delivery{RoutingKey: HeartbeatRoutingKey("door_contact", "door1"), Body: msg.Body})
+	require.NoError(t, err)
+	assert.Equal(t, "door1", heartbeat.DeviceID)
+	assert.True(t, sent.Equal(heartbeat.Timestamp))
+
+	heartbeat, err = ParseHeartbeat(amqp.Delivery{RoutingKey: "heartbeat.tv.tv1", Timestamp: sent})
+	require.NoError(t, err, "an empty heartbeat should be taken from the routing key")
+	assert.Equal(t, Heartbeat{DeviceID: "tv1", DeviceType: "tv", Timestamp: sent}, heartbeat)
+
+	_, err = ParseHeartbeat(amqp.Delivery{RoutingKey: "heartbeat"})
+	assert.Error(t, err)
+}
+
+func TestWatchdogCheck(t *testing.T) {
+	var config AppConfig
+	config.Presence.DefaultTimeout = 5 * time.Minute
+	config.Presence.Timeouts = []PresenceTimeout{{DeviceType: "door_contact", Timeout: time.Hour}}
+	store := &fakePresenceStore{devices: map[string]*Device{
+		"tv1":   {ID: "tv1", Type: "tv", State: "on"},
+		"door1": {ID: "door1", Type: "door_contact"},
+		"lamp1": {ID: "lamp1", Type: "lamp"},
+	}}
+	publisher := &fakePublisher{}
+	watchdog := NewWatchdog(config, store, publisher)
+
+	now := time.Now()
+	for _, id := range []string{"tv1", "door1"} {
+		_, err := store.TouchDevice(id, now.Add(-10*time.Minute))
+		require.NoError(t, err)
+	}
+
+	offline, err := watchdog.Check(context.Background(), now)
+	require.NoError(t, err)
+	require.Len(t, offline, 1, "only the tv should have exceeded its timeout")
+	assert.Equal(t, "tv1", offline[0].ID)
+	assert.Equal(t, PresenceOffline, store.devices["tv1"].Status)
+	assert.Equal(t, PresenceOnline, store.devices["door1"].Status)
+	assert.Equal(t, []string{"device.tv.offline"}, publisher.routingKeys)
+	assert.Equal(t, OfflineState, store.devices["tv1"].State, "the offline state should be recorded before it is published")
+
+	offline, err = watchdog.Check(context.Background(), now)
+	require.NoError(t, err)
+	assert.Empty(t, offline, "offline devices should not be reported again")
+
+	cameOnline, err := store.TouchDevice("tv1", now)
+	require.NoError(t, err)
+	assert.True(t, cameOnline)
+}
+
+func TestPresenceInPostgres(t *testing.T) {
+	device := Device{ID: "presence-" + NewMessageID(), Type: "tv", State: "off"}
+	require.NoError(t, testDB.InsertDevice(device))
+
+	stored, err := testDB.GetDevice(device.ID)
+	require.NoError(t, err)
+	assert.Equal(t, PresenceUnknown, stored.Status)
+
+	seen := time.Now().Add(-time.Hour).Truncate(time.Microsecond)
+	cameOnline, err := testDB.TouchDevice(device.ID, seen)
+	require.NoError(t, err)
+	assert.True(t, cameOnline)
+	cameOnline, err = testDB.TouchDevice(device.ID, seen.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.False(t, cameOnline, "a device already online should not come online again")
+
+	marked, err := testDB.MarkDeviceOffline(device.ID, seen.Add(-time.Second))
+	require.NoError(t, err)
+	assert.False(t, marked, "a device seen after the checked time should stay online")
+	marked, err = testDB.MarkDeviceOffline(device.ID, seen)
+	require.NoError(t, err)
+	assert.True(t, marked)
+
+	stored, err = testDB.GetDevice(device.ID)
+	require.NoError(t, err)
+	assert.Equal(t, PresenceOffline, stored.Status)
+	require.NotNil(t, stored.LastSeenAt)
+	assert.True(t, seen.Equal(*stored.LastSeenAt), "an older heartbeat should not move last_seen_at back")
+}
@@ -0,0 +1,294 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Errors returned when the broker does not accept a published message.
+var (
+	ErrPublishNacked  = errors.New("message nacked by broker")
+	ErrUnroutable     = errors.New("message unroutable")
+	ErrConfirmTimeout = errors.New("timed out waiting for publisher confirm")
+)
+
+// UnroutableError is returned for mandatory messages the broker returned because no queue was bound.
+type UnroutableError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyText  string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("message to %s with routing key %s returned: %s", e.Exchange, e.RoutingKey, e.ReplyText)
+}
+
+func (e *UnroutableError) Unwrap() error {
+	return ErrUnroutable
+}
+
+// returnBufferSize bounds the returns queued for the tracker. The tracker drains them in its own
+// goroutine, so a burst of unroutable messages does not block the channel while nobody publishes.
+const returnBufferSize = 256
+
+// returnTTL is how long a return is kept for the publish waiting on it. Returns arriving after their
+// publish gave up waiting are dropped once they are older.
+const returnTTL = time.Minute
+
+// returnTracker collects basic.return frames of a channel by message ID.
+//
+// The broker sends basic.return before the basic.ack of the same message, and the client dispatches
+// frames in order, so once a confirm arrives any return for that message is either buffered or
+// already collected. A single goroutine owns the collected returns and answers lookups only after
+// draining the buffer, so a lookup never misses a return that was dispatched before its confirm.
+type returnTracker struct {
+	returns chan amqp.Return
+	lookups chan returnLookup
+	done    chan struct{}
+	ttl     time.Duration
+}
+
+type returnLookup struct {
+	messageID string
+	result    chan returnLookupResult
+}
+
+type returnLookupResult struct {
+	ret amqp.Return
+	ok  bool
+}
+
+type trackedReturn struct {
+	ret        amqp.Return
+	receivedAt time.Time
+}
+
+func newReturnTracker(ch *amqp.Channel) *returnTracker {
+	return startReturnTracker(ch.NotifyReturn(make(chan amqp.Return, returnBufferSize)), returnTTL)
+}
+
+// startReturnTracker collects the returns sent on returns until the channel is closed.
+func startReturnTracker(returns chan amqp.Return, ttl time.Duration) *returnTracker {
+	t := &returnTracker{
+		returns: returns,
+		lookups: make(chan returnLookup),
+		done:    make(chan struct{}),
+		ttl:     ttl,
+	}
+	go t.run()
+	return t
+}
+
+func (t *returnTracker) run() {
+	defer close(t.done)
+	returned := make(map[string]trackedReturn)
+	collect := func(ret amqp.Return) {
+		publishReturnsTotal.WithLabelValues(ret.Exchange).Inc()
+		now := time.Now()
+		for id, tracked := range returned {
+			if now.Sub(tracked.receivedAt) > t.ttl {
+				delete(returned, id)
+			}
+		}
+		returned[ret.MessageId] = trackedReturn{ret: ret, receivedAt: now}
+	}
+	for {
+		select {
+		case ret, ok := <-t.returns:
+			if !ok {
+				return
+			}
+			collect(ret)
+		case lookup := <-t.lookups:
+			// Returns dispatched before the confirm of the message may still be buffered
+		drain:
+			for {
+				select {
+				case ret, ok := <-t.returns:
+					if !ok {
+						break drain
+					}
+					collect(ret)
+				default:
+					break drain
+				}
+			}
+			tracked, ok := returned[lookup.messageID]
+			delete(returned, lookup.messageID)
+			lookup.result <- returnLookupResult{ret: tracked.ret, ok: ok}
+		}
+	}
+}
+
+// take reports whether the message with the given ID was returned, forgetting it afterwards. It is
+// called for every publish that gets a confirm or gives up waiting, so no return is kept for it.
+func (t *returnTracker) take(messageID string) (amqp.Return, bool) {
+	lookup := returnLookup{messageID: messageID, result: make(chan returnLookupResult, 1)}
+	select {
+	case t.lookups <- lookup:
+		result := <-lookup.result
+		return result.ret, result.ok
+	case <-t.done:
+		return amqp.Return{}, false
+	}
+}
+
+// NewMessageID returns a random identifier for amqp.Publishing.MessageId.
+func NewMessageID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// publish sends a mandatory message, assigning a message ID so a return can be matched to it.
+func (rc RabbitClient) publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) (*amqp.DeferredConfirmation, amqp.Publishing, error) {
+	if msg.MessageId == "" {
+		msg.MessageId = NewMessageID()
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	confirmation, err := rc.Ch.PublishWithDeferredConfirmWithContext(ctx,
+		exchange,   // exchange
+		routingKey, // routing key
+		true,       // mandatory
+		false,      // immediate
+		msg,        // amqp publishing struct
+	)
+	if err != nil {
+		return nil, msg, fmt.Errorf("error publishing message: %w", err)
+	}
+	if confirmation == nil {
+		return nil, msg, fmt.Errorf("error publishing message: channel is not in confirm mode")
+	}
+	return confirmation, msg, nil
+}
+
+// awaitConfirm waits for the confirm of a published message and translates it into an error.
+func (rc RabbitClient) awaitConfirm(ctx context.Context, confirmation *amqp.DeferredConfirmation, exchange, routingKey, messageID string) error {
+	acked, err := confirmation.WaitContext(ctx)
+	var ret amqp.Return
+	var returned bool
+	if rc.returns != nil {
+		// Forget the return on every outcome, so a nacked or timed out message leaves nothing behind
+		ret, returned = rc.returns.take(messageID)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrConfirmTimeout, err)
+	}
+	if !acked {
+		return ErrPublishNacked
+	}
+	if returned {
+		return &UnroutableError{Exchange: exchange, RoutingKey: routingKey, ReplyText: ret.ReplyText}
+	}
+	return nil
+}
+
+// publishResult maps the outcome of a publish to the result label of the publish metrics.
+func publishResult(err error) string {
+	switch {
+	case err == nil:
+		return "ack"
+	case errors.Is(err, ErrPublishNacked):
+		return "nack"
+	case errors.Is(err, ErrUnroutable):
+		return "returned"
+	case errors.Is(err, ErrConfirmTimeout):
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+// FailedPublish describes a message of a batch that was not confirmed.
+type FailedPublish struct {
+	MessageID  string
+	RoutingKey string
+	Err        error
+}
+
+// BatchError is returned by BatchPublisher.Flush when some messages of the batch failed.
+type BatchError struct {
+	Failed []FailedPublish
+}
+
+func (e *BatchError) Error() string {
+	reasons := make([]string, len(e.Failed))
+	for i, failed := range e.Failed {
+		reasons[i] = fmt.Sprintf("%s: %v", failed.RoutingKey, failed.Err)
+	}
+	return fmt.Sprintf("%d messages failed: %s", len(e.Failed), strings.Join(reasons, "; "))
+}
+
+// BatchPublisher publishes without waiting for each confirm, collecting the confirms of up to
+// batchSize outstanding messages at once. It is meant for high-throughput producers and must not
+// be used concurrently.
+type BatchPublisher struct {
+	rc        RabbitClient
+	batchSize int
+	pending   []pendingConfirm
+}
+
+type pendingConfirm struct {
+	confirmation *amqp.DeferredConfirmation
+	exchange     string
+	routingKey   string
+	messageID    string
+	start        time.Time
+}
+
+// NewBatchPublisher creates a BatchPublisher flushing automatically every batchSize messages.
+func (rc RabbitClient) NewBatchPublisher(batchSize int) *BatchPublisher {
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	return &BatchPublisher{rc: rc, batchSize: batchSize}
+}
+
+// Publish sends a message without waiting for its confirm. When the batch is full it is flushed and
+// any failures of that batch are returned.
+func (b *BatchPublisher) Publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	start := time.Now()
+	confirmation, msg, err := b.rc.publish(ctx, exchange, routingKey, msg)
+	if err != nil {
+		observePublish(exchange, publishResult(err), start)
+		return err
+	}
+	b.pending = append(b.pending, pendingConfirm{confirmation, exchange, routingKey, msg.MessageId, start})
+
+	if len(b.pending) >= b.batchSize {
+		return b.Flush(ctx)
+	}
+	return nil
+}
+
+// Pending returns the number of messages waiting for a confirm.
+func (b *BatchPublisher) Pending() int {
+	return len(b.pending)
+}
+
+// Flush waits for the confirms of every outstanding message and reports the failed ones as a *BatchError.
+func (b *BatchPublisher) Flush(ctx context.Context) error {
+	var failed []FailedPublish
+	for _, p := range b.pending {
+		err := b.rc.awaitConfirm(ctx, p.confirmation, p.exchange, p.routingKey, p.messageID)
+		observePublish(p.exchange, publishResult(err), p.start)
+		if err != nil {
+			failed = append(failed, FailedPublish{MessageID: p.messageID, RoutingKey: p.routingKey, Err: err})
+		}
+	}
+	b.pending = b.pending[:0]
+
+	if len(failed) > 0 {
+		return &BatchError{Failed: failed}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnroutableErrorUnwraps(t *testing.T) {
+	err := fmt.Errorf("error sending: %w", &UnroutableError{Exchange: "device_events", RoutingKey: "device.lamp.on", ReplyText: "NO_ROUTE"})
+
+	assert.ErrorIs(t, err, ErrUnroutable)
+	var unroutable *UnroutableError
+	assert.True(t, errors.As(err, &unroutable))
+	assert.Equal(t, "device.lamp.on", unroutable.RoutingKey)
+}
+
+func TestPublishResult(t *testing.T) {
+	assert.Equal(t, "ack", publishResult(nil))
+	assert.Equal(t, "nack", publishResult(ErrPublishNacked))
+	assert.Equal(t, "returned", publishResult(&UnroutableError{}))
+	assert.Equal(t, "timeout", publishResult(fmt.Errorf("%w: context deadline exceeded", ErrConfirmTimeout)))
+	assert.Equal(t, "error", publishResult(errors.New("channel closed")))
+}
+
+func TestReturnTrackerTake(t *testing.T) {
+	returns := make(chan amqp.Return, 2)
+	tracker := startReturnTracker(returns, time.Minute)
+	defer close(returns)
+	returns <- amqp.Return{MessageId: "a", ReplyText: "NO_ROUTE"}
+	returns <- amqp.Return{MessageId: "b", ReplyText: "NO_ROUTE"}
+
+	_, ok := tracker.take("c")
+	assert.False(t, ok, "confirmed messages should not be reported as returned")
+
+	ret, ok := tracker.take("a")
+	assert.True(t, ok)
+	assert.Equal(t, "NO_ROUTE", ret.ReplyText)
+	_, ok = tracker.take("a")
+	assert.False(t, ok, "a return should only be reported once")
+
+	_, ok = tracker.take("b")
+	assert.True(t, ok, "returns buffered by an earlier take should be kept")
+}
+
+func TestReturnTrackerDrainsWithoutTakes(t *testing.T) {
+	returns := make(chan amqp.Return, 1)
+	tracker := startReturnTracker(returns, time.Millisecond)
+	defer close(returns)
+	for i := 0; i < 2*returnBufferSize; i++ {
+		select {
+		case returns <- amqp.Return{MessageId: fmt.Sprintf("m%d", i)}:
+		case <-time.After(time.Second):
+			t.Fatalf("return %d blocked the channel", i)
+		}
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	returns <- amqp.Return{MessageId: "last"}
+	_, ok := tracker.take("m0")
+	assert.False(t, ok, "returns nobody took should expire")
+	_, ok = tracker.take("last")
+	assert.True(t, ok)
+}
+
+func TestReturnTrackerClosed(t *testing.T) {
+	returns := make(chan amqp.Return)
+	tracker := startReturnTracker(returns, time.Minute)
+	close(returns)
+	<-tracker.done
+
+	_, ok := tracker.take("a")
+	assert.False(t, ok, "a closed channel should not block lookups")
+}
+
+func TestBatchErrorMessage(t *testing.T) {
+	err := &BatchError{Failed: []FailedPublish{
+		{MessageID: "1", RoutingKey: "device.lamp.on", Err: ErrPublishNacked},
+		{MessageID: "2", RoutingKey: "device.fan.off", Err: ErrUnroutable},
+	}}
+	assert.Equal(t, "2 messages failed: device.lamp.on: message nacked by broker; device.fan.off: message unroutable", err.Error())
+}
+
+func TestNewMessageID(t *testing.T) {
+	assert.Len(t, NewMessageID(), 32)
+	assert.NotEqual(t, NewMessageID(), NewMessageID(), "message IDs should be unique")
+}
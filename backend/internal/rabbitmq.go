@@ -2,9 +2,11 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"strings"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	"gopkg.in/yaml.v3"
@@ -15,10 +17,19 @@ type Device struct {
 	ID    string `json:"id"`
 	Type  string `json:"type"` // Device type (e.g., "lightbulb", "TV")
 	State string `json:"state"` // Device state (e.g., "off", "on")
+	Room  string `json:"room,omitempty"` // Room the device is placed in (e.g., "kitchen")
+
+	Version   int64      `json:"version,omitempty"`    // Incremented on every change; expected version when publishing
+	EventTime *time.Time `json:"event_time,omitempty"` // Time of the event that set the state
+
+	Status     string     `json:"status,omitempty"`       // Presence: "online", "offline" or "unknown"
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"` // Time of the latest heartbeat
 }
 type RabbitClient struct {
     Conn *amqp.Connection // Connection used by the client
     Ch   *amqp.Channel    // Channel used to process/send messagesjj
+
+	returns *returnTracker // Returned mandatory messages, matched to their publish by message ID
 }
 
 // LoadAppConfig loads the configuration from a YAML file.
@@ -56,9 +67,11 @@ func NewRabbitMQClient(conn *amqp.Connection) (RabbitClient, error) {
     if err := ch.Confirm(false); err != nil{
         return RabbitClient{}, fmt.Errorf("error setting channel confirmation mode: %w", err)
     }
+
     return RabbitClient{
         Conn: conn, // Use exported field
         Ch:   ch,   // Use exported field
+		returns: newReturnTracker(ch),
     }, nil
 }
 
@@ -110,6 +123,22 @@ func (rc RabbitClient) CreateQueue(deviceID string) (amqp.Queue, error) {
 	return q, nil
 }
 
+// CreateTemporaryQueue declares a server-named, exclusive queue that is deleted when the connection closes.
+func (rc RabbitClient) CreateTemporaryQueue() (amqp.Queue, error) {
+	q, err := rc.Ch.QueueDeclare(
+		"",    // Server generated name
+		false, // Durable
+		true,  // AutoDelete
+		true,  // Exclusive
+		false, // NoWait
+		nil,   // Arguments
+	)
+	if err != nil {
+		return amqp.Queue{}, fmt.Errorf("error creating temporary queue: %w", err)
+	}
+	return q, nil
+}
+
 // CreateTopicExchange declares a topic exchange, allowing flexible routing of events.
 func (rc RabbitClient) CreateTopicExchange(exchangeName string) error {
 	err := rc.Ch.ExchangeDeclare(
@@ -143,22 +172,21 @@ func (rc RabbitClient) CreateBinding(queueName, bindingKey, exchange string) err
 	return nil
 }
 
-// Send is used to publish a payload onto an exchange with a given routingkey
+// Send is used to publish a payload onto an exchange with a given routingkey and wait for the broker
+// to confirm it. It returns ErrPublishNacked when the broker rejects the message, an *UnroutableError
+// (matching ErrUnroutable) when no queue is bound for the routing key, and ErrConfirmTimeout when ctx
+// expires before the confirm arrives.
 func (rc RabbitClient) Send(ctx context.Context, exchange, routingKey string, options amqp.Publishing) error {
+	start := time.Now()
+
 	// PublishWithDeferredConfirmWithContext will wait for server to ACK the message
-	confirmation, err := rc.Ch.PublishWithDeferredConfirmWithContext(ctx,
-		exchange,   // exchange
-		routingKey, // routing key
-		true, // mandatory
-		false,   // immediate
-		options, // amqp publishing struct
-	)
-	if err != nil {
-		return err
+	confirmation, msg, err := rc.publish(ctx, exchange, routingKey, options)
+	if err == nil {
+		// Blocks until ACK from Server is receieved
+		err = rc.awaitConfirm(ctx, confirmation, exchange, routingKey, msg.MessageId)
 	}
-	// Blocks until ACK from Server is receieved
-	log.Println(confirmation.Wait())
-	return nil
+	observePublish(exchange, publishResult(err), start)
+	return err
 }
 
 // ConsumeEvent sets up a consumer to listen for messages from the specified queue.
@@ -178,6 +206,108 @@ func (rc RabbitClient) ConsumeEvent(queueName string) (<-chan amqp.Delivery, err
 	return messages, nil
 }
 
+// ConsumeEventWithAck consumes a queue without automatic acknowledgements, so messages are only
+// removed once the consumer acknowledges them.
+func (rc RabbitClient) ConsumeEventWithAck(queueName string) (<-chan amqp.Delivery, error) {
+	messages, err := rc.Ch.Consume(
+		queueName,
+		"",
+		false, // AutoAck
+		false, // Exclusive
+		false, // NoLocal
+		false, // NoWait
+		nil,   // Arguments
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error consuming events from queue %s: %w", queueName, err)
+	}
+	return messages, nil
+}
+
+// Headers set on device events, so consumers can order events per device.
+const (
+	DeviceIDHeader  = "device_id"
+	EventTimeHeader = "event_time" // RFC 3339 with nanoseconds, the Timestamp property only has seconds
+)
+
+// CreateDeviceEvent creates the message published for a device state change at eventTime.
+func CreateDeviceEvent(device Device, eventTime time.Time) amqp.Publishing {
+	msg := CreateMessage(fmt.Sprintf("{%s %s %s %s}", device.ID, device.Type, device.State, device.Room))
+	msg.MessageId = NewMessageID()
+	msg.Timestamp = eventTime
+	msg.Headers = amqp.Table{
+		DeviceIDHeader:  device.ID,
+		EventTimeHeader: eventTime.UTC().Format(time.RFC3339Nano),
+	}
+	return msg
+}
+
+// ErrNotPublished wraps the error of a device event that could not be published.
+var ErrNotPublished = errors.New("event was not published")
+
+// StateRecorder records the states of device events; PostgreSQLClient is one.
+type StateRecorder interface {
+	RecordStateChange(deviceID, state, messageID string, eventTime time.Time, expectedVersion int64) (bool, error)
+}
+
+// DeviceStates is a StateRecorder that also looks up registered devices, nil when not registered.
+type DeviceStates interface {
+	StateRecorder
+	GetDevice(deviceID string) (*Device, error)
+}
+
+// PublishDeviceState records the state of a device event created with CreateDeviceEvent and publishes
+// the event on device_events once the state is committed, so consumers only see states the registry
+// accepted. Conflicting, stale and future events are returned unpublished. When publishing fails the
+// state stays recorded and ErrNotPublished is returned; a retry with the same message ID publishes the
+// event without recording it twice. A nil recorder only publishes.
+func PublishDeviceState(ctx context.Context, recorder StateRecorder, publisher Publisher, device Device, msg amqp.Publishing, eventTime time.Time, expectedVersion int64) error {
+	if recorder != nil {
+		if _, err := recorder.RecordStateChange(device.ID, device.State, msg.MessageId, eventTime, expectedVersion); err != nil {
+			return err
+		}
+	}
+	err := publisher.Send(ctx, "device_events", fmt.Sprintf("device.%s.%s", device.Type, device.State), msg)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNotPublished, err)
+	}
+	return nil
+}
+
+// ParseDeviceEvent returns the device of a device event, taking the type and state from its routing key
+// device.<type>.<state> and the ID and room from its body.
+func ParseDeviceEvent(msg amqp.Delivery) (Device, error) {
+	parts := strings.Split(msg.RoutingKey, ".")
+	if len(parts) != 3 || parts[0] != "device" {
+		return Device{}, fmt.Errorf("routing key %s is not a device event", msg.RoutingKey)
+	}
+	device := Device{Type: parts[1], State: parts[2]}
+	fields := strings.Fields(strings.Trim(string(msg.Body), "{}"))
+	if len(fields) > 0 {
+		device.ID = fields[0]
+	}
+	if len(fields) > 3 {
+		device.Room = fields[3]
+	}
+	if id, ok := msg.Headers[DeviceIDHeader].(string); ok && id != "" {
+		device.ID = id
+	}
+	if device.ID == "" {
+		return Device{}, fmt.Errorf("device event on %s does not name a device", msg.RoutingKey)
+	}
+	return device, nil
+}
+
+// EventTime returns the time a device event happened, falling back to the Timestamp property.
+func EventTime(msg amqp.Delivery) time.Time {
+	if value, ok := msg.Headers[EventTimeHeader].(string); ok {
+		if eventTime, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return eventTime
+		}
+	}
+	return msg.Timestamp
+}
+
 func CreateMessage(body string) amqp.Publishing {
 	return amqp.Publishing{
 		ContentType: "text/plain",
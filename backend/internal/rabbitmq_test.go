@@ -1,9 +1,13 @@
 package internal
 
 import (
+	"context"
 	"testing"
+	"time"
 
+	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // TestConnectRabbitMQ tests the connection to RabbitMQ using the configuration
@@ -80,3 +84,59 @@ func TestCreateTopicExchange(t *testing.T) {
 	t.Logf("Topic exchange %s created successfully", exchangeName)
 	t.Log("TestCreateTopicExchange completed successfully")
 }
+
+func TestParseDeviceEvent(t *testing.T) {
+	msg := CreateDeviceEvent(Device{ID: "tv1", Type: "tv", State: "on", Room: "living_room"}, time.Now())
+	device, err := ParseDeviceEvent(amqp.Delivery{RoutingKey: "device.tv.on", Headers: msg.Headers, Body: msg.Body})
+	require.NoError(t, err)
+	assert.Equal(t, Device{ID: "tv1", Type: "tv", State: "on", Room: "living_room"}, device)
+
+	device, err = ParseDeviceEvent(amqp.Delivery{RoutingKey: "device.lamp.off", Body: []byte("{lamp1 lamp off }")})
+	require.NoError(t, err)
+	assert.Equal(t, Device{ID: "lamp1", Type: "lamp", State: "off"}, device, "the body should name the device without headers")
+
+	_, err = ParseDeviceEvent(amqp.Delivery{RoutingKey: "heartbeat.lamp.lamp1"})
+	assert.Error(t, err)
+}
+
+// recorderFunc records states with a function.
+type recorderFunc func(deviceID, state string) error
+
+func (f recorderFunc) RecordStateChange(deviceID, state, messageID string, eventTime time.Time, expectedVersion int64) (bool, error) {
+	return true, f(deviceID, state)
+}
+
+func TestPublishDeviceStateRecordsFirst(t *testing.T) {
+	device := Device{ID: "lamp1", Type: "lamp", State: "on"}
+	publisher := &fakePublisher{}
+	var recorded []string
+	recorder := recorderFunc(func(deviceID, state string) error {
+		assert.Len(t, publisher.routingKeys, len(recorded), "the state should be recorded before the event is published")
+		recorded = append(recorded, deviceID+" "+state)
+		return nil
+	})
+
+	now := time.Now()
+	require.NoError(t, PublishDeviceState(context.Background(), recorder, publisher, device, CreateDeviceEvent(device, now), now, 0))
+	assert.Equal(t, []string{"lamp1 on"}, recorded)
+	assert.Equal(t, []string{"device.lamp.on"}, publisher.routingKeys)
+
+	rejecting := recorderFunc(func(deviceID, state string) error { return ErrStaleEvent })
+	err := PublishDeviceState(context.Background(), rejecting, publisher, device, CreateDeviceEvent(device, now), now, 0)
+	assert.ErrorIs(t, err, ErrStaleEvent)
+	assert.Len(t, publisher.routingKeys, 1, "a rejected state should not be published")
+
+	err = PublishDeviceState(context.Background(), recorder, failingPublisher{}, device, CreateDeviceEvent(device, now), now, 0)
+	assert.ErrorIs(t, err, ErrNotPublished)
+	assert.ErrorIs(t, err, ErrPublishNacked)
+
+	require.NoError(t, PublishDeviceState(context.Background(), nil, publisher, device, CreateDeviceEvent(device, now), now, 0))
+	assert.Len(t, publisher.routingKeys, 2, "events should be published without a recorder")
+}
+
+// failingPublisher rejects every message.
+type failingPublisher struct{}
+
+func (failingPublisher) Send(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	return ErrPublishNacked
+}
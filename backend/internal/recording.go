@@ -0,0 +1,358 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ReplayedFromHeader carries the message ID of the recorded message a replayed message was created from.
+const ReplayedFromHeader = "replayed_from"
+
+// RecordedEvent is a message captured from device_events, one per line of a recording.
+type RecordedEvent struct {
+	RecordedAt  time.Time      `json:"recorded_at"` // When the recorder received the message, used to pace replays
+	Exchange    string         `json:"exchange"`
+	RoutingKey  string         `json:"routing_key"`
+	MessageID   string         `json:"message_id,omitempty"`
+	ContentType string         `json:"content_type,omitempty"`
+	Timestamp   time.Time      `json:"timestamp"`
+	Headers     map[string]any `json:"headers,omitempty"`
+	Body        string         `json:"body,omitempty"`
+	BodyBase64  []byte         `json:"body_base64,omitempty"` // Set instead of Body when the body is not UTF-8
+}
+
+// NewRecordedEvent captures a delivery received at recordedAt.
+func NewRecordedEvent(msg amqp.Delivery, recordedAt time.Time) RecordedEvent {
+	event := RecordedEvent{
+		RecordedAt:  recordedAt,
+		Exchange:    msg.Exchange,
+		RoutingKey:  msg.RoutingKey,
+		MessageID:   msg.MessageId,
+		ContentType: msg.ContentType,
+		Timestamp:   msg.Timestamp,
+	}
+	if len(msg.Headers) > 0 {
+		event.Headers = map[string]any(msg.Headers)
+	}
+	if utf8.Valid(msg.Body) {
+		event.Body = string(msg.Body)
+	} else {
+		event.BodyBase64 = msg.Body
+	}
+	return event
+}
+
+// Publishing returns the recorded message as it can be published again. Header values keep their JSON
+// types: numbers become int64 or float64, and times become strings.
+func (e RecordedEvent) Publishing() amqp.Publishing {
+	msg := amqp.Publishing{
+		ContentType: e.ContentType,
+		MessageId:   e.MessageID,
+		Timestamp:   e.Timestamp,
+		Body:        []byte(e.Body),
+	}
+	if e.BodyBase64 != nil {
+		msg.Body = e.BodyBase64
+	}
+	if len(e.Headers) > 0 {
+		msg.Headers = amqp.Table{}
+		for key, value := range e.Headers {
+			msg.Headers[key] = headerValue(value)
+		}
+	}
+	return msg
+}
+
+// headerValue converts a decoded JSON value to a type AMQP tables can carry.
+func headerValue(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		table := amqp.Table{}
+		for key, item := range v {
+			table[key] = headerValue(item)
+		}
+		return table
+	case []any:
+		items := make([]any, len(v))
+		for i, item := range v {
+			items[i] = headerValue(item)
+		}
+		return items
+	}
+	return value
+}
+
+// Recorder writes the messages it receives to a newline-delimited JSON recording.
+type Recorder struct {
+	mu      sync.Mutex
+	w       *bufio.Writer
+	encoder *json.Encoder
+	count   int
+}
+
+// NewRecorder creates a recorder writing to w. Call Flush to write out buffered messages.
+func NewRecorder(w io.Writer) *Recorder {
+	buffered := bufio.NewWriter(w)
+	return &Recorder{w: buffered, encoder: json.NewEncoder(buffered)}
+}
+
+// Record appends a message to the recording.
+func (r *Recorder) Record(msg amqp.Delivery) error {
+	event := NewRecordedEvent(msg, time.Now())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.encoder.Encode(event); err != nil {
+		return fmt.Errorf("failed to record message %s: %w", msg.MessageId, err)
+	}
+	r.count++
+	return nil
+}
+
+// Flush writes the buffered messages to the underlying writer.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write recording: %w", err)
+	}
+	return nil
+}
+
+// Count returns the number of messages recorded.
+func (r *Recorder) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.count
+}
+
+// ReadRecording calls handle for every event of a recording, in order, until handle returns an error.
+func ReadRecording(r io.Reader, handle func(RecordedEvent) error) error {
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.UseNumber()
+			var event RecordedEvent
+			if err := decoder.Decode(&event); err != nil {
+				return fmt.Errorf("failed to decode recording line %d: %w", line, err)
+			}
+			if err := handle(event); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read recording: %w", err)
+		}
+	}
+}
+
+// ReplayOptions select and pace the events of a replay.
+type ReplayOptions struct {
+	Speed    float64           // 1 replays in real time, 10 ten times faster, 0 as fast as possible
+	Filters  []string          // Routing key patterns of the events to replay, every event when empty
+	Remap    map[string]string // New device IDs by recorded device ID
+	Exchange string            // Replaces the recorded exchange when set
+}
+
+// ReplayResult counts the events of a replay.
+type ReplayResult struct {
+	Replayed    int
+	Skipped     int // Not matching the filters
+	Unroutable  int // Published, but no queue was bound for the routing key
+	FirstRecord time.Time
+	LastRecord  time.Time
+}
+
+// Replayer republishes recorded events through a Publisher, such as a RabbitClient, or an EventBus to
+// replay them in process.
+type Replayer struct {
+	publisher Publisher
+	options   ReplayOptions
+}
+
+// NewReplayer creates a replayer, validating the options.
+func NewReplayer(publisher Publisher, options ReplayOptions) (*Replayer, error) {
+	if options.Speed < 0 {
+		return nil, fmt.Errorf("invalid replay speed %g", options.Speed)
+	}
+	for _, filter := range options.Filters {
+		if err := ValidateRoutingKeyFilter(filter); err != nil {
+			return nil, err
+		}
+	}
+	for from, to := range options.Remap {
+		if from == "" || to == "" || strings.ContainsAny(to, ".*# ") {
+			return nil, fmt.Errorf("invalid device ID remapping %q to %q", from, to)
+		}
+	}
+	return &Replayer{publisher: publisher, options: options}, nil
+}
+
+// Replay republishes the events of a recording that match the filters, keeping the recorded gaps
+// between them divided by the speed. Every replayed message gets a new message ID, so consumers do not
+// skip it as a duplicate, and its event time is moved by the time passed since it was recorded.
+func (r *Replayer) Replay(ctx context.Context, recording io.Reader) (ReplayResult, error) {
+	var result ReplayResult
+	var start time.Time
+	err := ReadRecording(recording, func(event RecordedEvent) error {
+		if !r.matches(event.RoutingKey) {
+			result.Skipped++
+			return nil
+		}
+		if result.Replayed+result.Unroutable == 0 {
+			start = time.Now()
+			result.FirstRecord = event.RecordedAt
+		}
+		if r.options.Speed > 0 {
+			due := start.Add(time.Duration(float64(event.RecordedAt.Sub(result.FirstRecord)) / r.options.Speed))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Until(due)):
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		exchange, routingKey, msg := r.prepare(event, time.Now())
+		if err := r.publisher.Send(ctx, exchange, routingKey, msg); err != nil {
+			if !errors.Is(err, ErrUnroutable) {
+				return fmt.Errorf("error replaying message %s: %w", event.MessageID, err)
+			}
+			result.Unroutable++
+		} else {
+			result.Replayed++
+		}
+		result.LastRecord = event.RecordedAt
+		return nil
+	})
+	return result, err
+}
+
+func (r *Replayer) matches(routingKey string) bool {
+	if len(r.options.Filters) == 0 {
+		return true
+	}
+	for _, filter := range r.options.Filters {
+		if MatchRoutingKey(filter, routingKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepare returns the message to publish for a recorded event at now, with the device IDs remapped.
+func (r *Replayer) prepare(event RecordedEvent, now time.Time) (string, string, amqp.Publishing) {
+	msg := event.Publishing()
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	if event.MessageID != "" {
+		msg.Headers[ReplayedFromHeader] = event.MessageID
+	}
+	msg.MessageId = NewMessageID()
+
+	shift := now.Sub(event.RecordedAt)
+	if !msg.Timestamp.IsZero() {
+		msg.Timestamp = msg.Timestamp.Add(shift)
+	}
+	if value, ok := msg.Headers[EventTimeHeader].(string); ok {
+		if eventTime, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			msg.Headers[EventTimeHeader] = eventTime.Add(shift).UTC().Format(time.RFC3339Nano)
+		}
+	}
+
+	routingKey := event.RoutingKey
+	if len(r.options.Remap) > 0 {
+		routingKey = r.remapRoutingKey(routingKey)
+		if id, ok := msg.Headers[DeviceIDHeader].(string); ok {
+			msg.Headers[DeviceIDHeader] = r.remapID(id)
+		}
+		msg.Body = r.remapBody(msg.Body)
+	}
+
+	exchange := event.Exchange
+	if r.options.Exchange != "" {
+		exchange = r.options.Exchange
+	}
+	return exchange, routingKey, msg
+}
+
+func (r *Replayer) remapID(id string) string {
+	if to, ok := r.options.Remap[id]; ok {
+		return to
+	}
+	return id
+}
+
+// remapRoutingKey replaces the device ID at the end of routing keys like telemetry.<type>.<id> and
+// registry.<action>.<type>.<id>.
+func (r *Replayer) remapRoutingKey(routingKey string) string {
+	parts := strings.Split(routingKey, ".")
+	if len(parts) < 3 || parts[0] == "device" {
+		return routingKey // device.<type>.<state> names no device
+	}
+	parts[len(parts)-1] = r.remapID(parts[len(parts)-1])
+	return strings.Join(parts, ".")
+}
+
+// remapBody replaces the device ID of JSON bodies, in their id and device_id fields, and of device
+// events, the first field of "{<id> <type> <state> <room>}".
+func (r *Replayer) remapBody(body []byte) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err == nil {
+		changed := false
+		for _, key := range []string{"id", "device_id"} {
+			var id string
+			if err := json.Unmarshal(fields[key], &id); err != nil {
+				continue
+			}
+			if to := r.remapID(id); to != id {
+				fields[key], _ = json.Marshal(to)
+				changed = true
+			}
+		}
+		if !changed {
+			return body
+		}
+		remapped, err := json.Marshal(fields)
+		if err != nil {
+			log.Printf("Failed to remap message body: %v", err)
+			return body
+		}
+		return remapped
+	}
+
+	text := string(body)
+	if !strings.HasPrefix(text, "{") || !strings.HasSuffix(text, "}") {
+		return body
+	}
+	parts := strings.SplitN(strings.TrimPrefix(text, "{"), " ", 2)
+	if to := r.remapID(parts[0]); to != parts[0] && len(parts) == 2 {
+		return []byte("{" + to + " " + parts[1])
+	}
+	return body
+}
@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordEvents records deliveries spaced by gap and returns the recording.
+func recordEvents(t *testing.T, gap time.Duration, messages ...amqp.Delivery) []byte {
+	var buf bytes.Buffer
+	recorder := NewRecorder(&buf)
+	for i, msg := range messages {
+		if i > 0 {
+			time.Sleep(gap)
+		}
+		require.NoError(t, recorder.Record(msg))
+	}
+	require.NoError(t, recorder.Flush())
+	assert.Equal(t, len(messages), recorder.Count())
+	return buf.Bytes()
+}
+
+func deviceEventDelivery(device Device, eventTime time.Time) amqp.Delivery {
+	msg := CreateDeviceEvent(device, eventTime)
+	return amqp.Delivery{
+		Exchange:    "device_events",
+		RoutingKey:  "device." + device.Type + "." + device.State,
+		MessageId:   msg.MessageId,
+		ContentType: msg.ContentType,
+		Timestamp:   msg.Timestamp,
+		Headers:     msg.Headers,
+		Body:        msg.Body,
+	}
+}
+
+func TestRecordingRoundTrip(t *testing.T) {
+	eventTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	event := deviceEventDelivery(Device{ID: "tv1", Type: "tv", State: "on", Room: "living"}, eventTime)
+	event.Headers["attempt"] = int64(2)
+	binary := amqp.Delivery{Exchange: "device_events", RoutingKey: "telemetry.meter.m1", Body: []byte{0xff, 0x00, 0x01}}
+	recording := recordEvents(t, 0, event, binary)
+	assert.Equal(t, 2, strings.Count(string(recording), "\n"), "every event should take one line")
+
+	var events []RecordedEvent
+	require.NoError(t, ReadRecording(bytes.NewReader(append(recording, '\n')), func(event RecordedEvent) error {
+		events = append(events, event)
+		return nil
+	}))
+	require.Len(t, events, 2)
+
+	msg := events[0].Publishing()
+	assert.Equal(t, event.MessageId, msg.MessageId)
+	assert.Equal(t, event.Body, msg.Body)
+	assert.Equal(t, "tv1", msg.Headers[DeviceIDHeader])
+	assert.Equal(t, int64(2), msg.Headers["attempt"], "integer headers should stay integers")
+	assert.True(t, eventTime.Equal(EventTime(amqp.Delivery{Headers: msg.Headers})))
+	assert.Equal(t, "device.tv.on", events[0].RoutingKey)
+	assert.Equal(t, []byte{0xff, 0x00, 0x01}, events[1].Publishing().Body, "binary bodies should survive the recording")
+
+	err := ReadRecording(strings.NewReader("{}\nnot json\n"), func(RecordedEvent) error { return nil })
+	assert.ErrorContains(t, err, "line 2")
+}
+
+func TestReplayFiltersAndRemaps(t *testing.T) {
+	eventTime := time.Now().Add(-time.Hour)
+	reading, err := CreateTelemetryMessage(Reading{DeviceID: "tv1", DeviceType: "tv", Metric: "power", Value: 80, Timestamp: eventTime})
+	require.NoError(t, err)
+	recording := recordEvents(t, 0,
+		deviceEventDelivery(Device{ID: "tv1", Type: "tv", State: "on", Room: "living"}, eventTime),
+		amqp.Delivery{Exchange: "device_events", RoutingKey: TelemetryRoutingKey("tv", "tv1"), Body: reading.Body, Headers: reading.Headers},
+		deviceEventDelivery(Device{ID: "lamp1", Type: "light", State: "on"}, eventTime),
+	)
+
+	publisher := &recordingPublisher{}
+	replayer, err := NewReplayer(publisher, ReplayOptions{
+		Filters: []string{"device.tv.*", "telemetry.#"},
+		Remap:   map[string]string{"tv1": "tv-lab"},
+	})
+	require.NoError(t, err)
+	result, err := replayer.Replay(context.Background(), bytes.NewReader(recording))
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Replayed)
+	assert.Equal(t, 1, result.Skipped)
+
+	published := publisher.messages()
+	require.Len(t, published, 2)
+	assert.Equal(t, "device.tv.on", published[0].routingKey)
+	assert.Equal(t, "{tv-lab tv on living}", string(published[0].msg.Body))
+	assert.Equal(t, "tv-lab", published[0].msg.Headers[DeviceIDHeader])
+	assert.NotEmpty(t, published[0].msg.Headers[ReplayedFromHeader])
+	assert.NotEqual(t, published[0].msg.Headers[ReplayedFromHeader], published[0].msg.MessageId, "replays should get new message IDs")
+	replayedAt := EventTime(amqp.Delivery{Headers: published[0].msg.Headers})
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), replayedAt, time.Minute, "event times should move with the replay")
+
+	assert.Equal(t, TelemetryRoutingKey("tv", "tv-lab"), published[1].routingKey)
+	parsed, err := ParseTelemetry(amqp.Delivery{RoutingKey: published[1].routingKey, Body: published[1].msg.Body})
+	require.NoError(t, err)
+	assert.Equal(t, "tv-lab", parsed.DeviceID)
+	assert.Equal(t, 80.0, parsed.Value)
+
+	_, err = NewReplayer(publisher, ReplayOptions{Filters: []string{"device..on"}})
+	assert.Error(t, err)
+	_, err = NewReplayer(publisher, ReplayOptions{Speed: -1})
+	assert.Error(t, err)
+}
+
+func TestReplayPacing(t *testing.T) {
+	tv := deviceEventDelivery(Device{ID: "tv1", Type: "tv", State: "on"}, time.Now())
+	recording := recordEvents(t, 100*time.Millisecond, tv, tv, tv)
+
+	replay := func(speed float64) time.Duration {
+		replayer, err := NewReplayer(&recordingPublisher{}, ReplayOptions{Speed: speed})
+		require.NoError(t, err)
+		start := time.Now()
+		result, err := replayer.Replay(context.Background(), bytes.NewReader(recording))
+		require.NoError(t, err)
+		assert.Equal(t, 3, result.Replayed)
+		return time.Since(start)
+	}
+	assert.GreaterOrEqual(t, replay(1), 200*time.Millisecond, "real time should keep the recorded gaps")
+	accelerated := replay(4)
+	assert.GreaterOrEqual(t, accelerated, 50*time.Millisecond)
+	assert.Less(t, accelerated, 150*time.Millisecond, "speed 4 should shorten the gaps")
+	assert.Less(t, replay(0), 50*time.Millisecond, "speed 0 should not wait")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	replayer, err := NewReplayer(&recordingPublisher{}, ReplayOptions{Speed: 1})
+	require.NoError(t, err)
+	result, err := replayer.Replay(ctx, bytes.NewReader(recording))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, result.Replayed)
+}
+
+func TestReplayToEventBus(t *testing.T) {
+	recording := recordEvents(t, 0, deviceEventDelivery(Device{ID: "tv1", Type: "tv", State: "off"}, time.Now()))
+	bus := NewEventBus(10, 10, SlowClientDrop)
+	sub, _, err := bus.Subscribe("device.#", 0)
+	require.NoError(t, err)
+	defer bus.Unsubscribe(sub)
+
+	replayer, err := NewReplayer(bus, ReplayOptions{})
+	require.NoError(t, err)
+	_, err = replayer.Replay(context.Background(), bytes.NewReader(recording))
+	require.NoError(t, err)
+
+	select {
+	case event := <-sub.C:
+		assert.Equal(t, "device.tv.off", event.RoutingKey)
+		assert.Equal(t, "{tv1 tv off }", event.Body)
+	case <-time.After(time.Second):
+		t.Fatal("the replayed event should reach the bus subscribers")
+	}
+}
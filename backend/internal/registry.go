@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Actions of registry events, published when devices are registered or deleted.
+const (
+	RegistryCreated = "created"
+	RegistryDeleted = "deleted"
+)
+
+// RegistryRoutingKey returns the routing key of a registry event, registry.<action>.<type>.<id>.
+func RegistryRoutingKey(action, deviceType, deviceID string) string {
+	return fmt.Sprintf("registry.%s.%s.%s", action, deviceType, deviceID)
+}
+
+// CreateRegistryEvent encodes the registered or deleted device as a JSON message.
+func CreateRegistryEvent(device Device) amqp.Publishing {
+	body, _ := json.Marshal(device)
+	return amqp.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+		MessageId:   NewMessageID(),
+		Timestamp:   time.Now(),
+		Headers:     amqp.Table{DeviceIDHeader: device.ID},
+	}
+}
+
+// ParseRegistryEvent returns the action and the device of a registry event.
+func ParseRegistryEvent(msg amqp.Delivery) (string, Device, error) {
+	parts := strings.Split(msg.RoutingKey, ".")
+	if len(parts) != 4 || parts[0] != "registry" {
+		return "", Device{}, fmt.Errorf("routing key %s is not a registry event", msg.RoutingKey)
+	}
+	var device Device
+	if err := json.Unmarshal(msg.Body, &device); err != nil {
+		return "", Device{}, fmt.Errorf("error decoding registry event: %w", err)
+	}
+	if device.Type == "" {
+		device.Type = parts[2]
+	}
+	if device.ID == "" {
+		device.ID = parts[3]
+	}
+	return parts[1], device, nil
+}
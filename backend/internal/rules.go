@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Rule activates a scene when a device event matching Trigger is published.
+type Rule struct {
+	Name      string    `json:"name"`
+	Trigger   string    `json:"trigger"`             // Routing key pattern, e.g. "device.motion_sensor.detected"
+	DeviceID  string    `json:"device_id,omitempty"` // Only events of this device trigger the rule when set
+	Scene     string    `json:"scene"`
+	Enabled   bool      `json:"enabled"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Validate reports an error when the name, trigger or scene of the rule is invalid.
+func (r Rule) Validate() error {
+	if err := validateName(r.Name); err != nil {
+		return err
+	}
+	if r.Trigger == "" {
+		return errors.New("trigger is required")
+	}
+	if err := ValidateRoutingKeyFilter(r.Trigger); err != nil {
+		return err
+	}
+	if r.Scene == "" {
+		return errors.New("scene is required")
+	}
+	return nil
+}
+
+// Matches reports whether a device event published with routingKey triggers the rule.
+func (r Rule) Matches(device Device, routingKey string) bool {
+	return MatchRoutingKey(r.Trigger, routingKey) && (r.DeviceID == "" || r.DeviceID == device.ID)
+}
+
+// RuleStore provides the rules, scenes and devices used by the RuleEngine.
+type RuleStore interface {
+	ListEnabledRules() ([]Rule, error)
+	GetScene(name string) (*Scene, error)
+	GetDevice(deviceID string) (*Device, error)
+}
+
+// RuleEngine activates the scenes of the rules triggered by device events.
+type RuleEngine struct {
+	store     RuleStore
+	publisher Publisher
+	timeout   time.Duration // Deadline of each command publish
+}
+
+// NewRuleEngine creates a RuleEngine sending the commands of scenes with publisher.
+func NewRuleEngine(store RuleStore, publisher Publisher) *RuleEngine {
+	return &RuleEngine{store: store, publisher: publisher, timeout: 10 * time.Second}
+}
+
+// Run handles the events received on messages until the channel is closed, acknowledging each event
+// once the scenes it triggers were activated and requeueing it when that failed.
+func (e *RuleEngine) Run(ctx context.Context, messages <-chan amqp.Delivery) {
+	for msg := range messages {
+		if err := e.Handle(ctx, msg); err != nil {
+			log.Printf("Failed to apply rules to event %s: %v", msg.MessageId, err)
+			msg.Nack(false, true)
+			continue
+		}
+		msg.Ack(false)
+	}
+}
+
+// Handle activates the scene of every enabled rule a device event triggers.
+func (e *RuleEngine) Handle(ctx context.Context, msg amqp.Delivery) error {
+	device, err := ParseDeviceEvent(msg)
+	if err != nil {
+		log.Printf("Skipping event %s: %v", msg.MessageId, err)
+		return nil
+	}
+
+	rules, err := e.store.ListEnabledRules()
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if !rule.Matches(device, msg.RoutingKey) {
+			continue
+		}
+		log.Printf("Rule %s triggered by %s of device %s", rule.Name, msg.RoutingKey, device.ID)
+		if err := e.Activate(ctx, rule.Scene); err != nil {
+			return fmt.Errorf("error activating scene %s of rule %s: %w", rule.Scene, rule.Name, err)
+		}
+	}
+	return nil
+}
+
+// Activate sends the commands of a scene to its devices that are not in the requested state yet, so a
+// scene changing the devices that trigger it settles instead of looping. Devices that are not
+// registered are skipped.
+func (e *RuleEngine) Activate(ctx context.Context, name string) error {
+	scene, err := e.store.GetScene(name)
+	if err != nil {
+		return err
+	}
+	if scene == nil {
+		log.Printf("Scene %s does not exist", name)
+		return nil
+	}
+
+	for _, action := range scene.Actions {
+		device, err := e.store.GetDevice(action.DeviceID)
+		if err != nil {
+			return err
+		}
+		if device == nil {
+			log.Printf("Skipping device %s of scene %s, it is not registered", action.DeviceID, name)
+			continue
+		}
+		if device.State == action.State {
+			continue
+		}
+
+		msg := CreateCommandMessage(Command{DeviceID: device.ID, DeviceType: device.Type, State: action.State, Timestamp: time.Now()})
+		publishCtx, cancel := context.WithTimeout(ctx, e.timeout)
+		err = e.publisher.Send(publishCtx, "device_events", CommandRoutingKey(device.Type, device.ID), msg)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error sending command to device %s: %w", device.ID, err)
+		}
+		log.Printf("Scene %s sent command %s to device %s", name, action.State, device.ID)
+	}
+	return nil
+}
+
+// PutRule creates or replaces a rule, setting its update time.
+func (p *PostgreSQLClient) PutRule(rule *Rule) error {
+	query := `INSERT INTO rules (name, trigger, device_id, scene, enabled) VALUES ($1, $2, $3, $4, $5)
+              ON CONFLICT (name) DO UPDATE SET trigger = EXCLUDED.trigger, device_id = EXCLUDED.device_id,
+                  scene = EXCLUDED.scene, enabled = EXCLUDED.enabled, updated_at = NOW()
+              RETURNING updated_at`
+	err := p.DB.QueryRow(query, rule.Name, rule.Trigger, rule.DeviceID, rule.Scene, rule.Enabled).Scan(&rule.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save rule: %w", err)
+	}
+	return nil
+}
+
+const ruleColumns = `name, trigger, device_id, scene, enabled, updated_at`
+
+func scanRule(row interface{ Scan(...any) error }) (Rule, error) {
+	var rule Rule
+	err := row.Scan(&rule.Name, &rule.Trigger, &rule.DeviceID, &rule.Scene, &rule.Enabled, &rule.UpdatedAt)
+	return rule, err
+}
+
+// GetRule retrieves a rule by name, returning nil when it does not exist.
+func (p *PostgreSQLClient) GetRule(name string) (*Rule, error) {
+	rule, err := scanRule(p.DB.QueryRow(`SELECT `+ruleColumns+` FROM rules WHERE name = $1`, name))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rule: %w", err)
+	}
+	return &rule, nil
+}
+
+// ListRules retrieves every rule, ordered by name.
+func (p *PostgreSQLClient) ListRules() ([]Rule, error) {
+	return p.listRules(`SELECT ` + ruleColumns + ` FROM rules ORDER BY name`)
+}
+
+// ListEnabledRules retrieves the rules device events are matched against.
+func (p *PostgreSQLClient) ListEnabledRules() ([]Rule, error) {
+	return p.listRules(`SELECT ` + ruleColumns + ` FROM rules WHERE enabled ORDER BY name`)
+}
+
+func (p *PostgreSQLClient) listRules(query string) ([]Rule, error) {
+	rows, err := p.DB.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rules: %w", err)
+	}
+	defer rows.Close()
+
+	rules := []Rule{}
+	for rows.Next() {
+		rule, err := scanRule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan rule: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list rules: %w", err)
+	}
+	return rules, nil
+}
+
+// DeleteRule deletes a rule, reporting whether it existed.
+func (p *PostgreSQLClient) DeleteRule(name string) (bool, error) {
+	result, err := p.DB.Exec(`DELETE FROM rules WHERE name = $1`, name)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete rule: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete rule: %w", err)
+	}
+	return deleted == 1, nil
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryRuleStore keeps rules, scenes and devices in memory.
+type memoryRuleStore struct {
+	rules   []Rule
+	scenes  map[string]Scene
+	devices map[string]Device
+}
+
+func (m *memoryRuleStore) ListEnabledRules() ([]Rule, error) {
+	var enabled []Rule
+	for _, rule := range m.rules {
+		if rule.Enabled {
+			enabled = append(enabled, rule)
+		}
+	}
+	return enabled, nil
+}
+
+func (m *memoryRuleStore) GetScene(name string) (*Scene, error) {
+	scene, ok := m.scenes[name]
+	if !ok {
+		return nil, nil
+	}
+	return &scene, nil
+}
+
+func (m *memoryRuleStore) GetDevice(deviceID string) (*Device, error) {
+	device, ok := m.devices[deviceID]
+	if !ok {
+		return nil, nil
+	}
+	return &device, nil
+}
+
+func TestRuleValidate(t *testing.T) {
+	assert.NoError(t, Rule{Name: "lights_on_motion", Trigger: "device.motion_sensor.detected", Scene: "lights_on"}.Validate())
+	assert.Error(t, Rule{Name: "lights on", Trigger: "#", Scene: "lights_on"}.Validate())
+	assert.Error(t, Rule{Name: "lights_on_motion", Scene: "lights_on"}.Validate(), "a rule needs a trigger")
+	assert.Error(t, Rule{Name: "lights_on_motion", Trigger: "device.#motion", Scene: "lights_on"}.Validate())
+	assert.Error(t, Rule{Name: "lights_on_motion", Trigger: "#"}.Validate(), "a rule needs a scene")
+}
+
+func TestRuleEngine(t *testing.T) {
+	store := &memoryRuleStore{
+		rules: []Rule{
+			{Name: "hall_motion", Trigger: "device.motion_sensor.detected", DeviceID: "m1", Scene: "lights_on", Enabled: true},
+			{Name: "disabled", Trigger: "#", Scene: "all_off", Enabled: false},
+		},
+		scenes: map[string]Scene{
+			"lights_on": {Name: "lights_on", Actions: []SceneAction{
+				{DeviceID: "lamp1", State: "on"}, {DeviceID: "lamp2", State: "on"}, {DeviceID: "gone", State: "on"},
+			}},
+			"all_off": {Name: "all_off", Actions: []SceneAction{{DeviceID: "lamp1", State: "off"}}},
+		},
+		devices: map[string]Device{
+			"lamp1": {ID: "lamp1", Type: "light", State: "off"},
+			"lamp2": {ID: "lamp2", Type: "light", State: "on"},
+		},
+	}
+	publisher := &recordingPublisher{}
+	engine := NewRuleEngine(store, publisher)
+
+	event := func(id, routingKey string) amqp.Delivery {
+		return amqp.Delivery{RoutingKey: routingKey, Body: []byte("{" + id + " motion_sensor detected hall}")}
+	}
+
+	require.NoError(t, engine.Handle(context.Background(), event("m2", "device.motion_sensor.detected")))
+	assert.Empty(t, publisher.messages(), "events of other devices should not trigger the rule")
+
+	require.NoError(t, engine.Handle(context.Background(), event("m1", "device.motion_sensor.detected")))
+	published := publisher.messages()
+	require.Len(t, published, 1, "devices already in the state and unregistered devices should be skipped")
+	assert.Equal(t, "command.light.lamp1", published[0].routingKey)
+	command, err := ParseCommand(amqp.Delivery{RoutingKey: published[0].routingKey, Body: published[0].msg.Body})
+	require.NoError(t, err)
+	assert.Equal(t, "on", command.State)
+
+	require.NoError(t, engine.Handle(context.Background(), amqp.Delivery{RoutingKey: "telemetry.t1.temperature"}),
+		"events that are not device events should be skipped")
+
+	engine.publisher = failingPublisher{}
+	err = engine.Handle(context.Background(), event("m1", "device.motion_sensor.detected"))
+	assert.ErrorIs(t, err, ErrPublishNacked, "failed commands should be reported so the event is requeued")
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrSceneInUse is returned when deleting a scene that a rule activates.
+var ErrSceneInUse = errors.New("scene is activated by a rule")
+
+// SceneAction is the state a scene asks a device for.
+type SceneAction struct {
+	DeviceID string `json:"device_id"`
+	State    string `json:"state"`
+}
+
+// Scene is a named set of device states applied together by sending commands.
+type Scene struct {
+	Name      string        `json:"name"`
+	Actions   []SceneAction `json:"actions"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// SceneCommand is a command sent to activate a scene.
+type SceneCommand struct {
+	DeviceID string `json:"device_id"`
+	State    string `json:"state"`
+	ID       string `json:"id"` // Message ID of the published command
+}
+
+// Validate reports an error when the name or one of the actions of the scene is invalid.
+func (s Scene) Validate() error {
+	if err := validateName(s.Name); err != nil {
+		return err
+	}
+	if len(s.Actions) == 0 {
+		return errors.New("a scene needs at least one action")
+	}
+	for _, action := range s.Actions {
+		if action.DeviceID == "" || action.State == "" {
+			return errors.New("every action needs a device_id and a state")
+		}
+		if strings.ContainsAny(action.State, ".*# ") {
+			return errors.New("state must not contain '.', '*', '#' or spaces")
+		}
+	}
+	return nil
+}
+
+// validateName checks the name of a scene or rule, which is used as a path segment.
+func validateName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/ ") {
+		return errors.New("name must not be empty or contain '/' or spaces")
+	}
+	return nil
+}
+
+// PutScene creates or replaces a scene, setting its update time.
+func (p *PostgreSQLClient) PutScene(scene *Scene) error {
+	actions, err := json.Marshal(scene.Actions)
+	if err != nil {
+		return fmt.Errorf("failed to encode scene actions: %w", err)
+	}
+	query := `INSERT INTO scenes (name, actions) VALUES ($1, $2)
+              ON CONFLICT (name) DO UPDATE SET actions = EXCLUDED.actions, updated_at = NOW()
+              RETURNING updated_at`
+	if err := p.DB.QueryRow(query, scene.Name, actions).Scan(&scene.UpdatedAt); err != nil {
+		return fmt.Errorf("failed to save scene: %w", err)
+	}
+	return nil
+}
+
+func scanScene(row interface{ Scan(...any) error }) (Scene, error) {
+	var scene Scene
+	var actions []byte
+	if err := row.Scan(&scene.Name, &actions, &scene.UpdatedAt); err != nil {
+		return Scene{}, err
+	}
+	if err := json.Unmarshal(actions, &scene.Actions); err != nil {
+		return Scene{}, fmt.Errorf("failed to decode scene actions: %w", err)
+	}
+	return scene, nil
+}
+
+// GetScene retrieves a scene by name, returning nil when it does not exist.
+func (p *PostgreSQLClient) GetScene(name string) (*Scene, error) {
+	scene, err := scanScene(p.DB.QueryRow(`SELECT name, actions, updated_at FROM scenes WHERE name = $1`, name))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scene: %w", err)
+	}
+	return &scene, nil
+}
+
+// ListScenes retrieves every scene, ordered by name.
+func (p *PostgreSQLClient) ListScenes() ([]Scene, error) {
+	rows, err := p.DB.Query(`SELECT name, actions, updated_at FROM scenes ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list scenes: %w", err)
+	}
+	defer rows.Close()
+
+	scenes := []Scene{}
+	for rows.Next() {
+		scene, err := scanScene(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan scene: %w", err)
+		}
+		scenes = append(scenes, scene)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list scenes: %w", err)
+	}
+	return scenes, nil
+}
+
+// DeleteScene deletes a scene and reports whether it existed. It returns ErrSceneInUse when a rule
+// still activates the scene.
+func (p *PostgreSQLClient) DeleteScene(name string) (bool, error) {
+	var used bool
+	if err := p.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM rules WHERE scene = $1)`, name).Scan(&used); err != nil {
+		return false, fmt.Errorf("failed to delete scene: %w", err)
+	}
+	if used {
+		return false, ErrSceneInUse
+	}
+
+	result, err := p.DB.Exec(`DELETE FROM scenes WHERE name = $1`, name)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete scene: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete scene: %w", err)
+	}
+	return deleted == 1, nil
+}
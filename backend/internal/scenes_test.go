@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSceneValidate(t *testing.T) {
+	assert.NoError(t, Scene{Name: "movie_night", Actions: []SceneAction{{DeviceID: "tv1", State: "on"}}}.Validate())
+	assert.Error(t, Scene{Name: "", Actions: []SceneAction{{DeviceID: "tv1", State: "on"}}}.Validate())
+	assert.Error(t, Scene{Name: "movie/night", Actions: []SceneAction{{DeviceID: "tv1", State: "on"}}}.Validate())
+	assert.Error(t, Scene{Name: "movie_night"}.Validate(), "a scene needs actions")
+	assert.Error(t, Scene{Name: "movie_night", Actions: []SceneAction{{DeviceID: "tv1"}}}.Validate())
+	assert.Error(t, Scene{Name: "movie_night", Actions: []SceneAction{{DeviceID: "tv1", State: "on.#"}}}.Validate())
+}
+
+func TestScenesInPostgres(t *testing.T) {
+	scene := Scene{Name: "movie_night", Actions: []SceneAction{{DeviceID: "tv1", State: "on"}, {DeviceID: "lamp1", State: "off"}}}
+	require.NoError(t, testDB.PutScene(&scene))
+	assert.False(t, scene.UpdatedAt.IsZero())
+
+	scene.Actions = scene.Actions[:1]
+	require.NoError(t, testDB.PutScene(&scene))
+	stored, err := testDB.GetScene("movie_night")
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	assert.Equal(t, []SceneAction{{DeviceID: "tv1", State: "on"}}, stored.Actions, "putting a scene should replace its actions")
+
+	scenes, err := testDB.ListScenes()
+	require.NoError(t, err)
+	assert.Contains(t, scenes, *stored)
+
+	rule := Rule{Name: "movie_on_motion", Trigger: "device.motion_sensor.detected", Scene: "movie_night", Enabled: true}
+	require.NoError(t, testDB.PutRule(&rule))
+	_, err = testDB.DeleteScene("movie_night")
+	assert.ErrorIs(t, err, ErrSceneInUse, "scenes activated by a rule should not be deleted")
+
+	deleted, err := testDB.DeleteRule("movie_on_motion")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	deleted, err = testDB.DeleteScene("movie_night")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	stored, err = testDB.GetScene("movie_night")
+	require.NoError(t, err)
+	assert.Nil(t, stored)
+}
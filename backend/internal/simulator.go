@@ -0,0 +1,648 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"gopkg.in/yaml.v3"
+)
+
+// OriginSimulator marks the device events of simulated devices.
+const OriginSimulator = "simulator"
+
+// SimulatedType is the behaviour of the simulated devices of a type: a Markov model of their states
+// and the telemetry they report.
+type SimulatedType struct {
+	Type        string                        `yaml:"Type"`
+	Weight      int                           `yaml:"Weight"`      // Share of the simulated devices, default 1
+	Interval    time.Duration                 `yaml:"Interval"`    // Mean time between two steps of a device, default 10s
+	Initial     string                        `yaml:"Initial"`     // State of new devices, default the first state in Transitions
+	Transitions map[string]map[string]float64 `yaml:"Transitions"` // Chance of moving to each other state per step, by state
+	Metrics     []SimulatedMetric             `yaml:"Metrics"`     // Reported at every step
+}
+
+// SimulatedMetric is a reading that wanders between Min and Max by up to Step per report, or stays near
+// the level of the device's state when States has one.
+type SimulatedMetric struct {
+	Metric string             `yaml:"Metric"`
+	Unit   string             `yaml:"Unit"`
+	Min    float64            `yaml:"Min"`
+	Max    float64            `yaml:"Max"`
+	Step   float64            `yaml:"Step"`
+	States map[string]float64 `yaml:"States"` // Level by state, e.g. the power draw of a light when on
+}
+
+// Validate reports transition chances that are negative, add up to more than 1 or lead to unknown states.
+func (t SimulatedType) Validate() error {
+	if t.Type == "" || strings.ContainsAny(t.Type, ".*# ") {
+		return fmt.Errorf("invalid simulated device type %q", t.Type)
+	}
+	if len(t.Transitions) == 0 {
+		return fmt.Errorf("simulated type %s has no states", t.Type)
+	}
+	for state, next := range t.Transitions {
+		total := 0.0
+		for target, chance := range next {
+			if _, ok := t.Transitions[target]; !ok {
+				return fmt.Errorf("simulated type %s moves from %s to unknown state %s", t.Type, state, target)
+			}
+			if chance < 0 {
+				return fmt.Errorf("simulated type %s has a negative chance from %s to %s", t.Type, state, target)
+			}
+			total += chance
+		}
+		if total > 1 {
+			return fmt.Errorf("simulated type %s leaves %s with a chance above 1", t.Type, state)
+		}
+	}
+	if _, ok := t.Transitions[t.Initial]; t.Initial != "" && !ok {
+		return fmt.Errorf("simulated type %s starts in unknown state %s", t.Type, t.Initial)
+	}
+	for _, metric := range t.Metrics {
+		if metric.Metric == "" || metric.Min > metric.Max {
+			return fmt.Errorf("simulated type %s has an invalid metric %q", t.Type, metric.Metric)
+		}
+	}
+	return nil
+}
+
+// states returns the states of the type, sorted so runs with the same seed are repeatable.
+func (t SimulatedType) states() []string {
+	states := make([]string, 0, len(t.Transitions))
+	for state := range t.Transitions {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	return states
+}
+
+// Next returns the state a device in state moves to, given a uniform random number in [0, 1).
+func (t SimulatedType) Next(state string, roll float64) string {
+	next := t.Transitions[state]
+	targets := make([]string, 0, len(next))
+	for target := range next {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		if roll < next[target] {
+			return target
+		}
+		roll -= next[target]
+	}
+	return state
+}
+
+// DefaultSimulatedTypes are simulated when the configuration lists no types.
+func DefaultSimulatedTypes() []SimulatedType {
+	return []SimulatedType{
+		{
+			Type: "light", Weight: 3, Interval: 30 * time.Second, Initial: "off",
+			Transitions: map[string]map[string]float64{"off": {"on": 0.2}, "on": {"off": 0.3}},
+			Metrics:     []SimulatedMetric{{Metric: "power", Unit: "W", Min: 0, Max: 12, Step: 0.5, States: map[string]float64{"off": 0.3, "on": 9}}},
+		},
+		{
+			Type: "thermostat", Weight: 1, Interval: time.Minute, Initial: "idle",
+			Transitions: map[string]map[string]float64{"idle": {"heating": 0.25}, "heating": {"idle": 0.35}},
+			Metrics:     []SimulatedMetric{{Metric: "temperature", Unit: "C", Min: 16, Max: 25, Step: 0.3}},
+		},
+		{
+			Type: "motion_sensor", Weight: 2, Interval: 20 * time.Second, Initial: "clear",
+			Transitions: map[string]map[string]float64{"clear": {"detected": 0.1}, "detected": {"clear": 0.6}},
+		},
+	}
+}
+
+// Scenario is a script of device events and readings, replacing the Markov models.
+type Scenario struct {
+	Repeat bool           `yaml:"Repeat"` // Start over after the last step until the run ends
+	Steps  []ScenarioStep `yaml:"Steps"`
+}
+
+// ScenarioStep sets a state or reports readings, for one device or every simulated device of a type.
+type ScenarioStep struct {
+	After    time.Duration      `yaml:"After"`  // Delay after the previous step
+	Device   string             `yaml:"Device"` // ID of a simulated device, e.g. "sim-light-1"
+	Type     string             `yaml:"Type"`   // Used when Device is empty
+	State    string             `yaml:"State"`
+	Readings map[string]float64 `yaml:"Readings"` // Values by metric
+}
+
+// LoadScenario reads a scenario from a YAML file.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario: %w", err)
+	}
+	var scenario Scenario
+	if err := yaml.Unmarshal(data, &scenario); err != nil {
+		return nil, fmt.Errorf("failed to decode scenario: %w", err)
+	}
+	for i, step := range scenario.Steps {
+		if (step.Device == "") == (step.Type == "") {
+			return nil, fmt.Errorf("scenario step %d needs exactly one of Device or Type", i+1)
+		}
+		if strings.ContainsAny(step.State, ".*# ") {
+			return nil, fmt.Errorf("scenario step %d has an invalid state %q", i+1, step.State)
+		}
+	}
+	return &scenario, nil
+}
+
+// simulatedDevice is a virtual device and the current levels of its metrics.
+type simulatedDevice struct {
+	mu     sync.Mutex
+	device Device
+	model  *SimulatedType
+	levels map[string]float64
+}
+
+// Simulator runs virtual devices that publish device events and telemetry like real ones, and apply
+// the commands sent to them.
+type Simulator struct {
+	publisher      Publisher
+	registry       DeviceRegistry // Devices are registered and their states recorded when set
+	scenario       *Scenario
+	seed           int64
+	commandDelay   time.Duration
+	confirmTimeout time.Duration
+	devices        []*simulatedDevice
+	byID           map[string]*simulatedDevice
+	stats          *LoadStats
+	skipTelemetry  bool
+}
+
+// NewSimulator creates Simulator.Devices virtual devices spread over the configured types by weight,
+// named <IDPrefix>-<type>-<n>. The scenario replaces the Markov models when it is not nil.
+func NewSimulator(config AppConfig, publisher Publisher, registry DeviceRegistry, scenario *Scenario) (*Simulator, error) {
+	simConfig := config.Simulator
+	types := append([]SimulatedType(nil), simConfig.Types...)
+	if len(types) == 0 {
+		types = DefaultSimulatedTypes()
+	}
+	count := simConfig.Devices
+	if count <= 0 {
+		count = 10
+	}
+	prefix := simConfig.IDPrefix
+	if prefix == "" {
+		prefix = "sim"
+	}
+
+	s := &Simulator{
+		publisher:      publisher,
+		registry:       registry,
+		scenario:       scenario,
+		seed:           simConfig.Seed,
+		commandDelay:   simConfig.CommandDelay,
+		confirmTimeout: config.RabbitMQ.ConfirmTimeout,
+		byID:           make(map[string]*simulatedDevice),
+		stats:          NewLoadStats(),
+		skipTelemetry:  simConfig.SkipTelemetry,
+	}
+	if s.confirmTimeout <= 0 {
+		s.confirmTimeout = 5 * time.Second
+	}
+	if s.seed == 0 {
+		s.seed = time.Now().UnixNano()
+	}
+
+	totalWeight := 0
+	for i := range types {
+		if err := types[i].Validate(); err != nil {
+			return nil, err
+		}
+		if types[i].Weight <= 0 {
+			types[i].Weight = 1
+		}
+		if types[i].Interval <= 0 {
+			types[i].Interval = 10 * time.Second
+		}
+		if types[i].Initial == "" {
+			types[i].Initial = types[i].states()[0]
+		}
+		totalWeight += types[i].Weight
+	}
+
+	// Hand out the devices in proportion to the weights, and the remainder one each to the first types
+	shares := make([]int, len(types))
+	assigned := 0
+	for i := range types {
+		shares[i] = count * types[i].Weight / totalWeight
+		assigned += shares[i]
+	}
+	for i := 0; assigned < count; i++ {
+		shares[i%len(types)]++
+		assigned++
+	}
+	for i := range types {
+		for n := 1; n <= shares[i]; n++ {
+			s.addDevice(fmt.Sprintf("%s-%s-%d", prefix, types[i].Type, n), &types[i])
+		}
+	}
+	return s, nil
+}
+
+func (s *Simulator) addDevice(id string, model *SimulatedType) {
+	device := &simulatedDevice{
+		device: Device{ID: id, Type: model.Type, State: model.Initial},
+		model:  model,
+		levels: make(map[string]float64),
+	}
+	for _, metric := range model.Metrics {
+		device.levels[metric.Metric] = (metric.Min + metric.Max) / 2
+		if level, ok := metric.States[model.Initial]; ok {
+			device.levels[metric.Metric] = level
+		}
+	}
+	s.devices = append(s.devices, device)
+	s.byID[id] = device
+}
+
+// Devices returns the simulated devices with their current states.
+func (s *Simulator) Devices() []Device {
+	devices := make([]Device, 0, len(s.devices))
+	for _, d := range s.devices {
+		d.mu.Lock()
+		devices = append(devices, d.device)
+		d.mu.Unlock()
+	}
+	return devices
+}
+
+// Stats returns the publish and delivery statistics of the run.
+func (s *Simulator) Stats() *LoadStats {
+	return s.stats
+}
+
+// Register registers the simulated devices that are not registered yet, when there is a registry.
+func (s *Simulator) Register(ctx context.Context) error {
+	if s.registry == nil {
+		return nil
+	}
+	for _, d := range s.devices {
+		existing, err := s.registry.GetDevice(d.device.ID)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			continue
+		}
+		if err := s.registry.InsertDevice(d.device); err != nil {
+			return err
+		}
+		msg := CreateRegistryEvent(d.device)
+		err = s.publisher.Send(ctx, "device_events", RegistryRoutingKey(RegistryCreated, d.device.Type, d.device.ID), msg)
+		if err != nil && !errors.Is(err, ErrUnroutable) {
+			log.Printf("Failed to publish registry event for device %s: %v", d.device.ID, err)
+		}
+	}
+	return nil
+}
+
+// Run steps the devices through their Markov models, or plays the scenario, until ctx is done.
+func (s *Simulator) Run(ctx context.Context) {
+	if s.scenario != nil {
+		s.playScenario(ctx)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i, d := range s.devices {
+		wg.Add(1)
+		go func(d *simulatedDevice, rng *rand.Rand) {
+			defer wg.Done()
+			s.runDevice(ctx, d, rng)
+		}(d, rand.New(rand.NewSource(s.seed+int64(i))))
+	}
+	wg.Wait()
+}
+
+// runDevice steps a device at exponentially distributed intervals, so the devices do not report in lockstep.
+func (s *Simulator) runDevice(ctx context.Context, d *simulatedDevice, rng *rand.Rand) {
+	for {
+		delay := time.Duration(rng.ExpFloat64() * float64(d.model.Interval))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		d.mu.Lock()
+		state := d.model.Next(d.device.State, rng.Float64())
+		d.mu.Unlock()
+		s.step(ctx, d, state, nil, rng)
+	}
+}
+
+// step moves a device to state, publishing a device event when it changed, and reports its metrics.
+// The metrics move on their own when readings is nil, otherwise only the metrics in readings are reported.
+func (s *Simulator) step(ctx context.Context, d *simulatedDevice, state string, readings map[string]float64, rng *rand.Rand) error {
+	d.mu.Lock()
+	changed := state != "" && state != d.device.State
+	if changed {
+		d.device.State = state
+	}
+	device := d.device
+	values := make(map[string]float64)
+	for _, metric := range d.model.Metrics {
+		if value, ok := readings[metric.Metric]; ok {
+			d.levels[metric.Metric] = value
+		} else if readings == nil && rng != nil {
+			d.levels[metric.Metric] = metric.next(d.levels[metric.Metric], device.State, rng.Float64())
+		} else {
+			continue
+		}
+		values[metric.Metric] = d.levels[metric.Metric]
+	}
+	d.mu.Unlock()
+
+	var errs []error
+	if changed {
+		errs = append(errs, s.publishState(ctx, device))
+	}
+	if !s.skipTelemetry {
+		for _, metric := range d.model.Metrics {
+			value, ok := values[metric.Metric]
+			if !ok {
+				continue
+			}
+			reading := Reading{DeviceID: device.ID, DeviceType: device.Type, Metric: metric.Metric, Value: value, Unit: metric.Unit, Timestamp: time.Now()}
+			errs = append(errs, s.publishReading(ctx, reading))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// next returns the reading after value, moving it by up to Step towards the level of state when there
+// is one, or at random otherwise.
+func (m SimulatedMetric) next(value float64, state string, roll float64) float64 {
+	change := (roll*2 - 1) * m.Step
+	if level, ok := m.States[state]; ok {
+		value = level + change
+	} else {
+		value += change
+	}
+	value = math.Max(m.Min, math.Min(m.Max, value))
+	return math.Round(value*100) / 100
+}
+
+// publishState records the state of a device when there is a registry and publishes its event.
+func (s *Simulator) publishState(ctx context.Context, device Device) error {
+	eventTime := time.Now()
+	msg := CreateDeviceEvent(device, eventTime)
+	msg.Headers[OriginHeader] = OriginSimulator
+	err := PublishDeviceState(ctx, s.registry, publisherFunc(s.send), device, msg, eventTime, 0)
+	if errors.Is(err, ErrStaleEvent) {
+		return nil
+	}
+	return err
+}
+
+func (s *Simulator) publishReading(ctx context.Context, reading Reading) error {
+	msg, err := CreateTelemetryMessage(reading)
+	if err != nil {
+		return err
+	}
+	return s.send(ctx, TelemetryExchange, TelemetryRoutingKey(reading.DeviceType, reading.DeviceID), msg)
+}
+
+// send publishes a message and records how long the broker took to confirm it.
+func (s *Simulator) send(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(ctx, s.confirmTimeout)
+	defer cancel()
+	start := time.Now()
+	err := s.publisher.Send(ctx, exchange, routingKey, msg)
+	s.stats.ObservePublish(time.Since(start), err)
+	return err
+}
+
+// playScenario runs the scenario steps in order, once or until ctx is done when it repeats.
+func (s *Simulator) playScenario(ctx context.Context) {
+	for {
+		for i, step := range s.scenario.Steps {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(step.After):
+			}
+			for _, d := range s.scenarioTargets(step) {
+				if err := s.step(ctx, d, step.State, step.Readings, nil); err != nil {
+					log.Printf("Failed to play scenario step %d for device %s: %v", i+1, d.device.ID, err)
+				}
+			}
+		}
+		if !s.scenario.Repeat || len(s.scenario.Steps) == 0 {
+			return
+		}
+	}
+}
+
+func (s *Simulator) scenarioTargets(step ScenarioStep) []*simulatedDevice {
+	if step.Device != "" {
+		if d, ok := s.byID[step.Device]; ok {
+			return []*simulatedDevice{d}
+		}
+		return nil
+	}
+	var targets []*simulatedDevice
+	for _, d := range s.devices {
+		if d.device.Type == step.Type {
+			targets = append(targets, d)
+		}
+	}
+	return targets
+}
+
+// HandleCommands applies the commands for simulated devices until messages is closed. Like a real device,
+// a simulated device reports its new state after CommandDelay, and ignores states its model does not
+// know. Commands are requeued when the state could not be published.
+func (s *Simulator) HandleCommands(ctx context.Context, messages <-chan amqp.Delivery) {
+	for msg := range messages {
+		if err := s.Apply(ctx, msg); err != nil {
+			log.Printf("Failed to apply command %s: %v", msg.MessageId, err)
+			time.Sleep(time.Second) // Do not spin while the broker is unreachable
+			if err := msg.Nack(false, true); err != nil {
+				log.Printf("Failed to requeue command: %v", err)
+			}
+			continue
+		}
+		if err := msg.Ack(false); err != nil {
+			log.Printf("Failed to acknowledge command: %v", err)
+		}
+	}
+}
+
+// Apply moves a simulated device to the state a command asks for and publishes its device event.
+// Commands for other devices and unknown states are skipped.
+func (s *Simulator) Apply(ctx context.Context, msg amqp.Delivery) error {
+	command, err := ParseCommand(msg)
+	if err != nil {
+		log.Printf("Skipping command %s: %v", msg.MessageId, err)
+		return nil
+	}
+	d, ok := s.byID[command.DeviceID]
+	if !ok {
+		return nil
+	}
+	if _, known := d.model.Transitions[command.State]; !known {
+		log.Printf("Skipping command %s: %s devices cannot be %s", msg.MessageId, d.model.Type, command.State)
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(s.commandDelay):
+	}
+	return s.step(ctx, d, command.State, map[string]float64{}, nil)
+}
+
+// MeasureDeliveries records the end-to-end latency of the simulated device events delivered from
+// messages, from the event time set when publishing until delivery, until messages is closed.
+func (s *Simulator) MeasureDeliveries(messages <-chan amqp.Delivery) {
+	for msg := range messages {
+		if origin, _ := msg.Headers[OriginHeader].(string); origin == OriginSimulator {
+			if sent := EventTime(msg); !sent.IsZero() {
+				s.stats.ObserveDelivery(time.Since(sent))
+			}
+		}
+	}
+}
+
+// LoadStats collects publish outcomes, confirm latencies and delivery latencies of a load run. Latencies
+// are kept in fixed-size reservoirs, so long runs use bounded memory.
+type LoadStats struct {
+	mu        sync.Mutex
+	start     time.Time
+	published int64
+	failed    int64
+	delivered int64
+	confirm   *latencyReservoir
+	endToEnd  *latencyReservoir
+}
+
+// Latencies are sampled into reservoirs of this size.
+const latencyReservoirSize = 10000
+
+// NewLoadStats starts collecting statistics.
+func NewLoadStats() *LoadStats {
+	return &LoadStats{
+		start:    time.Now(),
+		confirm:  newLatencyReservoir(latencyReservoirSize),
+		endToEnd: newLatencyReservoir(latencyReservoirSize),
+	}
+}
+
+// ObservePublish records a publish and the time until the broker confirmed it.
+func (l *LoadStats) ObservePublish(latency time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		l.failed++
+		return
+	}
+	l.published++
+	l.confirm.add(latency)
+}
+
+// ObserveDelivery records the time from publishing an event until a consumer received it.
+func (l *LoadStats) ObserveDelivery(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.delivered++
+	l.endToEnd.add(latency)
+}
+
+// LatencyPercentiles summarizes the latencies of a reservoir.
+type LatencyPercentiles struct {
+	P50, P95, P99, Max time.Duration
+}
+
+func (p LatencyPercentiles) String() string {
+	return fmt.Sprintf("p50=%s p95=%s p99=%s max=%s", p.P50, p.P95, p.P99, p.Max)
+}
+
+// LoadReport is a snapshot of the statistics of a load run.
+type LoadReport struct {
+	Elapsed    time.Duration
+	Published  int64
+	Failed     int64
+	Delivered  int64
+	Throughput float64 // Confirmed publishes per second
+	Confirm    LatencyPercentiles
+	EndToEnd   LatencyPercentiles
+}
+
+func (r LoadReport) String() string {
+	return fmt.Sprintf("%s: published=%d failed=%d throughput=%.1f/s confirm %s, delivered=%d end-to-end %s",
+		r.Elapsed.Round(time.Second), r.Published, r.Failed, r.Throughput, r.Confirm, r.Delivered, r.EndToEnd)
+}
+
+// Report returns the statistics collected so far.
+func (l *LoadStats) Report() LoadReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	elapsed := time.Since(l.start)
+	report := LoadReport{
+		Elapsed:   elapsed,
+		Published: l.published,
+		Failed:    l.failed,
+		Delivered: l.delivered,
+		Confirm:   l.confirm.percentiles(),
+		EndToEnd:  l.endToEnd.percentiles(),
+	}
+	if elapsed > 0 {
+		report.Throughput = float64(l.published) / elapsed.Seconds()
+	}
+	return report
+}
+
+// latencyReservoir keeps a uniform sample of the latencies added to it.
+type latencyReservoir struct {
+	samples []time.Duration
+	size    int
+	seen    int64
+	max     time.Duration
+	rng     *rand.Rand
+}
+
+func newLatencyReservoir(size int) *latencyReservoir {
+	return &latencyReservoir{size: size, rng: rand.New(rand.NewSource(1))}
+}
+
+func (r *latencyReservoir) add(latency time.Duration) {
+	r.seen++
+	if latency > r.max {
+		r.max = latency
+	}
+	if len(r.samples) < r.size {
+		r.samples = append(r.samples, latency)
+		return
+	}
+	if i := r.rng.Int63n(r.seen); i < int64(r.size) {
+		r.samples[i] = latency
+	}
+}
+
+func (r *latencyReservoir) percentiles() LatencyPercentiles {
+	if len(r.samples) == 0 {
+		return LatencyPercentiles{}
+	}
+	sorted := append([]time.Duration(nil), r.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) time.Duration {
+		return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+	}
+	return LatencyPercentiles{P50: at(0.50), P95: at(0.95), P99: at(0.99), Max: r.max}
+}
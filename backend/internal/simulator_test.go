@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingPublisher records published messages from concurrent publishers.
+type recordingPublisher struct {
+	mu        sync.Mutex
+	published []publishedMessage
+}
+
+func (p *recordingPublisher) Send(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published = append(p.published, publishedMessage{routingKey, msg})
+	return nil
+}
+
+func (p *recordingPublisher) messages() []publishedMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]publishedMessage(nil), p.published...)
+}
+
+// lampType is a simulated type that steps quickly, for tests.
+func lampType() SimulatedType {
+	return SimulatedType{
+		Type: "lamp", Interval: time.Millisecond, Initial: "off",
+		Transitions: map[string]map[string]float64{"off": {"on": 1}, "on": {"off": 1}},
+		Metrics:     []SimulatedMetric{{Metric: "power", Unit: "W", Min: 0, Max: 10, Step: 1, States: map[string]float64{"off": 0, "on": 8}}},
+	}
+}
+
+func TestSimulatedTypeNext(t *testing.T) {
+	model := SimulatedType{
+		Type:        "fan",
+		Transitions: map[string]map[string]float64{"off": {"low": 0.2, "high": 0.1}, "low": {}, "high": {}},
+	}
+	require.NoError(t, model.Validate())
+	assert.Equal(t, "high", model.Next("off", 0.05), "targets are taken in sorted order")
+	assert.Equal(t, "low", model.Next("off", 0.15))
+	assert.Equal(t, "off", model.Next("off", 0.5), "the remaining chance keeps the state")
+	assert.Equal(t, "low", model.Next("low", 0))
+
+	model.Transitions["off"]["low"] = 0.95
+	assert.Error(t, model.Validate(), "chances above 1 should be rejected")
+	model.Transitions["off"] = map[string]float64{"broken": 0.1}
+	assert.Error(t, model.Validate(), "unknown target states should be rejected")
+	for _, model := range DefaultSimulatedTypes() {
+		assert.NoError(t, model.Validate(), model.Type)
+	}
+}
+
+func TestNewSimulatorSpreadsDevices(t *testing.T) {
+	var config AppConfig
+	config.Simulator.Devices = 10
+	config.Simulator.IDPrefix = "load"
+	simulator, err := NewSimulator(config, &recordingPublisher{}, nil, nil)
+	require.NoError(t, err)
+
+	counts := make(map[string]int)
+	for _, device := range simulator.Devices() {
+		counts[device.Type]++
+		assert.True(t, strings.HasPrefix(device.ID, "load-"+device.Type+"-"), device.ID)
+	}
+	assert.Equal(t, 6, counts["light"], "lights have weight 3 of 6 and take the remainder")
+	assert.Equal(t, 1, counts["thermostat"])
+	assert.Equal(t, 3, counts["motion_sensor"])
+
+	config.Simulator.Types = []SimulatedType{{Type: "lamp", Transitions: map[string]map[string]float64{"off": {"dim": 2}, "dim": {}}}}
+	_, err = NewSimulator(config, &recordingPublisher{}, nil, nil)
+	assert.Error(t, err, "invalid types should be rejected")
+}
+
+func TestSimulatorRun(t *testing.T) {
+	var config AppConfig
+	config.Simulator.Devices = 2
+	config.Simulator.Seed = 42
+	config.Simulator.Types = []SimulatedType{lampType()}
+	publisher := &recordingPublisher{}
+	simulator, err := NewSimulator(config, publisher, nil, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	simulator.Run(ctx)
+
+	var events, readings int
+	for _, published := range publisher.messages() {
+		switch {
+		case strings.HasPrefix(published.routingKey, "device.lamp."):
+			events++
+			assert.Equal(t, OriginSimulator, published.msg.Headers[OriginHeader])
+			assert.False(t, EventTime(amqp.Delivery{Headers: published.msg.Headers}).IsZero(), "events should carry their event time")
+		case strings.HasPrefix(published.routingKey, "telemetry.lamp."):
+			readings++
+		}
+	}
+	assert.Greater(t, events, 2, "the lamps should toggle at every step")
+	assert.GreaterOrEqual(t, readings, events, "every step should report the power draw")
+
+	report := simulator.Stats().Report()
+	assert.Equal(t, int64(len(publisher.messages())), report.Published)
+	assert.Zero(t, report.Failed)
+	assert.Greater(t, report.Throughput, 0.0)
+}
+
+func TestSimulatorApplyCommand(t *testing.T) {
+	var config AppConfig
+	config.Simulator.Devices = 1
+	config.Simulator.Types = []SimulatedType{lampType()}
+	publisher := &recordingPublisher{}
+	registry := &memoryRegistry{devices: make(map[string]Device)}
+	simulator, err := NewSimulator(config, publisher, registry, nil)
+	require.NoError(t, err)
+	require.NoError(t, simulator.Register(context.Background()))
+	require.NoError(t, simulator.Register(context.Background()), "registering again should skip known devices")
+
+	command := func(deviceID, state string) amqp.Delivery {
+		msg := CreateCommandMessage(Command{DeviceID: deviceID, DeviceType: "lamp", State: state})
+		return amqp.Delivery{RoutingKey: CommandRoutingKey("lamp", deviceID), Body: msg.Body, MessageId: msg.MessageId}
+	}
+	require.NoError(t, simulator.Apply(context.Background(), command("sim-lamp-1", "on")))
+	require.NoError(t, simulator.Apply(context.Background(), command("sim-lamp-1", "dimmed")), "unknown states should be skipped")
+	require.NoError(t, simulator.Apply(context.Background(), command("tv1", "on")), "other devices should be skipped")
+
+	var routingKeys []string
+	for _, published := range publisher.messages() {
+		routingKeys = append(routingKeys, published.routingKey)
+	}
+	assert.Equal(t, []string{RegistryRoutingKey(RegistryCreated, "lamp", "sim-lamp-1"), "device.lamp.on"}, routingKeys,
+		"a command should only report the new state")
+	assert.Equal(t, "on", simulator.Devices()[0].State)
+	device, err := registry.GetDevice("sim-lamp-1")
+	require.NoError(t, err)
+	assert.Equal(t, "on", device.State, "the state change should be recorded")
+}
+
+func TestSimulatorScenario(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scenario.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+Steps:
+  - Type: lamp
+    State: "on"
+  - After: 5ms
+    Device: sim-lamp-2
+    Readings:
+      power: 3.5
+`), 0o600))
+	scenario, err := LoadScenario(path)
+	require.NoError(t, err)
+
+	var config AppConfig
+	config.Simulator.Devices = 2
+	config.Simulator.Types = []SimulatedType{lampType()}
+	publisher := &recordingPublisher{}
+	simulator, err := NewSimulator(config, publisher, nil, scenario)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	simulator.Run(ctx)
+	require.NoError(t, ctx.Err(), "a scenario without Repeat should end after its last step")
+
+	var routingKeys []string
+	for _, published := range publisher.messages() {
+		routingKeys = append(routingKeys, published.routingKey)
+	}
+	assert.Equal(t, []string{"device.lamp.on", "device.lamp.on", TelemetryRoutingKey("lamp", "sim-lamp-2")}, routingKeys)
+	reading, err := ParseTelemetry(amqp.Delivery{Body: publisher.messages()[2].msg.Body})
+	require.NoError(t, err)
+	assert.Equal(t, 3.5, reading.Value)
+
+	require.NoError(t, os.WriteFile(path, []byte("Steps:\n  - State: \"on\"\n"), 0o600))
+	_, err = LoadScenario(path)
+	assert.Error(t, err, "steps need a device or type")
+}
+
+func TestLoadStats(t *testing.T) {
+	stats := NewLoadStats()
+	for i := 1; i <= 100; i++ {
+		stats.ObservePublish(time.Duration(i)*time.Millisecond, nil)
+	}
+	stats.ObservePublish(time.Second, assert.AnError)
+	stats.ObserveDelivery(20 * time.Millisecond)
+
+	report := stats.Report()
+	assert.Equal(t, int64(100), report.Published)
+	assert.Equal(t, int64(1), report.Failed, "failed publishes should not count towards the latencies")
+	assert.Equal(t, int64(1), report.Delivered)
+	assert.Equal(t, LatencyPercentiles{P50: 50 * time.Millisecond, P95: 95 * time.Millisecond, P99: 99 * time.Millisecond, Max: 100 * time.Millisecond}, report.Confirm)
+	assert.Equal(t, 20*time.Millisecond, report.EndToEnd.P99)
+	assert.Contains(t, report.String(), "published=100 failed=1")
+
+	reservoir := newLatencyReservoir(10)
+	for i := 1; i <= 1000; i++ {
+		reservoir.add(time.Duration(i))
+	}
+	assert.Len(t, reservoir.samples, 10, "the reservoir should keep a bounded sample")
+	assert.Equal(t, time.Duration(1000), reservoir.percentiles().Max, "the maximum should be exact")
+}
@@ -0,0 +1,379 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// StreamOffsetHeader carries the offset of a message delivered from a stream.
+const StreamOffsetHeader = "x-stream-offset"
+
+// DefaultHistoryStream is the stream device_events are mirrored into when History.Stream is empty.
+const DefaultHistoryStream = "device_events_stream"
+
+// StreamOffset selects where consuming a stream starts. The zero value resumes after the consumer's
+// stored offset, or starts at the first message when it has none.
+type StreamOffset struct {
+	spec      string // "first", "last", "next", "offset" or "timestamp"
+	offset    int64
+	timestamp time.Time
+}
+
+// Starting points of a stream consumer.
+var (
+	StreamFirst  = StreamOffset{spec: "first"} // The oldest message kept
+	StreamLast   = StreamOffset{spec: "last"}  // The last chunk of messages written
+	StreamNext   = StreamOffset{spec: "next"}  // Only messages written after subscribing
+	StreamStored = StreamOffset{}              // After the stored offset, or first
+)
+
+// StreamAt starts at the message with the given offset.
+func StreamAt(offset int64) StreamOffset {
+	return StreamOffset{spec: "offset", offset: offset}
+}
+
+// StreamSince starts at the first chunk of messages written at or after t.
+func StreamSince(t time.Time) StreamOffset {
+	return StreamOffset{spec: "timestamp", timestamp: t}
+}
+
+// ParseStreamOffset parses "first", "last", "next", "stored", an offset, an RFC 3339 time, or a
+// duration like "24h" for that long ago.
+func ParseStreamOffset(value string) (StreamOffset, error) {
+	switch value {
+	case "first", "last", "next":
+		return StreamOffset{spec: value}, nil
+	case "", "stored":
+		return StreamStored, nil
+	}
+	if offset, err := strconv.ParseInt(value, 10, 64); err == nil && offset >= 0 {
+		return StreamAt(offset), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return StreamSince(t), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return StreamSince(time.Now().Add(-d)), nil
+	}
+	return StreamOffset{}, fmt.Errorf("invalid stream offset %q, expected first, last, next, stored, an offset, a time or a duration", value)
+}
+
+func (o StreamOffset) String() string {
+	switch o.spec {
+	case "":
+		return "stored"
+	case "offset":
+		return strconv.FormatInt(o.offset, 10)
+	case "timestamp":
+		return o.timestamp.Format(time.RFC3339)
+	}
+	return o.spec
+}
+
+// argument returns the value of the x-stream-offset consumer argument.
+func (o StreamOffset) argument() any {
+	switch o.spec {
+	case "", "first":
+		return "first"
+	case "offset":
+		return o.offset
+	case "timestamp":
+		return o.timestamp
+	}
+	return o.spec
+}
+
+// DeliveryStreamOffset returns the stream offset of a delivery, and false when it did not come from a stream.
+func DeliveryStreamOffset(msg amqp.Delivery) (int64, bool) {
+	switch offset := msg.Headers[StreamOffsetHeader].(type) {
+	case int64:
+		return offset, true
+	case int32:
+		return int64(offset), true
+	case int:
+		return int64(offset), true
+	}
+	return 0, false
+}
+
+// StreamOptions limit how much history a stream keeps. Zero values keep the broker defaults.
+type StreamOptions struct {
+	MaxAge           string // e.g. "7D", "12h"
+	MaxLengthBytes   int64
+	SegmentSizeBytes int64
+}
+
+// CreateStream declares a durable stream queue, which keeps its messages after they are consumed so
+// consumers can read them again from any offset.
+func (rc RabbitClient) CreateStream(name string, options StreamOptions) (amqp.Queue, error) {
+	args := amqp.Table{"x-queue-type": "stream"}
+	if options.MaxAge != "" {
+		args["x-max-age"] = options.MaxAge
+	}
+	if options.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = options.MaxLengthBytes
+	}
+	if options.SegmentSizeBytes > 0 {
+		args["x-stream-max-segment-size-bytes"] = options.SegmentSizeBytes
+	}
+	q, err := rc.Ch.QueueDeclare(
+		name,
+		true,  // Durable, required for streams
+		false, // AutoDelete
+		false, // Exclusive
+		false, // NoWait
+		args,
+	)
+	if err != nil {
+		return amqp.Queue{}, fmt.Errorf("error creating stream %s: %w", name, err)
+	}
+	return q, nil
+}
+
+// ConsumeStream consumes a stream from offset. Streams require acknowledgements and a prefetch count,
+// so the channel's QoS is set to prefetch; acknowledging a message lets the broker send the next ones.
+func (rc RabbitClient) ConsumeStream(stream, consumer string, offset StreamOffset, prefetch int) (<-chan amqp.Delivery, error) {
+	if prefetch <= 0 {
+		prefetch = 100
+	}
+	if err := rc.ApplyQos(prefetch, false); err != nil {
+		return nil, err
+	}
+	messages, err := rc.Ch.Consume(
+		stream,
+		consumer,
+		false, // AutoAck, not supported by streams
+		false, // Exclusive
+		false, // NoLocal
+		false, // NoWait
+		amqp.Table{"x-stream-offset": offset.argument()},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error consuming stream %s from %s: %w", stream, offset, err)
+	}
+	return messages, nil
+}
+
+// OffsetStore keeps the last stream offset each consumer processed, so it can resume after restarts.
+type OffsetStore interface {
+	// LoadOffset returns the stored offset of a consumer, and false when it has none.
+	LoadOffset(stream, consumer string) (int64, bool, error)
+	StoreOffset(stream, consumer string, offset int64) error
+}
+
+// MemoryOffsetStore keeps offsets in memory, for consumers that start over after a restart.
+type MemoryOffsetStore struct {
+	mu      sync.Mutex
+	offsets map[string]int64
+}
+
+// NewMemoryOffsetStore creates an empty MemoryOffsetStore.
+func NewMemoryOffsetStore() *MemoryOffsetStore {
+	return &MemoryOffsetStore{offsets: make(map[string]int64)}
+}
+
+// LoadOffset returns the offset stored for the consumer.
+func (s *MemoryOffsetStore) LoadOffset(stream, consumer string) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offset, ok := s.offsets[stream+"/"+consumer]
+	return offset, ok, nil
+}
+
+// StoreOffset stores the offset of the consumer.
+func (s *MemoryOffsetStore) StoreOffset(stream, consumer string, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offsets[stream+"/"+consumer] = offset
+	return nil
+}
+
+// PostgresOffsetStore keeps offsets in PostgreSQL, per stream and consumer.
+type PostgresOffsetStore struct {
+	db *PostgreSQLClient
+}
+
+// NewPostgresOffsetStore creates a PostgresOffsetStore.
+func NewPostgresOffsetStore(db *PostgreSQLClient) *PostgresOffsetStore {
+	return &PostgresOffsetStore{db: db}
+}
+
+// LoadOffset returns the offset stored for the consumer.
+func (s *PostgresOffsetStore) LoadOffset(stream, consumer string) (int64, bool, error) {
+	var offset int64
+	query := `SELECT "offset" FROM stream_offsets WHERE stream = $1 AND consumer = $2`
+	err := s.db.DB.QueryRow(query, stream, consumer).Scan(&offset)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to load stream offset: %w", err)
+	}
+	return offset, true, nil
+}
+
+// StoreOffset stores the offset of the consumer.
+func (s *PostgresOffsetStore) StoreOffset(stream, consumer string, offset int64) error {
+	query := `INSERT INTO stream_offsets (stream, consumer, "offset", updated_at) VALUES ($1, $2, $3, NOW())
+              ON CONFLICT (stream, consumer) DO UPDATE SET "offset" = EXCLUDED."offset", updated_at = EXCLUDED.updated_at`
+	if _, err := s.db.DB.Exec(query, stream, consumer, offset); err != nil {
+		return fmt.Errorf("failed to store stream offset: %w", err)
+	}
+	return nil
+}
+
+// streamSource consumes streams; RabbitClient is one.
+type streamSource interface {
+	ConsumeStream(stream, consumer string, offset StreamOffset, prefetch int) (<-chan amqp.Delivery, error)
+}
+
+// StreamConsumer reads the history stream as a named consumer, tracking the offset it processed.
+type StreamConsumer struct {
+	source         streamSource
+	offsets        OffsetStore
+	stream         string
+	name           string
+	prefetch       int
+	commitInterval time.Duration
+}
+
+// NewStreamConsumer creates a consumer of the History.Stream named name. Use a RabbitClient of its own,
+// as consuming sets the channel's QoS.
+func NewStreamConsumer(config AppConfig, client RabbitClient, name string, offsets OffsetStore) *StreamConsumer {
+	return newStreamConsumer(config, client, name, offsets)
+}
+
+func newStreamConsumer(config AppConfig, source streamSource, name string, offsets OffsetStore) *StreamConsumer {
+	c := &StreamConsumer{
+		source:         source,
+		offsets:        offsets,
+		stream:         config.History.Stream,
+		name:           name,
+		prefetch:       config.History.Prefetch,
+		commitInterval: config.History.CommitInterval,
+	}
+	if c.stream == "" {
+		c.stream = DefaultHistoryStream
+	}
+	if c.commitInterval <= 0 {
+		c.commitInterval = 5 * time.Second
+	}
+	return c
+}
+
+// Consume passes the messages of the stream to handle, starting at start, until ctx is done or handle
+// fails. The offset of the last handled message is stored every CommitInterval and when Consume returns,
+// so the consumer resumes after it with StreamStored; a message whose handling failed is read again.
+func (c *StreamConsumer) Consume(ctx context.Context, start StreamOffset, handle func(amqp.Delivery) error) error {
+	if start == StreamStored {
+		offset, ok, err := c.offsets.LoadOffset(c.stream, c.name)
+		if err != nil {
+			return err
+		}
+		if ok {
+			start = StreamAt(offset + 1)
+		}
+	}
+	messages, err := c.source.ConsumeStream(c.stream, c.name, start, c.prefetch)
+	if err != nil {
+		return err
+	}
+	log.Printf("Consumer %s reading stream %s from %s", c.name, c.stream, start)
+
+	var last int64
+	pending := false
+	commit := func() error {
+		if !pending {
+			return nil
+		}
+		if err := c.offsets.StoreOffset(c.stream, c.name, last); err != nil {
+			return err
+		}
+		pending = false
+		return nil
+	}
+
+	ticker := time.NewTicker(c.commitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return commit()
+		case <-ticker.C:
+			if err := commit(); err != nil {
+				log.Printf("Failed to store offset of consumer %s: %v", c.name, err)
+			}
+		case msg, ok := <-messages:
+			if !ok {
+				if err := commit(); err != nil {
+					log.Printf("Failed to store offset of consumer %s: %v", c.name, err)
+				}
+				return fmt.Errorf("error consuming stream %s: channel closed", c.stream)
+			}
+			if err := handle(msg); err != nil {
+				if commitErr := commit(); commitErr != nil {
+					log.Printf("Failed to store offset of consumer %s: %v", c.name, commitErr)
+				}
+				return err
+			}
+			if err := msg.Ack(false); err != nil {
+				log.Printf("Failed to acknowledge stream message: %v", err)
+			}
+			if offset, ok := DeliveryStreamOffset(msg); ok {
+				last, pending = offset, true
+			}
+		}
+	}
+}
+
+// historyBindings returns the routing key patterns mirrored into the history stream.
+func historyBindings(config AppConfig) []string {
+	if len(config.History.Bindings) == 0 {
+		return []string{"#"}
+	}
+	return config.History.Bindings
+}
+
+// MirrorToHistory declares the history stream and binds it to device_events, so the stream receives
+// every matching device event alongside the queues.
+func MirrorToHistory(config AppConfig, client RabbitClient) (amqp.Queue, error) {
+	stream := config.History.Stream
+	if stream == "" {
+		stream = DefaultHistoryStream
+	}
+	q, err := client.CreateStream(stream, StreamOptions{
+		MaxAge:           config.History.MaxAge,
+		MaxLengthBytes:   config.History.MaxLengthBytes,
+		SegmentSizeBytes: config.History.SegmentSizeBytes,
+	})
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	for _, binding := range historyBindings(config) {
+		if err := client.CreateBinding(q.Name, binding, "device_events"); err != nil {
+			return amqp.Queue{}, err
+		}
+	}
+	return q, nil
+}
+
+// validateMaxAge checks an x-max-age value: a number followed by Y, M, D, h, m or s.
+func validateMaxAge(value string) error {
+	if value == "" {
+		return nil
+	}
+	number := strings.TrimRight(value, "YMDhms")
+	unit := value[len(number):]
+	if _, err := strconv.Atoi(number); err != nil || len(unit) != 1 {
+		return fmt.Errorf("invalid max age %q, expected a number followed by Y, M, D, h, m or s", value)
+	}
+	return nil
+}
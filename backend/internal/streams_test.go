@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStream delivers the messages from the requested offset and records acknowledgements.
+type fakeStream struct {
+	mu       sync.Mutex
+	messages []string
+	started  []StreamOffset
+	acked    []uint64
+}
+
+func (s *fakeStream) ConsumeStream(stream, consumer string, offset StreamOffset, prefetch int) (<-chan amqp.Delivery, error) {
+	s.started = append(s.started, offset)
+	first := 0
+	if offset.spec == "offset" {
+		first = int(offset.offset)
+	}
+	deliveries := make(chan amqp.Delivery, len(s.messages))
+	for i := first; i < len(s.messages); i++ {
+		deliveries <- amqp.Delivery{
+			Acknowledger: s,
+			DeliveryTag:  uint64(i + 1),
+			Headers:      amqp.Table{StreamOffsetHeader: int64(i)},
+			Body:         []byte(s.messages[i]),
+		}
+	}
+	return deliveries, nil
+}
+
+func (s *fakeStream) Ack(tag uint64, multiple bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acked = append(s.acked, tag)
+	return nil
+}
+
+func (s *fakeStream) Nack(tag uint64, multiple, requeue bool) error { return nil }
+
+func (s *fakeStream) Reject(tag uint64, requeue bool) error { return nil }
+
+func TestParseStreamOffset(t *testing.T) {
+	for value, expected := range map[string]StreamOffset{
+		"first":  StreamFirst,
+		"last":   StreamLast,
+		"next":   StreamNext,
+		"stored": StreamStored,
+		"":       StreamStored,
+		"42":     StreamAt(42),
+	} {
+		offset, err := ParseStreamOffset(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, expected, offset, value)
+	}
+
+	offset, err := ParseStreamOffset("2024-05-01T19:00:00Z")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 5, 1, 19, 0, 0, 0, time.UTC), offset.argument())
+
+	offset, err = ParseStreamOffset("48h")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(-48*time.Hour), offset.argument().(time.Time), time.Minute)
+
+	assert.Equal(t, "first", StreamStored.argument(), "new consumers should read the whole history")
+	assert.Equal(t, int64(42), StreamAt(42).argument())
+	for _, value := range []string{"-1", "yesterday", "-5m"} {
+		_, err := ParseStreamOffset(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestStreamConsumerResumesAfterStoredOffset(t *testing.T) {
+	stream := &fakeStream{messages: []string{"a", "b", "c", "d"}}
+	offsets := NewMemoryOffsetStore()
+	consumer := newStreamConsumer(AppConfig{}, stream, "analytics", offsets)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var read []string
+	err := consumer.Consume(ctx, StreamStored, func(msg amqp.Delivery) error {
+		read = append(read, string(msg.Body))
+		if len(read) == 2 {
+			cancel()
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, StreamFirst.argument(), stream.started[0].argument(), "a new consumer should start at the first message")
+	require.GreaterOrEqual(t, len(read), 2)
+	stored, ok, err := offsets.LoadOffset(DefaultHistoryStream, "analytics")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, int64(len(read)-1), stored, "the offset of the last handled message should be stored")
+	assert.Len(t, stream.acked, len(read))
+
+	// Restarting resumes after the stored offset, and an explicit offset ignores it
+	failure := errors.New("handler failed")
+	read = nil
+	err = consumer.Consume(context.Background(), StreamStored, func(msg amqp.Delivery) error {
+		if string(msg.Body) == "d" {
+			return failure
+		}
+		read = append(read, string(msg.Body))
+		return nil
+	})
+	assert.ErrorIs(t, err, failure)
+	assert.Equal(t, StreamAt(stored+1), stream.started[1])
+	stored, _, err = offsets.LoadOffset(DefaultHistoryStream, "analytics")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stored, "a failed message should be read again")
+
+	_, ok, err = offsets.LoadOffset(DefaultHistoryStream, "rebuild")
+	require.NoError(t, err)
+	assert.False(t, ok, "consumers should track their offsets separately")
+}
+
+func TestPostgresOffsetStore(t *testing.T) {
+	stream := "test-" + NewMessageID()
+	store := NewPostgresOffsetStore(testDB)
+
+	_, ok, err := store.LoadOffset(stream, "analytics")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, store.StoreOffset(stream, "analytics", 10))
+	require.NoError(t, store.StoreOffset(stream, "analytics", 25))
+	require.NoError(t, store.StoreOffset(stream, "rebuild", 3))
+
+	offset, ok, err := store.LoadOffset(stream, "analytics")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(25), offset)
+	offset, _, err = store.LoadOffset(stream, "rebuild")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), offset)
+}
+
+func TestConsumeStreamFromOffset(t *testing.T) {
+	config, err := LoadAppConfig()
+	require.NoError(t, err, "should load config without error")
+	conn, err := ConnectRabbitMQ(config.RabbitMQ.User, config.RabbitMQ.Password, config.RabbitMQ.Host, config.RabbitMQ.VHost)
+	require.NoError(t, err, "should connect without error")
+	defer conn.Close()
+	client, err := NewRabbitMQClient(conn)
+	require.NoError(t, err, "should create RabbitMQ client without error")
+	defer client.Close()
+
+	stream, err := client.CreateStream("test_stream_"+NewMessageID(), StreamOptions{MaxAge: "1h"})
+	require.NoError(t, err, "should create stream without error")
+	defer client.Ch.QueueDelete(stream.Name, false, false, false)
+	for _, body := range []string{"first", "second", "third"} {
+		require.NoError(t, client.Send(context.Background(), "", stream.Name, amqp.Publishing{Body: []byte(body)}))
+	}
+
+	messages, err := client.ConsumeStream(stream.Name, "test", StreamAt(1), 10)
+	require.NoError(t, err, "should consume stream without error")
+	for _, expected := range []string{"second", "third"} {
+		select {
+		case msg := <-messages:
+			assert.Equal(t, expected, string(msg.Body))
+			offset, ok := DeliveryStreamOffset(msg)
+			assert.True(t, ok, "stream deliveries should carry their offset")
+			assert.GreaterOrEqual(t, offset, int64(1))
+			require.NoError(t, msg.Ack(false))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", expected)
+		}
+	}
+}
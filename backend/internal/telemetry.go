@@ -0,0 +1,361 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// TelemetryExchange carries telemetry next to the device state events.
+const TelemetryExchange = "device_events"
+
+// Reading is a numeric measurement reported by a device.
+type Reading struct {
+	DeviceID   string    `json:"device_id"`
+	DeviceType string    `json:"device_type"`
+	Metric     string    `json:"metric"` // e.g. "temperature", "humidity", "power", "open"
+	Value      float64   `json:"value"`
+	Unit       string    `json:"unit,omitempty"` // e.g. "C", "%", "W"
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// MaxReadingAge is how old a reading may be when it is reported. Older readings, and readings more than
+// MaxEventTimeSkew ahead of the clock, are rejected, so a reading cannot create a daily partition far
+// outside the stored range.
+const MaxReadingAge = 31 * 24 * time.Hour
+
+// Validate reports an error when the reading cannot be stored.
+func (r Reading) Validate() error {
+	now := time.Now()
+	switch {
+	case r.DeviceID == "" || r.DeviceType == "":
+		return errors.New("device_id and device_type are required")
+	case r.Metric == "":
+		return errors.New("metric is required")
+	case math.IsNaN(r.Value) || math.IsInf(r.Value, 0):
+		return errors.New("value must be a finite number")
+	case strings.ContainsAny(r.DeviceID+r.DeviceType, ".*#"):
+		return errors.New("device_id and device_type must not contain '.', '*' or '#'")
+	case r.Timestamp.Before(now.Add(-MaxReadingAge)) || r.Timestamp.After(now.Add(MaxEventTimeSkew)):
+		return errors.New("timestamp must not be in the future or more than 31 days ago")
+	}
+	return nil
+}
+
+// TelemetryRoutingKey returns the routing key readings of a device are published with.
+func TelemetryRoutingKey(deviceType, deviceID string) string {
+	return fmt.Sprintf("telemetry.%s.%s", deviceType, deviceID)
+}
+
+// CreateTelemetryMessage encodes a reading as a JSON message.
+func CreateTelemetryMessage(reading Reading) (amqp.Publishing, error) {
+	body, err := json.Marshal(reading)
+	if err != nil {
+		return amqp.Publishing{}, fmt.Errorf("error encoding reading: %w", err)
+	}
+	return amqp.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+		MessageId:   NewMessageID(),
+		Timestamp:   reading.Timestamp,
+	}, nil
+}
+
+// ParseTelemetry decodes a telemetry message, taking the device type and ID from the routing key
+// when the body does not carry them.
+func ParseTelemetry(msg amqp.Delivery) (Reading, error) {
+	var reading Reading
+	if err := json.Unmarshal(msg.Body, &reading); err != nil {
+		return Reading{}, fmt.Errorf("error decoding reading: %w", err)
+	}
+	parts := strings.Split(msg.RoutingKey, ".")
+	if len(parts) == 3 && parts[0] == "telemetry" {
+		if reading.DeviceType == "" {
+			reading.DeviceType = parts[1]
+		}
+		if reading.DeviceID == "" {
+			reading.DeviceID = parts[2]
+		}
+	}
+	if reading.Timestamp.IsZero() {
+		reading.Timestamp = msg.Timestamp
+	}
+	return reading, reading.Validate()
+}
+
+// TelemetryStore stores batches of readings.
+type TelemetryStore interface {
+	InsertReadings(readings []Reading) error
+}
+
+// TelemetryBatcher consumes telemetry messages and inserts them in batches of up to size readings,
+// or whatever arrived within interval. Messages are acknowledged once their batch is stored and
+// requeued when storing it fails.
+type TelemetryBatcher struct {
+	store    TelemetryStore
+	size     int
+	interval time.Duration
+
+	readings []Reading
+	lastTag  uint64
+	acker    amqp.Acknowledger
+}
+
+// NewTelemetryBatcher creates a TelemetryBatcher, defaulting to batches of 500 readings every second.
+func NewTelemetryBatcher(store TelemetryStore, size int, interval time.Duration) *TelemetryBatcher {
+	if size <= 0 {
+		size = 500
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &TelemetryBatcher{store: store, size: size, interval: interval}
+}
+
+// Run batches the messages until the channel is closed, then flushes what is left.
+func (b *TelemetryBatcher) Run(messages <-chan amqp.Delivery) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				b.Flush()
+				return
+			}
+			b.add(msg)
+			if len(b.readings) >= b.size {
+				b.Flush()
+			}
+		case <-ticker.C:
+			b.Flush()
+		}
+	}
+}
+
+func (b *TelemetryBatcher) add(msg amqp.Delivery) {
+	reading, err := ParseTelemetry(msg)
+	if err != nil {
+		log.Printf("Discarding invalid telemetry %s: %v", msg.RoutingKey, err)
+		if msg.Acknowledger != nil {
+			msg.Reject(false)
+		}
+		return
+	}
+	b.readings = append(b.readings, reading)
+	b.lastTag = msg.DeliveryTag
+	b.acker = msg.Acknowledger
+}
+
+// Flush stores the pending readings and acknowledges their messages.
+func (b *TelemetryBatcher) Flush() {
+	if len(b.readings) == 0 {
+		return
+	}
+	err := b.store.InsertReadings(b.readings)
+	if err != nil {
+		log.Printf("Failed to store %d readings: %v", len(b.readings), err)
+	} else {
+		telemetryReadingsTotal.Add(float64(len(b.readings)))
+	}
+
+	if b.acker != nil {
+		if err != nil {
+			err = b.acker.Nack(b.lastTag, true, true)
+		} else {
+			err = b.acker.Ack(b.lastTag, true)
+		}
+		if err != nil {
+			log.Printf("Failed to acknowledge readings: %v", err)
+		}
+	}
+	b.readings = b.readings[:0]
+	b.acker = nil
+}
+
+// telemetryPartition returns the name of the daily partition holding readings of day.
+func telemetryPartition(day time.Time) string {
+	return "telemetry_p" + day.UTC().Format("20060102")
+}
+
+// EnsureTelemetryPartitions creates the daily partitions needed to store readings taken at the given times.
+func (p *PostgreSQLClient) EnsureTelemetryPartitions(times ...time.Time) error {
+	created := make(map[string]bool)
+	for _, t := range times {
+		day := t.UTC().Truncate(24 * time.Hour)
+		name := telemetryPartition(day)
+		if created[name] {
+			continue
+		}
+		query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF telemetry FOR VALUES FROM ('%s') TO ('%s')`,
+			pq.QuoteIdentifier(name), day.Format(time.RFC3339), day.Add(24*time.Hour).Format(time.RFC3339))
+		if _, err := p.DB.Exec(query); err != nil {
+			return fmt.Errorf("failed to create telemetry partition %s: %w", name, err)
+		}
+		created[name] = true
+	}
+	return nil
+}
+
+// InsertReadings stores a batch of readings with a single COPY, creating missing partitions first.
+func (p *PostgreSQLClient) InsertReadings(readings []Reading) error {
+	times := make([]time.Time, len(readings))
+	for i, reading := range readings {
+		times[i] = reading.Timestamp
+	}
+	if err := p.EnsureTelemetryPartitions(times...); err != nil {
+		return err
+	}
+
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin telemetry insert: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(pq.CopyIn("telemetry", "device_id", "device_type", "metric", "value", "unit", "recorded_at"))
+	if err != nil {
+		return fmt.Errorf("failed to prepare telemetry insert: %w", err)
+	}
+	for _, reading := range readings {
+		_, err := stmt.Exec(reading.DeviceID, reading.DeviceType, reading.Metric, reading.Value, reading.Unit, reading.Timestamp)
+		if err != nil {
+			stmt.Close()
+			return fmt.Errorf("failed to insert reading: %w", err)
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return fmt.Errorf("failed to insert readings: %w", err)
+	}
+	if err := stmt.Close(); err != nil {
+		return fmt.Errorf("failed to insert readings: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit readings: %w", err)
+	}
+	return nil
+}
+
+// ListReadings retrieves the raw readings of a device metric between from and to, oldest first.
+// A limit of zero returns every reading.
+func (p *PostgreSQLClient) ListReadings(deviceID, metric string, from, to time.Time, limit int) ([]Reading, error) {
+	query := `SELECT device_id, device_type, metric, value, unit, recorded_at FROM telemetry
+              WHERE device_id = $1 AND metric = $2 AND recorded_at >= $3 AND recorded_at < $4
+              ORDER BY recorded_at LIMIT $5`
+	var limitArg interface{} // LIMIT NULL returns all rows
+	if limit > 0 {
+		limitArg = limit
+	}
+	rows, err := p.DB.Query(query, deviceID, metric, from, to, limitArg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list readings: %w", err)
+	}
+	defer rows.Close()
+
+	readings := []Reading{}
+	for rows.Next() {
+		var reading Reading
+		err := rows.Scan(&reading.DeviceID, &reading.DeviceType, &reading.Metric, &reading.Value, &reading.Unit, &reading.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan reading: %w", err)
+		}
+		readings = append(readings, reading)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list readings: %w", err)
+	}
+	return readings, nil
+}
+
+// Aggregate summarizes the readings of one interval.
+type Aggregate struct {
+	Start time.Time `json:"start"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+	Count int64     `json:"count"`
+}
+
+// AggregateReadings downsamples the readings of a device metric between from and to into buckets of interval.
+func (p *PostgreSQLClient) AggregateReadings(deviceID, metric string, from, to time.Time, interval time.Duration) ([]Aggregate, error) {
+	query := `SELECT to_timestamp(floor(extract(epoch FROM recorded_at) / $5) * $5) AS bucket,
+                     min(value), max(value), avg(value), count(*)
+              FROM telemetry
+              WHERE device_id = $1 AND metric = $2 AND recorded_at >= $3 AND recorded_at < $4
+              GROUP BY bucket ORDER BY bucket`
+	rows, err := p.DB.Query(query, deviceID, metric, from, to, interval.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate readings: %w", err)
+	}
+	defer rows.Close()
+
+	aggregates := []Aggregate{}
+	for rows.Next() {
+		var aggregate Aggregate
+		if err := rows.Scan(&aggregate.Start, &aggregate.Min, &aggregate.Max, &aggregate.Avg, &aggregate.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan aggregate: %w", err)
+		}
+		aggregates = append(aggregates, aggregate)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to aggregate readings: %w", err)
+	}
+	return aggregates, nil
+}
+
+// ApplyTelemetryRetention drops the daily partitions older than retention and deletes the readings
+// that are older than a shorter policy. It returns the number of partitions dropped.
+func (p *PostgreSQLClient) ApplyTelemetryRetention(retention time.Duration, policies []TelemetryRetention, now time.Time) (int, error) {
+	for _, policy := range policies {
+		query := `DELETE FROM telemetry WHERE recorded_at < $1
+                  AND ($2::text = '' OR device_type = $2::text) AND ($3::text = '' OR metric = $3::text)`
+		_, err := p.DB.Exec(query, now.Add(-policy.Retention), policy.DeviceType, policy.Metric)
+		if err != nil {
+			return 0, fmt.Errorf("failed to apply telemetry retention: %w", err)
+		}
+	}
+	if retention <= 0 {
+		return 0, nil
+	}
+
+	rows, err := p.DB.Query(`SELECT child.relname FROM pg_inherits
+                             JOIN pg_class parent ON parent.oid = pg_inherits.inhparent
+                             JOIN pg_class child ON child.oid = pg_inherits.inhrelid
+                             WHERE parent.relname = 'telemetry'`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list telemetry partitions: %w", err)
+	}
+	var expired []string
+	cutoff := now.Add(-retention)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan telemetry partition: %w", err)
+		}
+		day, err := time.Parse("20060102", strings.TrimPrefix(name, "telemetry_p"))
+		if err == nil && !day.Add(24*time.Hour).After(cutoff) {
+			expired = append(expired, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to list telemetry partitions: %w", err)
+	}
+
+	for _, name := range expired {
+		if _, err := p.DB.Exec(`DROP TABLE IF EXISTS ` + pq.QuoteIdentifier(name)); err != nil {
+			return 0, fmt.Errorf("failed to drop telemetry partition %s: %w", name, err)
+		}
+	}
+	return len(expired), nil
+}
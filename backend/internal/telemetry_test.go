@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAcknowledger records the acknowledgements of deliveries.
+type fakeAcknowledger struct {
+	acked    []uint64
+	nacked   []uint64
+	rejected []uint64
+}
+
+func (f *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	f.acked = append(f.acked, tag)
+	return nil
+}
+
+func (f *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	f.nacked = append(f.nacked, tag)
+	return nil
+}
+
+func (f *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	f.rejected = append(f.rejected, tag)
+	return nil
+}
+
+// fakeTelemetryStore records inserted batches, failing while err is set.
+type fakeTelemetryStore struct {
+	batches [][]Reading
+	err     error
+}
+
+func (f *fakeTelemetryStore) InsertReadings(readings []Reading) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.batches = append(f.batches, append([]Reading(nil), readings...))
+	return nil
+}
+
+func telemetryDelivery(acker amqp.Acknowledger, tag uint64, body string) amqp.Delivery {
+	return amqp.Delivery{
+		Acknowledger: acker,
+		DeliveryTag:  tag,
+		RoutingKey:   "telemetry.thermometer.kitchen1",
+		Body:         []byte(body),
+		Timestamp:    time.Now(),
+	}
+}
+
+func TestReadingValidate(t *testing.T) {
+	valid := Reading{DeviceID: "kitchen1", DeviceType: "thermometer", Metric: "temperature", Value: 21.5, Timestamp: time.Now()}
+	assert.NoError(t, valid.Validate())
+
+	missingMetric := valid
+	missingMetric.Metric = ""
+	assert.Error(t, missingMetric.Validate(), "a metric is required")
+
+	notANumber := valid
+	notANumber.Value = math.NaN()
+	assert.Error(t, notANumber.Validate(), "values must be finite")
+
+	wildcard := valid
+	wildcard.DeviceID = "kitchen.*"
+	assert.Error(t, wildcard.Validate(), "IDs must not break the routing key")
+
+	ancient := valid
+	ancient.Timestamp = time.Now().Add(-MaxReadingAge - time.Hour)
+	assert.Error(t, ancient.Validate(), "old readings should be rejected")
+
+	future := valid
+	future.Timestamp = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Error(t, future.Validate(), "readings from the future should be rejected")
+
+	unset := valid
+	unset.Timestamp = time.Time{}
+	assert.Error(t, unset.Validate(), "readings need a timestamp")
+}
+
+func TestParseTelemetry(t *testing.T) {
+	msg, err := CreateTelemetryMessage(Reading{Metric: "temperature", Value: 21.5, Unit: "C"})
+	require.NoError(t, err)
+
+	reading, err := ParseTelemetry(amqp.Delivery{RoutingKey: "telemetry.thermometer.kitchen1", Body: msg.Body, Timestamp: time.Now()})
+	require.NoError(t, err)
+	assert.Equal(t, "thermometer", reading.DeviceType, "the device type should come from the routing key")
+	assert.Equal(t, "kitchen1", reading.DeviceID, "the device ID should come from the routing key")
+	assert.Equal(t, 21.5, reading.Value)
+	assert.False(t, reading.Timestamp.IsZero(), "the message timestamp should be used when the reading has none")
+
+	_, err = ParseTelemetry(amqp.Delivery{RoutingKey: "telemetry.thermometer.kitchen1", Body: []byte("21.5")})
+	assert.Error(t, err, "bodies that are not readings should be rejected")
+}
+
+func TestTelemetryBatcher(t *testing.T) {
+	acker := &fakeAcknowledger{}
+	store := &fakeTelemetryStore{}
+	batcher := NewTelemetryBatcher(store, 2, time.Hour)
+
+	messages := make(chan amqp.Delivery, 4)
+	messages <- telemetryDelivery(acker, 1, `{"metric":"temperature","value":21}`)
+	messages <- telemetryDelivery(acker, 2, `{"metric":"temperature","value":22}`)
+	messages <- telemetryDelivery(acker, 3, `not json`)
+	messages <- telemetryDelivery(acker, 4, `{"metric":"humidity","value":40}`)
+	close(messages)
+	batcher.Run(messages)
+
+	require.Len(t, store.batches, 2, "readings should be inserted per full batch and on close")
+	assert.Len(t, store.batches[0], 2)
+	assert.Len(t, store.batches[1], 1)
+	assert.Equal(t, []uint64{2, 4}, acker.acked, "each batch should be acknowledged up to its last message")
+	assert.Equal(t, []uint64{3}, acker.rejected, "invalid readings should be rejected")
+}
+
+func TestTelemetryBatcherRequeuesFailedBatch(t *testing.T) {
+	acker := &fakeAcknowledger{}
+	store := &fakeTelemetryStore{err: errors.New("connection refused")}
+	batcher := NewTelemetryBatcher(store, 10, time.Hour)
+
+	batcher.add(telemetryDelivery(acker, 1, `{"metric":"power","value":1200}`))
+	batcher.Flush()
+
+	assert.Empty(t, acker.acked)
+	assert.Equal(t, []uint64{1}, acker.nacked, "a batch that could not be stored should be requeued")
+}
+
+func TestTelemetryPartition(t *testing.T) {
+	assert.Equal(t, "telemetry_p20240501", telemetryPartition(time.Date(2024, 5, 1, 23, 59, 0, 0, time.UTC)))
+}
+
+func TestTelemetryInPostgres(t *testing.T) {
+	deviceID := "meter-" + NewMessageID()
+	start := time.Now().UTC().Truncate(time.Hour)
+	readings := []Reading{
+		{DeviceID: deviceID, DeviceType: "power_meter", Metric: "power", Value: 100, Unit: "W", Timestamp: start},
+		{DeviceID: deviceID, DeviceType: "power_meter", Metric: "power", Value: 300, Unit: "W", Timestamp: start.Add(time.Minute)},
+		{DeviceID: deviceID, DeviceType: "power_meter", Metric: "power", Value: 50, Unit: "W", Timestamp: start.Add(10 * time.Minute)},
+	}
+	require.NoError(t, testDB.InsertReadings(readings))
+
+	raw, err := testDB.ListReadings(deviceID, "power", start, start.Add(time.Hour), 10)
+	require.NoError(t, err)
+	require.Len(t, raw, 3)
+	assert.Equal(t, 300.0, raw[1].Value, "readings should be ordered by time")
+
+	aggregates, err := testDB.AggregateReadings(deviceID, "power", start, start.Add(time.Hour), 5*time.Minute)
+	require.NoError(t, err)
+	require.Len(t, aggregates, 2, "readings should be grouped per interval")
+	assert.Equal(t, 100.0, aggregates[0].Min)
+	assert.Equal(t, 300.0, aggregates[0].Max)
+	assert.Equal(t, 200.0, aggregates[0].Avg)
+	assert.Equal(t, int64(2), aggregates[0].Count)
+	assert.True(t, start.Equal(aggregates[0].Start))
+
+	policies := []TelemetryRetention{{DeviceType: "power_meter", Retention: time.Minute}}
+	_, err = testDB.ApplyTelemetryRetention(0, policies, start.Add(12*time.Minute))
+	require.NoError(t, err)
+	raw, err = testDB.ListReadings(deviceID, "power", start, start.Add(time.Hour), 10)
+	require.NoError(t, err)
+	assert.Len(t, raw, 1, "readings older than the policy should be deleted")
+}
@@ -0,0 +1,471 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Headers sent with every webhook delivery.
+const (
+	WebhookSignatureHeader = "X-HomeBunny-Signature" // "sha256=" and the hex HMAC-SHA256 of "<timestamp>.<body>"
+	WebhookTimestampHeader = "X-HomeBunny-Timestamp" // Unix seconds, part of the signed content
+	WebhookEventHeader     = "X-HomeBunny-Event"     // Routing key of the event
+	WebhookDeliveryHeader  = "X-HomeBunny-Delivery"  // Message ID, the same for every attempt
+)
+
+// WebhookSubscription sends the device events matching Filter to URL.
+type WebhookSubscription struct {
+	ID                  int64      `json:"id"`
+	URL                 string     `json:"url"`
+	Filter              string     `json:"filter"`
+	Secret              string     `json:"secret,omitempty"` // Only returned when the subscription is created
+	Enabled             bool       `json:"enabled"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	DisabledAt          *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+}
+
+// Validate reports an error when the URL or filter of the subscription is invalid.
+func (s WebhookSubscription) Validate() error {
+	target, err := url.Parse(s.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	return ValidateRoutingKeyFilter(s.Filter)
+}
+
+// WebhookDelivery records one attempt to deliver an event to a subscription.
+type WebhookDelivery struct {
+	ID             int64     `json:"id"`
+	SubscriptionID int64     `json:"subscription_id"`
+	MessageID      string    `json:"message_id"`
+	RoutingKey     string    `json:"routing_key"`
+	Attempt        int       `json:"attempt"`
+	StatusCode     int       `json:"status_code,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Success        bool      `json:"success"`
+	DurationMs     int64     `json:"duration_ms"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// WebhookPayload is the JSON body posted to subscribers.
+type WebhookPayload struct {
+	ID          string    `json:"id"`
+	RoutingKey  string    `json:"routing_key"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        string    `json:"body"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// NewWebhookSecret generates a random signing secret.
+func NewWebhookSecret() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return hex.EncodeToString(secret)
+}
+
+// SignWebhook returns the signature header value of a body sent at timestamp.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookStore provides the subscriptions and delivery log used by the WebhookDispatcher.
+type WebhookStore interface {
+	ListEnabledWebhookSubscriptions() ([]WebhookSubscription, error)
+	InsertWebhookDelivery(delivery WebhookDelivery) error
+	// RecordWebhookResult resets or increments the consecutive failures of a subscription, disabling it
+	// once they reach disableAfter, and reports whether it is disabled.
+	RecordWebhookResult(subscriptionID int64, success bool, disableAfter int) (bool, error)
+}
+
+// WebhookDispatcher posts device events to the webhook subscriptions matching their routing key,
+// retrying failed deliveries with exponential backoff.
+type WebhookDispatcher struct {
+	store          WebhookStore
+	client         *http.Client
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	disableAfter   int
+	concurrency    int
+	sleep          func(ctx context.Context, d time.Duration) error
+}
+
+// NewWebhookDispatcher creates a WebhookDispatcher from the Webhooks configuration.
+func NewWebhookDispatcher(config AppConfig, store WebhookStore) *WebhookDispatcher {
+	webhooks := config.Webhooks
+	d := &WebhookDispatcher{
+		store:          store,
+		client:         &http.Client{Timeout: webhooks.Timeout},
+		maxAttempts:    webhooks.MaxAttempts,
+		initialBackoff: webhooks.InitialBackoff,
+		maxBackoff:     webhooks.MaxBackoff,
+		disableAfter:   webhooks.DisableAfter,
+		concurrency:    webhooks.Concurrency,
+		sleep:          sleepContext,
+	}
+	if d.client.Timeout <= 0 {
+		d.client.Timeout = 10 * time.Second
+	}
+	if d.maxAttempts <= 0 {
+		d.maxAttempts = 5
+	}
+	if d.initialBackoff <= 0 {
+		d.initialBackoff = time.Second
+	}
+	if d.maxBackoff <= 0 {
+		d.maxBackoff = time.Minute
+	}
+	if d.concurrency <= 0 {
+		d.concurrency = 8
+	}
+	return d
+}
+
+// Concurrency returns how many events are delivered at the same time.
+func (d *WebhookDispatcher) Concurrency() int {
+	return d.concurrency
+}
+
+// Backoff returns the delay before the given retry, doubling from the initial backoff up to the maximum.
+func (d *WebhookDispatcher) Backoff(retry int) time.Duration {
+	backoff := d.initialBackoff
+	for i := 1; i < retry && backoff < d.maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, d.maxBackoff)
+}
+
+// Run dispatches the events received on messages until the channel is closed, acknowledging each
+// event once every matching subscription received it or ran out of attempts.
+func (d *WebhookDispatcher) Run(ctx context.Context, messages <-chan amqp.Delivery) {
+	slots := make(chan struct{}, d.concurrency)
+	var wg sync.WaitGroup
+	for msg := range messages {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(msg amqp.Delivery) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if err := d.Dispatch(ctx, msg); err != nil {
+				log.Printf("Failed to dispatch event %s: %v", msg.MessageId, err)
+				msg.Nack(false, true)
+				return
+			}
+			msg.Ack(false)
+		}(msg)
+	}
+	wg.Wait()
+}
+
+// Dispatch delivers an event to every enabled subscription whose filter matches its routing key.
+func (d *WebhookDispatcher) Dispatch(ctx context.Context, msg amqp.Delivery) error {
+	subscriptions, err := d.store.ListEnabledWebhookSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	messageID := msg.MessageId
+	if messageID == "" {
+		messageID = NewMessageID()
+	}
+	timestamp := msg.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	body, err := json.Marshal(WebhookPayload{
+		ID:          messageID,
+		RoutingKey:  msg.RoutingKey,
+		ContentType: msg.ContentType,
+		Body:        string(msg.Body),
+		Timestamp:   timestamp,
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding webhook payload: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, subscription := range subscriptions {
+		if !MatchRoutingKey(subscription.Filter, msg.RoutingKey) {
+			continue
+		}
+		wg.Add(1)
+		go func(subscription WebhookSubscription) {
+			defer wg.Done()
+			d.deliver(ctx, subscription, messageID, msg.RoutingKey, body)
+		}(subscription)
+	}
+	wg.Wait()
+	return nil
+}
+
+// deliver posts body to a subscription until it succeeds, fails permanently or runs out of attempts,
+// logging every attempt, and reports whether it succeeded.
+func (d *WebhookDispatcher) deliver(ctx context.Context, subscription WebhookSubscription, messageID, routingKey string, body []byte) bool {
+	success := false
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		if attempt > 1 {
+			if err := d.sleep(ctx, d.Backoff(attempt-1)); err != nil {
+				break
+			}
+		}
+
+		start := time.Now()
+		statusCode, err := d.post(ctx, subscription, messageID, routingKey, body)
+		delivery := WebhookDelivery{
+			SubscriptionID: subscription.ID,
+			MessageID:      messageID,
+			RoutingKey:     routingKey,
+			Attempt:        attempt,
+			StatusCode:     statusCode,
+			Success:        err == nil,
+			DurationMs:     time.Since(start).Milliseconds(),
+			CreatedAt:      time.Now(),
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		if err := d.store.InsertWebhookDelivery(delivery); err != nil {
+			log.Printf("Failed to record webhook delivery: %v", err)
+		}
+		observeWebhookDelivery(err)
+
+		if err == nil {
+			success = true
+			break
+		}
+		if !retryableStatus(statusCode) {
+			break
+		}
+	}
+
+	disabled, err := d.store.RecordWebhookResult(subscription.ID, success, d.disableAfter)
+	if err != nil {
+		log.Printf("Failed to record webhook result: %v", err)
+	} else if disabled && !success {
+		log.Printf("Disabled webhook subscription %d after repeated failures", subscription.ID)
+	}
+	return success
+}
+
+// post sends one signed delivery and returns the response status code.
+func (d *WebhookDispatcher) post(ctx context.Context, subscription WebhookSubscription, messageID, routingKey string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("error creating webhook request: %w", err)
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(subscription.Secret, timestamp, body))
+	req.Header.Set(WebhookEventHeader, routingKey)
+	req.Header.Set(WebhookDeliveryHeader, messageID)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error calling webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// retryableStatus reports whether a delivery that failed with statusCode may succeed when retried.
+// Requests without a response, server errors, timeouts and rate limits are retried.
+func retryableStatus(statusCode int) bool {
+	return statusCode == 0 || statusCode >= 500 ||
+		statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// InsertWebhookSubscription stores a new subscription, setting its ID and creation time.
+func (p *PostgreSQLClient) InsertWebhookSubscription(subscription *WebhookSubscription) error {
+	query := `INSERT INTO webhook_subscriptions (url, filter, secret, enabled) VALUES ($1, $2, $3, $4)
+              RETURNING id, created_at`
+	err := p.DB.QueryRow(query, subscription.URL, subscription.Filter, subscription.Secret, subscription.Enabled).
+		Scan(&subscription.ID, &subscription.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert webhook subscription: %w", err)
+	}
+	return nil
+}
+
+const webhookSubscriptionColumns = `id, url, filter, secret, enabled, consecutive_failures, disabled_at, created_at`
+
+func scanWebhookSubscription(row interface{ Scan(...any) error }) (WebhookSubscription, error) {
+	var subscription WebhookSubscription
+	err := row.Scan(&subscription.ID, &subscription.URL, &subscription.Filter, &subscription.Secret, &subscription.Enabled,
+		&subscription.ConsecutiveFailures, &subscription.DisabledAt, &subscription.CreatedAt)
+	return subscription, err
+}
+
+// GetWebhookSubscription retrieves a subscription by ID, returning nil when it does not exist.
+func (p *PostgreSQLClient) GetWebhookSubscription(id int64) (*WebhookSubscription, error) {
+	row := p.DB.QueryRow(`SELECT `+webhookSubscriptionColumns+` FROM webhook_subscriptions WHERE id = $1`, id)
+	subscription, err := scanWebhookSubscription(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook subscription: %w", err)
+	}
+	return &subscription, nil
+}
+
+// ListWebhookSubscriptions retrieves every subscription.
+func (p *PostgreSQLClient) ListWebhookSubscriptions() ([]WebhookSubscription, error) {
+	return p.listWebhookSubscriptions(`SELECT ` + webhookSubscriptionColumns + ` FROM webhook_subscriptions ORDER BY id`)
+}
+
+// ListEnabledWebhookSubscriptions retrieves the subscriptions events are delivered to.
+func (p *PostgreSQLClient) ListEnabledWebhookSubscriptions() ([]WebhookSubscription, error) {
+	return p.listWebhookSubscriptions(`SELECT ` + webhookSubscriptionColumns + ` FROM webhook_subscriptions WHERE enabled ORDER BY id`)
+}
+
+func (p *PostgreSQLClient) listWebhookSubscriptions(query string) ([]WebhookSubscription, error) {
+	rows, err := p.DB.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	subscriptions := []WebhookSubscription{}
+	for rows.Next() {
+		subscription, err := scanWebhookSubscription(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook subscription: %w", err)
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list webhook subscriptions: %w", err)
+	}
+	return subscriptions, nil
+}
+
+// UpdateWebhookSubscription changes the URL, filter and enabled flag of a subscription. Enabling a
+// subscription resets its failures. It reports whether the subscription exists.
+func (p *PostgreSQLClient) UpdateWebhookSubscription(subscription WebhookSubscription) (bool, error) {
+	query := `UPDATE webhook_subscriptions SET url = $2, filter = $3, enabled = $4,
+                  consecutive_failures = CASE WHEN $4 AND NOT enabled THEN 0 ELSE consecutive_failures END,
+                  disabled_at = CASE WHEN $4 THEN NULL ELSE COALESCE(disabled_at, NOW()) END
+              WHERE id = $1`
+	result, err := p.DB.Exec(query, subscription.ID, subscription.URL, subscription.Filter, subscription.Enabled)
+	if err != nil {
+		return false, fmt.Errorf("failed to update webhook subscription: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to update webhook subscription: %w", err)
+	}
+	return updated == 1, nil
+}
+
+// DeleteWebhookSubscription deletes a subscription and its delivery log, reporting whether it existed.
+func (p *PostgreSQLClient) DeleteWebhookSubscription(id int64) (bool, error) {
+	result, err := p.DB.Exec(`DELETE FROM webhook_subscriptions WHERE id = $1`, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete webhook subscription: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete webhook subscription: %w", err)
+	}
+	return deleted == 1, nil
+}
+
+// RecordWebhookResult resets the failures of a subscription after a success, or increments them and
+// disables the subscription once they reach disableAfter (never when 0).
+func (p *PostgreSQLClient) RecordWebhookResult(subscriptionID int64, success bool, disableAfter int) (bool, error) {
+	query := `UPDATE webhook_subscriptions SET
+                  consecutive_failures = CASE WHEN $2 THEN 0 ELSE consecutive_failures + 1 END,
+                  enabled = enabled AND ($2 OR $3 <= 0 OR consecutive_failures + 1 < $3),
+                  disabled_at = CASE WHEN enabled AND NOT ($2 OR $3 <= 0 OR consecutive_failures + 1 < $3)
+                                     THEN NOW() ELSE disabled_at END
+              WHERE id = $1
+              RETURNING NOT enabled`
+	var disabled bool
+	err := p.DB.QueryRow(query, subscriptionID, success, disableAfter).Scan(&disabled)
+	if err == sql.ErrNoRows {
+		return false, nil // Deleted while the event was delivered
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to record webhook result: %w", err)
+	}
+	return disabled, nil
+}
+
+// InsertWebhookDelivery records a delivery attempt.
+func (p *PostgreSQLClient) InsertWebhookDelivery(delivery WebhookDelivery) error {
+	query := `INSERT INTO webhook_deliveries
+              (subscription_id, message_id, routing_key, attempt, status_code, error, success, duration_ms, created_at)
+              VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err := p.DB.Exec(query, delivery.SubscriptionID, delivery.MessageID, delivery.RoutingKey, delivery.Attempt,
+		delivery.StatusCode, delivery.Error, delivery.Success, delivery.DurationMs, delivery.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// ListWebhookDeliveries retrieves the latest delivery attempts of a subscription, newest first.
+func (p *PostgreSQLClient) ListWebhookDeliveries(subscriptionID int64, limit int) ([]WebhookDelivery, error) {
+	query := `SELECT id, subscription_id, message_id, routing_key, attempt, status_code, error, success, duration_ms, created_at
+              FROM webhook_deliveries WHERE subscription_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2`
+	rows, err := p.DB.Query(query, subscriptionID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err := rows.Scan(&delivery.ID, &delivery.SubscriptionID, &delivery.MessageID, &delivery.RoutingKey, &delivery.Attempt,
+			&delivery.StatusCode, &delivery.Error, &delivery.Success, &delivery.DurationMs, &delivery.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryWebhookStore keeps subscriptions and delivery attempts in memory.
+type memoryWebhookStore struct {
+	mu            sync.Mutex
+	subscriptions []WebhookSubscription
+	deliveries    []WebhookDelivery
+}
+
+func (m *memoryWebhookStore) ListEnabledWebhookSubscriptions() ([]WebhookSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var enabled []WebhookSubscription
+	for _, subscription := range m.subscriptions {
+		if subscription.Enabled {
+			enabled = append(enabled, subscription)
+		}
+	}
+	return enabled, nil
+}
+
+func (m *memoryWebhookStore) InsertWebhookDelivery(delivery WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries = append(m.deliveries, delivery)
+	return nil
+}
+
+func (m *memoryWebhookStore) RecordWebhookResult(subscriptionID int64, success bool, disableAfter int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.subscriptions {
+		subscription := &m.subscriptions[i]
+		if subscription.ID != subscriptionID {
+			continue
+		}
+		if success {
+			subscription.ConsecutiveFailures = 0
+		} else {
+			subscription.ConsecutiveFailures++
+			if disableAfter > 0 && subscription.ConsecutiveFailures >= disableAfter {
+				subscription.Enabled = false
+			}
+		}
+		return !subscription.Enabled, nil
+	}
+	return false, nil
+}
+
+func newTestDispatcher(store WebhookStore, maxAttempts, disableAfter int) (*WebhookDispatcher, *[]time.Duration) {
+	var config AppConfig
+	config.Webhooks.MaxAttempts = maxAttempts
+	config.Webhooks.InitialBackoff = time.Second
+	config.Webhooks.MaxBackoff = 5 * time.Second
+	config.Webhooks.DisableAfter = disableAfter
+	dispatcher := NewWebhookDispatcher(config, store)
+
+	var sleeps []time.Duration
+	var mu sync.Mutex
+	dispatcher.sleep = func(ctx context.Context, d time.Duration) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sleeps = append(sleeps, d)
+		return nil
+	}
+	return dispatcher, &sleeps
+}
+
+func webhookEvent(routingKey string) amqp.Delivery {
+	return amqp.Delivery{
+		RoutingKey:  routingKey,
+		MessageId:   "event-1",
+		ContentType: "text/plain",
+		Body:        []byte("{tv1 tv on living_room}"),
+		Timestamp:   time.Now(),
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	signature := SignWebhook("secret", 1714564800, []byte(`{"id":"1"}`))
+	assert.Equal(t, signature, SignWebhook("secret", 1714564800, []byte(`{"id":"1"}`)))
+	assert.NotEqual(t, signature, SignWebhook("other", 1714564800, []byte(`{"id":"1"}`)))
+	assert.NotEqual(t, signature, SignWebhook("secret", 1714564801, []byte(`{"id":"1"}`)), "the timestamp should be signed")
+	assert.Regexp(t, "^sha256=[0-9a-f]{64}$", signature)
+}
+
+func TestWebhookSubscriptionValidate(t *testing.T) {
+	assert.NoError(t, WebhookSubscription{URL: "https://example.com/hook", Filter: "device.tv.#"}.Validate())
+	assert.Error(t, WebhookSubscription{URL: "ftp://example.com", Filter: "#"}.Validate())
+	assert.Error(t, WebhookSubscription{URL: "/hook", Filter: "#"}.Validate())
+	assert.Error(t, WebhookSubscription{URL: "https://example.com", Filter: "device.tv#"}.Validate())
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	dispatcher, _ := newTestDispatcher(&memoryWebhookStore{}, 5, 0)
+	assert.Equal(t, time.Second, dispatcher.Backoff(1))
+	assert.Equal(t, 2*time.Second, dispatcher.Backoff(2))
+	assert.Equal(t, 4*time.Second, dispatcher.Backoff(3))
+	assert.Equal(t, 5*time.Second, dispatcher.Backoff(4), "the backoff should be capped")
+}
+
+func TestWebhookDispatcherSignsAndFilters(t *testing.T) {
+	var received []*http.Request
+	var bodies [][]byte
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, r)
+		bodies = append(bodies, body)
+	}))
+	defer server.Close()
+
+	store := &memoryWebhookStore{subscriptions: []WebhookSubscription{
+		{ID: 1, URL: server.URL, Filter: "device.tv.#", Secret: "s3cr3t", Enabled: true},
+		{ID: 2, URL: server.URL, Filter: "device.lamp.#", Secret: "other", Enabled: true},
+	}}
+	dispatcher, _ := newTestDispatcher(store, 3, 0)
+
+	require.NoError(t, dispatcher.Dispatch(context.Background(), webhookEvent("device.tv.on")))
+	require.Len(t, received, 1, "only the matching subscription should receive the event")
+
+	request := received[0]
+	timestamp, err := strconv.ParseInt(request.Header.Get(WebhookTimestampHeader), 10, 64)
+	require.NoError(t, err)
+	assert.Equal(t, SignWebhook("s3cr3t", timestamp, bodies[0]), request.Header.Get(WebhookSignatureHeader))
+	assert.Equal(t, "device.tv.on", request.Header.Get(WebhookEventHeader))
+	assert.Equal(t, "event-1", request.Header.Get(WebhookDeliveryHeader))
+
+	var payload WebhookPayload
+	require.NoError(t, json.Unmarshal(bodies[0], &payload))
+	assert.Equal(t, "{tv1 tv on living_room}", payload.Body)
+
+	require.Len(t, store.deliveries, 1)
+	assert.True(t, store.deliveries[0].Success)
+	assert.Equal(t, http.StatusOK, store.deliveries[0].StatusCode)
+}
+
+func TestWebhookDispatcherRetries(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	store := &memoryWebhookStore{subscriptions: []WebhookSubscription{{ID: 1, URL: server.URL, Filter: "#", Secret: "s", Enabled: true}}}
+	dispatcher, sleeps := newTestDispatcher(store, 5, 0)
+
+	require.NoError(t, dispatcher.Dispatch(context.Background(), webhookEvent("device.tv.on")))
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, *sleeps, "retries should back off exponentially")
+	require.Len(t, store.deliveries, 3, "every attempt should be logged")
+	assert.False(t, store.deliveries[0].Success)
+	assert.Equal(t, http.StatusServiceUnavailable, store.deliveries[0].StatusCode)
+	assert.Equal(t, 3, store.deliveries[2].Attempt)
+	assert.True(t, store.deliveries[2].Success)
+	assert.Equal(t, 0, store.subscriptions[0].ConsecutiveFailures)
+}
+
+func TestWebhookDispatcherDisablesFailingSubscription(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer server.Close()
+
+	store := &memoryWebhookStore{subscriptions: []WebhookSubscription{{ID: 1, URL: server.URL, Filter: "#", Secret: "s", Enabled: true}}}
+	dispatcher, _ := newTestDispatcher(store, 5, 2)
+
+	require.NoError(t, dispatcher.Dispatch(context.Background(), webhookEvent("device.tv.on")))
+	assert.Equal(t, 1, attempts, "client errors should not be retried")
+	assert.True(t, store.subscriptions[0].Enabled)
+
+	require.NoError(t, dispatcher.Dispatch(context.Background(), webhookEvent("device.tv.off")))
+	assert.False(t, store.subscriptions[0].Enabled, "the subscription should be disabled after repeated failures")
+
+	require.NoError(t, dispatcher.Dispatch(context.Background(), webhookEvent("device.tv.on")))
+	assert.Equal(t, 2, attempts, "disabled subscriptions should not receive events")
+}
+
+func TestWebhooksInPostgres(t *testing.T) {
+	subscription := WebhookSubscription{URL: "https://example.com/hook", Filter: "device.#", Secret: NewWebhookSecret(), Enabled: true}
+	require.NoError(t, testDB.InsertWebhookSubscription(&subscription))
+	require.NotZero(t, subscription.ID)
+
+	disabled, err := testDB.RecordWebhookResult(subscription.ID, false, 2)
+	require.NoError(t, err)
+	assert.False(t, disabled)
+	disabled, err = testDB.RecordWebhookResult(subscription.ID, false, 2)
+	require.NoError(t, err)
+	assert.True(t, disabled, "the subscription should be disabled after two failures")
+
+	stored, err := testDB.GetWebhookSubscription(subscription.ID)
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	assert.False(t, stored.Enabled)
+	assert.NotNil(t, stored.DisabledAt)
+	assert.Equal(t, 2, stored.ConsecutiveFailures)
+
+	stored.Enabled = true
+	updated, err := testDB.UpdateWebhookSubscription(*stored)
+	require.NoError(t, err)
+	assert.True(t, updated)
+	stored, err = testDB.GetWebhookSubscription(subscription.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.Enabled)
+	assert.Nil(t, stored.DisabledAt)
+	assert.Equal(t, 0, stored.ConsecutiveFailures, "enabling a subscription should reset its failures")
+
+	delivery := WebhookDelivery{SubscriptionID: subscription.ID, MessageID: "m1", RoutingKey: "device.tv.on", Attempt: 1,
+		StatusCode: 500, Error: "webhook answered 500", DurationMs: 12, CreatedAt: time.Now()}
+	require.NoError(t, testDB.InsertWebhookDelivery(delivery))
+	deliveries, err := testDB.ListWebhookDeliveries(subscription.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, 500, deliveries[0].StatusCode)
+
+	deleted, err := testDB.DeleteWebhookSubscription(subscription.ID)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	deliveries, err = testDB.ListWebhookDeliveries(subscription.ID, 10)
+	require.NoError(t, err)
+	assert.Empty(t, deliveries, "deliveries should be deleted with their subscription")
+}
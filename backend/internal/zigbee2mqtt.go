@@ -0,0 +1,493 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// OriginZigbee2MQTT marks device events translated from Zigbee2MQTT payloads.
+const OriginZigbee2MQTT = "zigbee2mqtt"
+
+// UnknownState is the state devices are registered with before they report one.
+const UnknownState = "unknown"
+
+// DeviceRegistry is the part of the device registry adapters register devices and record states in.
+type DeviceRegistry interface {
+	DeviceStates
+	InsertDevice(device Device) error
+}
+
+// zigbeeBinaryStates maps the binary sensor properties of Zigbee2MQTT to device states.
+var zigbeeBinaryStates = map[string]struct{ deviceType, on, off string }{
+	"contact":    {"door_contact", "closed", "open"},
+	"occupancy":  {"motion_sensor", "occupied", "clear"},
+	"water_leak": {"leak_sensor", "leak", "dry"},
+	"smoke":      {"smoke_detector", "smoke", "clear"},
+}
+
+// zigbeeSystemModes maps thermostat system modes to the states of our climate devices.
+var zigbeeSystemModes = map[string]string{"heat": "heating", "cool": "cooling", "auto": "on", "off": "off"}
+
+// ZigbeeDevice is a device of the Zigbee2MQTT inventory and the device it is registered as.
+type ZigbeeDevice struct {
+	FriendlyName string
+	IEEEAddress  string
+	Model        string
+	Device       Device
+
+	stateProperty string            // Payload property holding the state, empty for pure sensors
+	states        map[string]string // Device state by Zigbee2MQTT value
+	settable      bool              // Whether the state can be set with commands
+	units         map[string]string // Unit of the numeric properties reported as telemetry
+}
+
+// zigbeeExpose is a capability in the Zigbee2MQTT inventory, either a property or a composite of them.
+type zigbeeExpose struct {
+	Type       string         `json:"type"`
+	Property   string         `json:"property"`
+	Access     int            `json:"access"` // Bit 1: published, bit 2: settable
+	Unit       string         `json:"unit"`
+	ValueOn    any            `json:"value_on"`
+	ValueOff   any            `json:"value_off"`
+	ValueOther any            `json:"value_toggle"`
+	Values     []string       `json:"values"`
+	Features   []zigbeeExpose `json:"features"`
+}
+
+// zigbeeInventoryDevice is an entry of the bridge/devices payload.
+type zigbeeInventoryDevice struct {
+	IEEEAddress        string `json:"ieee_address"`
+	FriendlyName       string `json:"friendly_name"`
+	Type               string `json:"type"`
+	Disabled           bool   `json:"disabled"`
+	InterviewCompleted bool   `json:"interview_completed"`
+	Definition         *struct {
+		Model   string         `json:"model"`
+		Exposes []zigbeeExpose `json:"exposes"`
+	} `json:"definition"`
+}
+
+// ZigbeeDeviceID returns the device ID a friendly name is registered as, which may not contain the
+// characters of routing keys and topics.
+func ZigbeeDeviceID(friendlyName string) string {
+	return invalidObjectID.ReplaceAllString(friendlyName, "_")
+}
+
+// ParseZigbeeInventory translates the bridge/devices payload into the devices to register. The
+// coordinator, disabled devices, devices still being interviewed and devices with neither a state nor
+// numeric properties are skipped. types overrides the device type guessed from the exposes by model.
+func ParseZigbeeInventory(payload []byte, types map[string]string) ([]ZigbeeDevice, error) {
+	var inventory []zigbeeInventoryDevice
+	if err := json.Unmarshal(payload, &inventory); err != nil {
+		return nil, fmt.Errorf("error decoding Zigbee2MQTT inventory: %w", err)
+	}
+
+	var devices []ZigbeeDevice
+	for _, entry := range inventory {
+		if entry.Type == "Coordinator" || entry.Disabled || !entry.InterviewCompleted || entry.Definition == nil {
+			continue
+		}
+		device := ZigbeeDevice{
+			FriendlyName: entry.FriendlyName,
+			IEEEAddress:  entry.IEEEAddress,
+			Model:        entry.Definition.Model,
+			units:        make(map[string]string),
+		}
+		deviceType := device.inspect(entry.Definition.Exposes)
+		if device.stateProperty == "" && len(device.units) == 0 {
+			continue
+		}
+		if override, ok := types[device.Model]; ok {
+			deviceType = override
+		}
+		device.Device = Device{ID: ZigbeeDeviceID(entry.FriendlyName), Type: deviceType, State: UnknownState}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// inspect finds the state and numeric properties in the exposes and returns the guessed device type.
+func (d *ZigbeeDevice) inspect(exposes []zigbeeExpose) string {
+	deviceType := ""
+	guess := func(t string) {
+		if deviceType == "" {
+			deviceType = t
+		}
+	}
+	for _, expose := range exposes {
+		switch expose.Type {
+		case "light", "switch", "lock", "cover":
+			guess(expose.Type)
+			for _, feature := range expose.Features {
+				if feature.Property == "state" {
+					d.setState(feature, func(value string) string { return strings.ToLower(value) })
+				}
+			}
+		case "climate":
+			guess("thermostat")
+			for _, feature := range expose.Features {
+				switch {
+				case feature.Property == "system_mode":
+					d.setState(feature, func(value string) string {
+						if state, ok := zigbeeSystemModes[value]; ok {
+							return state
+						}
+						return value
+					})
+				case feature.Type == "numeric" && feature.Access&1 != 0:
+					d.units[feature.Property] = zigbeeUnit(feature.Unit)
+				}
+			}
+		case "binary":
+			if binary, ok := zigbeeBinaryStates[expose.Property]; ok && d.stateProperty == "" {
+				guess(binary.deviceType)
+				d.stateProperty = expose.Property
+				d.states = map[string]string{"true": binary.on, "false": binary.off}
+			}
+		case "numeric":
+			if expose.Access&1 != 0 {
+				d.units[expose.Property] = zigbeeUnit(expose.Unit)
+			}
+		}
+	}
+	if _, ok := d.units["temperature"]; ok {
+		guess("temperature_sensor")
+	}
+	guess("sensor")
+	return deviceType
+}
+
+// setState uses a binary or enum feature as the state of the device, translating its values with state.
+func (d *ZigbeeDevice) setState(feature zigbeeExpose, state func(string) string) {
+	d.stateProperty = feature.Property
+	d.settable = feature.Access&2 != 0
+	d.states = make(map[string]string)
+	values := feature.Values
+	for _, value := range []any{feature.ValueOn, feature.ValueOff, feature.ValueOther} {
+		if value != nil {
+			values = append(values, zigbeeValue(value))
+		}
+	}
+	for _, value := range values {
+		d.states[value] = state(value)
+	}
+}
+
+// zigbeeValue formats a payload value as the key of the state maps.
+func zigbeeValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return ""
+	}
+}
+
+// zigbeeUnit shortens the units of Zigbee2MQTT to the ones used by telemetry.
+func zigbeeUnit(unit string) string {
+	return strings.TrimPrefix(unit, "°")
+}
+
+// TranslateState returns the state in a Zigbee2MQTT state payload, empty when it has none, the
+// readings of its numeric properties and the time the device was last seen.
+func (d ZigbeeDevice) TranslateState(payload []byte) (string, []Reading, time.Time, error) {
+	var values map[string]any
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return "", nil, time.Time{}, fmt.Errorf("error decoding Zigbee2MQTT state: %w", err)
+	}
+
+	eventTime := time.Now()
+	if lastSeen := zigbeeValue(values["last_seen"]); lastSeen != "" {
+		if t, err := parseHookTime(lastSeen); err == nil {
+			eventTime = t
+		}
+	}
+
+	state := ""
+	if value, ok := values[d.stateProperty]; ok && d.stateProperty != "" {
+		key := zigbeeValue(value)
+		if mapped, ok := d.states[key]; ok {
+			state = mapped
+		} else {
+			state = strings.ToLower(key)
+		}
+	}
+
+	var readings []Reading
+	for property, unit := range d.units {
+		if value, ok := values[property].(float64); ok {
+			readings = append(readings, Reading{
+				DeviceID:   d.Device.ID,
+				DeviceType: d.Device.Type,
+				Metric:     property,
+				Value:      value,
+				Unit:       unit,
+				Timestamp:  eventTime,
+			})
+		}
+	}
+	sort.Slice(readings, func(i, j int) bool { return readings[i].Metric < readings[j].Metric })
+	return state, readings, eventTime, nil
+}
+
+// CommandPayload returns the zigbee2mqtt/<name>/set payload that asks the device for state.
+func (d ZigbeeDevice) CommandPayload(state string) ([]byte, error) {
+	if !d.settable {
+		return nil, fmt.Errorf("the state of %s cannot be set", d.FriendlyName)
+	}
+	value := state
+	for zigbee, mapped := range d.states {
+		if mapped == state {
+			value = zigbee
+			break
+		}
+	}
+	return json.Marshal(map[string]string{d.stateProperty: value})
+}
+
+// errInvalidZigbeePayload is returned for messages that can never be translated and are dropped.
+var errInvalidZigbeePayload = errors.New("invalid Zigbee2MQTT payload")
+
+// ZigbeeAdapter registers the devices of a Zigbee2MQTT inventory, publishes their states as device
+// events and their numeric properties as telemetry, and sends commands to them.
+type ZigbeeAdapter struct {
+	conn      *mqttConnection
+	publisher Publisher
+	registry  DeviceRegistry
+	baseTopic string
+	types     map[string]string
+	qos       byte
+
+	mu      sync.Mutex
+	byName  map[string]ZigbeeDevice // Inventory by friendly name
+	byID    map[string]ZigbeeDevice // Inventory by device ID
+	reports map[string]string       // Last state reported by each device
+}
+
+// NewZigbeeAdapter creates an adapter for the Zigbee2MQTT instance configured under Zigbee2MQTT,
+// connecting to the broker configured under MQTT. Connect must be called before it translates anything.
+func NewZigbeeAdapter(config AppConfig, publisher Publisher, registry DeviceRegistry) *ZigbeeAdapter {
+	a := &ZigbeeAdapter{
+		publisher: publisher,
+		registry:  registry,
+		baseTopic: config.Zigbee2MQTT.BaseTopic,
+		types:     config.Zigbee2MQTT.Types,
+		qos:       config.MQTT.QoS,
+		byName:    make(map[string]ZigbeeDevice),
+		byID:      make(map[string]ZigbeeDevice),
+		reports:   make(map[string]string),
+	}
+	if a.baseTopic == "" {
+		a.baseTopic = "zigbee2mqtt"
+	}
+	if a.qos > 2 {
+		a.qos = 2
+	}
+	a.conn = newMQTTConnection(config, config.Zigbee2MQTT.ClientID, a.subscribe)
+	return a
+}
+
+// Connect connects to the MQTT broker and subscribes to the Zigbee2MQTT topics.
+func (a *ZigbeeAdapter) Connect() error {
+	return a.conn.connect()
+}
+
+// Close disconnects from the MQTT broker.
+func (a *ZigbeeAdapter) Close() {
+	a.conn.close()
+}
+
+// Check reports whether the adapter is connected to the MQTT broker, for health checks.
+func (a *ZigbeeAdapter) Check(ctx context.Context) error {
+	return a.conn.check(ctx)
+}
+
+func (a *ZigbeeAdapter) subscribe(client mqtt.Client) error {
+	if err := a.conn.subscribe(client, map[string]byte{a.baseTopic + "/#": a.qos}, a.handleMessage); err != nil {
+		return err
+	}
+	log.Printf("Translating Zigbee2MQTT messages on %s/#", a.baseTopic)
+	return nil
+}
+
+func (a *ZigbeeAdapter) handleMessage(_ mqtt.Client, msg mqtt.Message) {
+	a.conn.handle(msg, func(ctx context.Context) error {
+		return a.Ingest(ctx, msg.Topic(), msg.Payload())
+	}, errInvalidZigbeePayload)
+}
+
+// Ingest handles a message published by Zigbee2MQTT: the inventory registers devices, and the state
+// payload of a known device is published as a device event when its state changed and as telemetry.
+// Other bridge topics, availability and the adapter's own set messages are ignored.
+func (a *ZigbeeAdapter) Ingest(ctx context.Context, topic string, payload []byte) error {
+	name := strings.TrimPrefix(topic, a.baseTopic+"/")
+	switch {
+	case name == "bridge/devices":
+		return a.UpdateInventory(ctx, payload)
+	case name == topic, strings.HasPrefix(name, "bridge/"):
+		return nil
+	case strings.HasSuffix(name, "/set"), strings.HasSuffix(name, "/get"), strings.HasSuffix(name, "/availability"):
+		return nil
+	}
+
+	a.mu.Lock()
+	device, ok := a.byName[name]
+	a.mu.Unlock()
+	if !ok {
+		return nil // Not in the inventory, e.g. a group
+	}
+
+	state, readings, eventTime, err := device.TranslateState(payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidZigbeePayload, err)
+	}
+	for _, reading := range readings {
+		if err := a.publishReading(ctx, reading); err != nil {
+			return err
+		}
+	}
+	if state == "" || strings.ContainsAny(state, ".*# ") {
+		return nil
+	}
+
+	a.mu.Lock()
+	changed := a.reports[device.Device.ID] != state
+	a.mu.Unlock()
+	if !changed {
+		return nil // Zigbee2MQTT repeats the state with every report
+	}
+	if err := a.publishState(ctx, device.Device, state, eventTime); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.reports[device.Device.ID] = state
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *ZigbeeAdapter) publishReading(ctx context.Context, reading Reading) error {
+	msg, err := CreateTelemetryMessage(reading)
+	if err != nil {
+		return err
+	}
+	err = a.publisher.Send(ctx, TelemetryExchange, TelemetryRoutingKey(reading.DeviceType, reading.DeviceID), msg)
+	observeMQTTMessage("inbound", err)
+	return err
+}
+
+// publishState records the new state in the registry and publishes its device event. Stale states
+// are skipped.
+func (a *ZigbeeAdapter) publishState(ctx context.Context, device Device, state string, eventTime time.Time) error {
+	device.State = state
+	msg := CreateDeviceEvent(device, eventTime)
+	msg.Headers[OriginHeader] = OriginZigbee2MQTT
+	err := PublishDeviceState(ctx, a.registry, a.publisher, device, msg, eventTime, 0)
+	if errors.Is(err, ErrStaleEvent) {
+		log.Printf("Skipped stale state of device %s", device.ID)
+		return nil
+	}
+	if err == nil || errors.Is(err, ErrNotPublished) {
+		observeMQTTMessage("inbound", err)
+	}
+	return err
+}
+
+// UpdateInventory replaces the known devices with the bridge/devices payload and registers the ones
+// that are not registered yet.
+func (a *ZigbeeAdapter) UpdateInventory(ctx context.Context, payload []byte) error {
+	devices, err := ParseZigbeeInventory(payload, a.types)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidZigbeePayload, err)
+	}
+
+	byName := make(map[string]ZigbeeDevice, len(devices))
+	byID := make(map[string]ZigbeeDevice, len(devices))
+	for _, device := range devices {
+		byName[device.FriendlyName] = device
+		byID[device.Device.ID] = device
+	}
+	a.mu.Lock()
+	a.byName, a.byID = byName, byID
+	a.mu.Unlock()
+
+	registered := 0
+	for _, device := range devices {
+		existing, err := a.registry.GetDevice(device.Device.ID)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			continue
+		}
+		if err := a.registry.InsertDevice(device.Device); err != nil {
+			return err
+		}
+		registered++
+
+		msg := CreateRegistryEvent(device.Device)
+		err = a.publisher.Send(ctx, "device_events", RegistryRoutingKey(RegistryCreated, device.Device.Type, device.Device.ID), msg)
+		if err != nil && !errors.Is(err, ErrUnroutable) {
+			log.Printf("Failed to publish registry event for device %s: %v", device.Device.ID, err)
+		}
+	}
+	log.Printf("Zigbee2MQTT inventory has %d devices, %d newly registered", len(devices), registered)
+	return nil
+}
+
+// Run sends commands to Zigbee devices until messages is closed. Commands are acknowledged once the MQTT
+// broker accepted them and requeued when publishing failed.
+func (a *ZigbeeAdapter) Run(ctx context.Context, messages <-chan amqp.Delivery) {
+	for msg := range messages {
+		if err := a.Forward(ctx, msg); err != nil {
+			log.Printf("Failed to send command %s to Zigbee2MQTT: %v", msg.MessageId, err)
+			time.Sleep(time.Second) // Do not spin while the broker is unreachable
+			if err := msg.Nack(false, true); err != nil {
+				log.Printf("Failed to requeue command: %v", err)
+			}
+			continue
+		}
+		if err := msg.Ack(false); err != nil {
+			log.Printf("Failed to acknowledge command: %v", err)
+		}
+	}
+}
+
+// Forward publishes a command for a Zigbee device to zigbee2mqtt/<name>/set. Commands for other
+// devices and states the device cannot be set to are skipped.
+func (a *ZigbeeAdapter) Forward(ctx context.Context, msg amqp.Delivery) error {
+	command, err := ParseCommand(msg)
+	if err != nil {
+		log.Printf("Skipping command %s: %v", msg.MessageId, err)
+		return nil
+	}
+	a.mu.Lock()
+	device, ok := a.byID[command.DeviceID]
+	a.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	payload, err := device.CommandPayload(command.State)
+	if err != nil {
+		log.Printf("Skipping command %s: %v", msg.MessageId, err)
+		return nil
+	}
+	err = a.conn.publish(ctx, a.baseTopic+"/"+device.FriendlyName+"/set", a.qos, false, payload)
+	observeMQTTMessage("outbound", err)
+	return err
+}
@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryRegistry keeps registered devices in memory.
+type memoryRegistry struct {
+	mu      sync.Mutex
+	devices map[string]Device
+}
+
+func (r *memoryRegistry) GetDevice(deviceID string) (*Device, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	device, ok := r.devices[deviceID]
+	if !ok {
+		return nil, nil
+	}
+	return &device, nil
+}
+
+func (r *memoryRegistry) InsertDevice(device Device) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.devices[device.ID] = device
+	return nil
+}
+
+func (r *memoryRegistry) RecordStateChange(deviceID, state, messageID string, eventTime time.Time, expectedVersion int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	device, ok := r.devices[deviceID]
+	if !ok {
+		return false, nil
+	}
+	device.State = state
+	r.devices[deviceID] = device
+	return true, nil
+}
+
+// zigbeeMessage is a message recorded from Zigbee2MQTT.
+type zigbeeMessage struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+func readZigbeeFixtures(t *testing.T) ([]byte, []zigbeeMessage) {
+	inventory, err := os.ReadFile("testdata/zigbee2mqtt/bridge_devices.json")
+	require.NoError(t, err)
+	data, err := os.ReadFile("testdata/zigbee2mqtt/messages.json")
+	require.NoError(t, err)
+	var messages []zigbeeMessage
+	require.NoError(t, json.Unmarshal(data, &messages))
+	return inventory, messages
+}
+
+func zigbeeDevicesByName(t *testing.T, inventory []byte) map[string]ZigbeeDevice {
+	devices, err := ParseZigbeeInventory(inventory, nil)
+	require.NoError(t, err)
+	byName := make(map[string]ZigbeeDevice)
+	for _, device := range devices {
+		byName[device.FriendlyName] = device
+	}
+	return byName
+}
+
+func TestParseZigbeeInventory(t *testing.T) {
+	inventory, _ := readZigbeeFixtures(t)
+	devices, err := ParseZigbeeInventory(inventory, map[string]string{"TS011F_plug_1": "coffee_machine"})
+	require.NoError(t, err)
+
+	registered := make(map[string]Device)
+	for _, device := range devices {
+		registered[device.FriendlyName] = device.Device
+	}
+	assert.Equal(t, map[string]Device{
+		"living_room/ceiling": {ID: "living_room_ceiling", Type: "light", State: UnknownState},
+		"coffee_plug":         {ID: "coffee_plug", Type: "coffee_machine", State: UnknownState},
+		"front_door":          {ID: "front_door", Type: "door_contact", State: UnknownState},
+		"bedroom climate":     {ID: "bedroom_climate", Type: "temperature_sensor", State: UnknownState},
+		"radiator_office":     {ID: "radiator_office", Type: "thermostat", State: UnknownState},
+	}, registered, "the coordinator, disabled, uninterviewed and action-only devices should be skipped")
+
+	_, err = ParseZigbeeInventory([]byte(`{"not": "a list"}`), nil)
+	assert.Error(t, err)
+}
+
+func TestZigbeeTranslateState(t *testing.T) {
+	inventory, _ := readZigbeeFixtures(t)
+	devices := zigbeeDevicesByName(t, inventory)
+
+	tests := []struct {
+		name    string
+		payload string
+		state   string
+		metrics []string
+	}{
+		{"living_room/ceiling", `{"brightness": 254, "linkquality": 156, "state": "ON"}`, "on", []string{"linkquality"}},
+		{"coffee_plug", `{"current": 4.31, "power": 980, "state": "OFF"}`, "off", []string{"current", "power"}},
+		{"front_door", `{"battery": 91, "contact": false}`, "open", []string{"battery"}},
+		{"front_door", `{"contact": true}`, "closed", nil},
+		{"bedroom climate", `{"humidity": 48.71, "temperature": 21.34}`, "", []string{"humidity", "temperature"}},
+		{"radiator_office", `{"local_temperature": 19.5, "system_mode": "auto"}`, "on", []string{"local_temperature"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, readings, _, err := devices[tt.name].TranslateState([]byte(tt.payload))
+			require.NoError(t, err)
+			assert.Equal(t, tt.state, state)
+			var metrics []string
+			for _, reading := range readings {
+				metrics = append(metrics, reading.Metric)
+				assert.NoError(t, reading.Validate())
+			}
+			assert.Equal(t, tt.metrics, metrics)
+		})
+	}
+
+	_, readings, eventTime, err := devices["bedroom climate"].TranslateState([]byte(`{"temperature": 21.34, "last_seen": "2024-05-01T12:00:00+02:00"}`))
+	require.NoError(t, err)
+	assert.True(t, eventTime.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)), "last_seen should be the event time")
+	require.Len(t, readings, 1)
+	assert.Equal(t, "C", readings[0].Unit)
+
+	_, _, _, err = devices["front_door"].TranslateState([]byte("not json"))
+	assert.Error(t, err)
+}
+
+func TestZigbeeCommandPayload(t *testing.T) {
+	inventory, _ := readZigbeeFixtures(t)
+	devices := zigbeeDevicesByName(t, inventory)
+
+	payload, err := devices["living_room/ceiling"].CommandPayload("on")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"state": "ON"}`, string(payload))
+
+	payload, err = devices["radiator_office"].CommandPayload("heating")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"system_mode": "heat"}`, string(payload))
+
+	_, err = devices["front_door"].CommandPayload("open")
+	assert.Error(t, err, "sensors cannot be commanded")
+}
+
+func TestZigbeeAdapterReplay(t *testing.T) {
+	inventory, messages := readZigbeeFixtures(t)
+	var config AppConfig
+	publisher := &channelPublisher{published: make(chan publishedMessage, 100)}
+	registry := &memoryRegistry{devices: map[string]Device{"coffee_plug": {ID: "coffee_plug", Type: "switch", State: "off"}}}
+	adapter := NewZigbeeAdapter(config, publisher, registry)
+
+	ctx := context.Background()
+	require.NoError(t, adapter.Ingest(ctx, "zigbee2mqtt/bridge/devices", inventory))
+	for _, message := range messages {
+		require.NoError(t, adapter.Ingest(ctx, message.Topic, message.Payload))
+	}
+	// Zigbee2MQTT repeats unchanged states with every report
+	require.NoError(t, adapter.Ingest(ctx, "zigbee2mqtt/front_door", []byte(`{"contact": false}`)))
+	close(publisher.published)
+
+	var registered, events []string
+	telemetry := 0
+	for published := range publisher.published {
+		switch {
+		case published.msg.Headers[OriginHeader] == OriginZigbee2MQTT:
+			events = append(events, published.routingKey)
+		case published.msg.ContentType == "application/json" && published.msg.Headers[DeviceIDHeader] != nil:
+			registered = append(registered, published.routingKey)
+		default:
+			telemetry++
+		}
+	}
+	assert.Equal(t, []string{
+		"registry.created.light.living_room_ceiling",
+		"registry.created.door_contact.front_door",
+		"registry.created.temperature_sensor.bedroom_climate",
+		"registry.created.thermostat.radiator_office",
+	}, registered, "only devices that are not registered yet should be registered")
+	assert.Equal(t, []string{
+		"device.light.on",
+		"device.switch.on",
+		"device.door_contact.open",
+		"device.thermostat.heating",
+	}, events)
+	assert.Equal(t, 18, telemetry)
+
+	device, err := registry.GetDevice("radiator_office")
+	require.NoError(t, err)
+	assert.Equal(t, "heating", device.State)
+
+	assert.ErrorIs(t, adapter.Ingest(ctx, "zigbee2mqtt/front_door", []byte("not json")), errInvalidZigbeePayload)
+}
+
+func TestZigbeeAdapterForwardsCommands(t *testing.T) {
+	server, broker := startMQTTBroker(t)
+	inventory, _ := readZigbeeFixtures(t)
+	var config AppConfig
+	config.MQTT.Broker = broker
+	config.MQTT.QoS = 1
+	config.Zigbee2MQTT.ClientID = "zigbee2mqtt-" + NewMessageID()
+	publisher := &channelPublisher{published: make(chan publishedMessage, 100)}
+	adapter := NewZigbeeAdapter(config, publisher, &memoryRegistry{devices: make(map[string]Device)})
+	require.NoError(t, adapter.Connect())
+	t.Cleanup(adapter.Close)
+
+	received := make(chan packets.Packet, 10)
+	require.NoError(t, server.Subscribe("zigbee2mqtt/+/+/set", 1, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+	require.NoError(t, server.Publish("zigbee2mqtt/bridge/devices", inventory, true, 1))
+	require.Eventually(t, func() bool {
+		adapter.mu.Lock()
+		defer adapter.mu.Unlock()
+		return len(adapter.byID) > 0
+	}, 5*time.Second, 10*time.Millisecond, "the inventory was not received")
+
+	msg := CreateCommandMessage(Command{DeviceID: "living_room_ceiling", DeviceType: "light", State: "off", Timestamp: time.Now()})
+	command := amqp.Delivery{RoutingKey: CommandRoutingKey("light", "living_room_ceiling"), Headers: msg.Headers, Body: msg.Body}
+	require.NoError(t, adapter.Forward(context.Background(), command))
+
+	select {
+	case pk := <-received:
+		assert.Equal(t, "zigbee2mqtt/living_room/ceiling/set", pk.TopicName)
+		assert.JSONEq(t, `{"state": "OFF"}`, string(pk.Payload))
+		assert.False(t, pk.FixedHeader.Retain, "commands should not be retained")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the command was not published to Zigbee2MQTT")
+	}
+
+	msg = CreateCommandMessage(Command{DeviceID: "front_door", DeviceType: "door_contact", State: "open", Timestamp: time.Now()})
+	command = amqp.Delivery{RoutingKey: CommandRoutingKey("door_contact", "front_door"), Headers: msg.Headers, Body: msg.Body}
+	require.NoError(t, adapter.Forward(context.Background(), command), "commands a device cannot follow should be skipped")
+	select {
+	case pk := <-received:
+		t.Fatalf("unexpected command on %s", pk.TopicName)
+	case <-time.After(200 * time.Millisecond):
+	}
+}